@@ -38,7 +38,7 @@ func (g *cleanup) Name() string {
 
 func (g *cleanup) PrintUsage() {
 	fmt.Println("Usage of cleanup:")
-	fmt.Println("  Attempt to clear all iptables rules that wag creates, and bring down wireguard interface")
+	fmt.Println("  Attempt to clear all host firewall (iptables or nftables) rules that wag creates, and bring down wireguard interface")
 	g.fs.PrintDefaults()
 }
 
@@ -14,8 +14,8 @@ import (
 type devices struct {
 	fs *flag.FlagSet
 
-	address, username, socket string
-	action                    string
+	address, username, publickey, socket string
+	action                               string
 }
 
 func Devices() *devices {
@@ -27,6 +27,7 @@ func Devices() *devices {
 	gc.fs.StringVar(&gc.socket, "socket", control.DefaultWagSocket, "Wag control socket to act on")
 
 	gc.fs.StringVar(&gc.username, "username", "", "Owner of device (indicates that command acts on all devices owned by user)")
+	gc.fs.StringVar(&gc.publickey, "publickey", "", "Wireguard public key of the device to reserve the address for (Optional, with -reserve)")
 
 	gc.fs.Bool("del", false, "Remove device and block wireguard access")
 	gc.fs.Bool("list", false, "List wireguard devices")
@@ -36,6 +37,12 @@ func Devices() *devices {
 	gc.fs.Bool("unlock", false, "Unlock device")
 	gc.fs.Bool("lock", false, "Lock device access to mfa routes")
 
+	gc.fs.Bool("reserve", false, "Reserve -address for new devices of -username, or only the device with -publickey")
+	gc.fs.Bool("unreserve", false, "Remove the reservation of -address")
+	gc.fs.Bool("reservations", false, "List reserved addresses")
+
+	gc.fs.Bool("roaming", false, "List devices endpoint changes and whether their sessions were kept, newest first (filter with -address)")
+
 	return gc
 }
 
@@ -55,7 +62,7 @@ func (g *devices) PrintUsage() {
 func (g *devices) Check() error {
 	g.fs.Visit(func(f *flag.Flag) {
 		switch f.Name {
-		case "unlock", "del", "list", "lock", "mfa_sessions":
+		case "unlock", "del", "list", "lock", "mfa_sessions", "reserve", "unreserve", "reservations", "roaming":
 			g.action = strings.ToLower(f.Name)
 		}
 	})
@@ -65,7 +72,15 @@ func (g *devices) Check() error {
 		if g.address == "" && g.username == "" {
 			return errors.New("address or username must be supplied")
 		}
-	case "list", "mfa_sessions":
+	case "reserve":
+		if g.address == "" || g.username == "" {
+			return errors.New("address and username must be supplied")
+		}
+	case "unreserve":
+		if g.address == "" {
+			return errors.New("address must be supplied")
+		}
+	case "list", "mfa_sessions", "reservations", "roaming":
 	default:
 		return errors.New("Unknown flag: " + g.action)
 	}
@@ -113,9 +128,43 @@ func (g *devices) Run() error {
 			return err
 		}
 
-		fmt.Println("username,address,publickey,authattempts,endpoint")
+		fmt.Println("username,address,publickey,authattempts,endpoint,routes")
 		for _, device := range ds {
-			fmt.Printf("%s,%s,%s,%d,%s\n", device.Username, device.Address, device.Publickey, device.Attempts, device.Endpoint.String())
+			fmt.Printf("%s,%s,%s,%d,%s,%s\n", device.Username, device.Address, device.Publickey, device.Attempts, device.Endpoint.String(), strings.Join(device.Routes, " "))
+		}
+	case "reserve":
+		err := ctl.ReserveAddress(g.address, g.username, g.publickey)
+		if err != nil {
+			return err
+		}
+
+		fmt.Println("OK")
+	case "unreserve":
+		err := ctl.DeleteAddressReservation(g.address)
+		if err != nil {
+			return err
+		}
+
+		fmt.Println("OK")
+	case "reservations":
+		reservations, err := ctl.AddressReservations()
+		if err != nil {
+			return err
+		}
+
+		fmt.Println("address,username,publickey")
+		for _, reservation := range reservations {
+			fmt.Printf("%s,%s,%s\n", reservation.Address, reservation.Username, reservation.Publickey)
+		}
+	case "roaming":
+		events, err := ctl.RoamingEvents(g.address)
+		if err != nil {
+			return err
+		}
+
+		fmt.Println("time,username,address,previous_endpoint,endpoint,session_kept,reason")
+		for _, event := range events {
+			fmt.Printf("%s,%s,%s,%s,%s,%t,%s\n", event.Time.Format(time.RFC3339), event.Username, event.Address, event.PreviousEndpoint, event.Endpoint, event.Allowed, event.Reason)
 		}
 	case "mfa_sessions":
 		sessions, err := ctl.Sessions()
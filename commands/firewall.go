@@ -14,6 +14,9 @@ import (
 type firewallCmd struct {
 	fs             *flag.FlagSet
 	action, socket string
+
+	username, destination, protocol string
+	port                            uint
 }
 
 func Firewall() *firewallCmd {
@@ -22,8 +25,18 @@ func Firewall() *firewallCmd {
 	}
 
 	gc.fs.Bool("list", false, "List firewall rules")
+	gc.fs.Bool("counters", false, "List per user and per device traffic counters (passed/dropped packets and bytes)")
+	gc.fs.Bool("watch", false, "Stream dropped packet events (rate limited) until interrupted")
+	gc.fs.Bool("domains", false, "List the addresses of domains used in acls, and the history of them being re-resolved")
+	gc.fs.Bool("flows", false, "List the flows started by devices, traffic back to devices is only allowed for these")
+	gc.fs.Bool("test", false, "Simulate a packet from each of a users devices through the firewall, and show whether it would be allowed and why (requires -user and -dst)")
 	gc.fs.StringVar(&gc.socket, "socket", control.DefaultWagSocket, "Wag control socket to act on")
 
+	gc.fs.StringVar(&gc.username, "user", "", "User whose devices send the simulated packet (-test)")
+	gc.fs.StringVar(&gc.destination, "dst", "", "Destination address of the simulated packet (-test)")
+	gc.fs.UintVar(&gc.port, "port", 0, "Destination port of the simulated packet (-test)")
+	gc.fs.StringVar(&gc.protocol, "proto", "tcp", "Protocol of the simulated packet, icmp packets are echo requests (-test)")
+
 	return gc
 }
 
@@ -43,13 +56,21 @@ func (g *firewallCmd) PrintUsage() {
 func (g *firewallCmd) Check() error {
 	g.fs.Visit(func(f *flag.Flag) {
 		switch f.Name {
-		case "list":
+		case "list", "counters", "watch", "domains", "flows", "test":
 			g.action = strings.ToLower(f.Name)
 		}
 	})
 
 	switch g.action {
-	case "list":
+	case "list", "counters", "watch", "domains", "flows":
+	case "test":
+		if g.username == "" || g.destination == "" {
+			return errors.New("-test requires -user and -dst")
+		}
+
+		if g.port > 65535 {
+			return errors.New("-port must be between 0 and 65535")
+		}
 	default:
 		return errors.New("invalid action choice")
 	}
@@ -72,6 +93,63 @@ func (g *firewallCmd) Run() error {
 		b, _ := json.Marshal(rules)
 
 		fmt.Println(string(b))
+
+	case "counters":
+
+		counters, err := ctl.FirewallCounters()
+		if err != nil {
+			return err
+		}
+
+		b, _ := json.Marshal(counters)
+
+		fmt.Println(string(b))
+
+	case "domains":
+
+		domains, err := ctl.FirewallDomains()
+		if err != nil {
+			return err
+		}
+
+		b, _ := json.Marshal(domains)
+
+		fmt.Println(string(b))
+
+	case "flows":
+
+		flows, err := ctl.FirewallFlows()
+		if err != nil {
+			return err
+		}
+
+		b, _ := json.Marshal(flows)
+
+		fmt.Println(string(b))
+
+	case "test":
+
+		results, err := ctl.FirewallTest(g.username, g.destination, uint16(g.port), g.protocol)
+		if err != nil {
+			return err
+		}
+
+		b, _ := json.Marshal(results)
+
+		fmt.Println(string(b))
+
+	case "watch":
+
+		events, err := ctl.FirewallEvents()
+		if err != nil {
+			return err
+		}
+
+		for event := range events {
+			b, _ := json.Marshal(event)
+
+			fmt.Println(string(b))
+		}
 	}
 	return nil
 
@@ -32,6 +32,8 @@ type registration struct {
 	groups       arrayFlags
 	groupsString string
 	overwrite    string
+	address      string
+	routes       string
 
 	uses int
 }
@@ -51,6 +53,10 @@ func Registration() *registration {
 
 	gc.fs.StringVar(&gc.overwrite, "overwrite", "", "Add registration token for an existing user device, will overwrite wireguard public key (but not 2FA)")
 
+	gc.fs.StringVar(&gc.address, "address", "", "Address to give the device registered with the token, must be free and in the wireguard range (Optional)")
+
+	gc.fs.StringVar(&gc.routes, "routes", "", "Register a gateway that routes traffic for these networks, ',' delimited list of cidrs (Optional)")
+
 	gc.fs.IntVar(&gc.uses, "uses", 1, "Number of times a registration token can be used")
 
 	gc.fs.Bool("add", false, "Create a new enrolment token")
@@ -97,6 +103,14 @@ func (g *registration) Check() error {
 			return errors.New("Username must be supplied")
 		}
 
+		if g.address != "" && g.overwrite != "" {
+			return errors.New("-address cannot be used with -overwrite, the overwritten device keeps its address")
+		}
+
+		if g.routes != "" && g.overwrite != "" {
+			return errors.New("-routes cannot be used with -overwrite, the overwritten device keeps its routes")
+		}
+
 	case "del":
 		if g.token == "" && g.username == "" {
 			return errors.New("Token or username must be supplied")
@@ -117,7 +131,12 @@ func (g *registration) Run() error {
 	switch g.action {
 	case "add":
 
-		result, err := ctl.NewRegistration(g.token, g.username, g.overwrite, g.uses, g.groups...)
+		var routes []string
+		if g.routes != "" {
+			routes = strings.Split(g.routes, ",")
+		}
+
+		result, err := ctl.NewRegistration(g.token, g.username, g.overwrite, g.address, routes, g.uses, g.groups...)
 		if err != nil {
 			return err
 		}
@@ -144,9 +163,9 @@ func (g *registration) Run() error {
 			return err
 		}
 
-		fmt.Println("token,username,overwrites,groups")
+		fmt.Println("token,username,overwrites,groups,address,routes")
 		for _, token := range tokens {
-			fmt.Printf("%s,%s,%s,%s\n", token.Token, token.Username, token.Overwrites, token.Groups)
+			fmt.Printf("%s,%s,%s,%s,%s,%s\n", token.Token, token.Username, token.Overwrites, token.Groups, token.Address, strings.Join(token.Routes, " "))
 		}
 	}
 
@@ -13,6 +13,7 @@ import (
 	"github.com/NHAS/wag/internal/config"
 	"github.com/NHAS/wag/internal/data"
 	"github.com/NHAS/wag/internal/router"
+	wagusers "github.com/NHAS/wag/internal/users"
 	"github.com/NHAS/wag/internal/webserver"
 	"github.com/NHAS/wag/pkg/control/server"
 	"github.com/NHAS/wag/ui"
@@ -32,7 +33,7 @@ func Start() *start {
 
 	gc.fs.StringVar(&gc.config, "config", "./config.json", "Configuration file location")
 
-	gc.fs.Bool("noiptables", false, "Do not add iptables rules")
+	gc.fs.Bool("noiptables", false, "Do not add host firewall (iptables or nftables) rules")
 
 	return gc
 }
@@ -89,6 +90,11 @@ func (g *start) Check() error {
 		return fmt.Errorf("cannot load database: %v", err)
 	}
 
+	err = wagusers.LoadIdentityGroups()
+	if err != nil {
+		return fmt.Errorf("cannot load identity provider groups: %v", err)
+	}
+
 	return nil
 
 }
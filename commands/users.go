@@ -5,6 +5,7 @@ import (
 	"flag"
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/NHAS/wag/pkg/control"
 	"github.com/NHAS/wag/pkg/control/wagctl"
@@ -15,6 +16,8 @@ type users struct {
 
 	username, socket string
 	action           string
+
+	mfaType string
 }
 
 func Users() *users {
@@ -26,13 +29,17 @@ func Users() *users {
 	gc.fs.StringVar(&gc.socket, "socket", control.DefaultWagSocket, "Wag instance control socket")
 
 	gc.fs.Bool("del", false, "Delete user and all associated devices")
-	gc.fs.Bool("list", false, "List users, if '-username' supply will filter by user")
+	gc.fs.Bool("list", false, "List users, if '-username' supply will filter by user. Shows the groups identity providers (oidc, ldap) gave each user")
 
 	gc.fs.Bool("lockaccount", false, "Lock account disable authention from any device, deauthenticates user active sessions")
 	gc.fs.Bool("unlockaccount", false, "Unlock a locked account, does not unlock specific device locks (use device -unlock -username <> for that)")
 
 	gc.fs.Bool("reset-mfa", false, "Reset MFA details, invalids all session and set MFA to be shown")
 
+	gc.fs.Bool("list-mfa", false, "List the MFA methods registered by user")
+	gc.fs.StringVar(&gc.mfaType, "delete-mfa", "", "Remove a single MFA method (e.g totp) from user, invalidates all sessions")
+	gc.fs.Bool("recovery-codes", false, "Generate new MFA recovery codes for user, replacing their existing codes")
+
 	return gc
 }
 
@@ -52,13 +59,13 @@ func (g *users) PrintUsage() {
 func (g *users) Check() error {
 	g.fs.Visit(func(f *flag.Flag) {
 		switch f.Name {
-		case "lockaccount", "unlockaccount", "del", "list", "reset-mfa":
+		case "lockaccount", "unlockaccount", "del", "list", "reset-mfa", "list-mfa", "delete-mfa", "recovery-codes":
 			g.action = strings.ToLower(f.Name)
 		}
 	})
 
 	switch g.action {
-	case "del", "unlockaccount", "lockaccount", "reset-mfa":
+	case "del", "unlockaccount", "lockaccount", "reset-mfa", "list-mfa", "delete-mfa", "recovery-codes":
 		if g.username == "" {
 			return errors.New("username must be supplied")
 		}
@@ -90,9 +97,15 @@ func (g *users) Run() error {
 			return err
 		}
 
-		fmt.Println("username,locked,enforcingmfa")
+		fmt.Println("username,locked,enforcingmfa,identitygroups")
 		for _, user := range users {
-			fmt.Printf("%s,%t,%t\n", user.Username, user.Locked, user.Enforcing)
+			// Groups given to the user by identity providers, e.g group:admins (oidc 2023-08-07T20:40:56Z)
+			identityGroups := []string{}
+			for _, group := range user.IdentityGroups {
+				identityGroups = append(identityGroups, fmt.Sprintf("%s (%s %s)", group.Group, group.Source, group.Updated.Format(time.RFC3339)))
+			}
+
+			fmt.Printf("%s,%t,%t,%s\n", user.Username, user.Locked, user.Enforcing, strings.Join(identityGroups, ";"))
 		}
 	case "lockaccount":
 
@@ -117,6 +130,39 @@ func (g *users) Run() error {
 			return err
 		}
 		fmt.Println("OK")
+
+	case "list-mfa":
+		factors, err := ctl.ListUserMFA(g.username)
+		if err != nil {
+			return err
+		}
+
+		fmt.Println("type,enrolled")
+		for _, factor := range factors {
+			enrolled := "pending"
+			if factor.IsEnrolled() {
+				enrolled = factor.Enrolled.Format(time.RFC3339)
+			}
+
+			fmt.Printf("%s,%s\n", factor.Type, enrolled)
+		}
+
+	case "delete-mfa":
+		err := ctl.DeleteUserMFA(g.username, g.mfaType)
+		if err != nil {
+			return err
+		}
+		fmt.Println("OK")
+
+	case "recovery-codes":
+		codes, err := ctl.GenerateRecoveryCodes(g.username)
+		if err != nil {
+			return err
+		}
+
+		for _, code := range codes {
+			fmt.Println(code)
+		}
 	}
 
 	return nil
@@ -1,6 +1,7 @@
 package config
 
 import (
+	"crypto/x509"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -8,6 +9,7 @@ import (
 	"net"
 	"net/url"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -18,6 +20,7 @@ import (
 	"github.com/NHAS/wag/pkg/control"
 	"github.com/NHAS/wag/pkg/fsops"
 	"github.com/NHAS/webauthn/webauthn"
+	"github.com/go-ldap/ldap/v3"
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
 
@@ -45,6 +48,75 @@ func (wb webserverDetails) SupportsTLS() bool {
 type Acl struct {
 	Mfa   []string `json:",omitempty"`
 	Allow []string `json:",omitempty"`
+	Deny  []string `json:",omitempty"`
+
+	// Optional overrides of the global session timeouts for users this policy applies to, -1 disables the timeout
+	MaxSessionLifetimeMinutes       *int `json:",omitempty"`
+	SessionInactivityTimeoutMinutes *int `json:",omitempty"`
+
+	// Optional limit on the bandwidth of users this policy applies to, shared between all of a users devices
+	RateLimit *RateLimit `json:",omitempty"`
+}
+
+// The limits are enforced by the xdp firewall in bytes, which must not overflow when refilling the token bucket
+const maxRateLimitBitsPerSecond = 100_000_000_000
+
+type RateLimit struct {
+	BitsPerSecond uint64
+
+	// How much can be sent at once above the rate, defaults to one second of traffic
+	BurstBits uint64 `json:",omitempty"`
+}
+
+func (r RateLimit) validate() error {
+	if r.BitsPerSecond < 8 {
+		return errors.New("rate limit must be at least 8 bits per second")
+	}
+
+	if r.BitsPerSecond > maxRateLimitBitsPerSecond {
+		return fmt.Errorf("rate limit cannot be more than %d bits per second", uint64(maxRateLimitBitsPerSecond))
+	}
+
+	if r.BurstBits != 0 && r.BurstBits < 8 {
+		return errors.New("rate limit burst must be at least 8 bits")
+	}
+
+	if r.BurstBits > 3600*maxRateLimitBitsPerSecond {
+		return errors.New("rate limit burst is too large")
+	}
+
+	return nil
+}
+
+// The burst in bits, if the burst is not set it is one second of traffic
+func (r RateLimit) Burst() uint64 {
+	if r.BurstBits == 0 {
+		return r.BitsPerSecond
+	}
+
+	return r.BurstBits
+}
+
+func (a Acl) validate() error {
+	if err := routetypes.ValidateRules(a.Mfa, a.Allow, a.Deny); err != nil {
+		return err
+	}
+
+	if a.MaxSessionLifetimeMinutes != nil && *a.MaxSessionLifetimeMinutes == 0 {
+		return errors.New("session max lifetime override cannot be 0 (may be disabled by setting it to -1)")
+	}
+
+	if a.SessionInactivityTimeoutMinutes != nil && *a.SessionInactivityTimeoutMinutes == 0 {
+		return errors.New("session inactivity timeout override cannot be 0 (may be disabled by setting it to -1)")
+	}
+
+	if a.RateLimit != nil {
+		if err := a.RateLimit.validate(); err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
 type Acls struct {
@@ -55,13 +127,52 @@ type Acls struct {
 }
 
 func (a Acls) GetUserGroups(username string) (result []string) {
-	if values.Acls.rGroupLookup == nil {
-		return []string{}
+	valuesLock.RLock()
+	defer valuesLock.RUnlock()
+
+	groups := userGroups(username)
+
+	result = make([]string, 0, len(groups))
+	for group := range groups {
+		result = append(result, group)
+	}
+
+	return
+}
+
+// Returns the groups the user is a member of, from the config, virtual users and identity providers. valuesLock must be held
+func userGroups(username string) map[string]bool {
+	if len(identityGroups[username]) == 0 {
+		return values.Acls.rGroupLookup[username]
 	}
 
-	result = make([]string, 0, len(values.Acls.rGroupLookup[username]))
+	result := make(map[string]bool, len(values.Acls.rGroupLookup[username])+len(identityGroups[username]))
 	for group := range values.Acls.rGroupLookup[username] {
-		result = append(result, group)
+		result[group] = true
+	}
+
+	for group := range identityGroups[username] {
+		result[group] = true
+	}
+
+	return result
+}
+
+// GroupMembers returns the users in group, from the config, virtual users and identity providers
+func GroupMembers(group string) (members []string) {
+	valuesLock.RLock()
+	defer valuesLock.RUnlock()
+
+	for username, groups := range values.Acls.rGroupLookup {
+		if groups[group] {
+			members = append(members, username)
+		}
+	}
+
+	for username, groups := range identityGroups {
+		if groups[group] && !values.Acls.rGroupLookup[username][group] {
+			members = append(members, username)
+		}
 	}
 
 	return
@@ -111,6 +222,52 @@ type Config struct {
 			ServiceName string
 		} `json:",omitempty"`
 
+		RADIUS struct {
+			// Tried in order, a server is only used if the ones before it could not be reached
+			Servers []struct {
+				// host:port, the port defaults to 1812
+				Address string
+				Secret  string
+			}
+
+			// pap (default) or chap
+			Protocol string `json:",omitempty"`
+
+			NASIdentifier  string `json:",omitempty"`
+			TimeoutSeconds int    `json:",omitempty"`
+		} `json:",omitempty"`
+
+		LDAP struct {
+			// ldaps://host[:port], or ldap://host[:port] which is always upgraded with StartTLS
+			URL string
+
+			// PEM file of the certificate authorities that are trusted for the server, the system roots if unset
+			CACertPath string `json:",omitempty"`
+
+			// Account used to search for users, the search is made anonymously if unset
+			BindDN       string `json:",omitempty"`
+			BindPassword string `json:",omitempty"`
+
+			BaseDN string
+
+			// Finds the users entry, %s is replaced with their username. Defaults to (uid=%s), for active directory use (sAMAccountName=%s)
+			UserFilter string `json:",omitempty"`
+
+			// Add the user to the acl groups of the directory groups they are a member of. Only groups in GroupMap or under GroupBaseDN are used
+			SyncGroups bool `json:",omitempty"`
+
+			// Group DN -> acl group, e.g "CN=VPN Admins,OU=Groups,DC=example,DC=com": "group:admins"
+			GroupMap map[string]string `json:",omitempty"`
+
+			// Directory groups under this DN that are not in GroupMap are added as group:<name>, e.g CN=developers,OU=Wag,DC=example,DC=com is group:developers
+			GroupBaseDN string `json:",omitempty"`
+
+			// Attribute of the users entry that holds the DNs of their groups, defaults to memberOf
+			GroupAttribute string `json:",omitempty"`
+
+			TimeoutSeconds int `json:",omitempty"`
+		} `json:",omitempty"`
+
 		//Not externally configurable
 		Webauthn *webauthn.WebAuthn `json:"-"`
 	}
@@ -122,19 +279,112 @@ type Config struct {
 		MTU                 int
 		PersistentKeepAlive int
 
+		// Optional ipv6 prefix (at most /96) for tunnel addresses, each device is given the prefix with its ipv4 tunnel address as the lower 32 bits
+		IPv6Prefix string `json:",omitempty"`
+
+		// Optional sub-pools of the tunnel range that devices of members of a group are given addresses from, e.g {"group:admins": "10.2.43.0/28"}
+		GroupPools map[string]string `json:",omitempty"`
+
 		//Not externally configurable
-		External      bool       `json:"-"`
-		Range         *net.IPNet `json:"-"`
-		ServerAddress net.IP     `json:"-"`
+		External       bool       `json:"-"`
+		Range          *net.IPNet `json:"-"`
+		ServerAddress  net.IP     `json:"-"`
+		Range6         *net.IPNet `json:"-"`
+		ServerAddress6 net.IP     `json:"-"`
+
+		GroupPoolRanges map[string]*net.IPNet `json:"-"`
 
 		DNS []string `json:",omitempty"`
 	}
 
+	// Xdp firewall settings, the map sizes are fixed when the firewall is loaded so must be large enough for all devices, users and routes
+	Firewall struct {
+		MaxDevices       int `json:",omitempty"`
+		MaxUsers         int `json:",omitempty"`
+		MaxRoutesPerUser int `json:",omitempty"`
+		MaxFlows         int `json:",omitempty"`
+
+		// How long traffic back to a device is allowed after the last packet of a flow the device started
+		FlowTimeouts struct {
+			TCPSeconds   int `json:",omitempty"`
+			UDPSeconds   int `json:",omitempty"`
+			OtherSeconds int `json:",omitempty"`
+		} `json:",omitempty"`
+
+		// How often domains used in acls are re-resolved when the TTL of their records is unknown, negative disables re-resolution entirely
+		DomainRefreshSeconds int `json:",omitempty"`
+
+		// Bounds on how long the addresses of domains used in acls are kept, record TTLs outside of these are clamped to them
+		DomainMinTTLSeconds int `json:",omitempty"`
+		DomainMaxTTLSeconds int `json:",omitempty"`
+
+		// What manages the forwarding, NAT and input rules on the host, either iptables (default) or nftables
+		Backend string `json:",omitempty"`
+	} `json:",omitempty"`
+
+	// What happens to a devices session when its wireguard endpoint changes
+	Roaming struct {
+		// deauthenticate (default), same_network or grace
+		Policy string `json:",omitempty"`
+
+		// Named CIDR allow-lists for the same_network policy, e.g the prefixes a mobile carrier uses. Moving between endpoints in the same list is allowed.
+		// These are only ever the CIDRs listed, nothing is looked up
+		AllowedCIDRs map[string][]string `json:",omitempty"`
+
+		// For the grace policy, how recently the device must have had a handshake from its old endpoint for moving to be allowed. Wireguard renews
+		// handshakes every two minutes while traffic is flowing, so this should be longer than that
+		GraceSeconds int `json:",omitempty"`
+
+		// How often the wireguard device is checked for endpoint changes
+		CheckIntervalMilliseconds int `json:",omitempty"`
+
+		//Not externally configurable
+		AllowedRanges map[string][]*net.IPNet `json:"-"`
+	} `json:",omitempty"`
+
 	DatabaseLocation string
 
 	Acls Acls
 }
 
+// Default number of entries for each of the xdp firewall maps
+const defaultFirewallMapSize = 1024
+
+// Default interval to re-resolve acl domains when their TTL is unknown
+const defaultDomainRefreshSeconds = 300
+
+// Default bounds on acl domain TTLs. The minimum stops records with very short (or zero) TTLs causing constant firewall updates
+const (
+	defaultDomainMinTTLSeconds = 30
+	defaultDomainMaxTTLSeconds = 3600
+)
+
+// Host firewall backends
+const (
+	IptablesBackend = "iptables"
+	NftablesBackend = "nftables"
+)
+
+// Defaults for the flow table, tcp flows are kept for as long as the default tcp keepalive interval so idle connections using keepalives are not dropped
+const (
+	defaultMaxFlows         = 65536
+	defaultTCPFlowTimeout   = 7200
+	defaultUDPFlowTimeout   = 180
+	defaultOtherFlowTimeout = 60
+)
+
+// Roaming policies
+const (
+	RoamingDeauthenticate = "deauthenticate"
+	RoamingSameNetwork    = "same_network"
+	RoamingGrace          = "grace"
+)
+
+const (
+	defaultRoamingGraceSeconds         = 60
+	defaultEndpointCheckIntervalMillis = 250
+)
+
 var (
 	valuesLock sync.RWMutex
 	values     Config
@@ -219,7 +469,7 @@ func AddAcl(effects string, Rule Acl) error {
 		return fmt.Errorf("%s was already defined", effects)
 	}
 
-	err := routetypes.ValidateRules(Rule.Mfa, Rule.Allow)
+	err := Rule.validate()
 	if err != nil {
 		return fmt.Errorf("rules were invalid: %s", err)
 	}
@@ -238,7 +488,7 @@ func EditAcl(effects string, Rule Acl) error {
 		return fmt.Errorf("%s acl was not defined", effects)
 	}
 
-	err := routetypes.ValidateRules(Rule.Mfa, Rule.Allow)
+	err := Rule.validate()
 	if err != nil {
 		return fmt.Errorf("Public rules were invalid: %s", err)
 	}
@@ -372,6 +622,9 @@ func GetEffectiveAcl(username string) Acl {
 	var resultingACLs Acl
 	//Add the server address by default
 	resultingACLs.Allow = []string{values.Wireguard.ServerAddress.String() + "/32"}
+	if values.Wireguard.ServerAddress6 != nil {
+		resultingACLs.Allow = append(resultingACLs.Allow, values.Wireguard.ServerAddress6.String()+"/128")
+	}
 
 	// Add dns servers if defined
 	// Make sure we resolve the dns servers in case someone added them as domains, so that clients dont get stuck trying to use the domain dns servers to look up the dns servers
@@ -380,30 +633,225 @@ func GetEffectiveAcl(username string) Acl {
 		resultingACLs.Allow = append(resultingACLs.Allow, fmt.Sprintf("%s 53/any", server))
 	}
 
+	// Session timeouts and rate limits from the users own policy take precedence, otherwise the strictest of the "*" and group policies is used
+	var (
+		lifetime, inactivity *int
+		rateLimit            *RateLimit
+	)
+
 	if allPolicy, ok := values.Acls.Policies["*"]; ok {
 		resultingACLs.Allow = append(resultingACLs.Allow, allPolicy.Allow...)
 		resultingACLs.Mfa = append(resultingACLs.Mfa, allPolicy.Mfa...)
+		resultingACLs.Deny = append(resultingACLs.Deny, allPolicy.Deny...)
+
+		lifetime = strictestTimeout(lifetime, allPolicy.MaxSessionLifetimeMinutes)
+		inactivity = strictestTimeout(inactivity, allPolicy.SessionInactivityTimeoutMinutes)
+		rateLimit = strictestRateLimit(rateLimit, allPolicy.RateLimit)
 	}
 
 	//If the user has any user specific rules, add those
-	if acl, ok := values.Acls.Policies[username]; ok {
-		resultingACLs.Allow = append(resultingACLs.Allow, acl.Allow...)
-		resultingACLs.Mfa = append(resultingACLs.Mfa, acl.Mfa...)
+	userPolicy, hasUserPolicy := values.Acls.Policies[username]
+	if hasUserPolicy {
+		resultingACLs.Allow = append(resultingACLs.Allow, userPolicy.Allow...)
+		resultingACLs.Mfa = append(resultingACLs.Mfa, userPolicy.Mfa...)
+		resultingACLs.Deny = append(resultingACLs.Deny, userPolicy.Deny...)
 	}
 
 	//This may get expensive if the user belongs to a large number of
-	for group := range values.Acls.rGroupLookup[username] {
+	for group := range userGroups(username) {
 		//If the user belongs to a series of groups, grab those, and add their rules
 		if acl, ok := values.Acls.Policies[group]; ok {
 			resultingACLs.Allow = append(resultingACLs.Allow, acl.Allow...)
 			resultingACLs.Mfa = append(resultingACLs.Mfa, acl.Mfa...)
+			resultingACLs.Deny = append(resultingACLs.Deny, acl.Deny...)
+
+			lifetime = strictestTimeout(lifetime, acl.MaxSessionLifetimeMinutes)
+			inactivity = strictestTimeout(inactivity, acl.SessionInactivityTimeoutMinutes)
+			rateLimit = strictestRateLimit(rateLimit, acl.RateLimit)
 		}
 	}
 
+	if hasUserPolicy && userPolicy.MaxSessionLifetimeMinutes != nil {
+		lifetime = userPolicy.MaxSessionLifetimeMinutes
+	}
+
+	if hasUserPolicy && userPolicy.SessionInactivityTimeoutMinutes != nil {
+		inactivity = userPolicy.SessionInactivityTimeoutMinutes
+	}
+
+	if hasUserPolicy && userPolicy.RateLimit != nil {
+		rateLimit = userPolicy.RateLimit
+	}
+
+	if lifetime == nil {
+		lifetime = &values.MaxSessionLifetimeMinutes
+	}
+
+	// Copy so that the effective acl doesnt alias the configuration
+	resultingACLs.MaxSessionLifetimeMinutes = new(int)
+	*resultingACLs.MaxSessionLifetimeMinutes = *lifetime
+
+	// Left unset without an override, so the global inactivity timeout applies and follows changes to it
+	if inactivity != nil {
+		resultingACLs.SessionInactivityTimeoutMinutes = new(int)
+		*resultingACLs.SessionInactivityTimeoutMinutes = *inactivity
+	}
+
+	if rateLimit != nil {
+		resultingACLs.RateLimit = new(RateLimit)
+		*resultingACLs.RateLimit = *rateLimit
+	}
+
 	return resultingACLs
 }
 
-// Used in authentication methods that can specify user groups directly (for the moment just oidc)
+// Returns the lower of two rate limits, where nil is unset
+func strictestRateLimit(current, other *RateLimit) *RateLimit {
+	if other == nil {
+		return current
+	}
+
+	if current == nil || other.BitsPerSecond < current.BitsPerSecond {
+		return other
+	}
+
+	return current
+}
+
+// Returns the shorter of two timeouts, where nil is unset and a negative value is disabled (infinite)
+func strictestTimeout(current, other *int) *int {
+	if other == nil {
+		return current
+	}
+
+	if current == nil || *current < 0 {
+		return other
+	}
+
+	if *other < 0 || *current <= *other {
+		return current
+	}
+
+	return other
+}
+
+// Returns the ipv6 tunnel address of a device from its ipv4 tunnel address, or nil if ipv6 tunnel addresses are not enabled
+func TunnelIPv6Address(address net.IP) net.IP {
+	valuesLock.RLock()
+	defer valuesLock.RUnlock()
+
+	return embedIPv4(values.Wireguard.Range6, address)
+}
+
+// Returns the address pools of the groups the user is a member of, ordered by group name
+func UserGroupPools(username string) []*net.IPNet {
+	valuesLock.RLock()
+	defer valuesLock.RUnlock()
+
+	memberOf := userGroups(username)
+
+	groups := make([]string, 0, len(memberOf))
+	for group := range memberOf {
+		if _, ok := values.Wireguard.GroupPoolRanges[group]; ok {
+			groups = append(groups, group)
+		}
+	}
+
+	sort.Strings(groups)
+
+	pools := make([]*net.IPNet, 0, len(groups))
+	for _, group := range groups {
+		pools = append(pools, values.Wireguard.GroupPoolRanges[group])
+	}
+
+	return pools
+}
+
+func embedIPv4(prefix *net.IPNet, address net.IP) net.IP {
+	if prefix == nil || address.To4() == nil {
+		return nil
+	}
+
+	result := make(net.IP, net.IPv6len)
+	copy(result, prefix.IP.To16()[:12])
+	copy(result[12:], address.To4())
+
+	return result
+}
+
+func validateRoaming(c *Config) error {
+	switch c.Roaming.Policy {
+	case "":
+		c.Roaming.Policy = RoamingDeauthenticate
+	case RoamingDeauthenticate, RoamingSameNetwork, RoamingGrace:
+	default:
+		return fmt.Errorf("Roaming.Policy must be %s, %s or %s, not %q", RoamingDeauthenticate, RoamingSameNetwork, RoamingGrace, c.Roaming.Policy)
+	}
+
+	if c.Roaming.GraceSeconds < 0 {
+		return errors.New("Roaming.GraceSeconds cannot be negative")
+	}
+
+	if c.Roaming.GraceSeconds == 0 {
+		c.Roaming.GraceSeconds = defaultRoamingGraceSeconds
+	}
+
+	if c.Roaming.CheckIntervalMilliseconds < 0 {
+		return errors.New("Roaming.CheckIntervalMilliseconds cannot be negative")
+	}
+
+	if c.Roaming.CheckIntervalMilliseconds == 0 {
+		c.Roaming.CheckIntervalMilliseconds = defaultEndpointCheckIntervalMillis
+	}
+
+	c.Roaming.AllowedRanges = map[string][]*net.IPNet{}
+	for name, networks := range c.Roaming.AllowedCIDRs {
+		for _, network := range networks {
+			_, networkRange, err := net.ParseCIDR(network)
+			if err != nil {
+				return fmt.Errorf("Roaming.AllowedCIDRs %s has an invalid cidr: %s", name, err)
+			}
+
+			c.Roaming.AllowedRanges[name] = append(c.Roaming.AllowedRanges[name], networkRange)
+		}
+	}
+
+	return nil
+}
+
+// Group pools must be inside the tunnel range and must not overlap, so each pool address belongs to exactly one group
+func parseGroupPools(pools map[string]string, tunnelRange *net.IPNet) (map[string]*net.IPNet, error) {
+	result := map[string]*net.IPNet{}
+
+	tunnelOnes, _ := tunnelRange.Mask.Size()
+
+	for group, pool := range pools {
+		if !strings.HasPrefix(group, "group:") {
+			return nil, fmt.Errorf("Wireguard.GroupPools group %q does not have the 'group:' prefix", group)
+		}
+
+		_, poolRange, err := net.ParseCIDR(pool)
+		if err != nil {
+			return nil, fmt.Errorf("Wireguard.GroupPools pool for %s is invalid: %s", group, err)
+		}
+
+		if poolOnes, _ := poolRange.Mask.Size(); poolRange.IP.To4() == nil || poolOnes < tunnelOnes || !tunnelRange.Contains(poolRange.IP) {
+			return nil, fmt.Errorf("Wireguard.GroupPools pool for %s (%s) is not inside the wireguard range %s", group, pool, tunnelRange.String())
+		}
+
+		for otherGroup, otherRange := range result {
+			if otherRange.Contains(poolRange.IP) || poolRange.Contains(otherRange.IP) {
+				return nil, fmt.Errorf("Wireguard.GroupPools pool for %s (%s) overlaps the pool for %s (%s)", group, pool, otherGroup, otherRange.String())
+			}
+		}
+
+		result[group] = poolRange
+	}
+
+	return result, nil
+}
+
+// Used when registering users with groups set on their registration token
 // Adds groups to username, even if user does not exist in the config.json file, so GetEffectiveAcls works
 func AddVirtualUser(username string, groups []string) {
 	valuesLock.Lock()
@@ -418,6 +866,26 @@ func AddVirtualUser(username string, groups []string) {
 	}
 }
 
+// Groups that identity providers have given users, kept apart from the config so they are not lost when it is reloaded
+var identityGroups = map[string]map[string]bool{}
+
+// SetIdentityGroups replaces the groups identity providers have given username, unlike AddVirtualUser groups the user is no longer a member of are removed.
+// Groups the user is a member of in the config file are unaffected
+func SetIdentityGroups(username string, groups []string) {
+	valuesLock.Lock()
+	defer valuesLock.Unlock()
+
+	if len(groups) == 0 {
+		delete(identityGroups, username)
+		return
+	}
+
+	identityGroups[username] = make(map[string]bool, len(groups))
+	for _, group := range groups {
+		identityGroups[username][group] = true
+	}
+}
+
 func load(path string) (c Config, err error) {
 	configFile, err := os.Open(path)
 	if err != nil {
@@ -449,22 +917,22 @@ func load(path string) (c Config, err error) {
 			return c, errors.New("wireguard interface does not have an ip address")
 		}
 
-		addr := addresses[0].String()
-		for i := len(addr) - 1; i > 0; i-- {
-			if addr[i] == ':' || addr[i] == '/' {
-				addr = addr[:i]
+		// The interface may also have ipv6 addresses, so find the first ipv4 address
+		for _, address := range addresses {
+			ip, ipRange, err := net.ParseCIDR(address.String())
+			if err != nil {
+				return c, errors.New("unable to parse VPN range from tune device address: " + address.String() + " : " + err.Error())
+			}
+
+			if ip.To4() != nil {
+				c.Wireguard.ServerAddress = ip.To4()
+				c.Wireguard.Range = ipRange
 				break
 			}
 		}
 
-		c.Wireguard.ServerAddress = net.ParseIP(addr)
 		if c.Wireguard.ServerAddress == nil {
-			return c, fmt.Errorf("unable to find server address from tunnel interface:  '%s'", addr)
-		}
-
-		_, c.Wireguard.Range, err = net.ParseCIDR(addresses[0].String())
-		if err != nil {
-			return c, errors.New("unable to parse VPN range from tune device address: " + addresses[0].String() + " : " + err.Error())
+			return c, fmt.Errorf("unable to find ipv4 server address from tunnel interface: %s", c.Wireguard.DevName)
 		}
 
 	} else {
@@ -492,6 +960,104 @@ func load(path string) (c Config, err error) {
 		}
 	}
 
+	if c.Wireguard.IPv6Prefix != "" {
+		_, c.Wireguard.Range6, err = net.ParseCIDR(c.Wireguard.IPv6Prefix)
+		if err != nil {
+			return c, errors.New("wireguard IPv6Prefix invalid: " + err.Error())
+		}
+
+		if c.Wireguard.Range6.IP.To4() != nil {
+			return c, errors.New("wireguard IPv6Prefix was not an ipv6 prefix: " + c.Wireguard.IPv6Prefix)
+		}
+
+		if ones, _ := c.Wireguard.Range6.Mask.Size(); ones > 96 {
+			return c, errors.New("wireguard IPv6Prefix must be /96 or shorter as device ipv4 addresses are used as the lower 32 bits: " + c.Wireguard.IPv6Prefix)
+		}
+
+		c.Wireguard.ServerAddress6 = embedIPv4(c.Wireguard.Range6, c.Wireguard.ServerAddress)
+	}
+
+	c.Wireguard.GroupPoolRanges, err = parseGroupPools(c.Wireguard.GroupPools, c.Wireguard.Range)
+	if err != nil {
+		return c, err
+	}
+
+	for _, limit := range []struct {
+		name  string
+		value *int
+	}{
+		{"Firewall.MaxDevices", &c.Firewall.MaxDevices},
+		{"Firewall.MaxUsers", &c.Firewall.MaxUsers},
+		{"Firewall.MaxRoutesPerUser", &c.Firewall.MaxRoutesPerUser},
+	} {
+		if *limit.value < 0 {
+			return c, fmt.Errorf("%s cannot be negative", limit.name)
+		}
+
+		if *limit.value == 0 {
+			*limit.value = defaultFirewallMapSize
+		}
+	}
+
+	if c.Firewall.MaxFlows < 0 {
+		return c, errors.New("Firewall.MaxFlows cannot be negative")
+	}
+
+	if c.Firewall.MaxFlows == 0 {
+		c.Firewall.MaxFlows = defaultMaxFlows
+	}
+
+	for _, timeout := range []struct {
+		name         string
+		value        *int
+		defaultValue int
+	}{
+		{"Firewall.FlowTimeouts.TCPSeconds", &c.Firewall.FlowTimeouts.TCPSeconds, defaultTCPFlowTimeout},
+		{"Firewall.FlowTimeouts.UDPSeconds", &c.Firewall.FlowTimeouts.UDPSeconds, defaultUDPFlowTimeout},
+		{"Firewall.FlowTimeouts.OtherSeconds", &c.Firewall.FlowTimeouts.OtherSeconds, defaultOtherFlowTimeout},
+	} {
+		if *timeout.value < 0 {
+			return c, fmt.Errorf("%s cannot be negative", timeout.name)
+		}
+
+		if *timeout.value == 0 {
+			*timeout.value = timeout.defaultValue
+		}
+	}
+
+	switch c.Firewall.Backend {
+	case "":
+		c.Firewall.Backend = IptablesBackend
+	case IptablesBackend, NftablesBackend:
+	default:
+		return c, fmt.Errorf("Firewall.Backend must be %s or %s, not %q", IptablesBackend, NftablesBackend, c.Firewall.Backend)
+	}
+
+	if c.Firewall.DomainRefreshSeconds == 0 {
+		c.Firewall.DomainRefreshSeconds = defaultDomainRefreshSeconds
+	}
+
+	if c.Firewall.DomainMinTTLSeconds < 0 || c.Firewall.DomainMaxTTLSeconds < 0 {
+		return c, errors.New("Firewall.DomainMinTTLSeconds and Firewall.DomainMaxTTLSeconds cannot be negative")
+	}
+
+	if c.Firewall.DomainMinTTLSeconds == 0 {
+		c.Firewall.DomainMinTTLSeconds = defaultDomainMinTTLSeconds
+	}
+
+	if c.Firewall.DomainMaxTTLSeconds == 0 {
+		c.Firewall.DomainMaxTTLSeconds = defaultDomainMaxTTLSeconds
+	}
+
+	if c.Firewall.DomainMaxTTLSeconds < c.Firewall.DomainMinTTLSeconds {
+		return c, fmt.Errorf("Firewall.DomainMaxTTLSeconds (%d) is less than Firewall.DomainMinTTLSeconds (%d)", c.Firewall.DomainMaxTTLSeconds, c.Firewall.DomainMinTTLSeconds)
+	}
+
+	err = validateRoaming(&c)
+	if err != nil {
+		return c, err
+	}
+
 	if len(c.Acls.Policies) == 0 {
 		return c, errors.New("no policies set under acls.Policies")
 	}
@@ -584,10 +1150,16 @@ func load(path string) (c Config, err error) {
 	}
 
 	for _, acl := range c.Acls.Policies {
-		err = routetypes.ValidateRules(acl.Mfa, acl.Allow)
+		err = acl.validate()
 		if err != nil {
 			return c, fmt.Errorf("policy was invalid: %s", err)
 		}
+
+		for _, target := range routetypes.PeerTargets(acl.Mfa, acl.Allow, acl.Deny) {
+			if _, ok := c.Acls.Groups[target]; strings.HasPrefix(target, "group:") && !ok {
+				return c, fmt.Errorf("policy was invalid: rule uses the devices of %s, which is not a defined group", target)
+			}
+		}
 	}
 
 	if len(c.MFATemplatesDirectory) != 0 {
@@ -658,6 +1230,98 @@ func load(path string) (c Config, err error) {
 			settings["IssuerURL"] = c.Authenticators.OIDC.IssuerURL
 			settings["DomainURL"] = c.Authenticators.DomainURL
 
+		case "radius":
+			if len(c.Authenticators.RADIUS.Servers) == 0 {
+				return c, errors.New("Authenticators.RADIUS.Servers is empty, but radius authentication method is enabled")
+			}
+
+			for i, server := range c.Authenticators.RADIUS.Servers {
+				if server.Address == "" {
+					return c, fmt.Errorf("Authenticators.RADIUS.Servers[%d].Address is empty", i)
+				}
+
+				if _, _, err := net.SplitHostPort(server.Address); err != nil {
+					c.Authenticators.RADIUS.Servers[i].Address = net.JoinHostPort(server.Address, "1812")
+				}
+
+				if server.Secret == "" {
+					return c, fmt.Errorf("Authenticators.RADIUS.Servers[%d].Secret is empty", i)
+				}
+			}
+
+			switch c.Authenticators.RADIUS.Protocol {
+			case "":
+				c.Authenticators.RADIUS.Protocol = "pap"
+			case "pap", "chap":
+			default:
+				return c, errors.New("Authenticators.RADIUS.Protocol must be pap or chap, not: " + c.Authenticators.RADIUS.Protocol)
+			}
+
+			if c.Authenticators.RADIUS.TimeoutSeconds <= 0 {
+				c.Authenticators.RADIUS.TimeoutSeconds = 5
+			}
+
+		case "ldap":
+			ldapURL, err := url.Parse(c.Authenticators.LDAP.URL)
+			if err != nil {
+				return c, errors.New("unable to parse Authenticators.LDAP.URL: " + err.Error())
+			}
+
+			if ldapURL.Scheme != "ldaps" && ldapURL.Scheme != "ldap" {
+				return c, errors.New("Authenticators.LDAP.URL was not ldaps:// or ldap:// (StartTLS)")
+			}
+
+			if c.Authenticators.LDAP.CACertPath != "" {
+				pem, err := os.ReadFile(c.Authenticators.LDAP.CACertPath)
+				if err != nil {
+					return c, errors.New("unable to read Authenticators.LDAP.CACertPath: " + err.Error())
+				}
+
+				if !x509.NewCertPool().AppendCertsFromPEM(pem) {
+					return c, errors.New("Authenticators.LDAP.CACertPath contained no certificates")
+				}
+			}
+
+			if c.Authenticators.LDAP.BaseDN == "" {
+				return c, errors.New("Authenticators.LDAP.BaseDN is empty, but ldap authentication method is enabled")
+			}
+
+			if c.Authenticators.LDAP.UserFilter == "" {
+				c.Authenticators.LDAP.UserFilter = "(uid=%s)"
+			}
+
+			if strings.Count(c.Authenticators.LDAP.UserFilter, "%s") != 1 || strings.Count(c.Authenticators.LDAP.UserFilter, "%") != 1 {
+				return c, errors.New("Authenticators.LDAP.UserFilter must contain %s once, where the username is placed, and no other formatting directives")
+			}
+
+			if c.Authenticators.LDAP.GroupAttribute == "" {
+				c.Authenticators.LDAP.GroupAttribute = "memberOf"
+			}
+
+			if c.Authenticators.LDAP.SyncGroups && len(c.Authenticators.LDAP.GroupMap) == 0 && c.Authenticators.LDAP.GroupBaseDN == "" {
+				return c, errors.New("Authenticators.LDAP.SyncGroups is set, but neither GroupMap or GroupBaseDN are set so no directory groups would be used")
+			}
+
+			for groupDN, group := range c.Authenticators.LDAP.GroupMap {
+				if _, err := ldap.ParseDN(groupDN); err != nil {
+					return c, fmt.Errorf("Authenticators.LDAP.GroupMap has an invalid group dn %q: %s", groupDN, err)
+				}
+
+				if !strings.HasPrefix(group, "group:") || group == "group:" {
+					return c, fmt.Errorf("Authenticators.LDAP.GroupMap group for %q (%q) does not have the 'group:' prefix", groupDN, group)
+				}
+			}
+
+			if c.Authenticators.LDAP.GroupBaseDN != "" {
+				if _, err := ldap.ParseDN(c.Authenticators.LDAP.GroupBaseDN); err != nil {
+					return c, errors.New("Authenticators.LDAP.GroupBaseDN is not a valid dn: " + err.Error())
+				}
+			}
+
+			if c.Authenticators.LDAP.TimeoutSeconds <= 0 {
+				c.Authenticators.LDAP.TimeoutSeconds = 5
+			}
+
 		case "webauthn":
 
 			if c.Authenticators.DomainURL == "" {
@@ -790,16 +1454,13 @@ func parseAddress(address string) ([]string, error) {
 			}
 
 			output := []string{}
-			addedSomething := false
 			for _, addr := range addresses {
 				if addr.To4() != nil {
-					addedSomething = true
 					output = append(output, addr.String()+"/32")
+					continue
 				}
-			}
 
-			if !addedSomething {
-				return nil, fmt.Errorf("no addresses for domain %s were added, potentially because they were all ipv6 which is unsupported", address)
+				output = append(output, addr.String()+"/128")
 			}
 
 			return output, nil
@@ -808,5 +1469,9 @@ func parseAddress(address string) ([]string, error) {
 		return []string{cidr.String()}, nil
 	}
 
-	return []string{ip.To4().String() + "/32"}, nil
+	if ip.To4() != nil {
+		return []string{ip.To4().String() + "/32"}, nil
+	}
+
+	return []string{ip.String() + "/128"}, nil
 }
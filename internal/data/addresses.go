@@ -0,0 +1,446 @@
+package data
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/NHAS/wag/internal/config"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// Device addresses are allocated from the wireguard range. The Devices table is the record of which addresses are in use, so the address of a deleted device
+// is free to be given to the next new device. Addresses can be reserved for a user, or for a single device by its public key, and members of groups with
+// a pool in Wireguard.GroupPools are only given addresses from their groups pools
+//
+// Gateway devices also have routes, the networks behind them. These are checked here as well, as no two gateways can route the same network and
+// a gateway cannot route the tunnel ranges
+
+type AddressReservation struct {
+	Address  string
+	Username string
+
+	// Set if the address is reserved for a single device
+	Publickey string `json:",omitempty"`
+}
+
+// Held while picking an address and adding the device, so two new devices are not given the same address
+var allocationLock sync.Mutex
+
+// The addresses used by devices, reserved addresses and the routes of gateways, read while allocationLock is held
+type addressState struct {
+	used         map[string]string
+	reservations []AddressReservation
+
+	// Route to the address of the gateway that has it
+	routes map[string]string
+}
+
+// AllocateDevice gives a new device an address and adds it. If requestedAddress is set the device is given that address, or an error is returned if it cannot have it
+// If routes are set the device is a gateway for those networks
+func AllocateDevice(username, publickey, presharedKey, requestedAddress string, routes []string) (Device, error) {
+	allocationLock.Lock()
+	defer allocationLock.Unlock()
+
+	state, err := getAddressState()
+	if err != nil {
+		return Device{}, err
+	}
+
+	routes, err = state.checkRoutes(routes)
+	if err != nil {
+		return Device{}, err
+	}
+
+	var address net.IP
+	if requestedAddress != "" {
+		address = net.ParseIP(requestedAddress).To4()
+		if err := state.canUse(address, username, publickey); err != nil {
+			return Device{}, err
+		}
+	} else {
+		address, err = state.pick(username, publickey)
+		if err != nil {
+			return Device{}, err
+		}
+	}
+
+	return AddDevice(username, address.String(), publickey, presharedKey, routes)
+}
+
+// CheckGatewayRoutes returns an error if a new gateway could not have routes
+func CheckGatewayRoutes(routes []string) error {
+	allocationLock.Lock()
+	defer allocationLock.Unlock()
+
+	state, err := getAddressState()
+	if err != nil {
+		return err
+	}
+
+	_, err = state.checkRoutes(routes)
+	return err
+}
+
+// CheckRequestedAddress returns an error if a new device for username could not be given address
+func CheckRequestedAddress(username, address string) error {
+	allocationLock.Lock()
+	defer allocationLock.Unlock()
+
+	state, err := getAddressState()
+	if err != nil {
+		return err
+	}
+
+	return state.canUse(net.ParseIP(address).To4(), username, "")
+}
+
+// AddAddressReservation reserves address for the users devices, or if publickey is set for only that device
+func AddAddressReservation(address, username, publickey string) error {
+	if username == "" {
+		return errors.New("username must be set to reserve an address")
+	}
+
+	if publickey != "" {
+		if _, err := wgtypes.ParseKey(publickey); err != nil {
+			return errors.New("invalid public key: " + err.Error())
+		}
+	}
+
+	allocationLock.Lock()
+	defer allocationLock.Unlock()
+
+	ip := net.ParseIP(address).To4()
+	if err := assignable(ip); err != nil {
+		return err
+	}
+
+	state, err := getAddressState()
+	if err != nil {
+		return err
+	}
+
+	// An address can be reserved for the device that already has it, so it keeps its address if it is deleted and registered again
+	if owner, ok := state.used[ip.String()]; ok && owner != username {
+		return fmt.Errorf("address %s is in use by a device owned by %s", ip, owner)
+	}
+
+	_, err = database.Exec(`
+	INSERT INTO
+		AddressReservations (address, username, publickey)
+	VALUES
+		(?, ?, ?)
+	`, ip.String(), username, sql.NullString{String: publickey, Valid: publickey != ""})
+	if err != nil {
+		return fmt.Errorf("unable to reserve address %s: %s", ip, err)
+	}
+
+	return nil
+}
+
+func DeleteAddressReservation(address string) error {
+	result, err := database.Exec(`DELETE FROM AddressReservations WHERE address = ?`, address)
+	if err != nil {
+		return err
+	}
+
+	if n, _ := result.RowsAffected(); n == 0 {
+		return errors.New("no reservation for address " + address)
+	}
+
+	return nil
+}
+
+// GetAddressReservations returns the reserved addresses in address order
+func GetAddressReservations() (reservations []AddressReservation, err error) {
+	rows, err := database.Query(`SELECT address, username, publickey FROM AddressReservations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			publickey   sql.NullString
+			reservation AddressReservation
+		)
+
+		err = rows.Scan(&reservation.Address, &reservation.Username, &publickey)
+		if err != nil {
+			return nil, err
+		}
+
+		reservation.Publickey = publickey.String
+		reservations = append(reservations, reservation)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(reservations, func(i, j int) bool {
+		return bytes.Compare(net.ParseIP(reservations[i].Address).To16(), net.ParseIP(reservations[j].Address).To16()) < 0
+	})
+
+	return reservations, nil
+}
+
+func getAddressState() (state addressState, err error) {
+	state.used = map[string]string{}
+	state.routes = map[string]string{}
+
+	rows, err := database.Query(`SELECT address, username, routes FROM Devices`)
+	if err != nil {
+		return state, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			address, username string
+			routesJson        sql.NullString
+		)
+
+		if err := rows.Scan(&address, &username, &routesJson); err != nil {
+			return state, err
+		}
+
+		state.used[address] = username
+
+		if routesJson.Valid {
+			var routes []string
+			if err := json.Unmarshal([]byte(routesJson.String), &routes); err != nil {
+				return state, fmt.Errorf("device %s has invalid routes: %s", address, err)
+			}
+
+			for _, route := range routes {
+				state.routes[route] = address
+			}
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return state, err
+	}
+
+	state.reservations, err = GetAddressReservations()
+	return state, err
+}
+
+func (s addressState) reservation(address net.IP) (AddressReservation, bool) {
+	for _, reservation := range s.reservations {
+		if reservation.Address == address.String() {
+			return reservation, true
+		}
+	}
+
+	return AddressReservation{}, false
+}
+
+// Picks an address for a new device, in order: an address reserved for the device, an address reserved for the user, the first free address in the
+// users group pools, or if the user is not in a group with a pool the first free address in the wireguard range that is not in any pool
+func (s addressState) pick(username, publickey string) (net.IP, error) {
+	for _, reservedFor := range []string{publickey, ""} {
+		for _, reservation := range s.reservations {
+			if reservation.Username != username || reservation.Publickey != reservedFor {
+				continue
+			}
+
+			if _, used := s.used[reservation.Address]; !used {
+				return net.ParseIP(reservation.Address).To4(), nil
+			}
+		}
+	}
+
+	pools := config.UserGroupPools(username)
+	for _, pool := range pools {
+		if address := s.firstFree(pool, nil); address != nil {
+			return address, nil
+		}
+	}
+
+	if len(pools) > 0 {
+		return nil, fmt.Errorf("no free addresses in the group pools of %s", username)
+	}
+
+	allPools := config.Values().Wireguard.GroupPoolRanges
+	address := s.firstFree(config.Values().Wireguard.Range, func(address net.IP) bool {
+		for _, pool := range allPools {
+			if pool.Contains(address) {
+				return true
+			}
+		}
+
+		return false
+	})
+
+	if address == nil {
+		return nil, errors.New("no free addresses in the wireguard range")
+	}
+
+	return address, nil
+}
+
+// The lowest address in network that can be given to a device and is not used, reserved or excluded
+func (s addressState) firstFree(network *net.IPNet, excluded func(net.IP) bool) net.IP {
+	for address := network.IP.Mask(network.Mask).To4(); address != nil && network.Contains(address); address = nextAddress(address) {
+		if assignable(address) != nil {
+			continue
+		}
+
+		if _, used := s.used[address.String()]; used {
+			continue
+		}
+
+		if _, reserved := s.reservation(address); reserved {
+			continue
+		}
+
+		if excluded != nil && excluded(address) {
+			continue
+		}
+
+		return address
+	}
+
+	return nil
+}
+
+// Returns an error if a new device for username with publickey cannot be given address, if publickey is empty reservations for a single device are not checked
+func (s addressState) canUse(address net.IP, username, publickey string) error {
+	if err := assignable(address); err != nil {
+		return err
+	}
+
+	if owner, used := s.used[address.String()]; used {
+		return fmt.Errorf("address %s is already in use by a device owned by %s", address, owner)
+	}
+
+	if reservation, reserved := s.reservation(address); reserved {
+		if reservation.Username != username || (publickey != "" && reservation.Publickey != "" && reservation.Publickey != publickey) {
+			return fmt.Errorf("address %s is reserved", address)
+		}
+
+		return nil
+	}
+
+	// Group pools only contain devices of the groups members, so source addresses can be used to recognise the group
+	pools := config.UserGroupPools(username)
+	for _, pool := range pools {
+		if pool.Contains(address) {
+			return nil
+		}
+	}
+
+	if len(pools) > 0 {
+		return fmt.Errorf("address %s is not in the group pools of %s", address, username)
+	}
+
+	for group, pool := range config.Values().Wireguard.GroupPoolRanges {
+		if pool.Contains(address) {
+			return fmt.Errorf("address %s is in the pool for %s, which %s is not a member of", address, group, username)
+		}
+	}
+
+	return nil
+}
+
+// Parses the routes of a new gateway and returns them as networks, e.g 192.168.1.5/24 is 192.168.1.0/24. Returns an error if a route overlaps one of
+// the tunnel ranges, another of the routes or the routes of an existing gateway
+func (s addressState) checkRoutes(routes []string) ([]string, error) {
+	if len(routes) == 0 {
+		return nil, nil
+	}
+
+	excluded := map[string]*net.IPNet{
+		"the wireguard range": config.Values().Wireguard.Range,
+	}
+
+	if config.Values().Wireguard.Range6 != nil {
+		excluded["the wireguard ipv6 range"] = config.Values().Wireguard.Range6
+	}
+
+	for route, gateway := range s.routes {
+		_, network, err := net.ParseCIDR(route)
+		if err != nil {
+			return nil, fmt.Errorf("gateway %s has invalid route %q: %s", gateway, route, err)
+		}
+
+		excluded["route "+route+" of gateway "+gateway] = network
+	}
+
+	var result []string
+	for _, route := range routes {
+		_, network, err := net.ParseCIDR(strings.TrimSpace(route))
+		if err != nil {
+			return nil, fmt.Errorf("invalid route %q: %s", route, err)
+		}
+
+		for name, other := range excluded {
+			if other.Contains(network.IP) || network.Contains(other.IP) {
+				return nil, fmt.Errorf("route %s overlaps %s", network, name)
+			}
+		}
+
+		excluded["route "+network.String()] = network
+		result = append(result, network.String())
+	}
+
+	return result, nil
+}
+
+// Returns an error if address is not in the wireguard range, or is the server, network or broadcast address
+func assignable(address net.IP) error {
+	if address == nil {
+		return errors.New("device addresses must be ipv4 addresses")
+	}
+
+	tunnelRange := config.Values().Wireguard.Range
+	if !tunnelRange.Contains(address) {
+		return fmt.Errorf("address %s is not in the wireguard range %s", address, tunnelRange)
+	}
+
+	if address.Equal(config.Values().Wireguard.ServerAddress) {
+		return fmt.Errorf("address %s is the wireguard server address", address)
+	}
+
+	// Point to point ranges do not have network and broadcast addresses
+	if ones, bits := tunnelRange.Mask.Size(); bits-ones < 2 {
+		return nil
+	}
+
+	network := tunnelRange.IP.Mask(tunnelRange.Mask).To4()
+	mask := tunnelRange.Mask[len(tunnelRange.Mask)-net.IPv4len:]
+
+	broadcast := make(net.IP, net.IPv4len)
+	for i := range broadcast {
+		broadcast[i] = network[i] | ^mask[i]
+	}
+
+	if address.Equal(network) || address.Equal(broadcast) {
+		return fmt.Errorf("address %s is the network or broadcast address of the wireguard range", address)
+	}
+
+	return nil
+}
+
+func nextAddress(address net.IP) net.IP {
+	next := make(net.IP, len(address))
+	copy(next, address)
+
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i]++
+		if next[i] != 0 {
+			return next
+		}
+	}
+
+	// Wrapped around
+	return nil
+}
@@ -0,0 +1,243 @@
+package data
+
+import (
+	"testing"
+
+	"github.com/NHAS/wag/internal/config"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func newDevice(t *testing.T, username, requestedAddress string) (Device, error) {
+	key, err := wgtypes.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return AllocateDevice(username, key.PublicKey().String(), key.String(), requestedAddress, nil)
+}
+
+func newGateway(t *testing.T, routes []string) (Device, error) {
+	key, err := wgtypes.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return AllocateDevice("fronk", key.PublicKey().String(), key.String(), "", routes)
+}
+
+func expectAddress(t *testing.T, username, expected string) Device {
+	device, err := newDevice(t, username, "")
+	if err != nil {
+		t.Fatalf("unable to allocate device for %s: %s", username, err)
+	}
+
+	if device.Address != expected {
+		t.Fatalf("device for %s was given %s, expected %s", username, device.Address, expected)
+	}
+
+	return device
+}
+
+func TestAllocateDevice(t *testing.T) {
+	if err := config.Load("../config/test_group_pools.json"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Load("file::memory:"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The server has .1, and .16-.31 is the pool for group:administrators
+	first := expectAddress(t, "fronk", "10.2.43.2")
+	expectAddress(t, "fronk", "10.2.43.3")
+
+	expectAddress(t, "toaster", "10.2.43.16")
+	expectAddress(t, "tester", "10.2.43.17")
+
+	// abc is only in group:nerds, which does not have a pool
+	expectAddress(t, "abc", "10.2.43.4")
+
+	if err := DeleteDevice(first.Username, first.Address); err != nil {
+		t.Fatal(err)
+	}
+
+	expectAddress(t, "abc", first.Address)
+}
+
+func TestAddressReservations(t *testing.T) {
+	if err := config.Load("../config/test_group_pools.json"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Load("file::memory:"); err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := wgtypes.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := AddAddressReservation("10.2.43.2", "abc", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := AddAddressReservation("10.2.43.200", "fronk", key.PublicKey().String()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := AddAddressReservation("10.2.43.2", "fronk", ""); err == nil {
+		t.Fatal("reserved an address that was already reserved")
+	}
+
+	for _, address := range []string{"10.2.43.1", "10.2.43.0", "10.2.43.255", "10.2.44.5", "fd00::1", "not an address"} {
+		if err := AddAddressReservation(address, "fronk", ""); err == nil {
+			t.Fatalf("reserved %s which cannot be given to devices", address)
+		}
+	}
+
+	// Reserved addresses are skipped for other users
+	expectAddress(t, "fronk", "10.2.43.3")
+	expectAddress(t, "abc", "10.2.43.2")
+
+	// Once the users reservations are used they get addresses like everyone else
+	expectAddress(t, "abc", "10.2.43.4")
+
+	device, err := AllocateDevice("fronk", key.PublicKey().String(), key.String(), "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if device.Address != "10.2.43.200" {
+		t.Fatalf("device was not given the address reserved for it: %s", device.Address)
+	}
+
+	if err := DeleteAddressReservation("10.2.43.2"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := DeleteAddressReservation("10.2.43.2"); err == nil {
+		t.Fatal("deleted a reservation that does not exist")
+	}
+
+	reservations, err := GetAddressReservations()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(reservations) != 1 || reservations[0].Address != "10.2.43.200" || reservations[0].Username != "fronk" || reservations[0].Publickey != key.PublicKey().String() {
+		t.Fatalf("unexpected reservations: %+v", reservations)
+	}
+}
+
+func TestRequestedAddress(t *testing.T) {
+	if err := config.Load("../config/test_group_pools.json"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Load("file::memory:"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := AddAddressReservation("10.2.43.50", "abc", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	device, err := newDevice(t, "fronk", "10.2.43.100")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if device.Address != "10.2.43.100" {
+		t.Fatalf("device was not given the requested address: %s", device.Address)
+	}
+
+	for _, test := range []struct {
+		username, address string
+	}{
+		{"abc", "10.2.43.100"},    // in use
+		{"fronk", "10.2.43.50"},   // reserved for abc
+		{"fronk", "10.2.43.20"},   // in the pool of a group fronk is not in
+		{"toaster", "10.2.43.60"}, // outside of toasters group pool
+		{"fronk", "10.2.43.1"},    // server address
+		{"fronk", "10.2.44.1"},    // outside of the wireguard range
+	} {
+		if _, err := newDevice(t, test.username, test.address); err == nil {
+			t.Fatalf("%s was given %s", test.username, test.address)
+		}
+
+		if err := CheckRequestedAddress(test.username, test.address); err == nil {
+			t.Fatalf("%s could request %s", test.username, test.address)
+		}
+	}
+
+	if _, err := newDevice(t, "abc", "10.2.43.50"); err != nil {
+		t.Fatal("user could not request their reserved address: ", err)
+	}
+
+	if _, err := newDevice(t, "toaster", "10.2.43.30"); err != nil {
+		t.Fatal("user could not request an address in their group pool: ", err)
+	}
+}
+
+func TestGatewayRoutes(t *testing.T) {
+	if err := config.Load("../config/test_group_pools.json"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Load("file::memory:"); err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := wgtypes.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gateway, err := AllocateDevice("fronk", key.PublicKey().String(), key.String(), "", []string{"172.16.5.9/24", " fd00:5::/64"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !gateway.IsGateway() || len(gateway.Routes) != 2 || gateway.Routes[0] != "172.16.5.0/24" || gateway.Routes[1] != "fd00:5::/64" {
+		t.Fatalf("gateway routes were not normalised: %+v", gateway.Routes)
+	}
+
+	stored, err := GetDeviceByAddress(gateway.Address)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(stored.Routes) != 2 || stored.Routes[0] != "172.16.5.0/24" {
+		t.Fatalf("gateway routes were not stored: %+v", stored.Routes)
+	}
+
+	for _, routes := range [][]string{
+		{"172.16.5.128/25"},                // inside another gateways route
+		{"172.16.0.0/16"},                  // contains another gateways route
+		{"10.2.43.0/28"},                   // inside the wireguard range
+		{"0.0.0.0/0"},                      // contains the wireguard range
+		{"172.17.0.0/24", "172.17.0.0/25"}, // overlap each other
+		{"not a route"},
+	} {
+		if err := CheckGatewayRoutes(routes); err == nil {
+			t.Fatalf("gateway could have routes %v", routes)
+		}
+
+		if _, err := newGateway(t, routes); err == nil {
+			t.Fatalf("gateway was added with routes %v", routes)
+		}
+	}
+
+	if _, err := newGateway(t, []string{"172.17.0.0/24"}); err != nil {
+		t.Fatal("gateway could not be added with a free route: ", err)
+	}
+
+	if err := DeleteDevice(gateway.Username, gateway.Address); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := CheckGatewayRoutes([]string{"172.16.5.0/24"}); err != nil {
+		t.Fatal("routes of a deleted gateway should be free: ", err)
+	}
+}
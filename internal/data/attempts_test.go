@@ -0,0 +1,61 @@
+package data
+
+import (
+	"testing"
+
+	"github.com/NHAS/wag/internal/config"
+)
+
+func expectAttempts(t *testing.T, username, address string, expected int) {
+	t.Helper()
+
+	device, err := GetDeviceByAddress(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if device.Attempts != expected {
+		t.Fatalf("%s %s has %d attempts, expected %d", username, address, device.Attempts, expected)
+	}
+}
+
+func TestAuthenticationAttempts(t *testing.T) {
+	if err := config.Load("../config/test_in_memory_db.json"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Load("file::memory:"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := CreateUserDataAccount("toaster"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := AddDevice("toaster", "10.2.43.2", "dc99y+fmhaHwFToSIw/1MSVXewbiyegBMwNGA6LG8yM=", "", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := IncrementAuthenticationAttempt("toaster", "10.2.43.2"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expectAttempts(t, "toaster", "10.2.43.2", 2)
+
+	if err := DecrementAuthenticationAttempt("toaster", "10.2.43.2"); err != nil {
+		t.Fatal(err)
+	}
+
+	expectAttempts(t, "toaster", "10.2.43.2", 1)
+
+	// Attempts never go below zero
+	for i := 0; i < 2; i++ {
+		if err := DecrementAuthenticationAttempt("toaster", "10.2.43.2"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expectAttempts(t, "toaster", "10.2.43.2", 0)
+}
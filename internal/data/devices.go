@@ -2,6 +2,7 @@ package data
 
 import (
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"net"
 	"strconv"
@@ -19,6 +20,40 @@ type Device struct {
 	Endpoint     *net.UDPAddr
 	Attempts     int
 	Active       bool
+
+	// Networks behind the device that it routes traffic for, a device with routes is a gateway
+	Routes []string `json:",omitempty"`
+}
+
+// IsGateway returns true if the device routes traffic for networks behind it
+func (d Device) IsGateway() bool {
+	return len(d.Routes) > 0
+}
+
+const deviceColumns = "address, username, publickey, endpoint, attempts, preshared_key, routes"
+
+// Satisfied by both *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanDevice(row rowScanner) (device Device, err error) {
+	var endpoint, routesJson sql.NullString
+
+	err = row.Scan(&device.Address, &device.Username, &device.Publickey, &endpoint, &device.Attempts, &device.PresharedKey, &routesJson)
+	if err != nil {
+		return Device{}, err
+	}
+
+	if endpoint.Valid {
+		device.Endpoint = stringToUDPaddr(endpoint.String)
+	}
+
+	if routesJson.Valid {
+		err = json.Unmarshal([]byte(routesJson.String), &device.Routes)
+	}
+
+	return
 }
 
 func stringToUDPaddr(address string) (r *net.UDPAddr) {
@@ -51,29 +86,15 @@ func UpdateDeviceEndpoint(address string, endpoint *net.UDPAddr) error {
 }
 
 func GetDevice(username, id string) (device Device, err error) {
-	var (
-		endpoint sql.NullString
-	)
-
-	err = database.QueryRow(`SELECT 
-								* 
+	return scanDevice(database.QueryRow(`SELECT 
+								`+deviceColumns+` 
 							FROM 
 								Devices 
 							WHERE 
 								username = ? 
 									AND 
 								(address = $2 OR publickey = $2)`,
-		username, id).Scan(&device.Address, &device.Username, &device.Publickey, &endpoint, &device.Attempts, &device.PresharedKey)
-
-	if err != nil {
-		return Device{}, err
-	}
-
-	if endpoint.Valid {
-		device.Endpoint = stringToUDPaddr(endpoint.String)
-	}
-
-	return
+		username, id))
 }
 
 func SetDeviceAuthenticationAttempts(username, address string, attempts int) error {
@@ -95,50 +116,51 @@ func SetDeviceAuthenticationAttempts(username, address string, attempts int) err
 
 func GetAllDevices() (devices []Device, err error) {
 
-	rows, err := database.Query("SELECT address, publickey, username, endpoint, attempts, preshared_key FROM Devices ORDER by ROWID DESC")
+	rows, err := database.Query("SELECT " + deviceColumns + " FROM Devices ORDER by ROWID DESC")
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 
 	for rows.Next() {
-
-		var (
-			endpoint sql.NullString
-			d        Device
-		)
-		err = rows.Scan(&d.Address, &d.Publickey, &d.Username, &endpoint, &d.Attempts, &d.PresharedKey)
+		d, err := scanDevice(rows)
 		if err != nil {
 			return nil, err
 		}
 
-		if endpoint.Valid {
-			d.Endpoint = stringToUDPaddr(endpoint.String)
-		}
-
 		devices = append(devices, d)
 	}
 
-	return devices, nil
+	return devices, rows.Err()
 
 }
 
-func AddDevice(username, address, publickey, preshared_key string) (Device, error) {
+// AddDevice adds a device with a known address, routes are the networks behind the device if it is a gateway
+func AddDevice(username, address, publickey, preshared_key string, routes []string) (Device, error) {
 	if net.ParseIP(address) == nil {
 		return Device{}, errors.New("Address '" + address + "' cannot be parsed as IP, invalid")
 	}
 
+	var routesJson sql.NullString
+	if len(routes) > 0 {
+		result, _ := json.Marshal(routes)
+		routesJson = sql.NullString{String: string(result), Valid: true}
+	}
+
 	//Leaves enforcing null
 	_, err := database.Exec(`
 	INSERT INTO
-		Devices (address, username, publickey, preshared_key)
+		Devices (address, username, publickey, preshared_key, routes)
 	VALUES
-		(?, ?, ?, ?)
-`, address, username, publickey, preshared_key)
+		(?, ?, ?, ?, ?)
+`, address, username, publickey, preshared_key, routesJson)
 
 	return Device{
-		Address:   address,
-		Publickey: publickey,
-		Username:  username,
+		Address:      address,
+		Publickey:    publickey,
+		Username:     username,
+		PresharedKey: preshared_key,
+		Routes:       routes,
 	}, err
 }
 
@@ -177,53 +199,27 @@ func UpdateDevicePublicKey(username, address string, publicKey wgtypes.Key) erro
 //CREATE TABLE Devices(address string primary key, username string not null, publickey string not null unique, endpoint string, attempts integer  DEFAULT 0 not null);
 
 func GetDeviceByAddress(address string) (device Device, err error) {
-	var (
-		endpoint sql.NullString
-	)
-
-	err = database.QueryRow(`SELECT 
-								* 
+	return scanDevice(database.QueryRow(`SELECT 
+								`+deviceColumns+` 
 							FROM 
 								Devices 
 							WHERE 
 								address = ?`,
-		address).Scan(&device.Address, &device.Username, &device.Publickey, &endpoint, &device.Attempts, &device.PresharedKey)
-
-	if err != nil {
-		return Device{}, err
-	}
-
-	if endpoint.Valid {
-		device.Endpoint = stringToUDPaddr(endpoint.String)
-	}
-
-	return
+		address))
 }
 
 func GetDevicesByUser(username string) (devices []Device, err error) {
-	rows, err := database.Query(`SELECT * FROM Devices WHERE username = ?`, username)
+	rows, err := database.Query(`SELECT `+deviceColumns+` FROM Devices WHERE username = ?`, username)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 	for rows.Next() {
-
-		var (
-			endpoint sql.NullString
-		)
-
-		var d Device
-		//Devices(address string primary key,
-		//username string not null, publickey string not null unique, endpoint string, attempts integer not null
-		err = rows.Scan(&d.Address, &d.Username, &d.Publickey, &endpoint, &d.Attempts, &d.PresharedKey)
+		d, err := scanDevice(rows)
 		if err != nil {
 			return nil, err
 		}
 
-		if endpoint.Valid {
-			d.Endpoint = stringToUDPaddr(endpoint.String)
-		}
-
 		devices = append(devices, d)
 	}
 
@@ -0,0 +1,216 @@
+package data
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// A user can enrol several mfa methods, e.g webauthn with totp as a fallback, and may authorise with any of them. Each method is a factor, which is
+// enrolled once the user has completed its registration by authorising with it. Until then the factor cannot be used to authorise
+//
+// The mfa_type in the Users table is the users primary method, the one they are prompted with first
+
+type MFAFactor struct {
+	Username string
+	Type     string
+
+	// When the user completed registration of the factor, zero if they have not
+	Enrolled time.Time
+
+	// Totp url, webauthn credentials, or whatever the method needs to authorise the user
+	Secret string `json:"-"`
+}
+
+func (f MFAFactor) IsEnrolled() bool {
+	return !f.Enrolled.IsZero()
+}
+
+// SetUserMfa sets the secret of the users factor for mfaType, adding the factor if the user does not have it
+func SetUserMfa(username, value, mfaType string) error {
+
+	_, err := database.Exec(`
+	INSERT INTO
+		MFAFactors (username, mfa_type, mfa)
+	VALUES
+		(?, ?, ?)
+	ON CONFLICT (username, mfa_type) DO UPDATE SET
+		mfa = excluded.mfa
+	`, username, mfaType, value)
+
+	return err
+}
+
+// EnrolMFAFactor marks the factor as enrolled, and makes it the users primary method if they do not already have an enrolled one
+func EnrolMFAFactor(username, mfaType string) error {
+	result, err := database.Exec(`
+	UPDATE
+		MFAFactors
+	SET
+		enrolled = ?
+	WHERE
+		username = ? AND mfa_type = ? AND enrolled IS NULL
+	`, time.Now().Format(time.RFC3339), username, mfaType)
+	if err != nil {
+		return err
+	}
+
+	if n, _ := result.RowsAffected(); n == 0 {
+		return fmt.Errorf("user %s has no %s factor waiting to be enrolled", username, mfaType)
+	}
+
+	_, err = database.Exec(`
+	UPDATE
+		Users
+	SET
+		mfa_type = ?
+	WHERE
+		username = ? AND mfa_type NOT IN (SELECT mfa_type FROM MFAFactors WHERE username = ? AND mfa_type != ? AND enrolled IS NOT NULL)
+	`, mfaType, username, username, mfaType)
+
+	return err
+}
+
+func GetMFAFactor(username, mfaType string) (MFAFactor, error) {
+	factor, err := scanFactor(database.QueryRow(`
+	SELECT
+		username, mfa_type, mfa, enrolled
+	FROM
+		MFAFactors
+	WHERE
+		username = ? AND mfa_type = ?
+	`, username, mfaType))
+	if err == sql.ErrNoRows {
+		return MFAFactor{}, fmt.Errorf("user %s has not registered %s", username, mfaType)
+	}
+
+	return factor, err
+}
+
+// GetMFAFactors returns the users factors, including those they have not finished registering, in the order they were enrolled
+func GetMFAFactors(username string) (factors []MFAFactor, err error) {
+	rows, err := database.Query(`
+	SELECT
+		username, mfa_type, mfa, enrolled
+	FROM
+		MFAFactors
+	WHERE
+		username = ?
+	ORDER BY
+		enrolled IS NULL, enrolled, mfa_type
+	`, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		factor, err := scanFactor(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		factors = append(factors, factor)
+	}
+
+	return factors, rows.Err()
+}
+
+// GetEnrolledMFATypes returns the methods the user can authorise with, the primary method first
+func GetEnrolledMFATypes(username string) ([]string, error) {
+	primary, err := GetMFAType(username)
+	if err != nil {
+		return nil, err
+	}
+
+	factors, err := GetMFAFactors(username)
+	if err != nil {
+		return nil, err
+	}
+
+	var types []string
+	for _, factor := range factors {
+		if !factor.IsEnrolled() {
+			continue
+		}
+
+		if factor.Type == primary {
+			types = append([]string{factor.Type}, types...)
+			continue
+		}
+
+		types = append(types, factor.Type)
+	}
+
+	return types, nil
+}
+
+// DeleteMFAFactor removes one of the users factors. If it was their primary method another enrolled factor becomes primary, if there are none left the user
+// has to register mfa again
+func DeleteMFAFactor(username, mfaType string) error {
+	result, err := database.Exec(`DELETE FROM MFAFactors WHERE username = ? AND mfa_type = ?`, username, mfaType)
+	if err != nil {
+		return err
+	}
+
+	if n, _ := result.RowsAffected(); n == 0 {
+		return fmt.Errorf("user %s has not registered %s", username, mfaType)
+	}
+
+	factors, err := GetMFAFactors(username)
+	if err != nil {
+		return err
+	}
+
+	// Ordered by enrollment, so the first factor is the oldest enrolled one
+	if len(factors) == 0 || !factors[0].IsEnrolled() {
+		_, err = database.Exec(`UPDATE Users SET mfa_type = ?, enforcing = ? WHERE username = ?`, "unset", nil, username)
+		return err
+	}
+
+	_, err = database.Exec(`
+	UPDATE
+		Users
+	SET
+		mfa_type = ?
+	WHERE
+		username = ? AND mfa_type = ?
+	`, factors[0].Type, username, mfaType)
+
+	return err
+}
+
+// DeleteAllMFAFactors removes all of the users factors and recovery codes, and unsets their primary method
+func DeleteAllMFAFactors(username string) error {
+	_, err := database.Exec(`DELETE FROM MFAFactors WHERE username = ?`, username)
+	if err != nil {
+		return err
+	}
+
+	err = DeleteRecoveryCodes(username)
+	if err != nil {
+		return err
+	}
+
+	_, err = database.Exec(`UPDATE Users SET mfa_type = ? WHERE username = ?`, "unset", username)
+	return err
+}
+
+func scanFactor(row rowScanner) (factor MFAFactor, err error) {
+	var enrolled sql.NullString
+
+	err = row.Scan(&factor.Username, &factor.Type, &factor.Secret, &enrolled)
+	if err != nil {
+		return MFAFactor{}, err
+	}
+
+	if enrolled.Valid {
+		factor.Enrolled, err = time.Parse(time.RFC3339, enrolled.String)
+		if err != nil {
+			return MFAFactor{}, errors.New("factor has invalid enrollment time: " + err.Error())
+		}
+	}
+
+	return factor, nil
+}
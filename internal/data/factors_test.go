@@ -0,0 +1,104 @@
+package data
+
+import (
+	"testing"
+
+	"github.com/NHAS/wag/internal/config"
+)
+
+func expectMFATypes(t *testing.T, username string, expected ...string) {
+	types, err := GetEnrolledMFATypes(username)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(types) != len(expected) {
+		t.Fatalf("%s has enrolled %v, expected %v", username, types, expected)
+	}
+
+	for i := range types {
+		if types[i] != expected[i] {
+			t.Fatalf("%s has enrolled %v, expected %v", username, types, expected)
+		}
+	}
+}
+
+func TestMFAFactors(t *testing.T) {
+	if err := config.Load("../config/test_in_memory_db.json"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Load("file::memory:"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := CreateUserDataAccount("toaster"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := SetUserMfa("toaster", "otpauth://totp/wag:toaster?secret=AAAA", "totp"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Factors cannot be used until the user has finished registering them
+	expectMFATypes(t, "toaster")
+
+	if _, err := GetMFASecret("toaster", "totp"); err != nil {
+		t.Fatal("secret of a factor that is being registered should be shown: ", err)
+	}
+
+	if err := EnrolMFAFactor("toaster", "totp"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := EnrolMFAFactor("toaster", "totp"); err == nil {
+		t.Fatal("enrolled a factor twice")
+	}
+
+	if _, err := GetMFASecret("toaster", "totp"); err == nil {
+		t.Fatal("revealed the secret of an enrolled totp factor")
+	}
+
+	if err := SetUserMfa("toaster", "{}", "webauthn"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := EnrolMFAFactor("toaster", "webauthn"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Updating the secret, as webauthn does after each login, keeps the factor enrolled
+	if err := SetUserMfa("toaster", `{"updated": true}`, "webauthn"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The first enrolled factor is the primary method
+	expectMFATypes(t, "toaster", "totp", "webauthn")
+
+	if err := DeleteMFAFactor("toaster", "totp"); err != nil {
+		t.Fatal(err)
+	}
+
+	expectMFATypes(t, "toaster", "webauthn")
+
+	if err := DeleteMFAFactor("toaster", "totp"); err == nil {
+		t.Fatal("removed a factor the user does not have")
+	}
+
+	if err := SetEnforceMFAOn("toaster"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := DeleteMFAFactor("toaster", "webauthn"); err != nil {
+		t.Fatal(err)
+	}
+
+	primary, err := GetMFAType("toaster")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if primary != "unset" || IsEnforcingMFA("toaster") {
+		t.Fatalf("user without factors should have to register mfa again, primary: %s enforcing: %t", primary, IsEnforcingMFA("toaster"))
+	}
+}
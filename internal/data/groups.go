@@ -0,0 +1,93 @@
+package data
+
+import (
+	"errors"
+	"time"
+)
+
+// Identity providers, e.g oidc, tell wag which groups a user is a member of when they authorise. Each login replaces the groups the user was given by that
+// provider, so groups they have been removed from at the provider stop applying, and the groups are kept so they still apply after wag restarts
+
+type IdentityGroup struct {
+	Username string
+	Group    string
+
+	// The mfa method that supplied the group
+	Source string
+
+	// When the user last authorised with the source
+	Updated time.Time
+}
+
+// SetIdentityGroups replaces the groups source gave the user with groups
+func SetIdentityGroups(username, source string, groups []string) error {
+	tx, err := database.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`DELETE FROM IdentityGroups WHERE username = ? AND source = ?`, username, source)
+	if err != nil {
+		return err
+	}
+
+	updated := time.Now().Format(time.RFC3339)
+	for _, group := range groups {
+		_, err = tx.Exec(`
+		INSERT OR IGNORE INTO
+			IdentityGroups (username, group_name, source, updated)
+		VALUES
+			(?, ?, ?, ?)
+		`, username, group, source, updated)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// GetIdentityGroups returns the groups identity providers have given the user, ordered by group name
+func GetIdentityGroups(username string) ([]IdentityGroup, error) {
+	return queryIdentityGroups(`SELECT username, group_name, source, updated FROM IdentityGroups WHERE username = ? ORDER BY group_name, source`, username)
+}
+
+// GetAllIdentityGroups returns the groups identity providers have given every user
+func GetAllIdentityGroups() ([]IdentityGroup, error) {
+	return queryIdentityGroups(`SELECT username, group_name, source, updated FROM IdentityGroups ORDER BY username, group_name, source`)
+}
+
+func DeleteIdentityGroups(username string) error {
+	_, err := database.Exec(`DELETE FROM IdentityGroups WHERE username = ?`, username)
+	return err
+}
+
+func queryIdentityGroups(query string, args ...interface{}) (groups []IdentityGroup, err error) {
+	rows, err := database.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			group   IdentityGroup
+			updated string
+		)
+
+		err = rows.Scan(&group.Username, &group.Group, &group.Source, &updated)
+		if err != nil {
+			return nil, err
+		}
+
+		group.Updated, err = time.Parse(time.RFC3339, updated)
+		if err != nil {
+			return nil, errors.New("identity group has invalid update time: " + err.Error())
+		}
+
+		groups = append(groups, group)
+	}
+
+	return groups, rows.Err()
+}
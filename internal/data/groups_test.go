@@ -0,0 +1,93 @@
+package data
+
+import (
+	"testing"
+
+	"github.com/NHAS/wag/internal/config"
+)
+
+func expectIdentityGroups(t *testing.T, username string, expected ...string) {
+	groups, err := GetIdentityGroups(username)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(groups) != len(expected) {
+		t.Fatalf("%s has identity groups %v, expected %v", username, groups, expected)
+	}
+
+	for i := range groups {
+		if groups[i].Group+" "+groups[i].Source != expected[i] {
+			t.Fatalf("%s has identity groups %v, expected %v", username, groups, expected)
+		}
+
+		if groups[i].Updated.IsZero() {
+			t.Fatalf("%s identity group %s has no update time", username, groups[i].Group)
+		}
+	}
+}
+
+func TestIdentityGroups(t *testing.T) {
+	if err := config.Load("../config/test_in_memory_db.json"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Load("file::memory:"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := SetIdentityGroups("toaster", "oidc", []string{"group:admins", "group:developers"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := SetIdentityGroups("toaster", "ldap", []string{"group:admins"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := SetIdentityGroups("fronk", "oidc", []string{"group:developers"}); err != nil {
+		t.Fatal(err)
+	}
+
+	expectIdentityGroups(t, "toaster", "group:admins ldap", "group:admins oidc", "group:developers oidc")
+
+	// Each login replaces the groups from that source, so removals at the identity provider take effect
+	if err := SetIdentityGroups("toaster", "oidc", []string{"group:developers", "group:support"}); err != nil {
+		t.Fatal(err)
+	}
+
+	expectIdentityGroups(t, "toaster", "group:admins ldap", "group:developers oidc", "group:support oidc")
+
+	if err := SetIdentityGroups("toaster", "ldap", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	expectIdentityGroups(t, "toaster", "group:developers oidc", "group:support oidc")
+	expectIdentityGroups(t, "fronk", "group:developers oidc")
+
+	all, err := GetAllIdentityGroups()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(all) != 3 {
+		t.Fatalf("expected 3 identity groups for all users, got %v", all)
+	}
+
+	if err := DeleteIdentityGroups("toaster"); err != nil {
+		t.Fatal(err)
+	}
+
+	expectIdentityGroups(t, "toaster")
+	expectIdentityGroups(t, "fronk", "group:developers oidc")
+
+	// Groups are not left behind for a user of the same name to inherit
+	if _, err := CreateUserDataAccount("fronk"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := DeleteUser("fronk"); err != nil {
+		t.Fatal(err)
+	}
+
+	expectIdentityGroups(t, "fronk")
+}
@@ -0,0 +1,3 @@
+-- version 11
+CREATE TABLE IF NOT EXISTS AddressReservations ( address string primary key, username string not null, publickey string );
+ALTER TABLE RegistrationTokens ADD address TEXT;
@@ -0,0 +1,2 @@
+-- version 12
+CREATE TABLE IF NOT EXISTS RoamingEvents ( time integer not null, username string not null, address string not null, previous_endpoint string not null, endpoint string not null, allowed BOOLEAN not null, reason string not null );
@@ -0,0 +1,3 @@
+-- version 13
+ALTER TABLE Devices ADD routes TEXT;
+ALTER TABLE RegistrationTokens ADD routes TEXT;
@@ -0,0 +1,4 @@
+-- version 14
+CREATE TABLE IF NOT EXISTS MFAFactors ( username string not null, mfa_type string not null, mfa string not null, enrolled string, PRIMARY KEY (username, mfa_type) );
+INSERT INTO MFAFactors (username, mfa_type, mfa, enrolled) SELECT username, mfa_type, mfa, CASE WHEN enforcing IS NULL THEN NULL ELSE strftime('%Y-%m-%dT%H:%M:%SZ', 'now') END FROM Users WHERE mfa_type != 'unset';
+UPDATE Users SET mfa = username;
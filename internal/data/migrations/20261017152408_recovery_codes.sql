@@ -0,0 +1,2 @@
+-- version 15
+CREATE TABLE IF NOT EXISTS RecoveryCodes ( username string not null, hash string not null, used string, used_by string );
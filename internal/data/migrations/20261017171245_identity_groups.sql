@@ -0,0 +1,2 @@
+-- version 16
+CREATE TABLE IF NOT EXISTS IdentityGroups ( username string not null, group_name string not null, source string not null, updated string not null, PRIMARY KEY(username, group_name, source) );
@@ -0,0 +1,131 @@
+package data
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// Recovery codes let a user authorise when they cannot use any of their mfa methods, e.g when they have lost their phone. Each code can be used once, and
+// only the argon2 hashes of the codes are stored, in the same form as admin passwords
+
+const recoveryCodeCount = 10
+
+var recoveryCodeEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GenerateRecoveryCodes replaces the users recovery codes with new ones, and returns them. The codes cannot be retrieved again
+func GenerateRecoveryCodes(username string) ([]string, error) {
+	var codes, hashes []string
+	for i := 0; i < recoveryCodeCount; i++ {
+		random := make([]byte, 10)
+		if _, err := rand.Read(random); err != nil {
+			return nil, err
+		}
+
+		code := strings.ToLower(recoveryCodeEncoding.EncodeToString(random))
+
+		salt, err := generateSalt()
+		if err != nil {
+			return nil, err
+		}
+
+		hash := argon2.IDKey([]byte(code), salt, 1, 10*1024, 4, 32)
+
+		codes = append(codes, code[:8]+"-"+code[8:])
+		hashes = append(hashes, base64.RawStdEncoding.EncodeToString(append(hash, salt...)))
+	}
+
+	err := DeleteRecoveryCodes(username)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, hash := range hashes {
+		_, err := database.Exec(`
+		INSERT INTO
+			RecoveryCodes (username, hash)
+		VALUES
+			(?, ?)
+		`, username, hash)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return codes, nil
+}
+
+// UseRecoveryCode marks the users recovery code as used by address, and returns how many unused codes they have left. Returns an error if code is not one of
+// the users unused codes
+func UseRecoveryCode(username, code, address string) (remaining int, err error) {
+	code = strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+
+	rows, err := database.Query(`SELECT ROWID, hash FROM RecoveryCodes WHERE username = ? AND used IS NULL`, username)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	matched := int64(-1)
+	for rows.Next() {
+		var (
+			rowid       int64
+			b64HashSalt string
+		)
+
+		if err := rows.Scan(&rowid, &b64HashSalt); err != nil {
+			return 0, err
+		}
+
+		rawHashSalt, err := base64.RawStdEncoding.DecodeString(b64HashSalt)
+		if err != nil || len(rawHashSalt) <= 16 {
+			return 0, errors.New("recovery code hash is invalid")
+		}
+
+		// Every code is checked, so how long this takes does not depend on which code matched
+		thisHash := argon2.IDKey([]byte(code), rawHashSalt[len(rawHashSalt)-16:], 1, 10*1024, 4, 32)
+		if subtle.ConstantTimeCompare(thisHash, rawHashSalt[:len(rawHashSalt)-16]) == 1 {
+			matched = rowid
+		}
+
+		remaining++
+	}
+
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	rows.Close()
+
+	if matched == -1 {
+		return 0, errors.New("recovery code did not match")
+	}
+
+	// Only one use of the code can mark it as used
+	result, err := database.Exec(`UPDATE RecoveryCodes SET used = ?, used_by = ? WHERE ROWID = ? AND used IS NULL`, time.Now().Format(time.RFC3339), address, matched)
+	if err != nil {
+		return 0, err
+	}
+
+	if n, _ := result.RowsAffected(); n == 0 {
+		return 0, errors.New("recovery code has already been used")
+	}
+
+	return remaining - 1, nil
+}
+
+// RecoveryCodesRemaining returns how many unused recovery codes the user has
+func RecoveryCodesRemaining(username string) (remaining int, err error) {
+	err = database.QueryRow(`SELECT COUNT(*) FROM RecoveryCodes WHERE username = ? AND used IS NULL`, username).Scan(&remaining)
+	return
+}
+
+func DeleteRecoveryCodes(username string) error {
+	_, err := database.Exec(`DELETE FROM RecoveryCodes WHERE username = ?`, username)
+	return err
+}
@@ -0,0 +1,69 @@
+package data
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/NHAS/wag/internal/config"
+)
+
+func TestRecoveryCodes(t *testing.T) {
+	if err := config.Load("../config/test_in_memory_db.json"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Load("file::memory:"); err != nil {
+		t.Fatal(err)
+	}
+
+	codes, err := GenerateRecoveryCodes("toaster")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(codes) != recoveryCodeCount {
+		t.Fatalf("expected %d codes, got %d", recoveryCodeCount, len(codes))
+	}
+
+	if _, err := UseRecoveryCode("toaster", "not-a-code", "10.0.0.2"); err == nil {
+		t.Fatal("used a code that was not generated")
+	}
+
+	if _, err := UseRecoveryCode("fronk", codes[0], "10.0.0.2"); err == nil {
+		t.Fatal("used the code of another user")
+	}
+
+	remaining, err := UseRecoveryCode("toaster", codes[0], "10.0.0.2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if remaining != recoveryCodeCount-1 {
+		t.Fatalf("expected %d codes remaining, got %d", recoveryCodeCount-1, remaining)
+	}
+
+	if _, err := UseRecoveryCode("toaster", codes[0], "10.0.0.2"); err == nil {
+		t.Fatal("used a code twice")
+	}
+
+	// Codes are accepted however the user typed them
+	if _, err := UseRecoveryCode("toaster", " "+strings.ToUpper(strings.ReplaceAll(codes[1], "-", ""))+" ", "10.0.0.2"); err != nil {
+		t.Fatal("code was not accepted without formatting: ", err)
+	}
+
+	if remaining, err := RecoveryCodesRemaining("toaster"); err != nil || remaining != recoveryCodeCount-2 {
+		t.Fatalf("expected %d codes remaining, got %d: %v", recoveryCodeCount-2, remaining, err)
+	}
+
+	if _, err := GenerateRecoveryCodes("toaster"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := UseRecoveryCode("toaster", codes[2], "10.0.0.2"); err == nil {
+		t.Fatal("used a code after new codes were generated")
+	}
+
+	if remaining, err := RecoveryCodesRemaining("toaster"); err != nil || remaining != recoveryCodeCount {
+		t.Fatalf("expected %d codes remaining, got %d: %v", recoveryCodeCount, remaining, err)
+	}
+}
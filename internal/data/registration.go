@@ -11,28 +11,37 @@ import (
 	"github.com/NHAS/wag/pkg/control"
 )
 
-func GetRegistrationToken(token string) (username, overwrites string, group []string, err error) {
+func GetRegistrationToken(token string) (username, overwrites, address string, group, routes []string, err error) {
 
 	minTime := time.After(1 * time.Second)
 
-	var groupsJson sql.NullString
+	var groupsJson, addressString, routesJson sql.NullString
 
 	err = database.QueryRow(`
 		SELECT 
-			token, username, overwrite, groups 
+			token, username, overwrite, groups, address, routes 
 		FROM 
 			RegistrationTokens
 		WHERE
 			token = ?
 				AND
 			uses > 0
-	`, token).Scan(&token, &username, &overwrites, &groupsJson)
+	`, token).Scan(&token, &username, &overwrites, &groupsJson, &addressString, &routesJson)
 	if err != nil {
 		return
 	}
 
+	address = addressString.String
+
 	if groupsJson.Valid {
 		err = json.Unmarshal([]byte(groupsJson.String), &group)
+		if err != nil {
+			return
+		}
+	}
+
+	if routesJson.Valid {
+		err = json.Unmarshal([]byte(routesJson.String), &routes)
 	}
 
 	<-minTime
@@ -43,21 +52,23 @@ func GetRegistrationToken(token string) (username, overwrites string, group []st
 // Returns list of tokens
 func GetRegistrationTokens() (result []control.RegistrationResult, err error) {
 
-	rows, err := database.Query("SELECT token, username, overwrite, groups, uses FROM RegistrationTokens ORDER by ROWID DESC")
+	rows, err := database.Query("SELECT token, username, overwrite, groups, uses, address, routes FROM RegistrationTokens ORDER by ROWID DESC")
 	if err != nil {
 		return nil, err
 	}
 
 	for rows.Next() {
 		var (
-			groupsJson   sql.NullString
-			registration control.RegistrationResult
+			groupsJson, address, routesJson sql.NullString
+			registration                    control.RegistrationResult
 		)
-		err = rows.Scan(&registration.Token, &registration.Username, &registration.Overwrites, &groupsJson, &registration.NumUses)
+		err = rows.Scan(&registration.Token, &registration.Username, &registration.Overwrites, &groupsJson, &registration.NumUses, &address, &routesJson)
 		if err != nil {
 			return nil, err
 		}
 
+		registration.Address = address.String
+
 		if groupsJson.Valid {
 			err = json.Unmarshal([]byte(groupsJson.String), &registration.Groups)
 			if err != nil {
@@ -65,6 +76,13 @@ func GetRegistrationTokens() (result []control.RegistrationResult, err error) {
 			}
 		}
 
+		if routesJson.Valid {
+			err = json.Unmarshal([]byte(routesJson.String), &registration.Routes)
+			if err != nil {
+				return
+			}
+		}
+
 		result = append(result, registration)
 	}
 
@@ -109,20 +127,21 @@ func FinaliseRegistration(token string) error {
 }
 
 // Randomly generate a token for a specific username
-func GenerateToken(username, overwrite string, groups []string, uses int) (token string, err error) {
+func GenerateToken(username, overwrite, address string, groups, routes []string, uses int) (token string, err error) {
 	tokenBytes, err := generateRandomBytes(32)
 	if err != nil {
 		return "", err
 	}
 
 	token = hex.EncodeToString(tokenBytes)
-	err = AddRegistrationToken(token, username, overwrite, groups, uses)
+	err = AddRegistrationToken(token, username, overwrite, address, groups, routes, uses)
 
 	return
 }
 
 // Add a token to the database to add or overwrite a device for a user, may fail of the token does not meet complexity requirements
-func AddRegistrationToken(token, username, overwrite string, groups []string, uses int) error {
+// If address is set the device added with the token is given that address, if routes are set the device is a gateway for those networks
+func AddRegistrationToken(token, username, overwrite, address string, groups, routes []string, uses int) error {
 	if len(token) < 32 {
 		return errors.New("registration token is too short")
 	}
@@ -132,6 +151,38 @@ func AddRegistrationToken(token, username, overwrite string, groups []string, us
 	}
 
 	var err error
+	if address != "" {
+		if overwrite != "" {
+			return errors.New("an address cannot be requested for a token that overwrites a device, the device keeps its address")
+		}
+
+		if uses != 1 {
+			return errors.New("a token that requests an address can only have one use")
+		}
+
+		if err := CheckRequestedAddress(username, address); err != nil {
+			return errors.New("requested address cannot be used: " + err.Error())
+		}
+	}
+
+	var routesJson sql.NullString
+	if len(routes) > 0 {
+		if overwrite != "" {
+			return errors.New("routes cannot be set for a token that overwrites a device, the device keeps its routes")
+		}
+
+		if uses != 1 {
+			return errors.New("a token for a gateway can only have one use, as gateways cannot share routes")
+		}
+
+		if err := CheckGatewayRoutes(routes); err != nil {
+			return errors.New("gateway routes cannot be used: " + err.Error())
+		}
+
+		result, _ := json.Marshal(routes)
+		routesJson = sql.NullString{String: string(result), Valid: true}
+	}
+
 	if overwrite != "" {
 		var u string
 		err = database.QueryRow("SELECT address FROM Devices WHERE address = ? AND username = ?", overwrite, username).Scan(&u)
@@ -149,20 +200,20 @@ func AddRegistrationToken(token, username, overwrite string, groups []string, us
 
 		_, err = database.Exec(`
 		INSERT INTO
-			RegistrationTokens (token, username, overwrite, groups, uses)
+			RegistrationTokens (token, username, overwrite, groups, uses, address, routes)
 		VALUES
-			(?, ?, ?, ?, ?)
-	`, token, username, overwrite, string(result), uses)
+			(?, ?, ?, ?, ?, ?, ?)
+	`, token, username, overwrite, string(result), uses, sql.NullString{String: address, Valid: address != ""}, routesJson)
 
 		return err
 	}
 
 	_, err = database.Exec(`
 	INSERT INTO
-		RegistrationTokens (token, username, overwrite, uses)
+		RegistrationTokens (token, username, overwrite, uses, address, routes)
 	VALUES
-		(?, ?, ?, ?)
-`, token, username, overwrite, uses)
+		(?, ?, ?, ?, ?, ?)
+`, token, username, overwrite, uses, sql.NullString{String: address, Valid: address != ""}, routesJson)
 
 	return err
 }
@@ -0,0 +1,69 @@
+package data
+
+import (
+	"time"
+)
+
+// The number of roaming events kept, older events are removed as new ones are added
+const maxRoamingEvents = 10000
+
+// RoamingEvent records a device moving to a new wireguard endpoint, and whether its session was kept
+type RoamingEvent struct {
+	Time     time.Time
+	Username string
+	Address  string
+
+	PreviousEndpoint string
+	Endpoint         string
+
+	Allowed bool
+	Reason  string
+}
+
+func AddRoamingEvent(event RoamingEvent) error {
+	_, err := database.Exec(`
+	INSERT INTO
+		RoamingEvents (time, username, address, previous_endpoint, endpoint, allowed, reason)
+	VALUES
+		(?, ?, ?, ?, ?, ?, ?)
+	`, event.Time.Unix(), event.Username, event.Address, event.PreviousEndpoint, event.Endpoint, event.Allowed, event.Reason)
+	if err != nil {
+		return err
+	}
+
+	_, err = database.Exec(`DELETE FROM RoamingEvents WHERE ROWID <= (SELECT MAX(ROWID) FROM RoamingEvents) - ?`, maxRoamingEvents)
+	return err
+}
+
+// GetRoamingEvents returns the roaming events of the device with address, or of all devices if address is empty, newest first
+func GetRoamingEvents(address string) (events []RoamingEvent, err error) {
+	rows, err := database.Query(`
+	SELECT 
+		time, username, address, previous_endpoint, endpoint, allowed, reason 
+	FROM 
+		RoamingEvents 
+	WHERE 
+		$1 = '' OR address = $1 
+	ORDER BY ROWID DESC`, address)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			event    RoamingEvent
+			unixTime int64
+		)
+
+		err = rows.Scan(&unixTime, &event.Username, &event.Address, &event.PreviousEndpoint, &event.Endpoint, &event.Allowed, &event.Reason)
+		if err != nil {
+			return nil, err
+		}
+
+		event.Time = time.Unix(unixTime, 0)
+		events = append(events, event)
+	}
+
+	return events, rows.Err()
+}
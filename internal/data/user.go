@@ -11,10 +11,12 @@ import (
 
 type UserModel struct {
 	Username  string
-	Mfa       string
 	MfaType   string
 	Locked    bool
 	Enforcing bool
+
+	// Only set when listing users over the control socket
+	IdentityGroups []IdentityGroup `json:",omitempty"`
 }
 
 func (um *UserModel) GetID() [20]byte {
@@ -37,10 +39,24 @@ func IncrementAuthenticationAttempt(username, device string) error {
 	return nil
 }
 
-func GetAuthenticationDetails(username, device string) (mfa, mfaType string, attempts int, locked bool, err error) {
+// DecrementAuthenticationAttempt undoes IncrementAuthenticationAttempt, for attempts that should not count towards the lockout
+func DecrementAuthenticationAttempt(username, device string) error {
+	_, err := database.Exec(`UPDATE 
+		Devices 
+	SET 
+		attempts = attempts - 1 
+	WHERE 
+		address = ? AND attempts > 0 AND username = ?`,
+		device, username)
+
+	return err
+}
+
+// GetAuthenticationDetails returns the users factor for mfaType, with Type empty if the user has not registered it
+func GetAuthenticationDetails(username, device, mfaType string) (factor MFAFactor, attempts int, locked bool, err error) {
 
 	err = database.QueryRow(`SELECT 
-								mfa, mfa_type, attempts, locked 
+								attempts, locked 
 							 FROM 
 							 	Users 
 							 INNER JOIN 
@@ -48,11 +64,16 @@ func GetAuthenticationDetails(username, device string) (mfa, mfaType string, att
 							 ON 
 							 	Users.username = Devices.username 
 							 WHERE 
-							 	Devices.address = ? AND Users.username = ?`, device, username).Scan(&mfa, &mfaType, &attempts, &locked)
+							 	Devices.address = ? AND Users.username = ?`, device, username).Scan(&attempts, &locked)
 	if err != nil {
 		return
 	}
 
+	factor, err = scanFactor(database.QueryRow(`SELECT username, mfa_type, mfa, enrolled FROM MFAFactors WHERE username = ? AND mfa_type = ?`, username, mfaType))
+	if err == sql.ErrNoRows {
+		err = nil
+	}
+
 	return
 }
 
@@ -139,31 +160,21 @@ func SetEnforceMFAOff(username string) error {
 	return err
 }
 
-func GetMFASecret(username string) (string, error) {
-	var (
-		url, mfaType string
-		enforcing    sql.NullString
-	)
-	err := database.QueryRow(`
-		SELECT 
-			mfa, mfa_type, enforcing 
-		FROM 
-			Users
-		WHERE
-			username = ?
-	`, username).Scan(&url, &mfaType, &enforcing)
+func GetMFASecret(username, mfaType string) (string, error) {
+	factor, err := GetMFAFactor(username, mfaType)
 	if err != nil {
 		return "", err
 	}
 
 	// The webauthn "secret" needs to be used, but isnt returned to the client
-	if enforcing.Valid && mfaType != "webauthn" {
+	if factor.IsEnrolled() && mfaType != "webauthn" {
 		return "", errors.New("MFA is set to enforcing, cannot reveal totp secret")
 	}
 
-	return url, nil
+	return factor.Secret, nil
 }
 
+// GetMFAType returns the users primary mfa method
 func GetMFAType(username string) (string, error) {
 	var (
 		mfaType string
@@ -199,8 +210,25 @@ func DeleteUser(username string) error {
 			Devices
 		WHERE
 			username = ?`, username)
+	if err != nil {
+		return err
+	}
 
-	return err
+	_, err = database.Exec(`
+		DELETE FROM
+			MFAFactors
+		WHERE
+			username = ?`, username)
+	if err != nil {
+		return err
+	}
+
+	err = DeleteRecoveryCodes(username)
+	if err != nil {
+		return err
+	}
+
+	return DeleteIdentityGroups(username)
 }
 
 func GetUserData(username string) (u UserModel, err error) {
@@ -209,11 +237,11 @@ func GetUserData(username string) (u UserModel, err error) {
 
 	err = database.QueryRow(`
 	SELECT 
-		username, mfa, mfa_type, locked, enforcing
+		username, mfa_type, locked, enforcing
 	FROM 
 		Users
 	WHERE
-		username = ?`, username).Scan(&u.Username, &u.Mfa, &u.MfaType, &u.Locked, &enforcing)
+		username = ?`, username).Scan(&u.Username, &u.MfaType, &u.Locked, &enforcing)
 	if err != nil {
 		return UserModel{}, err
 	}
@@ -240,20 +268,6 @@ func GetUserDataFromAddress(address string) (u UserModel, err error) {
 	return GetUserData(username)
 }
 
-func SetUserMfa(username, value, mfaType string) error {
-
-	_, err := database.Exec(`
-	UPDATE 
-		Users
-	SET
-		mfa = ?, mfa_type = ?
-	WHERE
-		username = ?
-	`, value, mfaType, username)
-
-	return err
-}
-
 func CreateUserDataAccount(username string) (UserModel, error) {
 
 	//Leaves enforcing null
@@ -271,7 +285,7 @@ func CreateUserDataAccount(username string) (UserModel, error) {
 
 func GetAllUsers() (users []UserModel, err error) {
 
-	rows, err := database.Query("SELECT username, mfa, mfa_type, enforcing, locked FROM Users ORDER by ROWID DESC")
+	rows, err := database.Query("SELECT username, mfa_type, enforcing, locked FROM Users ORDER by ROWID DESC")
 	if err != nil {
 		return nil, err
 	}
@@ -282,7 +296,7 @@ func GetAllUsers() (users []UserModel, err error) {
 			enforcing sql.NullString
 			u         UserModel
 		)
-		err = rows.Scan(&u.Username, &u.Mfa, &u.MfaType, &enforcing, &u.Locked)
+		err = rows.Scan(&u.Username, &u.MfaType, &enforcing, &u.Locked)
 		if err != nil {
 			return nil, err
 		}
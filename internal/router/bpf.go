@@ -6,8 +6,11 @@ import (
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"log"
 	"math"
 	"net"
+	"os"
+	"path/filepath"
 	"strings"
 	"syscall"
 	"time"
@@ -40,11 +43,11 @@ var (
 		Type: ebpf.LPMTrie,
 
 		// 4 byte, prefix length;
-		// 4 byte, ipv4 addr;
-		KeySize: 8,
+		// 16 byte, ipv6 addr (ipv4 addresses are ipv4-mapped);
+		KeySize: 20,
 
 		//policies array
-		ValueSize: 8 * 128,
+		ValueSize: routetypes.PolicySize * 128,
 
 		// This flag is required for dynamically sized inner maps.
 		// Added in linux 5.10.
@@ -54,6 +57,22 @@ var (
 		// and altered later.
 		MaxEntries: 1024,
 	}
+
+	// Smallest mfa freshness requirement (seconds) in each users policies, users without step up routes are not present
+	userFreshness = map[[20]byte]uint32{}
+
+	// Maps that are pinned under ebpfFS so that device sessions survive restarts of wag
+	pinnedMaps = []string{"devices", "account_locked", "policies_table", "flows"}
+
+	// Records the hash of the xdp program that created the pinned maps, state is only reused by the same program
+	versionMapSpec = &ebpf.MapSpec{
+		Name:       "wag_version",
+		Type:       ebpf.Array,
+		KeySize:    4,
+		ValueSize:  sha256.Size,
+		MaxEntries: 1,
+		Pinning:    ebpf.PinByName,
+	}
 )
 
 type Timespec struct {
@@ -69,6 +88,11 @@ func GetTimeStamp() uint64 {
 }
 
 func loadXDP() error {
+	return loadXDPObjects("")
+}
+
+// Load the xdp program and maps, if pinPath is set the session state maps are pinned there, or reused if they already exist
+func loadXDPObjects(pinPath string) error {
 
 	err := rlimit.RemoveMemlock()
 	if err != nil {
@@ -80,28 +104,154 @@ func loadXDP() error {
 		return fmt.Errorf("loading spec: %s", err)
 	}
 
+	// The map sizes in xdp.c are only defaults, resize them to the configured limits before anything is created
+	limits := config.Values().Firewall
+	for name, size := range map[string]int{
+		"devices":         limits.MaxDevices,
+		"device_counters": limits.MaxDevices,
+		"device_routes":   limits.MaxDevices,
+		"account_locked":  limits.MaxUsers,
+		"user_counters":   limits.MaxUsers,
+		"policies_table":  limits.MaxUsers,
+
+		"user_inactivity_timeout": limits.MaxUsers,
+		"user_rate_limits":        limits.MaxUsers,
+		"rate_limit_buckets":      limits.MaxUsers,
+
+		"flows": limits.MaxFlows,
+	} {
+		mapSpec, ok := spec.Maps[name]
+		if !ok {
+			return fmt.Errorf("xdp program does not contain map %q", name)
+		}
+
+		mapSpec.MaxEntries = uint32(size)
+	}
+
+	routesMapSpec.MaxEntries = uint32(limits.MaxRoutesPerUser)
+
 	spec.Maps["policies_table"].InnerMap = routesMapSpec
+
+	var opts ebpf.CollectionOptions
+	if pinPath != "" {
+		for _, name := range pinnedMaps {
+			spec.Maps[name].Pinning = ebpf.PinByName
+		}
+
+		opts.Maps.PinPath = pinPath
+	}
+
 	// Load pre-compiled programs into the kernel.
-	if err = spec.LoadAndAssign(&xdpObjects, nil); err != nil {
+	if err = spec.LoadAndAssign(&xdpObjects, &opts); err != nil {
 
 		var ve *ebpf.VerifierError
 		b := errors.As(err, &ve)
 		if b {
 			fmt.Print(strings.Join(ve.Log, "\n"))
-			return fmt.Errorf("loading objects: %s", err)
+			return fmt.Errorf("loading objects: %w", err)
 		}
 
-		return fmt.Errorf("loading objects: %s", err)
+		return fmt.Errorf("loading objects: %w", err)
+	}
+
+	err = xdpObjects.InactivityTimeoutMinutes.Put(uint32(0), minutesToNanoseconds(config.Values().SessionInactivityTimeoutMinutes))
+	if err != nil {
+		return fmt.Errorf("could not set inactivity timeout: %s", err)
+	}
+
+	if err := setFlowTimeouts(); err != nil {
+		return err
 	}
 
-	value := uint64(config.Values().SessionInactivityTimeoutMinutes) * 60000000000
-	if config.Values().SessionInactivityTimeoutMinutes < 0 {
-		value = math.MaxUint64
+	// Devices ipv6 tunnel addresses are the prefix with the devices ipv4 address in the lower 32 bits, all zeros disables ipv6 tunnel addresses
+	var prefix [16]byte
+	if range6 := config.Values().Wireguard.Range6; range6 != nil {
+		copy(prefix[:12], range6.IP.To16())
 	}
 
-	err = xdpObjects.InactivityTimeoutMinutes.Put(uint32(0), value)
+	err = xdpObjects.TunnelPrefix6.Put(uint32(0), prefix)
 	if err != nil {
-		return fmt.Errorf("could not set inactivity timeout: %s", err)
+		return fmt.Errorf("could not set ipv6 tunnel prefix: %s", err)
+	}
+
+	return nil
+}
+
+// Load the xdp program, reusing the session state pinned by a previous run of wag if it was created by the same program
+// Returns whether the previous state was adopted
+func loadPinnedXDP() (adopted bool, err error) {
+	var fs unix.Statfs_t
+	if err := unix.Statfs(ebpfFS, &fs); err != nil || fs.Type != unix.BPF_FS_MAGIC {
+		log.Println("bpf filesystem is not mounted at", ebpfFS, "firewall state will not persist across restarts")
+		return false, loadXDPObjects("")
+	}
+
+	pinPath := filepath.Join(ebpfFS, "wag", config.Values().Wireguard.DevName)
+
+	if err := os.MkdirAll(pinPath, 0700); err != nil {
+		return false, fmt.Errorf("unable to create bpf pin path: %s", err)
+	}
+
+	adopted = pinnedBPFHash(pinPath) == bpfHash()
+	if !adopted {
+		if err := removePins(pinPath); err != nil {
+			return false, err
+		}
+	}
+
+	err = loadXDPObjects(pinPath)
+	if errors.Is(err, ebpf.ErrMapIncompatible) {
+		// Typically because map sizes have been changed in the configuration
+		log.Println("pinned firewall maps are not compatible with the current configuration, firewall state will be rebuilt")
+
+		if err := removePins(pinPath); err != nil {
+			return false, err
+		}
+
+		adopted = false
+		err = loadXDPObjects(pinPath)
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	return adopted, setPinnedBPFHash(pinPath)
+}
+
+// Get the hash of the xdp program that created the pinned maps, or empty string if there is none
+func pinnedBPFHash(pinPath string) string {
+	versionMap, err := ebpf.LoadPinnedMap(filepath.Join(pinPath, versionMapSpec.Name), nil)
+	if err != nil {
+		return ""
+	}
+	defer versionMap.Close()
+
+	var hash [sha256.Size]byte
+	if err := versionMap.Lookup(uint32(0), &hash); err != nil {
+		return ""
+	}
+
+	return hex.EncodeToString(hash[:])
+}
+
+func setPinnedBPFHash(pinPath string) error {
+	versionMap, err := ebpf.NewMapWithOptions(versionMapSpec, ebpf.MapOptions{PinPath: pinPath})
+	if err != nil {
+		return fmt.Errorf("unable to create bpf version map: %s", err)
+	}
+	defer versionMap.Close()
+
+	return versionMap.Put(uint32(0), sha256.Sum256(_BpfBytes))
+}
+
+func removePins(pinPath string) error {
+	if err := os.RemoveAll(pinPath); err != nil {
+		return fmt.Errorf("unable to remove pinned bpf maps: %s", err)
+	}
+
+	if err := os.MkdirAll(pinPath, 0700); err != nil {
+		return fmt.Errorf("unable to create bpf pin path: %s", err)
 	}
 
 	return nil
@@ -137,14 +287,28 @@ func attachXDP() error {
 
 func setupXDP() error {
 
-	if err := loadXDP(); err != nil {
+	adopted, err := loadPinnedXDP()
+	if err != nil {
 		return err
 	}
 
+	if adopted {
+		log.Println("Reusing firewall state from previous run")
+	}
+
 	if err := attachXDP(); err != nil {
 		return err
 	}
 
+	if err := startDropEventReader(); err != nil {
+		return err
+	}
+
+	// Must be started before any rules are added, so that the domains in them are tracked
+	startDomainResolver()
+
+	routetypes.PeerResolver = peerAddresses
+
 	knownDevices, err := data.GetAllDevices()
 	if err != nil {
 		return errors.New("xdp setup get all devices: " + err.Error())
@@ -155,20 +319,124 @@ func setupXDP() error {
 		return errors.New("xdp setup get all users: " + err.Error())
 	}
 
+	limits := config.Values().Firewall
+	if len(knownDevices) > limits.MaxDevices {
+		return fmt.Errorf("xdp setup: database contains %d devices but the firewall can only hold %d, increase Firewall.MaxDevices", len(knownDevices), limits.MaxDevices)
+	}
+
+	if len(users) > limits.MaxUsers {
+		return fmt.Errorf("xdp setup: database contains %d users but the firewall can only hold %d, increase Firewall.MaxUsers", len(users), limits.MaxUsers)
+	}
+
+	return reconcileXDP(users, knownDevices)
+}
+
+// Make the firewall maps match the database. Users and devices that already exist (e.g in maps adopted from a previous run) keep their
+// lock and session state, anything not in the database is removed
+func reconcileXDP(users []data.UserModel, devices []data.Device) error {
+
+	knownUsers := map[[20]byte]bool{}
 	for _, user := range users {
+		userid := user.GetID()
+		knownUsers[userid] = true
+
+		if xdpUserExists(userid) == nil {
+			if err := setMaps(userid, config.GetEffectiveAcl(user.Username)); err != nil {
+				return errors.New("xdp setup refresh user: " + err.Error())
+			}
+			continue
+		}
 
 		if err := AddUser(user.Username, config.GetEffectiveAcl(user.Username)); err != nil {
 			return errors.New("xdp setup add user: " + err.Error())
 		}
 	}
 
-	for _, device := range knownDevices {
-		err := xdpAddDevice(device.Username, device.Address)
-		if err != nil {
+	var (
+		userid   [20]byte
+		locked   uint32
+		oldUsers [][20]byte
+	)
+
+	userIter := xdpObjects.AccountLocked.Iterate()
+	for userIter.Next(&userid, &locked) {
+		if !knownUsers[userid] {
+			oldUsers = append(oldUsers, userid)
+		}
+	}
+
+	if userIter.Err() != nil {
+		return errors.New("xdp setup iterate users: " + userIter.Err().Error())
+	}
+
+	for _, userid := range oldUsers {
+		if err := xdpRemoveUser(userid); err != nil {
+			return errors.New("xdp setup remove old user: " + err.Error())
+		}
+	}
+
+	knownDevices := map[string]bool{}
+	for _, device := range devices {
+		knownDevices[device.Address] = true
+
+		var deviceStruct fwentry
+		deviceBytes, err := xdpObjects.Devices.LookupBytes(net.ParseIP(device.Address).To4())
+		if err == nil && deviceBytes != nil && deviceStruct.Unpack(deviceBytes) == nil {
+			if deviceStruct.user_id == sha1.Sum([]byte(device.Username)) {
+				continue
+			}
+
+			// Address has been reused by another user since the state was saved
+			if err := xdpRemoveDevice(device.Address); err != nil {
+				return errors.New("xdp setup remove reused device: " + err.Error())
+			}
+		}
+
+		if err := xdpAddDevice(device.Username, device.Address); err != nil {
 			return errors.New("xdp setup add device to user: " + err.Error())
 		}
 	}
 
+	// Gateway routes are not kept between runs, so are always added
+	for _, device := range devices {
+		if !device.IsGateway() {
+			continue
+		}
+
+		if err := xdpAddGateway(device.Address, device.Routes); err != nil {
+			return errors.New("xdp setup add gateway routes: " + err.Error())
+		}
+	}
+
+	var (
+		deviceAddr  [4]byte
+		deviceBytes []byte
+		oldDevices  []string
+	)
+
+	deviceIter := xdpObjects.Devices.Iterate()
+	for deviceIter.Next(&deviceAddr, &deviceBytes) {
+		if address := net.IP(deviceAddr[:]).String(); !knownDevices[address] {
+			oldDevices = append(oldDevices, address)
+		}
+	}
+
+	if deviceIter.Err() != nil {
+		return errors.New("xdp setup iterate devices: " + deviceIter.Err().Error())
+	}
+
+	for _, address := range oldDevices {
+		if err := xdpRemoveDevice(address); err != nil {
+			return errors.New("xdp setup remove old device: " + err.Error())
+		}
+	}
+
+	// Users were added before their devices, so rules that use device addresses need to be built again
+	err := refreshUsersWithPeerRules(func(string) bool { return true })
+	if err != nil {
+		return errors.New("xdp setup: " + err.Error())
+	}
+
 	return nil
 }
 
@@ -217,18 +485,74 @@ func isAuthed(address string) bool {
 		return false
 	}
 
+	return deviceSessionState(deviceStruct) == SessionAuthorised
+}
+
+// Device session states, if a device is not authorised why its session is not valid
+const (
+	SessionAuthorised    = "authorised"
+	SessionUnauthorised  = "not authorised"
+	SessionAccountLocked = "account locked"
+	SessionExpired       = "session expired"
+	SessionTimedOut      = "session timed out"
+)
+
+// The state of a devices session, the same checks the xdp program makes for mfa routes
+func deviceSessionState(deviceStruct fwentry) string {
 	var isAccountLocked uint32
-	if xdpObjects.AccountLocked.Lookup(deviceStruct.user_id, &isAccountLocked) != nil {
-		return false
+	if xdpObjects.AccountLocked.Lookup(deviceStruct.user_id, &isAccountLocked) != nil || isAccountLocked != 0 {
+		return SessionAccountLocked
+	}
+
+	if deviceStruct.sessionExpiry == 0 {
+		return SessionUnauthorised
 	}
 
 	currentTime := GetTimeStamp()
 
-	sessionValid := (deviceStruct.sessionExpiry > currentTime || deviceStruct.sessionExpiry == math.MaxUint64)
+	if deviceStruct.sessionExpiry != math.MaxUint64 && deviceStruct.sessionExpiry <= currentTime {
+		return SessionExpired
+	}
+
+	// Same as the xdp program, the users inactivity timeout from their policies if set, otherwise the global timeout
+	var inactivityTimeout uint64
+	if xdpObjects.UserInactivityTimeout.Lookup(deviceStruct.user_id, &inactivityTimeout) != nil {
+		inactivityTimeout = minutesToNanoseconds(config.Values().SessionInactivityTimeoutMinutes)
+	}
 
-	sessionActive := ((currentTime-deviceStruct.lastPacketTime) < uint64(config.Values().SessionInactivityTimeoutMinutes)*60000000000 || config.Values().SessionInactivityTimeoutMinutes < 0)
+	if deviceStruct.flags&deviceGateway == 0 && inactivityTimeout != math.MaxUint64 && (currentTime-deviceStruct.lastPacketTime) >= inactivityTimeout {
+		return SessionTimedOut
+	}
 
-	return isAccountLocked == 0 && sessionValid && sessionActive
+	return SessionAuthorised
+}
+
+// RequiresStepUp returns true if the device is authorised, but authenticated too long ago to access routes that require a fresh authentication
+func RequiresStepUp(address string) bool {
+
+	lock.RLock()
+	defer lock.RUnlock()
+
+	if !isAuthed(address) {
+		return false
+	}
+
+	deviceBytes, err := xdpObjects.Devices.LookupBytes([]byte(net.ParseIP(address).To4()))
+	if err != nil {
+		return false
+	}
+
+	var deviceStruct fwentry
+	if deviceStruct.Unpack(deviceBytes) != nil {
+		return false
+	}
+
+	freshness, ok := userFreshness[deviceStruct.user_id]
+	if !ok {
+		return false
+	}
+
+	return GetTimeStamp()-deviceStruct.lastAuthTime >= uint64(freshness)*uint64(time.Second)
 }
 
 func xdpRemoveDevice(address string) error {
@@ -243,11 +567,21 @@ func xdpRemoveDevice(address string) error {
 	var deviceStruct fwentry
 	deviceBytes := make([]byte, deviceStruct.Size())
 
-	deviceTableErr := xdpObjects.Devices.LookupAndDelete(ip.To4(), deviceBytes)
+	deviceTableErr := xdpObjects.Devices.LookupAndDelete(ip.To4(), &deviceBytes)
 	if deviceTableErr != nil && !strings.Contains(deviceTableErr.Error(), ebpf.ErrKeyNotExist.Error()) {
 		finalError = errors.New(finalError.Error() + "removing from devices table failed: " + deviceTableErr.Error() + " ")
 	}
 
+	countersTableErr := xdpObjects.DeviceCounters.Delete(ip.To4())
+	if countersTableErr != nil && !strings.Contains(countersTableErr.Error(), ebpf.ErrKeyNotExist.Error()) {
+		finalError = errors.New(finalError.Error() + "removing from device counters table failed: " + countersTableErr.Error() + " ")
+	}
+
+	routesTableErr := xdpRemoveGatewayRoutes(ip.To4())
+	if routesTableErr != nil {
+		finalError = errors.New(finalError.Error() + "removing from device routes table failed: " + routesTableErr.Error() + " ")
+	}
+
 	if finalError.Error() == msg {
 		finalError = nil
 	}
@@ -278,28 +612,159 @@ func xdpAddDevice(username, address string) error {
 		return err
 	}
 
-	return xdpObjects.Devices.Put(ip.To4(), deviceStruct.Bytes())
+	err = xdpObjects.Devices.Put(ip.To4(), deviceStruct.Bytes())
+	if err != nil {
+		return mapFullError(err, "devices", "Firewall.MaxDevices", xdpObjects.Devices)
+	}
+
+	return nil
 }
 
-// Takes the LPM table and associates a route to a policy
-func xdpAddRoute(usersRouteTable *ebpf.Map, userAcls config.Acl) error {
+// Marks a device as a gateway and adds the networks behind it, so traffic to and from hosts in those networks is treated as the gateways
+func xdpAddGateway(address string, routes []string) error {
+	ip := net.ParseIP(address).To4()
+	if ip == nil {
+		return errors.New("gateway address " + address + " is not an ipv4 address")
+	}
+
+	deviceBytes, err := xdpObjects.Devices.LookupBytes(ip)
+	if err != nil || deviceBytes == nil {
+		return errors.New("gateway " + address + " is not in the firewall")
+	}
 
-	rules, err := routetypes.ParseRules(userAcls.Mfa, userAcls.Allow)
-	if err != nil {
+	var deviceStruct fwentry
+	if err := deviceStruct.Unpack(deviceBytes); err != nil {
 		return err
 	}
 
+	var gateway [4]byte
+	copy(gateway[:], ip)
+
+	for _, route := range routes {
+		_, network, err := net.ParseCIDR(route)
+		if err != nil {
+			return fmt.Errorf("gateway %s has invalid route %q: %s", address, route, err)
+		}
+
+		prefixlen, _ := network.Mask.Size()
+
+		err = xdpObjects.DeviceRoutes.Put(routetypes.NewKey(network.IP, prefixlen), gateway)
+		if err != nil {
+			return mapFullError(err, "device routes", "Firewall.MaxDevices", xdpObjects.DeviceRoutes)
+		}
+	}
+
+	deviceStruct.flags |= deviceGateway
+
+	return xdpObjects.Devices.Update(ip, deviceStruct.Bytes(), ebpf.UpdateExist)
+}
+
+// Removes the networks behind a gateway from the firewall
+func xdpRemoveGatewayRoutes(address net.IP) error {
+	var (
+		key     routetypes.Key
+		gateway [4]byte
+		keys    []routetypes.Key
+	)
+
+	iter := xdpObjects.DeviceRoutes.Iterate()
+	for iter.Next(&key, &gateway) {
+		if net.IP(gateway[:]).Equal(address) {
+			keys = append(keys, key)
+		}
+	}
+
+	if iter.Err() != nil {
+		return iter.Err()
+	}
+
+	for _, key := range keys {
+		if err := xdpObjects.DeviceRoutes.Delete(key); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// The ipv4 tunnel address of the gateway that routes address, nil if address is not behind a gateway
+func routingGateway(address net.IP) net.IP {
+	prefixlen := 128
+	if address.To4() != nil {
+		prefixlen = 32
+	}
+
+	var gateway [4]byte
+	if xdpObjects.DeviceRoutes.Lookup(routetypes.NewKey(address, prefixlen), &gateway) != nil {
+		return nil
+	}
+
+	return net.IP(gateway[:])
+}
+
+// The networks behind each gateway in the firewall, by gateway address
+func xdpGatewayRoutes() (map[string][]string, error) {
+	var (
+		key     routetypes.Key
+		gateway [4]byte
+	)
+
+	routes := map[string][]string{}
+
+	iter := xdpObjects.DeviceRoutes.Iterate()
+	for iter.Next(&key, &gateway) {
+		address := net.IP(gateway[:]).String()
+		routes[address] = append(routes[address], key.String())
+	}
+
+	return routes, iter.Err()
+}
+
+// A users rules built into a new routes LPM trie, that has not been added to the firewall yet
+type userPolicies struct {
+	routes *ebpf.Map
+
+	// Smallest mfa freshness requirement in the rules, 0 if there are no step up routes
+	freshness uint32
+}
+
+// Takes parsed rules and builds a new LPM trie that associates each route to its policies. The firewall is not changed until the result is given to setPolicies
+func buildPolicies(rules []routetypes.Rule) (policies userPolicies, err error) {
+
+	routes := map[routetypes.Key]bool{}
+	for _, rule := range rules {
+		for _, key := range rule.Keys {
+			routes[key] = true
+		}
+	}
+
+	if len(routes) > int(routesMapSpec.MaxEntries) {
+		return policies, fmt.Errorf("user has %d routes but the firewall can only hold %d per user, increase Firewall.MaxRoutesPerUser", len(routes), routesMapSpec.MaxEntries)
+	}
+
+	policies.routes, err = ebpf.NewMap(routesMapSpec)
+	if err != nil {
+		return policies, fmt.Errorf("creating new routes map: %s", err)
+	}
+
 	for _, rule := range rules {
 		for i := range rule.Keys {
 
-			err := usersRouteTable.Put(&rule.Keys[i], &rule.Values)
+			err := policies.routes.Put(&rule.Keys[i], &rule.Values)
 			if err != nil {
-				return fmt.Errorf("error putting route key in inner map: %s", err)
+				policies.routes.Close()
+				return userPolicies{}, fmt.Errorf("error putting route key in inner map: %s", mapFullError(err, "routes", "Firewall.MaxRoutesPerUser", policies.routes))
+			}
+		}
+
+		for _, policy := range rule.Values[:rule.NumPolicies] {
+			if policy.FreshSeconds != 0 && (policies.freshness == 0 || policy.FreshSeconds < policies.freshness) {
+				policies.freshness = policy.FreshSeconds
 			}
 		}
 	}
 
-	return nil
+	return policies, nil
 }
 
 // If err != nil then user does not exist
@@ -314,21 +779,6 @@ func xdpUserExists(userid [20]byte) error {
 	return nil
 }
 
-// Returns the inner LPM trie map that was created for the user
-func addInnerMapTo(key interface{}, spec *ebpf.MapSpec, table *ebpf.Map) (*ebpf.Map, error) {
-	inner, err := ebpf.NewMap(spec)
-	if err != nil {
-		return nil, fmt.Errorf("%s creating new map: %s", table.String(), err)
-	}
-
-	err = table.Put(key, uint32(inner.FD()))
-	if err != nil {
-		return nil, fmt.Errorf("%s adding new map to table: %s", table.String(), err)
-	}
-
-	return inner, nil
-}
-
 func AddUser(username string, acls config.Acl) error {
 
 	lock.Lock()
@@ -342,32 +792,91 @@ func AddUser(username string, acls config.Acl) error {
 
 	err := xdpObjects.AccountLocked.Put(userid, uint32(0))
 	if err != nil {
-		return err
+		return mapFullError(err, "users", "Firewall.MaxUsers", xdpObjects.AccountLocked)
 	}
 
 	return setMaps(userid, acls)
 }
 
+// Turns the errors the kernel gives when a map has no room left (E2BIG for hash maps, ENOSPC for LPM tries) into something actionable
+func mapFullError(err error, name, option string, m *ebpf.Map) error {
+	if errors.Is(err, unix.E2BIG) || errors.Is(err, unix.ENOSPC) {
+		return fmt.Errorf("firewall %s map is full (%d entries), increase %s", name, m.MaxEntries(), option)
+	}
+
+	return err
+}
+
 func setMaps(userid [20]byte, userAcls config.Acl) error {
-	// Adds LPM trie to existing map (hashmap to map)
-	policiesInnerTable, err := addInnerMapTo(userid, routesMapSpec, xdpObjects.PoliciesTable)
+	rules, err := routetypes.ParseRules(userAcls.Mfa, userAcls.Allow, userAcls.Deny)
 	if err != nil {
 		return err
 	}
 
-	if err := xdpAddRoute(policiesInnerTable, userAcls); err != nil {
+	policies, err := buildPolicies(rules)
+	if err != nil {
+		return err
+	}
+
+	return setPolicies(userid, policies, userAcls)
+}
+
+// Swaps the users routes map into the policies table with a single update, so packets are checked against either the old or new rules and never a partially filled table
+// The kernel releases the old map once the xdp program is no longer using it
+func setPolicies(userid [20]byte, policies userPolicies, userAcls config.Acl) error {
+	// The policies table holds its own reference to the map
+	defer policies.routes.Close()
+
+	err := xdpObjects.PoliciesTable.Put(userid, uint32(policies.routes.FD()))
+	if err != nil {
+		return fmt.Errorf("%s adding new map to table: %s", xdpObjects.PoliciesTable.String(), mapFullError(err, "policies", "Firewall.MaxUsers", xdpObjects.PoliciesTable))
+	}
+
+	delete(userFreshness, userid)
+	if policies.freshness != 0 {
+		userFreshness[userid] = policies.freshness
+	}
+
+	if err := setRateLimit(userid, userAcls.RateLimit); err != nil {
 		return err
 	}
 
+	// Without an override the xdp program falls back to the global inactivity timeout
+	if userAcls.SessionInactivityTimeoutMinutes == nil {
+		err = xdpObjects.UserInactivityTimeout.Delete(userid)
+		if err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+			return errors.New("removing user inactivity timeout failed: " + err.Error())
+		}
+
+		return nil
+	}
+
+	err = xdpObjects.UserInactivityTimeout.Put(userid, minutesToNanoseconds(*userAcls.SessionInactivityTimeoutMinutes))
+	if err != nil {
+		return mapFullError(err, "user inactivity timeout", "Firewall.MaxUsers", xdpObjects.UserInactivityTimeout)
+	}
+
 	return nil
 }
 
+// Converts a timeout in minutes to nanoseconds, negative (disabled) timeouts are the max value
+func minutesToNanoseconds(minutes int) uint64 {
+	if minutes < 0 {
+		return math.MaxUint64
+	}
+
+	return uint64(minutes) * uint64(time.Minute)
+}
+
 func RemoveUser(username string) error {
 
 	lock.Lock()
 	defer lock.Unlock()
 
-	userid := sha1.Sum([]byte(username))
+	return xdpRemoveUser(sha1.Sum([]byte(username)))
+}
+
+func xdpRemoveUser(userid [20]byte) error {
 
 	err := xdpObjects.AccountLocked.Delete(userid)
 	if err != nil {
@@ -379,40 +888,100 @@ func RemoveUser(username string) error {
 		return errors.New("removing user from policies table failed: " + err.Error())
 	}
 
+	err = xdpObjects.UserInactivityTimeout.Delete(userid)
+	if err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+		return errors.New("removing user from inactivity timeout table failed: " + err.Error())
+	}
+
+	err = setRateLimit(userid, nil)
+	if err != nil {
+		return err
+	}
+
+	delete(userFreshness, userid)
+
+	err = xdpObjects.UserCounters.Delete(userid)
+	if err != nil && !strings.Contains(err.Error(), ebpf.ErrKeyNotExist.Error()) {
+		return errors.New("removing user from counters table failed: " + err.Error())
+	}
+
 	return nil
 }
 
 // RefreshConfiguration updates acls on all users, and updates the inactivity timeout
+// All of the new rules are built first, then each user has their rules swapped in with a single update so there is no point where traffic is checked against an incomplete table
 func RefreshConfiguration() []error {
 
-	lock.Lock()
-	defer lock.Unlock()
-
 	users, err := data.GetAllUsers()
 	if err != nil {
 		return []error{err}
 	}
 
-	var errors []error
+	var errs []error
 
-	value := uint64(config.Values().SessionInactivityTimeoutMinutes) * 60000000000
-	if config.Values().SessionInactivityTimeoutMinutes < 0 {
-		value = math.MaxUint64
-	}
+	// Reloading is also a way to force domains in acls to be looked up again
+	clearResolvedDomains()
 
-	err = xdpObjects.InactivityTimeoutMinutes.Put(uint32(0), value)
-	if err != nil {
-		return []error{fmt.Errorf("could not set inactivity timeout: %s", err)}
+	type update struct {
+		userid   [20]byte
+		acls     config.Acl
+		policies userPolicies
 	}
 
+	// Users with the same effective acls (e.g members of the same groups) share the same parsed rules
+	parsed := map[string][]routetypes.Rule{}
+	updates := make([]update, 0, len(users))
 	for _, user := range users {
-		err := refreshUserAcls(user.Username)
+		acls := config.GetEffectiveAcl(user.Username)
+
+		ruleSet := fmt.Sprintf("%q %q %q", acls.Mfa, acls.Allow, acls.Deny)
+		rules, ok := parsed[ruleSet]
+		if !ok {
+			rules, err = routetypes.ParseRules(acls.Mfa, acls.Allow, acls.Deny)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %s", user.Username, err))
+				continue
+			}
+			parsed[ruleSet] = rules
+		}
+
+		policies, err := buildPolicies(rules)
 		if err != nil {
-			errors = append(errors, err)
+			errs = append(errs, fmt.Errorf("%s: %s", user.Username, err))
+			continue
 		}
+
+		updates = append(updates, update{userid: user.GetID(), acls: acls, policies: policies})
 	}
 
-	return errors
+	lock.Lock()
+	defer lock.Unlock()
+
+	err = xdpObjects.InactivityTimeoutMinutes.Put(uint32(0), minutesToNanoseconds(config.Values().SessionInactivityTimeoutMinutes))
+	if err == nil {
+		err = setFlowTimeouts()
+	}
+
+	if err != nil {
+		for _, u := range updates {
+			u.policies.routes.Close()
+		}
+		return []error{fmt.Errorf("could not set firewall timeouts: %s", err)}
+	}
+
+	for _, u := range updates {
+		// The user may have been removed while the rules were being built
+		if xdpUserExists(u.userid) != nil {
+			u.policies.routes.Close()
+			continue
+		}
+
+		if err := setPolicies(u.userid, u.policies, u.acls); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errs
 }
 
 // Update FW routes for specific user
@@ -445,10 +1014,25 @@ func SetAuthorized(internalAddress, username string) error {
 	defer lock.Unlock()
 
 	var deviceStruct fwentry
+
+	// Keep the flags the device was added with
+	if deviceBytes, err := xdpObjects.Devices.LookupBytes(net.ParseIP(internalAddress).To4()); err == nil && deviceBytes != nil {
+		if err := deviceStruct.Unpack(deviceBytes); err != nil {
+			return err
+		}
+	}
+
 	deviceStruct.lastPacketTime = GetTimeStamp()
+	deviceStruct.lastAuthTime = deviceStruct.lastPacketTime
+
+	// Groups and users may have a different max session lifetime to the global setting
+	lifetime := config.Values().MaxSessionLifetimeMinutes
+	if override := config.GetEffectiveAcl(username).MaxSessionLifetimeMinutes; override != nil {
+		lifetime = *override
+	}
 
-	deviceStruct.sessionExpiry = GetTimeStamp() + uint64(config.Values().MaxSessionLifetimeMinutes)*60000000000
-	if config.Values().MaxSessionLifetimeMinutes < 0 {
+	deviceStruct.sessionExpiry = GetTimeStamp() + minutesToNanoseconds(lifetime)
+	if lifetime < 0 {
 		deviceStruct.sessionExpiry = math.MaxUint64 // If the session timeout is disabled, (<0) then we set to max value
 	}
 
@@ -492,13 +1076,18 @@ type FirewallRules struct {
 	Policies      []string
 	Devices       []fwDevice
 	AccountLocked uint32
+	RateLimit     *config.RateLimit `json:",omitempty"`
 }
 
 type fwDevice struct {
 	LastPacketTimestamp uint64
 	Expiry              uint64
 	IP                  string
+	IP6                 string `json:",omitempty"`
 	Authorized          bool
+
+	// Networks behind the device, if it is a gateway
+	Routes []string `json:",omitempty"`
 }
 
 func GetRoutes(username string) ([]string, error) {
@@ -595,6 +1184,11 @@ func GetRules() (map[string]FirewallRules, error) {
 		return
 	}
 
+	gatewayRoutes, err := xdpGatewayRoutes()
+	if err != nil {
+		return nil, err
+	}
+
 	var deviceStruct fwentry
 	deviceBytes := make([]byte, deviceStruct.Size())
 	ipBytes := make([]byte, 4)
@@ -610,12 +1204,23 @@ func GetRules() (map[string]FirewallRules, error) {
 		res := hashToUsername[hex.EncodeToString(deviceStruct.user_id[:])]
 
 		fwRule := result[res]
-		fwRule.Devices = append(fwRule.Devices, fwDevice{IP: net.IP(ipBytes).String(), Authorized: isAuthed(net.IP(ipBytes).String()), Expiry: deviceStruct.sessionExpiry, LastPacketTimestamp: deviceStruct.lastPacketTime})
+		fwDev := fwDevice{IP: net.IP(ipBytes).String(), Authorized: isAuthed(net.IP(ipBytes).String()), Expiry: deviceStruct.sessionExpiry, LastPacketTimestamp: deviceStruct.lastPacketTime}
+		fwDev.Routes = gatewayRoutes[fwDev.IP]
+		if ip6 := config.TunnelIPv6Address(net.IP(ipBytes)); ip6 != nil {
+			fwDev.IP6 = ip6.String()
+		}
+
+		fwRule.Devices = append(fwRule.Devices, fwDev)
 
 		if err := xdpObjects.AccountLocked.Lookup(deviceStruct.user_id, &fwRule.AccountLocked); err != nil {
 			return nil, err
 		}
 
+		fwRule.RateLimit, err = getRateLimit(deviceStruct.user_id)
+		if err != nil {
+			return nil, err
+		}
+
 		var innerMapID ebpf.MapID
 
 		err = xdpObjects.PoliciesTable.Lookup(deviceStruct.user_id, &innerMapID)
@@ -634,10 +1239,117 @@ func GetRules() (map[string]FirewallRules, error) {
 	return result, iter.Err()
 }
 
+// TrafficCounters is the number of packets and bytes the xdp firewall has passed and dropped
+type TrafficCounters struct {
+	PassedPackets  uint64
+	PassedBytes    uint64
+	DroppedPackets uint64
+	DroppedBytes   uint64
+}
+
+func (t *TrafficCounters) add(other TrafficCounters) {
+	t.PassedPackets += other.PassedPackets
+	t.PassedBytes += other.PassedBytes
+	t.DroppedPackets += other.DroppedPackets
+	t.DroppedBytes += other.DroppedBytes
+}
+
+// UserTraffic contains the total traffic for a user, and the traffic for each of their devices keyed by device address
+type UserTraffic struct {
+	Total   TrafficCounters
+	Devices map[string]TrafficCounters
+}
+
+// GetTrafficCounters returns the traffic counters for all users, keyed by username
+func GetTrafficCounters() (map[string]UserTraffic, error) {
+
+	lock.RLock()
+	defer lock.RUnlock()
+
+	users, err := data.GetAllUsers()
+	if err != nil {
+		return nil, errors.New("traffic counters get all users: " + err.Error())
+	}
+
+	hashToUsername := make(map[[20]byte]string)
+	for _, user := range users {
+		hashToUsername[sha1.Sum([]byte(user.Username))] = user.Username
+	}
+
+	result := make(map[string]UserTraffic)
+	getUser := func(username string) UserTraffic {
+		traffic, ok := result[username]
+		if !ok {
+			traffic.Devices = make(map[string]TrafficCounters)
+		}
+		return traffic
+	}
+
+	var (
+		userid     [20]byte
+		perCpu     []TrafficCounters
+		deviceAddr [4]byte
+	)
+
+	userIter := xdpObjects.UserCounters.Iterate()
+	for userIter.Next(&userid, &perCpu) {
+		username, ok := hashToUsername[userid]
+		if !ok {
+			continue
+		}
+
+		traffic := getUser(username)
+		for _, counters := range perCpu {
+			traffic.Total.add(counters)
+		}
+		result[username] = traffic
+	}
+
+	if userIter.Err() != nil {
+		return nil, userIter.Err()
+	}
+
+	var deviceStruct fwentry
+	deviceBytes := make([]byte, deviceStruct.Size())
+
+	deviceIter := xdpObjects.DeviceCounters.Iterate()
+	for deviceIter.Next(&deviceAddr, &perCpu) {
+
+		// Counters may outlive the device for a moment, if so just ignore them
+		if xdpObjects.Devices.Lookup(deviceAddr, &deviceBytes) != nil {
+			continue
+		}
+
+		if err := deviceStruct.Unpack(deviceBytes); err != nil {
+			return nil, err
+		}
+
+		username, ok := hashToUsername[deviceStruct.user_id]
+		if !ok {
+			continue
+		}
+
+		var total TrafficCounters
+		for _, counters := range perCpu {
+			total.add(counters)
+		}
+
+		traffic := getUser(username)
+		traffic.Devices[net.IP(deviceAddr[:]).String()] = total
+		result[username] = traffic
+	}
+
+	return result, deviceIter.Err()
+}
+
 func GetBPFHash() string {
 	lock.RLock()
 	defer lock.RUnlock()
 
+	return bpfHash()
+}
+
+func bpfHash() string {
 	hash := sha256.Sum256(_BpfBytes)
 	return hex.EncodeToString(hash[:])
 }
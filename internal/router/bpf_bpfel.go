@@ -61,9 +61,20 @@ type bpfProgramSpecs struct {
 // It can be passed ebpf.CollectionSpec.Assign.
 type bpfMapSpecs struct {
 	AccountLocked            *ebpf.MapSpec `ebpf:"account_locked"`
+	DeviceCounters           *ebpf.MapSpec `ebpf:"device_counters"`
+	DeviceRoutes             *ebpf.MapSpec `ebpf:"device_routes"`
 	Devices                  *ebpf.MapSpec `ebpf:"devices"`
+	DropEventLimiter         *ebpf.MapSpec `ebpf:"drop_event_limiter"`
+	DropEvents               *ebpf.MapSpec `ebpf:"drop_events"`
+	FlowTimeouts             *ebpf.MapSpec `ebpf:"flow_timeouts"`
+	Flows                    *ebpf.MapSpec `ebpf:"flows"`
 	InactivityTimeoutMinutes *ebpf.MapSpec `ebpf:"inactivity_timeout_minutes"`
 	PoliciesTable            *ebpf.MapSpec `ebpf:"policies_table"`
+	RateLimitBuckets         *ebpf.MapSpec `ebpf:"rate_limit_buckets"`
+	TunnelPrefix6            *ebpf.MapSpec `ebpf:"tunnel_prefix6"`
+	UserCounters             *ebpf.MapSpec `ebpf:"user_counters"`
+	UserInactivityTimeout    *ebpf.MapSpec `ebpf:"user_inactivity_timeout"`
+	UserRateLimits           *ebpf.MapSpec `ebpf:"user_rate_limits"`
 }
 
 // bpfObjects contains all objects after they have been loaded into the kernel.
@@ -86,17 +97,39 @@ func (o *bpfObjects) Close() error {
 // It can be passed to loadBpfObjects or ebpf.CollectionSpec.LoadAndAssign.
 type bpfMaps struct {
 	AccountLocked            *ebpf.Map `ebpf:"account_locked"`
+	DeviceCounters           *ebpf.Map `ebpf:"device_counters"`
+	DeviceRoutes             *ebpf.Map `ebpf:"device_routes"`
 	Devices                  *ebpf.Map `ebpf:"devices"`
+	DropEventLimiter         *ebpf.Map `ebpf:"drop_event_limiter"`
+	DropEvents               *ebpf.Map `ebpf:"drop_events"`
+	FlowTimeouts             *ebpf.Map `ebpf:"flow_timeouts"`
+	Flows                    *ebpf.Map `ebpf:"flows"`
 	InactivityTimeoutMinutes *ebpf.Map `ebpf:"inactivity_timeout_minutes"`
 	PoliciesTable            *ebpf.Map `ebpf:"policies_table"`
+	RateLimitBuckets         *ebpf.Map `ebpf:"rate_limit_buckets"`
+	TunnelPrefix6            *ebpf.Map `ebpf:"tunnel_prefix6"`
+	UserCounters             *ebpf.Map `ebpf:"user_counters"`
+	UserInactivityTimeout    *ebpf.Map `ebpf:"user_inactivity_timeout"`
+	UserRateLimits           *ebpf.Map `ebpf:"user_rate_limits"`
 }
 
 func (m *bpfMaps) Close() error {
 	return _BpfClose(
 		m.AccountLocked,
+		m.DeviceCounters,
+		m.DeviceRoutes,
 		m.Devices,
+		m.DropEventLimiter,
+		m.DropEvents,
+		m.FlowTimeouts,
+		m.Flows,
 		m.InactivityTimeoutMinutes,
 		m.PoliciesTable,
+		m.RateLimitBuckets,
+		m.TunnelPrefix6,
+		m.UserCounters,
+		m.UserInactivityTimeout,
+		m.UserRateLimits,
 	)
 }
 
@@ -1,14 +1,20 @@
 package router
 
 import (
+	"bytes"
 	"crypto/sha1"
+	"crypto/sha256"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"log"
 	"math"
 	"math/rand"
 	"net"
+	"os"
+	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -18,11 +24,17 @@ import (
 
 	"github.com/cilium/ebpf"
 	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"golang.org/x/sys/unix"
 )
 
 const (
 	XDP_DROP = 1
 	XDP_PASS = 2
+
+	ICMPV6      = 58
+	IPV6HOPOPTS = 0
+	IPV6DSTOPTS = 60
 )
 
 func TestBasicLoad(t *testing.T) {
@@ -63,7 +75,7 @@ func TestAddNewDevices(t *testing.T) {
 	}
 
 	var ipBytes []byte
-	var deviceBytes = make([]byte, 40)
+	var deviceBytes = make([]byte, fwentry{}.Size())
 
 	found := map[string]bool{}
 
@@ -119,7 +131,7 @@ func TestAddUser(t *testing.T) {
 
 		acl := config.GetEffectiveAcl(device.Username)
 
-		results, err := routetypes.ParseRules(acl.Mfa, acl.Allow)
+		results, err := routetypes.ParseRules(acl.Mfa, acl.Allow, acl.Deny)
 		if err != nil {
 			t.Fatal("parsing rules failed?:", err)
 		}
@@ -132,7 +144,7 @@ func TestAddUser(t *testing.T) {
 			}
 		}
 
-		results, err = routetypes.ParseRules(acl.Mfa, acl.Allow)
+		results, err = routetypes.ParseRules(acl.Mfa, acl.Allow, acl.Deny)
 		if err != nil {
 			t.Fatal("parsing rules failed?:", err)
 		}
@@ -315,7 +327,7 @@ func TestBasicAuthorise(t *testing.T) {
 		headers[5].String(): XDP_DROP,
 	}
 
-	mfas, err := routetypes.ParseRules(config.GetEffectiveAcl(out[0].Username).Mfa, nil)
+	mfas, err := routetypes.ParseRules(config.GetEffectiveAcl(out[0].Username).Mfa, nil, nil)
 	if err != nil {
 		t.Fatal("failed to parse mfa rules: ", err)
 	}
@@ -939,7 +951,8 @@ func (p *pkthdr) UnpackIcmp(b []byte) {
 func (p *pkthdr) Icmp() []byte {
 	r := make([]byte, 9) // 1 byte over as we need to fake some data
 
-	//icmp isnt parsed, other than proto and length
+	// icmp has no ports, the "port" is the message type and code (type << 8 | code)
+	binary.BigEndian.PutUint16(r, p.dst)
 
 	return r
 }
@@ -972,26 +985,76 @@ func createPacket(src, dst net.IP, proto, port int) []byte {
 
 	hdrbytes, _ := iphdr.Marshal()
 
+	return append(hdrbytes, createPayload(proto, port)...)
+}
+
+// Creates an ipv6 packet, optionally with extension headers (e.g hop-by-hop options) between the ipv6 header and the payload
+func createPacket6(src, dst net.IP, proto, port int, extensionHeaders ...int) []byte {
+	hdrbytes := make([]byte, ipv6.HeaderLen)
+	hdrbytes[0] = 6 << 4
+
+	nextHeader := proto
+	if len(extensionHeaders) > 0 {
+		nextHeader = extensionHeaders[0]
+	}
+	hdrbytes[6] = byte(nextHeader)
+	hdrbytes[7] = 64
+
+	copy(hdrbytes[8:24], src.To16())
+	copy(hdrbytes[24:40], dst.To16())
+
+	for i := range extensionHeaders {
+		nextHeader = proto
+		if i+1 < len(extensionHeaders) {
+			nextHeader = extensionHeaders[i+1]
+		}
+
+		// Minimum sized extension header (8 bytes), with padding options
+		hdrbytes = append(hdrbytes, byte(nextHeader), 0, 1, 4, 0, 0, 0, 0)
+	}
+
+	payload := createPayload(proto, port)
+	binary.BigEndian.PutUint16(hdrbytes[4:], uint16(len(hdrbytes)-ipv6.HeaderLen+len(payload)))
+
+	return append(hdrbytes, payload...)
+}
+
+// Creates the reply to a packet without extension headers, by swapping its addresses and ports
+func reply(packet []byte) []byte {
+	r := make([]byte, len(packet))
+	copy(r, packet)
+
+	addrLen, addrStart := net.IPv4len, 12
+	if r[0]>>4 == 6 {
+		addrLen, addrStart = net.IPv6len, 8
+	}
+
+	copy(r[addrStart:], packet[addrStart+addrLen:addrStart+2*addrLen])
+	copy(r[addrStart+addrLen:], packet[addrStart:addrStart+addrLen])
+
+	ports := addrStart + 2*addrLen
+	copy(r[ports:], packet[ports+2:ports+4])
+	copy(r[ports+2:], packet[ports:ports+2])
+
+	return r
+}
+
+func createPayload(proto, port int) []byte {
 	pkt := pkthdr{
 		src: 3884,
 		dst: uint16(port),
 	}
 
 	switch proto {
-	case routetypes.UDP:
-		hdrbytes = append(hdrbytes, pkt.Udp()...)
+	case routetypes.UDP, routetypes.SCTP:
+		return pkt.Udp()
 	case routetypes.TCP:
-		hdrbytes = append(hdrbytes, pkt.Tcp()...)
-
-	case routetypes.ICMP:
-		hdrbytes = append(hdrbytes, pkt.Icmp()...)
-
+		return pkt.Tcp()
+	case routetypes.ICMP, routetypes.ICMPV6:
+		return pkt.Icmp()
 	default:
-		hdrbytes = append(hdrbytes, pkt.Any()...)
-
+		return pkt.Any()
 	}
-
-	return hdrbytes
 }
 
 func TestPortRestrictions(t *testing.T) {
@@ -1019,7 +1082,7 @@ func TestPortRestrictions(t *testing.T) {
 
 	acl := config.GetEffectiveAcl(out[0].Username)
 
-	rules, err := routetypes.ParseRules(acl.Mfa, acl.Allow)
+	rules, err := routetypes.ParseRules(acl.Mfa, acl.Allow, acl.Deny)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -1145,7 +1208,7 @@ func TestAgnosticRuleOrdering(t *testing.T) {
 	for _, user := range out {
 		acl := config.GetEffectiveAcl(user.Username)
 
-		rules, err := routetypes.ParseRules(acl.Mfa, acl.Allow)
+		rules, err := routetypes.ParseRules(acl.Mfa, acl.Allow, acl.Deny)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -1243,10 +1306,7 @@ func TestLookupDifferentKeyTypesInMap(t *testing.T) {
 	   ]
 	*/
 
-	k := routetypes.Key{
-		IP:        [4]byte{1, 1, 1, 1},
-		Prefixlen: 32,
-	}
+	k := routetypes.NewKey(net.ParseIP("1.1.1.1"), 32)
 
 	var policies [routetypes.MAX_POLICIES]routetypes.Policy
 	err = userPublicRoutes.Lookup(k.Bytes(), &policies)
@@ -1266,10 +1326,7 @@ func TestLookupDifferentKeyTypesInMap(t *testing.T) {
 		t.Fatal("policy should only contain one any/any rule")
 	}
 
-	k = routetypes.Key{
-		IP:        [4]byte{3, 3, 3, 3},
-		Prefixlen: 32,
-	}
+	k = routetypes.NewKey(net.ParseIP("3.3.3.3"), 32)
 
 	err = userPublicRoutes.Lookup(k.Bytes(), &policies)
 	if err != nil {
@@ -1290,6 +1347,214 @@ func TestLookupDifferentKeyTypesInMap(t *testing.T) {
 
 }
 
+func TestIPv6Rules(t *testing.T) {
+	if err := setup("../config/test_ipv6.json"); err != nil {
+		t.Fatal(err)
+	}
+	defer xdpObjects.Close()
+
+	out, err := addDevices()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	device := config.TunnelIPv6Address(net.ParseIP(out[0].Address))
+	if device == nil || device.String() != "fd00:5:1::c0a8:102" {
+		t.Fatal("device ipv6 address was not derived from the ipv6 prefix and ipv4 address: ", device)
+	}
+
+	/*
+		"Allow": [
+			"2.2.2.2",
+			"2001:db8::/32 443/tcp",
+			"2001:db8:ffff::/48",
+			"2001:db8:aaaa::1 icmp"
+		]
+		tester "Mfa": [
+			"2001:db8:5::/48"
+		]
+	*/
+
+	var packets [][]byte
+	expectedResults := []uint32{}
+
+	addPacket := func(packet []byte, expected uint32) {
+		packets = append(packets, packet)
+		expectedResults = append(expectedResults, expected)
+	}
+
+	addPacket(createPacket6(device, net.ParseIP("2001:db8::5"), routetypes.TCP, 443), XDP_PASS)
+	addPacket(createPacket6(device, net.ParseIP("2001:db8::5"), routetypes.TCP, 80), XDP_DROP)
+	addPacket(createPacket6(device, net.ParseIP("2001:db8::5"), routetypes.UDP, 443), XDP_DROP)
+	addPacket(createPacket6(device, net.ParseIP("2001:db9::1"), routetypes.TCP, 443), XDP_DROP)
+
+	// Return traffic
+	addPacket(createPacket6(device, net.ParseIP("2001:db8:ffff::1"), routetypes.UDP, 53), XDP_PASS)
+	addPacket(reply(createPacket6(device, net.ParseIP("2001:db8:ffff::1"), routetypes.UDP, 53)), XDP_PASS)
+	addPacket(createPacket6(net.ParseIP("2001:db9::1"), device, routetypes.UDP, 53), XDP_DROP)
+
+	// Allowed hosts cant start connections to the device
+	addPacket(createPacket6(net.ParseIP("2001:db8:ffff::1"), device, routetypes.UDP, 53), XDP_DROP)
+
+	// Not a device
+	addPacket(createPacket6(net.ParseIP("fd00:dead::c0a8:102"), net.ParseIP("2001:db8:ffff::1"), routetypes.UDP, 53), XDP_DROP)
+	addPacket(createPacket6(net.ParseIP("fd00:5:1::c0a8:1ff"), net.ParseIP("2001:db8:ffff::1"), routetypes.UDP, 53), XDP_DROP)
+
+	// icmp rules apply to icmpv6
+	addPacket(createPacket6(device, net.ParseIP("2001:db8:aaaa::1"), ICMPV6, 0), XDP_PASS)
+	addPacket(createPacket6(device, net.ParseIP("2001:db8:aaaa::1"), routetypes.TCP, 22), XDP_DROP)
+
+	// Extension headers are skipped to find the transport header
+	addPacket(createPacket6(device, net.ParseIP("2001:db8::5"), routetypes.TCP, 443, IPV6HOPOPTS, IPV6DSTOPTS), XDP_PASS)
+	addPacket(createPacket6(device, net.ParseIP("2001:db8::5"), routetypes.TCP, 80, IPV6HOPOPTS), XDP_DROP)
+
+	// ipv4 still works for the same device
+	addPacket(createPacket(net.ParseIP(out[0].Address), net.ParseIP("2.2.2.2"), routetypes.TCP, 80), XDP_PASS)
+	addPacket(createPacket(net.ParseIP(out[0].Address), net.ParseIP("3.3.3.3"), routetypes.TCP, 80), XDP_DROP)
+
+	// mfa routes
+	addPacket(createPacket6(device, net.ParseIP("2001:db8:5::1"), routetypes.TCP, 22), XDP_DROP)
+
+	for i := range packets {
+		value, _, err := xdpObjects.bpfPrograms.XdpWagFirewall.Test(packets[i])
+		if err != nil {
+			t.Fatalf("program failed %s", err)
+		}
+
+		if value != expectedResults[i] {
+			t.Fatalf("%d, packet %x, expected %s got %s", i, packets[i], result(expectedResults[i]), result(value))
+		}
+	}
+
+	err = SetAuthorized(out[0].Address, out[0].Username)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	value, _, err := xdpObjects.bpfPrograms.XdpWagFirewall.Test(createPacket6(device, net.ParseIP("2001:db8:5::1"), routetypes.TCP, 22))
+	if err != nil {
+		t.Fatalf("program failed %s", err)
+	}
+
+	if value != XDP_PASS {
+		t.Fatal("authorised device should be able to access ipv6 mfa route, got: ", result(value))
+	}
+
+	routes, err := GetRoutes(out[0].Username)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !contains(routes, []string{"2001:db8::/32", "2001:db8:5::/48", "fd00:5:1::c0a8:101/128", "2.2.2.2/32"}) {
+		t.Fatal("routes did not contain ipv6 routes: ", routes)
+	}
+}
+
+func TestIPv6DisabledTunnelAddresses(t *testing.T) {
+	if err := setup("../config/test_port_based_rules.json"); err != nil {
+		t.Fatal(err)
+	}
+	defer xdpObjects.Close()
+
+	out, err := addDevices()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// With no ipv6 prefix the prefix map is all zeros, so make sure that doesnt allow ::<device ipv4>
+	packet := createPacket6(net.ParseIP("::"+out[0].Address), net.ParseIP("2.2.2.2"), routetypes.TCP, 80)
+
+	value, _, err := xdpObjects.bpfPrograms.XdpWagFirewall.Test(packet)
+	if err != nil {
+		t.Fatalf("program failed %s", err)
+	}
+
+	if value != XDP_DROP {
+		t.Fatal("ipv6 packet should be dropped when ipv6 tunnel addresses are disabled, got: ", result(value))
+	}
+
+	// ipv4-mapped addresses still resolve to the device
+	packet = createPacket6(net.ParseIP("::ffff:"+out[0].Address), net.ParseIP("::ffff:2.2.2.2"), routetypes.TCP, 80)
+
+	value, _, err = xdpObjects.bpfPrograms.XdpWagFirewall.Test(packet)
+	if err != nil {
+		t.Fatalf("program failed %s", err)
+	}
+
+	if value != XDP_PASS {
+		t.Fatal("ipv4-mapped packet should match the ipv4 rules, got: ", result(value))
+	}
+}
+
+func TestTrafficCounters(t *testing.T) {
+	if err := setup("../config/test_port_based_rules.json"); err != nil {
+		t.Fatal(err)
+	}
+	defer xdpObjects.Close()
+
+	out, err := addDevices()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	passPacket := createPacket(net.ParseIP(out[0].Address), net.ParseIP("2.2.2.2"), routetypes.TCP, 80)
+	dropPacket := createPacket(net.ParseIP(out[0].Address), net.ParseIP("3.3.3.3"), routetypes.TCP, 80)
+
+	for _, packet := range [][]byte{passPacket, passPacket, dropPacket} {
+		_, _, err := xdpObjects.bpfPrograms.XdpWagFirewall.Test(packet)
+		if err != nil {
+			t.Fatalf("program failed %s", err)
+		}
+	}
+
+	// Traffic from the other device and its return traffic, so it should have seperate counters
+	otherPacket := createPacket(net.ParseIP(out[1].Address), net.ParseIP("2.2.2.2"), routetypes.TCP, 80)
+	for _, packet := range [][]byte{otherPacket, reply(otherPacket)} {
+		_, _, err = xdpObjects.bpfPrograms.XdpWagFirewall.Test(packet)
+		if err != nil {
+			t.Fatalf("program failed %s", err)
+		}
+	}
+
+	counters, err := GetTrafficCounters()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := TrafficCounters{
+		PassedPackets:  2,
+		PassedBytes:    uint64(2 * len(passPacket)),
+		DroppedPackets: 1,
+		DroppedBytes:   uint64(len(dropPacket)),
+	}
+
+	if counters[out[0].Username].Total != expected {
+		t.Fatalf("user counters were incorrect, expected %+v got %+v", expected, counters[out[0].Username].Total)
+	}
+
+	if counters[out[0].Username].Devices[out[0].Address] != expected {
+		t.Fatalf("device counters were incorrect, expected %+v got %+v", expected, counters[out[0].Username].Devices[out[0].Address])
+	}
+
+	if counters[out[1].Username].Total.PassedPackets != 2 || counters[out[1].Username].Total.DroppedPackets != 0 {
+		t.Fatalf("second user counters were incorrect: %+v", counters[out[1].Username].Total)
+	}
+
+	err = xdpRemoveDevice(out[0].Address)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	counters, err = GetTrafficCounters()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := counters[out[0].Username].Devices[out[0].Address]; ok {
+		t.Fatal("removed device should not have counters")
+	}
+}
+
 func BenchmarkGeneralRun(b *testing.B) {
 
 	if err := setup("../config/test_port_based_rules.json"); err != nil {
@@ -1441,3 +1706,1369 @@ func setup(what string) error {
 
 	return loadXDP()
 }
+
+func TestDropEvents(t *testing.T) {
+	if err := setup("../config/test_port_based_rules.json"); err != nil {
+		t.Fatal(err)
+	}
+	defer xdpObjects.Close()
+
+	out, err := addDevices()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := startDropEventReader(); err != nil {
+		t.Fatal(err)
+	}
+	defer stopDropEventReader()
+
+	events, cancel := SubscribeDropEvents()
+	defer cancel()
+
+	packets := []struct {
+		packet []byte
+		event  DropEvent
+	}{
+		{
+			packet: createPacket(net.ParseIP(out[0].Address), net.ParseIP("3.3.3.3"), routetypes.TCP, 80),
+			event: DropEvent{
+				Device:          out[0].Address,
+				Username:        out[0].Username,
+				Source:          out[0].Address,
+				Destination:     "3.3.3.3",
+				SourcePort:      3884,
+				DestinationPort: 80,
+				Protocol:        routetypes.TCP,
+				Reason:          dropReason(DropNoPolicy),
+			},
+		},
+		{
+			packet: createPacket(net.ParseIP(out[0].Address), net.ParseIP("99.99.99.99"), routetypes.UDP, 53),
+			event: DropEvent{
+				Device:          out[0].Address,
+				Username:        out[0].Username,
+				Source:          out[0].Address,
+				Destination:     "99.99.99.99",
+				SourcePort:      3884,
+				DestinationPort: 53,
+				Protocol:        routetypes.UDP,
+				Reason:          dropReason(DropNoRoute),
+			},
+		},
+		{
+			packet: createPacket(net.ParseIP("50.50.50.50"), net.ParseIP("51.51.51.51"), routetypes.TCP, 22),
+			event: DropEvent{
+				Source:          "50.50.50.50",
+				Destination:     "51.51.51.51",
+				SourcePort:      3884,
+				DestinationPort: 22,
+				Protocol:        routetypes.TCP,
+				Reason:          dropReason(DropNoDevice),
+			},
+		},
+	}
+
+	for _, p := range packets {
+		value, _, err := xdpObjects.bpfPrograms.XdpWagFirewall.Test(p.packet)
+		if err != nil {
+			t.Fatalf("program failed %s", err)
+		}
+
+		if result(value) != "XDP_DROP" {
+			t.Fatalf("packet to %s should have been dropped, got %s", p.event.Destination, result(value))
+		}
+
+		select {
+		case event := <-events:
+			event.Time = time.Time{}
+
+			if event != p.event {
+				t.Fatalf("drop event was incorrect, expected %+v got %+v", p.event, event)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("did not receive drop event for packet to %s", p.event.Destination)
+		}
+	}
+}
+
+func TestDenyRules(t *testing.T) {
+	if err := setup("../config/test_deny_rules.json"); err != nil {
+		t.Fatal(err)
+	}
+	defer xdpObjects.Close()
+
+	out, err := addDevices()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := SetAuthorized(out[0].Address, out[0].Username); err != nil {
+		t.Fatal(err)
+	}
+
+	/*
+		"*": {
+			"Allow": [
+				"10.0.0.0/8",
+				"11.11.11.11 443/tcp"
+			],
+			"Deny": [
+				"10.0.5.0/24 22/tcp",
+				"11.11.0.0/16"
+			]
+		},
+		"tester": {
+			"Mfa": [
+				"10.0.5.5 22/tcp 8080/tcp"
+			]
+		}
+	*/
+
+	var packets [][]byte
+	expectedResults := []uint32{}
+
+	addPacket := func(packet []byte, expected uint32) {
+		packets = append(packets, packet)
+		expectedResults = append(expectedResults, expected)
+	}
+
+	device := net.ParseIP(out[0].Address)
+
+	// Less specific allow still applies to everything the deny does not match
+	addPacket(createPacket(device, net.ParseIP("10.1.1.1"), routetypes.TCP, 22), XDP_PASS)
+	addPacket(createPacket(device, net.ParseIP("10.0.5.1"), routetypes.TCP, 80), XDP_PASS)
+	addPacket(createPacket(device, net.ParseIP("10.0.5.1"), routetypes.UDP, 22), XDP_PASS)
+	addPacket(createPacket(device, net.ParseIP("10.0.5.1"), routetypes.TCP, 22), XDP_DROP)
+
+	// Deny takes precedence over a more specific mfa route, even when authorised
+	addPacket(createPacket(device, net.ParseIP("10.0.5.5"), routetypes.TCP, 22), XDP_DROP)
+	addPacket(createPacket(device, net.ParseIP("10.0.5.5"), routetypes.TCP, 8080), XDP_PASS)
+
+	// Deny takes precedence over a more specific public route
+	addPacket(createPacket(device, net.ParseIP("11.11.11.11"), routetypes.TCP, 443), XDP_DROP)
+	addPacket(createPacket(device, net.ParseIP("11.11.1.1"), routetypes.TCP, 443), XDP_DROP)
+
+	for i := range packets {
+		value, _, err := xdpObjects.bpfPrograms.XdpWagFirewall.Test(packets[i])
+		if err != nil {
+			t.Fatalf("program failed %s", err)
+		}
+
+		if value != expectedResults[i] {
+			t.Fatalf("%d, packet %x, expected %s got %s", i, packets[i], result(expectedResults[i]), result(value))
+		}
+	}
+
+	// Users without the mfa rule are still governed by the deny rules
+	value, _, err := xdpObjects.bpfPrograms.XdpWagFirewall.Test(createPacket(net.ParseIP(out[1].Address), net.ParseIP("10.0.5.5"), routetypes.TCP, 22))
+	if err != nil {
+		t.Fatalf("program failed %s", err)
+	}
+
+	if value != XDP_DROP {
+		t.Fatal("denied route should be dropped, got: ", result(value))
+	}
+}
+
+func TestMapLimits(t *testing.T) {
+	if err := setup("../config/test_map_limits.json"); err != nil {
+		t.Fatal(err)
+	}
+	defer xdpObjects.Close()
+
+	if xdpObjects.Devices.MaxEntries() != 1 || xdpObjects.AccountLocked.MaxEntries() != 1 || xdpObjects.PoliciesTable.MaxEntries() != 1 {
+		t.Fatal("maps were not resized to configured limits")
+	}
+
+	// Server address and 1.1.1.1
+	if err := AddUser("tester", config.GetEffectiveAcl("tester")); err != nil {
+		t.Fatal(err)
+	}
+
+	err := AddUser("randomthingappliedtoall", config.GetEffectiveAcl("randomthingappliedtoall"))
+	if err == nil || !strings.Contains(err.Error(), "Firewall.MaxUsers") {
+		t.Fatal("adding more users than the limit should give a clear error, got: ", err)
+	}
+
+	if err := xdpAddDevice("tester", "192.168.1.2"); err != nil {
+		t.Fatal(err)
+	}
+
+	err = xdpAddDevice("tester", "192.168.1.3")
+	if err == nil || !strings.Contains(err.Error(), "Firewall.MaxDevices") {
+		t.Fatal("adding more devices than the limit should give a clear error, got: ", err)
+	}
+
+	rules, err := routetypes.ParseRules(nil, []string{"1.1.1.1", "2.2.2.2", "3.3.3.3 22/tcp"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = buildPolicies(rules)
+	if err == nil || !strings.Contains(err.Error(), "Firewall.MaxRoutesPerUser") {
+		t.Fatal("adding more routes than the limit should give a clear error, got: ", err)
+	}
+}
+
+func TestPinnedStateRestart(t *testing.T) {
+	if err := setup("../config/test_port_based_rules.json"); err != nil {
+		t.Fatal(err)
+	}
+	xdpObjects.Close()
+
+	var fs unix.Statfs_t
+	if err := unix.Statfs(ebpfFS, &fs); err != nil || fs.Type != unix.BPF_FS_MAGIC {
+		t.Skip("bpf filesystem not mounted at ", ebpfFS)
+	}
+
+	pinPath := filepath.Join(ebpfFS, "wag", config.Values().Wireguard.DevName)
+	defer os.RemoveAll(pinPath)
+
+	if err := removePins(pinPath); err != nil {
+		t.Fatal(err)
+	}
+
+	adopted, err := loadPinnedXDP()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if adopted {
+		t.Fatal("should not adopt state when nothing was pinned")
+	}
+
+	out, err := addDevices()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := SetAuthorized(out[0].Address, out[0].Username); err != nil {
+		t.Fatal(err)
+	}
+
+	// Simulate wag restarting
+	xdpObjects.Close()
+
+	adopted, err = loadPinnedXDP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer xdpObjects.Close()
+
+	if !adopted {
+		t.Fatal("pinned state from the same program should be adopted")
+	}
+
+	// The second device was deleted while wag was down
+	err = reconcileXDP([]data.UserModel{{Username: out[0].Username}}, out[:1])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !IsAuthed(out[0].Address) {
+		t.Fatal("device session should have survived the restart")
+	}
+
+	if err := xdpObjects.Devices.Lookup(net.ParseIP(out[1].Address).To4(), make([]byte, fwentry{}.Size())); err == nil {
+		t.Fatal("device that is no longer in the database should have been removed")
+	}
+
+	if xdpUserExists(sha1.Sum([]byte(out[1].Username))) == nil {
+		t.Fatal("user that is no longer in the database should have been removed")
+	}
+
+	value, _, err := xdpObjects.bpfPrograms.XdpWagFirewall.Test(createPacket(net.ParseIP(out[0].Address), net.ParseIP("2.2.2.2"), routetypes.TCP, 80))
+	if err != nil {
+		t.Fatalf("program failed %s", err)
+	}
+
+	if value != XDP_PASS {
+		t.Fatal("routes should have been restored, got: ", result(value))
+	}
+
+	// State pinned by a different program is not reused
+	xdpObjects.Close()
+
+	versionMap, err := ebpf.LoadPinnedMap(filepath.Join(pinPath, versionMapSpec.Name), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = versionMap.Put(uint32(0), [sha256.Size]byte{1})
+	versionMap.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	adopted, err = loadPinnedXDP()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if adopted || IsAuthed(out[0].Address) {
+		t.Fatal("state from a different program should not be adopted")
+	}
+}
+
+func TestSessionOverrides(t *testing.T) {
+	if err := setup("../config/test_session_overrides.json"); err != nil {
+		t.Fatal(err)
+	}
+	defer xdpObjects.Close()
+
+	out, err := addDevices()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	/*
+		Global: MaxSessionLifetimeMinutes 2, SessionInactivityTimeoutMinutes 1
+		"*": inactivity 10
+		"group:admins" (tester): lifetime 60, inactivity 5
+		"randomthingappliedtoall": lifetime -1
+	*/
+
+	expectedInactivity := map[string]uint64{
+		out[0].Username: 5 * uint64(time.Minute),
+		out[1].Username: 10 * uint64(time.Minute),
+	}
+
+	for username, expected := range expectedInactivity {
+		var timeout uint64
+		if err := xdpObjects.UserInactivityTimeout.Lookup(sha1.Sum([]byte(username)), &timeout); err != nil {
+			t.Fatal(err)
+		}
+
+		if timeout != expected {
+			t.Fatalf("%s inactivity timeout was %d expected %d", username, timeout, expected)
+		}
+	}
+
+	for _, device := range out {
+		if err := SetAuthorized(device.Address, device.Username); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	getDevice := func(address string) fwentry {
+		var device fwentry
+		deviceBytes, err := xdpObjects.Devices.LookupBytes(net.ParseIP(address).To4())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := device.Unpack(deviceBytes); err != nil {
+			t.Fatal(err)
+		}
+
+		return device
+	}
+
+	admin := getDevice(out[0].Address)
+	if lifetime := admin.sessionExpiry - admin.lastPacketTime; lifetime < 59*uint64(time.Minute) || lifetime > 61*uint64(time.Minute) {
+		t.Fatalf("group lifetime override was not used, session lifetime was %s", time.Duration(lifetime))
+	}
+
+	if getDevice(out[1].Address).sessionExpiry != math.MaxUint64 {
+		t.Fatal("user policy disabling max lifetime was not used")
+	}
+
+	// Make both devices look like they have been idle for 7 minutes, which is over the admin inactivity timeout but not the other users
+	for _, device := range out {
+		entry := getDevice(device.Address)
+		entry.lastPacketTime = GetTimeStamp() - 7*uint64(time.Minute)
+
+		if err := xdpObjects.Devices.Update(net.ParseIP(device.Address).To4(), entry.Bytes(), ebpf.UpdateExist); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if IsAuthed(out[0].Address) {
+		t.Fatal("admin device should have timed out")
+	}
+
+	if !IsAuthed(out[1].Address) {
+		t.Fatal("device should not have timed out, as its inactivity timeout is 10 minutes")
+	}
+
+	expectedResults := []uint32{XDP_DROP, XDP_PASS}
+	for i, device := range out {
+		value, _, err := xdpObjects.bpfPrograms.XdpWagFirewall.Test(createPacket(net.ParseIP(device.Address), net.ParseIP("3.3.3.3"), routetypes.TCP, 80))
+		if err != nil {
+			t.Fatalf("program failed %s", err)
+		}
+
+		if value != expectedResults[i] {
+			t.Fatalf("%s expected %s got %s", device.Username, result(expectedResults[i]), result(value))
+		}
+	}
+}
+
+func TestGlobalInactivityTimeout(t *testing.T) {
+	if err := setup("../config/test_in_memory_db.json"); err != nil {
+		t.Fatal(err)
+	}
+	defer xdpObjects.Close()
+
+	out, err := addDevices()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// No policy overrides the inactivity timeout, so users should not have their own and the global timeout (disabled) applies
+	for _, device := range out {
+		if config.GetEffectiveAcl(device.Username).SessionInactivityTimeoutMinutes != nil {
+			t.Fatalf("%s effective acl had an inactivity timeout without an override", device.Username)
+		}
+
+		var timeout uint64
+		if err := xdpObjects.UserInactivityTimeout.Lookup(sha1.Sum([]byte(device.Username)), &timeout); !errors.Is(err, ebpf.ErrKeyNotExist) {
+			t.Fatalf("%s had an inactivity timeout of %d without an override: %v", device.Username, timeout, err)
+		}
+	}
+
+	// An override left behind from a previous policy is removed when the users acls are refreshed
+	userid := sha1.Sum([]byte(out[0].Username))
+	if err := xdpObjects.UserInactivityTimeout.Put(userid, uint64(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := RefreshUserAcls(out[0].Username); err != nil {
+		t.Fatal(err)
+	}
+
+	var timeout uint64
+	if err := xdpObjects.UserInactivityTimeout.Lookup(userid, &timeout); !errors.Is(err, ebpf.ErrKeyNotExist) {
+		t.Fatalf("stale inactivity timeout of %d was not removed: %v", timeout, err)
+	}
+
+	if err := SetAuthorized(out[0].Address, out[0].Username); err != nil {
+		t.Fatal(err)
+	}
+
+	deviceBytes, err := xdpObjects.Devices.LookupBytes(net.ParseIP(out[0].Address).To4())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var device fwentry
+	if err := device.Unpack(deviceBytes); err != nil {
+		t.Fatal(err)
+	}
+
+	device.lastPacketTime = GetTimeStamp() - 7*uint64(time.Minute)
+	if err := xdpObjects.Devices.Update(net.ParseIP(out[0].Address).To4(), device.Bytes(), ebpf.UpdateExist); err != nil {
+		t.Fatal(err)
+	}
+
+	if !IsAuthed(out[0].Address) {
+		t.Fatal("device timed out, but the global inactivity timeout is disabled")
+	}
+}
+
+func TestStepUpAuthentication(t *testing.T) {
+	if err := setup("../config/test_step_up.json"); err != nil {
+		t.Fatal(err)
+	}
+	defer xdpObjects.Close()
+
+	out, err := addDevices()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	device := out[0]
+	if RequiresStepUp(device.Address) {
+		t.Fatal("unauthorised device should not require step up, it needs to authenticate anyway")
+	}
+
+	if err := SetAuthorized(device.Address, device.Username); err != nil {
+		t.Fatal(err)
+	}
+
+	if RequiresStepUp(device.Address) {
+		t.Fatal("device that just authenticated should not require step up")
+	}
+
+	// Authenticated 20 minutes ago, but still active so the session is valid
+	deviceBytes, err := xdpObjects.Devices.LookupBytes(net.ParseIP(device.Address).To4())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var entry fwentry
+	if err := entry.Unpack(deviceBytes); err != nil {
+		t.Fatal(err)
+	}
+	entry.lastAuthTime = GetTimeStamp() - 20*uint64(time.Minute)
+
+	if err := xdpObjects.Devices.Update(net.ParseIP(device.Address).To4(), entry.Bytes(), ebpf.UpdateExist); err != nil {
+		t.Fatal(err)
+	}
+
+	if !IsAuthed(device.Address) {
+		t.Fatal("device session should still be valid")
+	}
+
+	if !RequiresStepUp(device.Address) {
+		t.Fatal("device that authenticated 20 minutes ago should require step up for a 15 minute freshness route")
+	}
+
+	if err := startDropEventReader(); err != nil {
+		t.Fatal(err)
+	}
+	defer stopDropEventReader()
+
+	events, cancel := SubscribeDropEvents()
+	defer cancel()
+
+	tests := []struct {
+		dst      string
+		port     int
+		expected uint32
+	}{
+		{"3.3.3.3", 22, XDP_DROP},
+		{"3.3.3.3", 80, XDP_DROP},
+		{"4.4.4.4", 22, XDP_PASS},
+		{"5.5.5.5", 22, XDP_PASS},
+	}
+
+	for _, test := range tests {
+		value, _, err := xdpObjects.bpfPrograms.XdpWagFirewall.Test(createPacket(net.ParseIP(device.Address), net.ParseIP(test.dst), routetypes.TCP, test.port))
+		if err != nil {
+			t.Fatalf("program failed %s", err)
+		}
+
+		if value != test.expected {
+			t.Fatalf("%s:%d expected %s got %s", test.dst, test.port, result(test.expected), result(value))
+		}
+	}
+
+	select {
+	case event := <-events:
+		if event.Reason != dropReason(DropStaleAuth) {
+			t.Fatal("expected stale authentication drop reason, got: ", event.Reason)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("did not receive drop event")
+	}
+
+	// Re-authenticating refreshes the authentication time
+	if err := SetAuthorized(device.Address, device.Username); err != nil {
+		t.Fatal(err)
+	}
+
+	if RequiresStepUp(device.Address) {
+		t.Fatal("device should not require step up after re-authenticating")
+	}
+
+	value, _, err := xdpObjects.bpfPrograms.XdpWagFirewall.Test(createPacket(net.ParseIP(device.Address), net.ParseIP("3.3.3.3"), routetypes.TCP, 22))
+	if err != nil {
+		t.Fatalf("program failed %s", err)
+	}
+
+	if value != XDP_PASS {
+		t.Fatalf("expected %s got %s after re-authenticating", result(XDP_PASS), result(value))
+	}
+}
+
+func TestDomainReresolution(t *testing.T) {
+
+	var (
+		addressesLock sync.Mutex
+		addresses     = []net.IP{net.ParseIP("10.0.0.1")}
+		lookupErr     error
+	)
+
+	fakeLookup := func(domain string) ([]net.IP, time.Duration, error) {
+		addressesLock.Lock()
+		defer addressesLock.Unlock()
+
+		if domain != "service.wag.test" {
+			return nil, 0, errors.New("unknown domain " + domain)
+		}
+
+		return addresses, time.Hour, lookupErr
+	}
+
+	defer func(resolver func(string) ([]net.IP, error), lookup func(string) ([]net.IP, time.Duration, error)) {
+		routetypes.Resolver = resolver
+		lookupDomain = lookup
+	}(routetypes.Resolver, lookupDomain)
+
+	lookupDomain = fakeLookup
+	routetypes.Resolver = func(domain string) ([]net.IP, error) {
+		addresses, _, err := fakeLookup(domain)
+		return addresses, err
+	}
+
+	if err := setup("../config/test_domain_rules.json"); err != nil {
+		t.Fatal(err)
+	}
+	defer xdpObjects.Close()
+
+	startDomainResolver()
+	defer stopDomainResolver()
+
+	out, err := addDevices()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	innerMapID := func(username string) (id uint32) {
+		if err := xdpObjects.PoliciesTable.Lookup(sha1.Sum([]byte(username)), &id); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	check := func(allowed, blocked string) {
+		for dst, expected := range map[string]uint32{allowed: XDP_PASS, blocked: XDP_DROP} {
+			value, _, err := xdpObjects.bpfPrograms.XdpWagFirewall.Test(createPacket(net.ParseIP(out[0].Address), net.ParseIP(dst), routetypes.TCP, 443))
+			if err != nil {
+				t.Fatalf("program failed %s", err)
+			}
+
+			if value != expected {
+				t.Fatalf("%s expected %s got %s", dst, result(expected), result(value))
+			}
+		}
+	}
+
+	check("10.0.0.1", "10.0.0.2")
+
+	testerMap, otherMap := innerMapID(out[0].Username), innerMapID(out[1].Username)
+
+	addressesLock.Lock()
+	addresses = []net.IP{net.ParseIP("10.0.0.2")}
+	addressesLock.Unlock()
+
+	refreshDomains(time.Now().Add(2 * time.Hour))
+
+	check("10.0.0.2", "10.0.0.1")
+
+	if innerMapID(out[0].Username) == testerMap {
+		t.Fatal("user with the domain in their acls did not have their rules updated")
+	}
+
+	if innerMapID(out[1].Username) != otherMap {
+		t.Fatal("user without the domain in their acls should not have their rules updated")
+	}
+
+	resolutions := GetDomainResolutions()
+	if len(resolutions.History) != 1 {
+		t.Fatal("expected one resolution change, got: ", resolutions.History)
+	}
+
+	change := resolutions.History[0]
+	if change.Domain != "service.wag.test" || len(change.Added) != 1 || change.Added[0] != "10.0.0.2/32" ||
+		len(change.Removed) != 1 || change.Removed[0] != "10.0.0.1/32" || len(change.Users) != 1 || change.Users[0] != out[0].Username {
+		t.Fatalf("resolution history was incorrect: %+v", change)
+	}
+
+	if len(resolutions.Domains) != 1 || len(resolutions.Domains[0].Addresses) != 1 || resolutions.Domains[0].Addresses[0] != "10.0.0.2" {
+		t.Fatalf("current domain addresses were incorrect: %+v", resolutions.Domains)
+	}
+
+	// Failing to resolve keeps the previous addresses
+	addressesLock.Lock()
+	lookupErr = errors.New("server failure")
+	addressesLock.Unlock()
+
+	refreshDomains(time.Now().Add(4 * time.Hour))
+
+	check("10.0.0.2", "10.0.0.1")
+
+	resolutions = GetDomainResolutions()
+	if len(resolutions.History) != 2 || resolutions.History[1].Error == "" {
+		t.Fatal("failed resolution was not recorded: ", resolutions.History)
+	}
+}
+
+func TestHitlessRefresh(t *testing.T) {
+	if err := setup("../config/test_step_up.json"); err != nil {
+		t.Fatal(err)
+	}
+	defer xdpObjects.Close()
+
+	out, err := addDevices()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	openFiles := func() int {
+		fds, err := os.ReadDir("/proc/self/fd")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(fds)
+	}
+
+	packet := createPacket(net.ParseIP(out[0].Address), net.ParseIP("5.5.5.5"), routetypes.TCP, 22)
+
+	before := openFiles()
+
+	done := make(chan []error)
+	go func() {
+		var errs []error
+		for i := 0; i < 50; i++ {
+			errs = append(errs, RefreshConfiguration()...)
+		}
+		done <- errs
+	}()
+
+	checked := 0
+	for {
+		select {
+		case errs := <-done:
+			if len(errs) != 0 {
+				t.Fatal("refreshing configuration failed: ", errs)
+			}
+
+			if checked == 0 {
+				t.Fatal("no packets were checked while refreshing")
+			}
+
+			// The new maps are owned by the policies table, and the old ones are released
+			if after := openFiles(); after > before+2 {
+				t.Fatalf("refreshing leaked file descriptors, before %d after %d", before, after)
+			}
+
+			return
+		default:
+		}
+
+		value, _, err := xdpObjects.bpfPrograms.XdpWagFirewall.Test(packet)
+		if err != nil {
+			t.Fatalf("program failed %s", err)
+		}
+
+		if value != XDP_PASS {
+			t.Fatalf("packet to unchanged route was dropped during refresh after %d checks", checked)
+		}
+		checked++
+	}
+}
+
+func TestProtocolRules(t *testing.T) {
+	if err := setup("../config/test_protocol_rules.json"); err != nil {
+		t.Fatal(err)
+	}
+	defer xdpObjects.Close()
+
+	out, err := addDevices()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	device := net.ParseIP(out[0].Address)
+	device6 := config.TunnelIPv6Address(device)
+
+	icmp := func(messageType, code int) int {
+		return messageType<<8 | code
+	}
+
+	tests := []struct {
+		packet   []byte
+		expected uint32
+	}{
+		{createPacket(device, net.ParseIP("10.5.5.5"), routetypes.ICMP, icmp(8, 0)), XDP_PASS},
+		{createPacket(device, net.ParseIP("10.5.5.5"), routetypes.ICMP, icmp(13, 0)), XDP_DROP},
+		{createPacket(device, net.ParseIP("10.5.5.5"), routetypes.ICMP, icmp(5, 1)), XDP_DROP},
+		// Replies to an allowed echo request
+		{createPacket(net.ParseIP("10.5.5.5"), device, routetypes.ICMP, icmp(0, 0)), XDP_PASS},
+		// But the device cant send a reply to a host it is only allowed to ping
+		{createPacket(device, net.ParseIP("10.5.5.5"), routetypes.ICMP, icmp(0, 0)), XDP_DROP},
+
+		{createPacket(device, net.ParseIP("10.6.6.6"), routetypes.ICMP, icmp(3, 4)), XDP_PASS},
+		{createPacket(device, net.ParseIP("10.6.6.6"), routetypes.ICMP, icmp(3, 3)), XDP_DROP},
+
+		{createPacket(device, net.ParseIP("10.7.7.7"), routetypes.GRE, 0), XDP_PASS},
+		{createPacket(device, net.ParseIP("10.7.7.7"), routetypes.SCTP, 3868), XDP_PASS},
+		{createPacket(device, net.ParseIP("10.7.7.7"), routetypes.SCTP, 3869), XDP_DROP},
+		{createPacket(device, net.ParseIP("10.7.7.7"), routetypes.ESP, 0), XDP_DROP},
+		{createPacket(device, net.ParseIP("10.7.7.7"), routetypes.TCP, 3868), XDP_DROP},
+
+		// Port ranges for any protocol dont match icmp messages whose type and code happen to be in range
+		{createPacket(device, net.ParseIP("10.8.8.8"), routetypes.SCTP, 80), XDP_PASS},
+		{createPacket(device, net.ParseIP("10.8.8.8"), routetypes.ICMP, icmp(3, 4)), XDP_DROP},
+
+		{createPacket(device, net.ParseIP("10.9.9.9"), routetypes.ICMP, icmp(13, 0)), XDP_PASS},
+
+		{createPacket6(device6, net.ParseIP("2001:db8:bbbb::1"), routetypes.ICMPV6, icmp(128, 0)), XDP_PASS},
+		{createPacket6(net.ParseIP("2001:db8:bbbb::1"), device6, routetypes.ICMPV6, icmp(129, 0)), XDP_PASS},
+		{createPacket6(device6, net.ParseIP("2001:db8:bbbb::1"), routetypes.ICMPV6, icmp(8, 0)), XDP_DROP},
+		{createPacket6(device6, net.ParseIP("2001:db8:bbbb::1"), routetypes.ICMPV6, icmp(135, 0)), XDP_DROP},
+	}
+
+	for i, test := range tests {
+		value, _, err := xdpObjects.bpfPrograms.XdpWagFirewall.Test(test.packet)
+		if err != nil {
+			t.Fatalf("program failed %s", err)
+		}
+
+		if value != test.expected {
+			t.Fatalf("packet %d expected %s got %s", i, result(test.expected), result(value))
+		}
+	}
+
+	rules, err := GetRules()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	policies := strings.Join(rules[out[0].Username].Policies, "\n")
+	for _, expected := range []string{"icmp/echo-request", "icmpv6/echo-request", "icmp/destination-unreachable:4", "any/gre", "3868/sctp"} {
+		if !strings.Contains(policies, expected) {
+			t.Fatalf("firewall listing did not contain %q: %s", expected, policies)
+		}
+	}
+}
+
+func TestPeerRules(t *testing.T) {
+	if err := setup("../config/test_peer_rules.json"); err != nil {
+		t.Fatal(err)
+	}
+	defer xdpObjects.Close()
+
+	defer func(resolver func(string) ([]net.IP, error)) {
+		routetypes.PeerResolver = resolver
+	}(routetypes.PeerResolver)
+	routetypes.PeerResolver = peerAddresses
+
+	out, err := addDevices()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	developer := net.ParseIP(out[0].Address)
+	buildAgent := net.ParseIP(out[1].Address)
+
+	// The build agent device was added after the developers rules were built, as AddPeer does
+	lock.Lock()
+	err = refreshPeerRules(sha1.Sum([]byte(out[1].Username)))
+	lock.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(packet []byte, expected uint32, description string) {
+		t.Helper()
+
+		value, _, err := xdpObjects.bpfPrograms.XdpWagFirewall.Test(packet)
+		if err != nil {
+			t.Fatalf("program failed %s", err)
+		}
+
+		if value != expected {
+			t.Fatalf("%s: expected %s got %s", description, result(expected), result(value))
+		}
+	}
+
+	check(createPacket(developer, buildAgent, routetypes.TCP, 22), XDP_PASS, "developer to build agent ssh")
+	check(createPacket(developer, buildAgent, routetypes.TCP, 23), XDP_DROP, "developer to build agent other port")
+	check(createPacket(developer, buildAgent, routetypes.UDP, 22), XDP_DROP, "developer to build agent udp")
+	check(createPacket6(config.TunnelIPv6Address(developer), config.TunnelIPv6Address(buildAgent), routetypes.TCP, 22), XDP_PASS, "developer to build agent ssh over ipv6")
+
+	// Replies from the build agent are allowed, but the build agent cant start connections to the developer
+	check(reply(createPacket(developer, buildAgent, routetypes.TCP, 22)), XDP_PASS, "build agent ssh reply to developer")
+	check(reply(createPacket(developer, buildAgent, routetypes.TCP, 23)), XDP_DROP, "build agent reply to a dropped connection")
+	check(createPacket(buildAgent, developer, routetypes.TCP, 22), XDP_DROP, "build agent to developer")
+
+	// New devices are added to the rules that use them
+	err = xdpAddDevice(out[1].Username, "192.168.1.4")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check(createPacket(developer, net.ParseIP("192.168.1.4"), routetypes.TCP, 22), XDP_DROP, "new build agent device before rules are refreshed")
+
+	lock.Lock()
+	err = refreshPeerRules(sha1.Sum([]byte(out[1].Username)))
+	lock.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check(createPacket(developer, net.ParseIP("192.168.1.4"), routetypes.TCP, 22), XDP_PASS, "new build agent device")
+
+	err = xdpRemoveDevice("192.168.1.4")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lock.Lock()
+	err = refreshPeerRules(sha1.Sum([]byte(out[1].Username)))
+	lock.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	routes, err := GetRoutes(out[0].Username)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !contains(routes, []string{out[1].Address + "/32"}) || contains(routes, []string{"192.168.1.4/32"}) {
+		t.Fatal("developer rules did not have the current build agent devices: ", routes)
+	}
+
+	// Group members from registration tokens and identity providers are peers too, not just those in the config file
+	config.AddVirtualUser("tokenagent", []string{"group:build-agents"})
+	config.SetIdentityGroups("idpagent", []string{"group:build-agents"})
+	defer config.SetIdentityGroups("idpagent", nil)
+
+	for username, address := range map[string]string{"tokenagent": "192.168.1.5", "idpagent": "192.168.1.6"} {
+		_, err = data.CreateUserDataAccount(username)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = AddUser(username, config.GetEffectiveAcl(username))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = xdpAddDevice(username, address)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		lock.Lock()
+		err = refreshPeerRules(sha1.Sum([]byte(username)))
+		lock.Unlock()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		check(createPacket(developer, net.ParseIP(address), routetypes.TCP, 22), XDP_PASS, username+" build agent device")
+	}
+
+	// Leaving a group at the identity provider removes the users devices from rules that use the group
+	config.SetIdentityGroups("idpagent", nil)
+
+	err = RefreshGroupPeerRules(map[string]bool{"group:build-agents": true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check(createPacket(developer, net.ParseIP("192.168.1.6"), routetypes.TCP, 22), XDP_DROP, "device of user removed from group")
+	check(createPacket(developer, net.ParseIP("192.168.1.5"), routetypes.TCP, 22), XDP_PASS, "device of user still in group")
+}
+
+func TestFlowTracking(t *testing.T) {
+	if err := setup("../config/test_step_up.json"); err != nil {
+		t.Fatal(err)
+	}
+	defer xdpObjects.Close()
+
+	out, err := addDevices()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	device := net.ParseIP(out[0].Address)
+
+	check := func(packet []byte, expected uint32, description string) {
+		t.Helper()
+
+		value, _, err := xdpObjects.bpfPrograms.XdpWagFirewall.Test(packet)
+		if err != nil {
+			t.Fatalf("program failed %s", err)
+		}
+
+		if value != expected {
+			t.Fatalf("%s: expected %s got %s", description, result(expected), result(value))
+		}
+	}
+
+	if err := startDropEventReader(); err != nil {
+		t.Fatal(err)
+	}
+	defer stopDropEventReader()
+
+	events, cancel := SubscribeDropEvents()
+	defer cancel()
+
+	// Allowed hosts cant start connections to the device
+	check(createPacket(net.ParseIP("5.5.5.5"), device, routetypes.TCP, 80), XDP_DROP, "connection from allowed host")
+
+	select {
+	case event := <-events:
+		if event.Reason != dropReason(DropNoFlow) {
+			t.Fatal("expected no flow drop reason, got: ", event.Reason)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("did not receive drop event")
+	}
+
+	request := createPacket(device, net.ParseIP("5.5.5.5"), routetypes.TCP, 80)
+	check(request, XDP_PASS, "connection to allowed host")
+	check(reply(request), XDP_PASS, "reply from allowed host")
+	check(reply(createPacket(device, net.ParseIP("5.5.5.5"), routetypes.TCP, 81)), XDP_DROP, "reply to a different port")
+	check(reply(createPacket(device, net.ParseIP("5.5.5.5"), routetypes.UDP, 80)), XDP_DROP, "reply with a different protocol")
+
+	// Errors about packets the device sent are allowed without a flow, but other icmp messages are not
+	check(createPacket(net.ParseIP("5.5.5.5"), device, routetypes.ICMP, 3<<8|4), XDP_PASS, "icmp fragmentation needed")
+	check(createPacket(net.ParseIP("5.5.5.5"), device, routetypes.ICMP, 8<<8), XDP_DROP, "ping from allowed host")
+
+	flows, err := GetFlows()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found := false
+	for _, flow := range flows {
+		if flow.Destination == "5.5.5.5" && flow.DestinationPort == 80 && flow.Protocol == routetypes.TCP {
+			found = true
+
+			if flow.Device != out[0].Address || flow.Username != out[0].Username || flow.Source != out[0].Address || flow.SourcePort != 3884 {
+				t.Fatalf("flow had incorrect details: %+v", flow)
+			}
+
+			if time.Until(flow.Expires) > 7200*time.Second || time.Until(flow.Expires) < 7100*time.Second {
+				t.Fatalf("flow should expire after the default tcp timeout: %+v", flow)
+			}
+		}
+	}
+
+	if !found {
+		t.Fatalf("flow was not listed: %+v", flows)
+	}
+
+	// Replies are not allowed once the flow times out
+	err = xdpObjects.FlowTimeouts.Put(uint32(0), uint64(time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(5 * time.Millisecond)
+
+	check(reply(request), XDP_DROP, "reply after flow timeout")
+
+	if err := setFlowTimeouts(); err != nil {
+		t.Fatal(err)
+	}
+
+	check(request, XDP_PASS, "connection to allowed host after timeout")
+	check(reply(request), XDP_PASS, "reply after the flow was started again")
+
+	// Replies on mfa routes stop as soon as the session ends, even if there is a flow
+	mfaRequest := createPacket(device, net.ParseIP("4.4.4.4"), routetypes.TCP, 443)
+	check(mfaRequest, XDP_DROP, "connection to mfa host while unauthorised")
+	check(reply(mfaRequest), XDP_DROP, "reply from mfa host while unauthorised")
+
+	if err := SetAuthorized(out[0].Address, out[0].Username); err != nil {
+		t.Fatal(err)
+	}
+
+	check(mfaRequest, XDP_PASS, "connection to mfa host")
+	check(reply(mfaRequest), XDP_PASS, "reply from mfa host")
+
+	if err := Deauthenticate(out[0].Address); err != nil {
+		t.Fatal(err)
+	}
+
+	check(reply(mfaRequest), XDP_DROP, "reply from mfa host after deauthentication")
+}
+
+func TestGatewayRoutes(t *testing.T) {
+	if err := setup("../config/test_step_up.json"); err != nil {
+		t.Fatal(err)
+	}
+	defer xdpObjects.Close()
+
+	out, err := addDevices()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gateway := out[0].Address
+	if err := xdpAddGateway(gateway, []string{"10.50.0.0/24", "fd50::/64"}); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(packet []byte, expected uint32, description string) {
+		t.Helper()
+
+		value, _, err := xdpObjects.bpfPrograms.XdpWagFirewall.Test(packet)
+		if err != nil {
+			t.Fatalf("program failed %s", err)
+		}
+
+		if value != expected {
+			t.Fatalf("%s: expected %s got %s", description, result(expected), result(value))
+		}
+	}
+
+	host := net.ParseIP("10.50.0.7")
+	host6 := net.ParseIP("fd50::7")
+
+	// Hosts behind the gateway have the gateways policies
+	request := createPacket(host, net.ParseIP("5.5.5.5"), routetypes.TCP, 80)
+	check(request, XDP_PASS, "host behind gateway to allowed host")
+	check(reply(request), XDP_PASS, "reply to host behind gateway")
+	check(createPacket6(host6, net.ParseIP("::ffff:5.5.5.5"), routetypes.TCP, 80), XDP_PASS, "ipv6 host behind gateway to allowed host")
+	check(createPacket(net.ParseIP("10.51.0.7"), net.ParseIP("5.5.5.5"), routetypes.TCP, 80), XDP_DROP, "host that is not behind the gateway")
+
+	mfaRequest := createPacket(host, net.ParseIP("4.4.4.4"), routetypes.TCP, 443)
+	check(mfaRequest, XDP_DROP, "host behind unauthorised gateway to mfa host")
+
+	if err := SetAuthorized(gateway, out[0].Username); err != nil {
+		t.Fatal(err)
+	}
+
+	check(mfaRequest, XDP_PASS, "host behind authorised gateway to mfa host")
+
+	flows, err := GetFlows()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found := false
+	for _, flow := range flows {
+		if flow.Source == host.String() && flow.Destination == "5.5.5.5" {
+			found = true
+			if flow.Device != gateway || flow.Username != out[0].Username {
+				t.Fatalf("flow from host behind gateway should belong to the gateway: %+v", flow)
+			}
+		}
+	}
+
+	if !found {
+		t.Fatalf("flow from host behind gateway was not listed: %+v", flows)
+	}
+
+	// Gateways are kept authorised by their handshakes, so do not time out
+	deviceBytes, err := xdpObjects.Devices.LookupBytes(net.ParseIP(gateway).To4())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var deviceStruct fwentry
+	if err := deviceStruct.Unpack(deviceBytes); err != nil {
+		t.Fatal(err)
+	}
+
+	if deviceStruct.flags&deviceGateway == 0 {
+		t.Fatal("authorising the gateway should not clear its flags")
+	}
+
+	deviceStruct.lastPacketTime = 1
+	if err := xdpObjects.Devices.Update(net.ParseIP(gateway).To4(), deviceStruct.Bytes(), ebpf.UpdateExist); err != nil {
+		t.Fatal(err)
+	}
+
+	if !IsAuthed(gateway) {
+		t.Fatal("gateway should not time out")
+	}
+
+	check(mfaRequest, XDP_PASS, "host behind inactive gateway to mfa host")
+
+	if err := xdpRemoveDevice(gateway); err != nil {
+		t.Fatal(err)
+	}
+
+	routes, err := xdpGatewayRoutes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(routes) != 0 {
+		t.Fatalf("removing the gateway should remove its routes: %+v", routes)
+	}
+
+	check(request, XDP_DROP, "host behind removed gateway")
+}
+
+func TestRateLimits(t *testing.T) {
+	if err := setup("../config/test_rate_limits.json"); err != nil {
+		t.Fatal(err)
+	}
+	defer xdpObjects.Close()
+
+	out, err := addDevices()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	/*
+		"*": 1000000 bits/s
+		"group:limited" (tester): 8000 bits/s with a burst of 8000 bits (1000 bytes), the lowest of the "*" and group limits
+		"randomthingappliedtoall": 2000000 bits/s, the users own policy takes precedence
+	*/
+
+	expectedLimits := map[string]config.RateLimit{
+		out[0].Username: {BitsPerSecond: 8000, BurstBits: 8000},
+		out[1].Username: {BitsPerSecond: 2000000, BurstBits: 2000000},
+	}
+
+	rules, err := GetRules()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for username, expected := range expectedLimits {
+		if rules[username].RateLimit == nil || *rules[username].RateLimit != expected {
+			t.Fatalf("%s rate limit was %+v expected %+v", username, rules[username].RateLimit, expected)
+		}
+	}
+
+	sendPackets := func(address string, count int) (passed int, packetSize int) {
+		packet := createPacket(net.ParseIP(address), net.ParseIP("3.3.3.3"), routetypes.TCP, 80)
+
+		for i := 0; i < count; i++ {
+			value, _, err := xdpObjects.bpfPrograms.XdpWagFirewall.Test(packet)
+			if err != nil {
+				t.Fatalf("program failed %s", err)
+			}
+
+			if value == XDP_PASS {
+				passed++
+			}
+		}
+
+		return passed, len(packet)
+	}
+
+	// The bucket allows packets while it has tokens, so at most one packet more than the burst gets through
+	passed, size := sendPackets(out[0].Address, 100)
+	if passed == 0 || passed > 1000/size+2 {
+		t.Fatalf("expected the burst of 1000 bytes (%d packets) to be allowed, %d packets passed", 1000/size, passed)
+	}
+
+	counters, err := GetTrafficCounters()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if counters[out[0].Username].Total.DroppedPackets != uint64(100-passed) {
+		t.Fatalf("rate limited packets should be counted as dropped: %+v", counters[out[0].Username].Total)
+	}
+
+	if passed, _ := sendPackets(out[1].Address, 100); passed != 100 {
+		t.Fatalf("user under their rate limit had packets dropped, %d passed", passed)
+	}
+
+	// Changing the limit resets the users bucket
+	err = setRateLimit(sha1.Sum([]byte(out[0].Username)), &config.RateLimit{BitsPerSecond: 16000})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if passed, _ := sendPackets(out[0].Address, 1); passed != 1 {
+		t.Fatal("bucket was not refilled when the rate limit changed")
+	}
+
+	err = setRateLimit(sha1.Sum([]byte(out[0].Username)), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if passed, _ := sendPackets(out[0].Address, 200); passed != 200 {
+		t.Fatalf("user without a rate limit had packets dropped, %d passed", passed)
+	}
+}
+
+func TestSimulate(t *testing.T) {
+	if err := setup("../config/test_step_up.json"); err != nil {
+		t.Fatal(err)
+	}
+	defer xdpObjects.Close()
+
+	out, err := addDevices()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	/*
+		"Mfa": ["3.3.3.3 22/tcp fresh=15m", "4.4.4.4"],
+		"Allow": ["5.5.5.5"]
+	*/
+
+	simulate := func(destination string, port uint16, protocol string) SimulationResult {
+		t.Helper()
+
+		results, err := Simulate(out[0].Username, net.ParseIP(destination), port, protocol)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(results) != 1 || results[0].Device != out[0].Address {
+			t.Fatalf("expected a result for the users device: %+v", results)
+		}
+
+		return results[0]
+	}
+
+	check := func(result SimulationResult, allowed bool, reason, route, session string) {
+		t.Helper()
+
+		if result.Allowed != allowed || result.Reason != reason || result.Route != route || result.Session != session {
+			t.Fatalf("simulation result was incorrect, expected allowed %t reason %q route %q session %q got %+v", allowed, reason, route, session, result)
+		}
+	}
+
+	before, err := xdpObjects.Devices.LookupBytes(net.ParseIP(out[0].Address).To4())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check(simulate("5.5.5.5", 80, "tcp"), true, "", "5.5.5.5/32", SessionUnauthorised)
+	check(simulate("5.5.5.5", 0, "icmp"), true, "", "5.5.5.5/32", SessionUnauthorised)
+	check(simulate("4.4.4.4", 80, "tcp"), false, dropReason(DropUnauthorised), "4.4.4.4/32", SessionUnauthorised)
+	check(simulate("3.3.3.3", 23, "tcp"), false, dropReason(DropNoPolicy), "", SessionUnauthorised)
+	check(simulate("6.6.6.6", 80, "udp"), false, dropReason(DropNoRoute), "", SessionUnauthorised)
+
+	if result := simulate("5.5.5.5", 80, "tcp"); !strings.HasPrefix(result.Policy, "public") {
+		t.Fatal("expected the public policy to be reported: ", result.Policy)
+	}
+
+	// Simulating must not change the firewall state
+	after, err := xdpObjects.Devices.LookupBytes(net.ParseIP(out[0].Address).To4())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(before, after) {
+		t.Fatal("simulating packets changed the device")
+	}
+
+	counters, err := GetTrafficCounters()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if counters[out[0].Username].Total != (TrafficCounters{}) {
+		t.Fatalf("simulated packets were counted: %+v", counters[out[0].Username].Total)
+	}
+
+	flows, err := GetFlows()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(flows) != 0 {
+		t.Fatalf("simulated packets created flows: %+v", flows)
+	}
+
+	if err := SetAuthorized(out[0].Address, out[0].Username); err != nil {
+		t.Fatal(err)
+	}
+
+	check(simulate("4.4.4.4", 80, "tcp"), true, "", "4.4.4.4/32", SessionAuthorised)
+	check(simulate("3.3.3.3", 22, "tcp"), true, "", "3.3.3.3/32", SessionAuthorised)
+
+	if err := xdpObjects.AccountLocked.Put(sha1.Sum([]byte(out[0].Username)), uint32(1)); err != nil {
+		t.Fatal(err)
+	}
+
+	check(simulate("4.4.4.4", 80, "tcp"), false, dropReason(DropAccountLocked), "4.4.4.4/32", SessionAccountLocked)
+
+	if _, err := Simulate("nobody", net.ParseIP("5.5.5.5"), 80, "tcp"); err == nil {
+		t.Fatal("simulating for a user without devices should fail")
+	}
+
+	if _, err := Simulate(out[0].Username, net.ParseIP("5.5.5.5"), 80, "notaprotocol"); err == nil {
+		t.Fatal("simulating an unknown protocol should fail")
+	}
+}
@@ -0,0 +1,208 @@
+package router
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/NHAS/wag/internal/data"
+	"github.com/cilium/ebpf/ringbuf"
+)
+
+// Drop reasons, these must match the DROP_* definitions in xdp.c
+const (
+	DropNoDevice       = 1
+	DropNoAccount      = 2
+	DropNoRoute        = 3
+	DropNoPolicy       = 4
+	DropUnauthorised   = 5
+	DropAccountLocked  = 6
+	DropDenied         = 7
+	DropStaleAuth      = 8
+	DropNoFlow         = 9
+	DropRateLimited    = 10
+	dropEventSizeBytes = 56
+)
+
+var (
+	dropEventReader *ringbuf.Reader
+
+	dropSubscribersLock sync.RWMutex
+	dropSubscribers     = map[chan DropEvent]bool{}
+)
+
+// DropEvent is a (rate limited) record of a packet that the xdp firewall dropped
+type DropEvent struct {
+	Time time.Time
+
+	// The device and user involved, empty if neither the source or destination was a device
+	Device   string `json:",omitempty"`
+	Username string `json:",omitempty"`
+
+	Source          string
+	SourcePort      uint16
+	Destination     string
+	DestinationPort uint16
+	Protocol        uint32
+
+	Reason string
+
+	// Number of drops that were not reported due to rate limiting, before this event
+	Suppressed uint64 `json:",omitempty"`
+}
+
+func dropReason(reason uint32) string {
+	switch reason {
+	case DropNoDevice:
+		return "no device"
+	case DropNoAccount:
+		return "no account"
+	case DropNoRoute:
+		return "no matching route"
+	case DropNoPolicy:
+		return "no matching policy"
+	case DropUnauthorised:
+		return "mfa route, device not authorised"
+	case DropAccountLocked:
+		return "mfa route, account locked"
+	case DropDenied:
+		return "denied by policy"
+	case DropStaleAuth:
+		return "mfa route, authentication not fresh"
+	case DropNoFlow:
+		return "not part of a flow started by the device"
+	case DropRateLimited:
+		return "over the users rate limit"
+	default:
+		return "unknown"
+	}
+}
+
+// Unpack the C struct drop_event
+func (e *DropEvent) Unpack(b []byte) error {
+	if len(b) < dropEventSizeBytes {
+		return errors.New("drop event too short")
+	}
+
+	e.Source = net.IP(b[0:16]).String()
+	e.Destination = net.IP(b[16:32]).String()
+
+	if !bytes.Equal(b[32:36], []byte{0, 0, 0, 0}) {
+		e.Device = net.IP(b[32:36]).String()
+	}
+
+	e.SourcePort = binary.LittleEndian.Uint16(b[36:38])
+	e.DestinationPort = binary.LittleEndian.Uint16(b[38:40])
+	e.Protocol = binary.LittleEndian.Uint32(b[40:44])
+	e.Reason = dropReason(binary.LittleEndian.Uint32(b[44:48]))
+	e.Suppressed = binary.LittleEndian.Uint64(b[48:56])
+
+	return nil
+}
+
+// SubscribeDropEvents returns a channel of drop events, and a function to call to stop receiving them
+// If the subscriber doesnt keep up with events, they are discarded
+func SubscribeDropEvents() (<-chan DropEvent, func()) {
+	events := make(chan DropEvent, 100)
+
+	dropSubscribersLock.Lock()
+	dropSubscribers[events] = true
+	dropSubscribersLock.Unlock()
+
+	return events, func() {
+		dropSubscribersLock.Lock()
+		defer dropSubscribersLock.Unlock()
+
+		if dropSubscribers[events] {
+			delete(dropSubscribers, events)
+			close(events)
+		}
+	}
+}
+
+func startDropEventReader() error {
+	var err error
+	dropEventReader, err = ringbuf.NewReader(xdpObjects.DropEvents)
+	if err != nil {
+		return errors.New("unable to read drop events: " + err.Error())
+	}
+
+	go func(reader *ringbuf.Reader) {
+		usernames := map[[20]byte]string{}
+		for {
+			record, err := reader.Read()
+			if err != nil {
+				if !errors.Is(err, ringbuf.ErrClosed) {
+					log.Println("drop event reader failed: ", err)
+				}
+				return
+			}
+
+			var event DropEvent
+			if err := event.Unpack(record.RawSample); err != nil {
+				log.Println("unable to unpack drop event: ", err)
+				continue
+			}
+			event.Time = time.Now()
+
+			if event.Device != "" {
+				event.Username = deviceOwner(record.RawSample[32:36], usernames)
+			}
+
+			dropSubscribersLock.RLock()
+			for subscriber := range dropSubscribers {
+				select {
+				case subscriber <- event:
+				default:
+				}
+			}
+			dropSubscribersLock.RUnlock()
+		}
+	}(dropEventReader)
+
+	return nil
+}
+
+// Get the username that owns a device from the firewall maps, usernames is a cache of user id to username
+// that is refreshed from the database if the user id is not known
+func deviceOwner(address []byte, usernames map[[20]byte]string) string {
+	lock.RLock()
+	defer lock.RUnlock()
+
+	var device fwentry
+	deviceBytes := make([]byte, device.Size())
+
+	if xdpObjects.Devices.Lookup(address, &deviceBytes) != nil {
+		return ""
+	}
+
+	if err := device.Unpack(deviceBytes); err != nil {
+		return ""
+	}
+
+	if username, ok := usernames[device.user_id]; ok {
+		return username
+	}
+
+	users, err := data.GetAllUsers()
+	if err != nil {
+		return ""
+	}
+
+	for _, user := range users {
+		usernames[user.GetID()] = user.Username
+	}
+
+	return usernames[device.user_id]
+}
+
+func stopDropEventReader() {
+	if dropEventReader != nil {
+		dropEventReader.Close()
+		dropEventReader = nil
+	}
+}
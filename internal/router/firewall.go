@@ -0,0 +1,24 @@
+package router
+
+import "github.com/NHAS/wag/internal/config"
+
+// The xdp firewall decides what devices can reach, but wag also needs the host to forward and NAT tunnel traffic, and to only accept input from the tunnel for
+// its own services. A host firewall backend manages those rules
+type firewallBackend interface {
+	// Lines logged on startup describing what the backend changed
+	description() []string
+
+	apply() error
+
+	// Remove everything apply added, failures are logged as wag may be shutting down
+	remove()
+}
+
+// The backend selected by Firewall.Backend
+func hostFirewallBackend() firewallBackend {
+	if config.Values().Firewall.Backend == config.NftablesBackend {
+		return nftablesBackend{}
+	}
+
+	return iptablesBackend{}
+}
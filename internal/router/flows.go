@@ -0,0 +1,137 @@
+package router
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/NHAS/wag/internal/config"
+	"github.com/NHAS/wag/internal/routetypes"
+	"golang.org/x/sys/unix"
+)
+
+// The xdp firewall records flows started by devices, traffic back to a device is only allowed if it is part of a flow that has not timed out
+// Flows are kept in an LRU map, so when it is full the least recently used flows are replaced
+
+const (
+	flowKeySizeBytes   = 40
+	flowValueSizeBytes = 16
+)
+
+// Flow is a connection started by a device
+type Flow struct {
+	// The tunnel address of the device that started the flow (the gateway for hosts behind one), and the user that owns it
+	Device   string
+	Username string `json:",omitempty"`
+
+	Source          string
+	SourcePort      uint16
+	Destination     string
+	DestinationPort uint16
+	Protocol        uint32
+
+	Created  time.Time
+	LastSeen time.Time
+	Expires  time.Time
+}
+
+// Sets the flow timeouts in the firewall, the order must match the FLOW_TIMEOUT_* definitions in xdp.c
+func setFlowTimeouts() error {
+	for index, proto := range []uint32{routetypes.TCP, routetypes.UDP, routetypes.ANY} {
+		err := xdpObjects.FlowTimeouts.Put(uint32(index), uint64(flowTimeout(proto)))
+		if err != nil {
+			return fmt.Errorf("could not set flow timeouts: %s", err)
+		}
+	}
+
+	return nil
+}
+
+func flowTimeout(proto uint32) time.Duration {
+	timeouts := config.Values().Firewall.FlowTimeouts
+
+	switch proto {
+	case routetypes.TCP:
+		return time.Duration(timeouts.TCPSeconds) * time.Second
+	case routetypes.UDP:
+		return time.Duration(timeouts.UDPSeconds) * time.Second
+	default:
+		return time.Duration(timeouts.OtherSeconds) * time.Second
+	}
+}
+
+// Converts a time from bpf_ktime_get_ns (CLOCK_MONOTONIC) to wall clock time
+func ktimeToTime(ktime uint64) time.Time {
+	return time.Now().Add(-time.Duration(ktimeNow() - ktime))
+}
+
+func ktimeNow() uint64 {
+	var now unix.Timespec
+	unix.ClockGettime(unix.CLOCK_MONOTONIC, &now)
+
+	return uint64(now.Nano())
+}
+
+// Unpack the C struct flow_key, and struct flow
+func (f *Flow) Unpack(key, value []byte) error {
+	if len(key) < flowKeySizeBytes || len(value) < flowValueSizeBytes {
+		return errors.New("flow too short")
+	}
+
+	// Both ipv4-mapped and ipv6 tunnel addresses have the devices ipv4 address as the lower 32 bits
+	f.Device = net.IP(key[12:16]).String()
+
+	f.Source = net.IP(key[0:16]).String()
+	f.Destination = net.IP(key[16:32]).String()
+	f.SourcePort = binary.BigEndian.Uint16(key[32:34])
+	f.DestinationPort = binary.BigEndian.Uint16(key[34:36])
+	f.Protocol = binary.LittleEndian.Uint32(key[36:40])
+
+	f.Created = ktimeToTime(binary.LittleEndian.Uint64(value[0:8]))
+	f.LastSeen = ktimeToTime(binary.LittleEndian.Uint64(value[8:16]))
+	f.Expires = f.LastSeen.Add(flowTimeout(f.Protocol))
+
+	return nil
+}
+
+// GetFlows returns the flows started by devices that have not timed out
+func GetFlows() ([]Flow, error) {
+
+	var (
+		key   [flowKeySizeBytes]byte
+		value [flowValueSizeBytes]byte
+	)
+
+	now := ktimeNow()
+	usernames := map[[20]byte]string{}
+
+	flows := []Flow{}
+
+	iter := xdpObjects.Flows.Iterate()
+	for iter.Next(&key, &value) {
+		if now-binary.LittleEndian.Uint64(value[8:16]) >= uint64(flowTimeout(binary.LittleEndian.Uint32(key[36:40]))) {
+			continue
+		}
+
+		var flow Flow
+		if err := flow.Unpack(key[:], value[:]); err != nil {
+			return nil, err
+		}
+
+		if gateway := routingGateway(net.IP(key[0:16])); gateway != nil {
+			flow.Device = gateway.String()
+		}
+
+		flow.Username = deviceOwner(net.ParseIP(flow.Device).To4(), usernames)
+
+		flows = append(flows, flow)
+	}
+
+	if iter.Err() != nil {
+		return nil, errors.New("iterating flows: " + iter.Err().Error())
+	}
+
+	return flows, nil
+}
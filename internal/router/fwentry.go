@@ -5,47 +5,58 @@ import (
 	"errors"
 )
 
+// Device flags, the same as in xdp.c
+const (
+	// The device routes traffic for networks behind it, and is authorised by completing wireguard handshakes
+	deviceGateway uint32 = 1
+)
+
 // Firewall entry for a device
 type fwentry struct {
 	sessionExpiry  uint64
 	lastPacketTime uint64
 
+	// When the device last completed mfa, used by routes that require step up authentication
+	lastAuthTime uint64
+
 	// Hash of username (sha1 20 bytes)
 	// Essentially allows us to compress all usernames, if collisions are a problem in the future we'll move to sha256 or xxhash
 	user_id [20]byte
 
-	pad uint32
+	flags uint32
 }
 
 func (d fwentry) Size() int {
-	return 40 // 8 + 8 + 20 + 4
+	return 48 // 8 + 8 + 8 + 20 + 4
 }
 
 func (d fwentry) Bytes() []byte {
 
-	output := make([]byte, 40)
+	output := make([]byte, d.Size())
 
 	binary.LittleEndian.PutUint64(output[0:8], d.sessionExpiry)
 	binary.LittleEndian.PutUint64(output[8:16], d.lastPacketTime)
+	binary.LittleEndian.PutUint64(output[16:24], d.lastAuthTime)
 
-	copy(output[16:36], d.user_id[:])
+	copy(output[24:44], d.user_id[:])
 
-	binary.LittleEndian.PutUint32(output[36:], d.pad)
+	binary.LittleEndian.PutUint32(output[44:], d.flags)
 
 	return output
 }
 
 func (d *fwentry) Unpack(b []byte) error {
-	if len(b) != 40 {
+	if len(b) != d.Size() {
 		return errors.New("too short")
 	}
 
 	d.sessionExpiry = binary.LittleEndian.Uint64(b[:8])
 	d.lastPacketTime = binary.LittleEndian.Uint64(b[8:16])
+	d.lastAuthTime = binary.LittleEndian.Uint64(b[16:24])
 
-	copy(d.user_id[:], b[16:36])
+	copy(d.user_id[:], b[24:44])
 
-	d.pad = binary.LittleEndian.Uint32(b[36:])
+	d.flags = binary.LittleEndian.Uint32(b[44:])
 
 	return nil
 }
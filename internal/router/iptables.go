@@ -2,6 +2,10 @@ package router
 
 import (
 	"errors"
+	"fmt"
+	"log"
+	"net"
+	"regexp"
 	"strings"
 
 	"github.com/NHAS/wag/internal/config"
@@ -9,41 +13,102 @@ import (
 	"github.com/coreos/go-iptables/iptables"
 )
 
-func setupIptables() error {
+// Arguments to match icmp echo requests for each protocol
+var (
+	icmpEcho   = []string{"-p", "icmp", "--icmp-type", "8"}
+	icmpv6Echo = []string{"-p", "ipv6-icmp", "--icmpv6-type", "128"}
+)
+
+// Wag keeps its rules in its own chains, which are reached by a single jump rule from each of the builtin chains
+const (
+	forwardChain = "WAG-FORWARD"
+	inputChain   = "WAG-INPUT"
+	natChain     = "WAG-NAT"
+
+	// Older versions of wag set the FORWARD policy to DROP, and kept the previous policy in a comment on the FORWARD jump rule. Wag no longer
+	// changes the policy, but still restores it when removing a jump left by an older version
+	previousPolicyComment = "wag previous policy "
+)
+
+var previousPolicyRegex = regexp.MustCompile(previousPolicyComment + `([A-Z]+)`)
+
+type iptablesBackend struct{}
+
+func (iptablesBackend) description() []string {
+	return []string{
+		"Allow Iptables FORWARDS from wireguard device, and only established or related FORWARDS to it (" + forwardChain + ")",
+		"Allow input to VPN host (" + inputChain + ")",
+	}
+}
+
+func (iptablesBackend) apply() error {
 	ipt, err := iptables.New()
 	if err != nil {
 		return err
 	}
 
-	devName := config.Values().Wireguard.DevName
+	err = applyIptables(ipt, config.Values().Wireguard.Range, icmpEcho)
+	if err != nil {
+		return err
+	}
 
-	//So. This to the average person will look like we say "Hey server forward anything and everything from the wireguard interface"
-	//And without the xdp ebpf program it would be, however if you look at xdp.c you can see that we can manipluate maps of addresses for each user
-	//This then controls whether the packet is dropped, but we still need iptables to do the higher level routing stuffs
+	if config.Values().Wireguard.Range6 != nil {
+		ip6t, err := iptables.NewWithProtocol(iptables.ProtocolIPv6)
+		if err != nil {
+			return err
+		}
+
+		err = applyIptables(ip6t, config.Values().Wireguard.Range6, icmpv6Echo)
+		if err != nil {
+			return errors.New("unable to apply ip6tables rules: " + err.Error())
+		}
+	}
 
-	err = ipt.ChangePolicy("filter", "FORWARD", "DROP")
+	return nil
+}
+
+func applyIptables(ipt *iptables.IPTables, tunnelRange *net.IPNet, icmpEcho []string) error {
+
+	devName := config.Values().Wireguard.DevName
+
+	// Anything left behind by a previous run is removed first, which also restores the FORWARD policy if an older version changed it
+	err := removeIptables(ipt)
 	if err != nil {
 		return err
 	}
 
-	err = ipt.Append("filter", "FORWARD", "-m", "conntrack", "--ctstate", "RELATED,ESTABLISHED", "-j", "ACCEPT")
+	for table, chains := range map[string][]string{"filter": {forwardChain, inputChain}, "nat": {natChain}} {
+		for _, chain := range chains {
+			err = ipt.NewChain(table, chain)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	//So. This to the average person will look like we say "Hey server forward anything and everything from the wireguard interface"
+	//And without the xdp ebpf program it would be, however if you look at xdp.c you can see that we can manipluate maps of addresses for each user
+	//This then controls whether the packet is dropped, but we still need iptables to do the higher level routing stuffs
+
+	err = ipt.Append("filter", forwardChain, "-i", devName, "-j", "ACCEPT")
 	if err != nil {
 		return err
 	}
 
-	err = ipt.Append("filter", "FORWARD", "-i", devName, "-j", "ACCEPT")
+	// The xdp program only sees packets arriving from the tunnel, so connections from outside the tunnel to devices are stopped here
+	err = ipt.Append("filter", forwardChain, "-o", devName, "-m", "conntrack", "--ctstate", "RELATED,ESTABLISHED", "-j", "ACCEPT")
 	if err != nil {
 		return err
 	}
 
-	err = ipt.Append("filter", "FORWARD", "-o", devName, "-j", "ACCEPT")
+	err = ipt.Append("filter", forwardChain, "-o", devName, "-j", "DROP")
 	if err != nil {
 		return err
 	}
 
 	shouldNAT := config.Values().NAT == nil || (config.Values().NAT != nil && *config.Values().NAT)
 	if shouldNAT {
-		err = ipt.Append("nat", "POSTROUTING", "-s", config.Values().Wireguard.Range.String(), "-j", "MASQUERADE")
+		err = ipt.Append("nat", natChain, "-s", tunnelRange.String(), "-j", "MASQUERADE")
 		if err != nil {
 			return err
 		}
@@ -51,7 +116,7 @@ func setupIptables() error {
 
 	if !config.Values().Proxied {
 		//Allow input to authorize web server on the tunnel, if we're not behind a proxy
-		err = ipt.Append("filter", "INPUT", "-m", "tcp", "-p", "tcp", "-i", devName, "--dport", config.Values().Webserver.Tunnel.Port, "-j", "ACCEPT")
+		err = ipt.Append("filter", inputChain, "-m", "tcp", "-p", "tcp", "-i", devName, "--dport", config.Values().Webserver.Tunnel.Port, "-j", "ACCEPT")
 		if err != nil {
 			return err
 		}
@@ -63,26 +128,145 @@ func setupIptables() error {
 			return errors.New(port + " is not in a valid port format. E.g 80/tcp")
 		}
 
-		err = ipt.Append("filter", "INPUT", "-m", parts[1], "-p", parts[1], "-i", devName, "--dport", parts[0], "-j", "ACCEPT")
+		err = ipt.Append("filter", inputChain, "-m", parts[1], "-p", parts[1], "-i", devName, "--dport", parts[0], "-j", "ACCEPT")
 		if err != nil {
 			return err
 		}
 	}
 
-	err = ipt.Append("filter", "INPUT", "-p", "icmp", "--icmp-type", "8", "-i", devName, "-m", "state", "--state", "NEW,ESTABLISHED,RELATED", "-j", "ACCEPT")
+	err = ipt.Append("filter", inputChain, append(icmpEcho, "-i", devName, "-m", "state", "--state", "NEW,ESTABLISHED,RELATED", "-j", "ACCEPT")...)
+	if err != nil {
+		return err
+	}
+
+	err = ipt.Append("filter", inputChain, "-i", devName, "-m", "conntrack", "--ctstate", "RELATED,ESTABLISHED", "-j", "ACCEPT")
+	if err != nil {
+		return err
+	}
+
+	err = ipt.Append("filter", inputChain, "-i", devName, "-j", "DROP")
+	if err != nil {
+		return err
+	}
+
+	// The FORWARD policy is left alone so other forwarding on the host is unaffected. Wags chain goes first so its drop of connections into the tunnel
+	// cannot be bypassed by an earlier accept
+	err = ipt.Insert("filter", "FORWARD", 1, "-j", forwardChain)
+	if err != nil {
+		return err
+	}
+
+	err = ipt.Append("filter", "INPUT", "-j", inputChain)
+	if err != nil {
+		return err
+	}
+
+	return ipt.Append("nat", "POSTROUTING", "-j", natChain)
+}
+
+// The jump from FORWARD to wags chain added by older versions, which records the policy FORWARD had before they set it to DROP
+func forwardJump(previousPolicy string) []string {
+	return []string{"-m", "comment", "--comment", previousPolicyComment + previousPolicy, "-j", forwardChain}
+}
+
+// The policy recorded in a FORWARD jump rule by older versions, as listed by iptables -S. Returns false if the rule is not a jump to wags chain
+func parseForwardJump(rule string) (previousPolicy string, ok bool) {
+	fields := strings.Fields(rule)
+	if len(fields) < 2 || fields[len(fields)-2] != "-j" || fields[len(fields)-1] != forwardChain {
+		return "", false
+	}
+
+	match := previousPolicyRegex.FindStringSubmatch(rule)
+	if match == nil {
+		return "", true
+	}
+
+	return match[1], true
+}
+
+func (iptablesBackend) remove() {
+	ipt, err := iptables.New()
+	if err != nil {
+		log.Println("Unable to clean up firewall rules: ", err)
+		return
+	}
+
+	if err := removeIptables(ipt); err != nil {
+		log.Println("Unable to clean up firewall rules: ", err)
+	}
+
+	if config.Values().Wireguard.Range6 != nil {
+		ip6t, err := iptables.NewWithProtocol(iptables.ProtocolIPv6)
+		if err != nil {
+			log.Println("Unable to clean up ip6tables firewall rules: ", err)
+			return
+		}
+
+		if err := removeIptables(ip6t); err != nil {
+			log.Println("Unable to clean up ip6tables firewall rules: ", err)
+		}
+	}
+}
+
+// Removes the jumps to wags chains and the chains themselves, and restores the FORWARD policy if an older version recorded one
+// Does nothing if wags chains do not exist
+func removeIptables(ipt *iptables.IPTables) error {
+	rules, err := ipt.List("filter", "FORWARD")
 	if err != nil {
 		return err
 	}
 
-	err = ipt.Append("filter", "INPUT", "-i", devName, "-m", "conntrack", "--ctstate", "RELATED,ESTABLISHED", "-j", "ACCEPT")
+	for _, rule := range rules {
+		previousPolicy, ok := parseForwardJump(rule)
+		if !ok {
+			continue
+		}
+
+		jump := []string{"-j", forwardChain}
+		if previousPolicy != "" {
+			jump = forwardJump(previousPolicy)
+		}
+
+		err = ipt.Delete("filter", "FORWARD", jump...)
+		if err != nil {
+			return err
+		}
+
+		if previousPolicy != "" {
+			err = ipt.ChangePolicy("filter", "FORWARD", previousPolicy)
+			if err != nil {
+				return fmt.Errorf("unable to restore FORWARD policy to %s: %s", previousPolicy, err)
+			}
+		}
+	}
+
+	err = ipt.DeleteIfExists("filter", "INPUT", "-j", inputChain)
 	if err != nil {
 		return err
 	}
 
-	err = ipt.Append("filter", "INPUT", "-i", devName, "-j", "DROP")
+	err = ipt.DeleteIfExists("nat", "POSTROUTING", "-j", natChain)
 	if err != nil {
 		return err
 	}
 
+	for table, chains := range map[string][]string{"filter": {forwardChain, inputChain}, "nat": {natChain}} {
+		for _, chain := range chains {
+			exists, err := ipt.ChainExists(table, chain)
+			if err != nil {
+				return err
+			}
+
+			if !exists {
+				continue
+			}
+
+			err = ipt.ClearAndDeleteChain(table, chain)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
 	return nil
 }
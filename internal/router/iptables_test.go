@@ -0,0 +1,22 @@
+package router
+
+import "testing"
+
+func TestParseForwardJump(t *testing.T) {
+	for rule, expected := range map[string]struct {
+		policy string
+		ok     bool
+	}{
+		`-A FORWARD -m comment --comment "wag previous policy ACCEPT" -j WAG-FORWARD`: {"ACCEPT", true},
+		`-A FORWARD -m comment --comment "wag previous policy DROP" -j WAG-FORWARD`:   {"DROP", true},
+		`-A FORWARD -j WAG-FORWARD`:       {"", true},
+		`-A FORWARD -i wg0 -j ACCEPT`:     {"", false},
+		`-A FORWARD -j WAG-FORWARD-OTHER`: {"", false},
+		`-P FORWARD DROP`:                 {"", false},
+	} {
+		policy, ok := parseForwardJump(rule)
+		if policy != expected.policy || ok != expected.ok {
+			t.Fatalf("%q: expected (%q, %t) got (%q, %t)", rule, expected.policy, expected.ok, policy, ok)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package router
+
+import (
+	"fmt"
+	"log"
+	"os/exec"
+	"strings"
+
+	"github.com/NHAS/wag/internal/config"
+)
+
+// All of wags rules are kept in a single inet table, so nothing outside of it is changed and removing the rules is deleting the table
+// Rulesets are applied with nft -f, which replaces the table in one transaction
+type nftablesBackend struct{}
+
+// The name of the table wag uses for the wireguard device, device names may contain characters that nft does not allow in identifiers
+func nftablesTable() string {
+	name := []rune(config.Values().Wireguard.DevName)
+	for i, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_') {
+			name[i] = '_'
+		}
+	}
+
+	return "wag_" + string(name)
+}
+
+func (nftablesBackend) description() []string {
+	return []string{
+		"Using nftables table inet " + nftablesTable(),
+		"Allow forwards from wireguard device, and only established or related forwards to it",
+		"Allow input to VPN host",
+	}
+}
+
+func (nftablesBackend) apply() error {
+	ruleset, err := nftablesRuleset()
+	if err != nil {
+		return err
+	}
+
+	return runNft(ruleset)
+}
+
+func (nftablesBackend) remove() {
+	if err := runNft("delete table inet " + nftablesTable() + "\n"); err != nil {
+		log.Println("Unable to clean up nftables table: ", err)
+	}
+}
+
+// Builds the nft script that replaces wags table. What devices can reach is decided by the xdp firewall, but it only sees packets arriving from the
+// tunnel, so the table drops connections started from outside the tunnel to devices. It also adds NAT and restricts what the tunnel can reach on the host,
+// the same as the iptables rules
+func nftablesRuleset() (string, error) {
+	devName := config.Values().Wireguard.DevName
+	table := nftablesTable()
+
+	var ruleset strings.Builder
+
+	// Creating the table first means the delete always succeeds, so the whole script is a replacement of the table
+	fmt.Fprintf(&ruleset, "table inet %s\n", table)
+	fmt.Fprintf(&ruleset, "delete table inet %s\n\n", table)
+
+	fmt.Fprintf(&ruleset, "table inet %s {\n", table)
+
+	shouldNAT := config.Values().NAT == nil || (config.Values().NAT != nil && *config.Values().NAT)
+	if shouldNAT {
+		ruleset.WriteString("\tchain postrouting {\n")
+		ruleset.WriteString("\t\ttype nat hook postrouting priority srcnat; policy accept;\n")
+		fmt.Fprintf(&ruleset, "\t\tip saddr %s masquerade\n", config.Values().Wireguard.Range.String())
+
+		if config.Values().Wireguard.Range6 != nil {
+			fmt.Fprintf(&ruleset, "\t\tip6 saddr %s masquerade\n", config.Values().Wireguard.Range6.String())
+		}
+
+		ruleset.WriteString("\t}\n\n")
+	}
+
+	ruleset.WriteString("\tchain forward {\n")
+	ruleset.WriteString("\t\ttype filter hook forward priority filter; policy accept;\n")
+	// Traffic between devices is checked by the xdp firewall as it enters the tunnel
+	fmt.Fprintf(&ruleset, "\t\tiifname %q accept\n", devName)
+	fmt.Fprintf(&ruleset, "\t\toifname %q ct state related,established accept\n", devName)
+	fmt.Fprintf(&ruleset, "\t\toifname %q drop\n", devName)
+	ruleset.WriteString("\t}\n\n")
+
+	ruleset.WriteString("\tchain input {\n")
+	ruleset.WriteString("\t\ttype filter hook input priority filter; policy accept;\n")
+
+	if !config.Values().Proxied {
+		//Allow input to authorize web server on the tunnel, if we're not behind a proxy
+		fmt.Fprintf(&ruleset, "\t\tiifname %q tcp dport %s accept\n", devName, config.Values().Webserver.Tunnel.Port)
+	}
+
+	for _, port := range config.Values().ExposePorts {
+		parts := strings.Split(port, "/")
+		if len(parts) < 2 {
+			return "", fmt.Errorf("%s is not in a valid port format. E.g 80/tcp", port)
+		}
+
+		fmt.Fprintf(&ruleset, "\t\tiifname %q %s dport %s accept\n", devName, strings.ToLower(parts[1]), parts[0])
+	}
+
+	fmt.Fprintf(&ruleset, "\t\tiifname %q icmp type echo-request accept\n", devName)
+	if config.Values().Wireguard.Range6 != nil {
+		fmt.Fprintf(&ruleset, "\t\tiifname %q icmpv6 type echo-request accept\n", devName)
+	}
+
+	fmt.Fprintf(&ruleset, "\t\tiifname %q ct state related,established accept\n", devName)
+	fmt.Fprintf(&ruleset, "\t\tiifname %q drop\n", devName)
+	ruleset.WriteString("\t}\n")
+
+	ruleset.WriteString("}\n")
+
+	return ruleset.String(), nil
+}
+
+func runNft(script string) error {
+	cmd := exec.Command("nft", "-f", "-")
+	cmd.Stdin = strings.NewReader(script)
+
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("nft failed: %s: %s", err, strings.TrimSpace(string(output)))
+	}
+
+	return nil
+}
@@ -0,0 +1,74 @@
+package router
+
+import (
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/NHAS/wag/internal/config"
+)
+
+func TestNftablesRuleset(t *testing.T) {
+	if err := config.Load("../config/test_ipv6.json"); err != nil {
+		t.Fatal(err)
+	}
+
+	ruleset, err := nftablesRuleset()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	devName := config.Values().Wireguard.DevName
+	table := nftablesTable()
+
+	if !strings.HasPrefix(ruleset, "table inet "+table+"\ndelete table inet "+table+"\n") {
+		t.Fatal("ruleset should replace the whole table: ", ruleset)
+	}
+
+	for _, expected := range []string{
+		"ip saddr " + config.Values().Wireguard.Range.String() + " masquerade",
+		"ip6 saddr " + config.Values().Wireguard.Range6.String() + " masquerade",
+		"iifname \"" + devName + "\" tcp dport " + config.Values().Webserver.Tunnel.Port + " accept",
+		"iifname \"" + devName + "\" icmpv6 type echo-request accept",
+		"iifname \"" + devName + "\" drop",
+		"iifname \"" + devName + "\" accept\n\t\toifname \"" + devName + "\" ct state related,established accept\n\t\toifname \"" + devName + "\" drop",
+	} {
+		if !strings.Contains(ruleset, expected) {
+			t.Fatalf("ruleset did not contain %q: %s", expected, ruleset)
+		}
+	}
+
+	// Nothing outside of wags table is changed
+	if strings.Count(ruleset, "table ") != 3 || strings.Contains(ruleset, "policy drop") {
+		t.Fatal("ruleset should only contain wags table: ", ruleset)
+	}
+
+	// The drops must come after the rules accepting tunnel traffic
+	if strings.Index(ruleset, "iifname \""+devName+"\" drop") < strings.Index(ruleset, "iifname \""+devName+"\" ct state related,established accept") ||
+		strings.Index(ruleset, "oifname \""+devName+"\" drop") < strings.Index(ruleset, "oifname \""+devName+"\" ct state related,established accept") {
+		t.Fatal("drop rule was before the accept rules: ", ruleset)
+	}
+}
+
+func TestNftablesRulesetSyntax(t *testing.T) {
+	if _, err := exec.LookPath("nft"); err != nil {
+		t.Skip("nft is not installed")
+	}
+
+	if err := config.Load("../config/test_ipv6.json"); err != nil {
+		t.Fatal(err)
+	}
+
+	ruleset, err := nftablesRuleset()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// -c only checks the ruleset, nothing is applied
+	cmd := exec.Command("nft", "-c", "-f", "-")
+	cmd.Stdin = strings.NewReader(ruleset)
+
+	if output, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("nft rejected the ruleset: %s: %s\n%s", err, output, ruleset)
+	}
+}
@@ -0,0 +1,143 @@
+package router
+
+import (
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/NHAS/wag/internal/config"
+	"github.com/NHAS/wag/internal/data"
+	"github.com/NHAS/wag/internal/routetypes"
+)
+
+// Rules may use the devices of other users as their address (user:<name> or group:<name>), so that traffic between devices inside the tunnel can be allowed
+// These are resolved from the devices in the firewall, and rebuilt whenever a device belonging to a user they include is added or removed
+
+// The user ids that a peer target includes
+func peerTargetUsers(target string) map[[20]byte]bool {
+	users := map[[20]byte]bool{}
+
+	if strings.HasPrefix(target, "user:") {
+		users[sha1.Sum([]byte(strings.TrimPrefix(target, "user:")))] = true
+		return users
+	}
+
+	// Groups may also come from registration tokens and identity providers, so use the same membership as the acls do
+	for _, username := range config.GroupMembers(target) {
+		users[sha1.Sum([]byte(username))] = true
+	}
+
+	return users
+}
+
+// Used as the routetypes peer resolver, returns the ipv4 and (if enabled) ipv6 tunnel addresses of every device owned by the users in target
+func peerAddresses(target string) (addresses []net.IP, err error) {
+	users := peerTargetUsers(target)
+	if len(users) == 0 || xdpObjects.Devices == nil {
+		return nil, nil
+	}
+
+	var (
+		deviceAddr  [4]byte
+		deviceBytes []byte
+	)
+
+	deviceIter := xdpObjects.Devices.Iterate()
+	for deviceIter.Next(&deviceAddr, &deviceBytes) {
+		var device fwentry
+		if err := device.Unpack(deviceBytes); err != nil {
+			return nil, err
+		}
+
+		if !users[device.user_id] {
+			continue
+		}
+
+		address := net.IPv4(deviceAddr[0], deviceAddr[1], deviceAddr[2], deviceAddr[3])
+		addresses = append(addresses, address)
+
+		if ip6 := config.TunnelIPv6Address(address); ip6 != nil {
+			addresses = append(addresses, ip6)
+		}
+	}
+
+	if deviceIter.Err() != nil {
+		return nil, errors.New("iterating devices: " + deviceIter.Err().Error())
+	}
+
+	return addresses, nil
+}
+
+// Rebuilds the rules of users whose acls include the devices of owner, so that they have the current device addresses
+// Must be called with lock held
+func refreshPeerRules(owner [20]byte) error {
+	return refreshUsersWithPeerRules(func(target string) bool {
+		return peerTargetUsers(target)[owner]
+	})
+}
+
+// RefreshGroupPeerRules rebuilds the rules of users whose acls include the devices of groups, used when a users group membership changes
+func RefreshGroupPeerRules(groups map[string]bool) error {
+	lock.Lock()
+	defer lock.Unlock()
+
+	return refreshUsersWithPeerRules(func(target string) bool {
+		return groups[target]
+	})
+}
+
+// Rebuilds the rules of every user with a peer target that matches, must be called with lock held
+func refreshUsersWithPeerRules(matches func(target string) bool) error {
+	users, err := data.GetAllUsers()
+	if err != nil {
+		return err
+	}
+
+	var errs []string
+	for _, user := range users {
+		acls := config.GetEffectiveAcl(user.Username)
+
+		for _, target := range routetypes.PeerTargets(acls.Mfa, acls.Allow, acls.Deny) {
+			if !matches(target) {
+				continue
+			}
+
+			if err := setMaps(user.GetID(), acls); err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %s", user.Username, err))
+			}
+			break
+		}
+	}
+
+	if len(errs) > 0 {
+		return errors.New("updating device rules failed: " + strings.Join(errs, ", "))
+	}
+
+	return nil
+}
+
+// The owner of a device in the firewall
+func deviceUserID(address string) (userid [20]byte, err error) {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return userid, errors.New("Address " + address + " is not parsable as an IP address")
+	}
+
+	deviceBytes, err := xdpObjects.Devices.LookupBytes(ip.To4())
+	if err != nil {
+		return userid, err
+	}
+
+	if deviceBytes == nil {
+		return userid, errors.New("device " + address + " not found")
+	}
+
+	var device fwentry
+	if err := device.Unpack(deviceBytes); err != nil {
+		return userid, err
+	}
+
+	return device.user_id, nil
+}
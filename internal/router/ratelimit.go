@@ -0,0 +1,123 @@
+package router
+
+import (
+	"encoding/binary"
+	"errors"
+	"math/big"
+	"time"
+
+	"github.com/NHAS/wag/internal/config"
+	"github.com/cilium/ebpf"
+)
+
+// Users with a rate limit in their policies have a token bucket in the xdp firewall, shared between all of their devices
+// The limits are in bits per second in the configuration, and bytes in the firewall
+
+const rateLimitSizeBytes = 24
+
+// The C struct rate_limit
+type rateLimit struct {
+	rate     uint64
+	burst    uint64
+	fillTime uint64
+}
+
+func (r rateLimit) Bytes() []byte {
+	output := make([]byte, rateLimitSizeBytes)
+
+	binary.LittleEndian.PutUint64(output[0:8], r.rate)
+	binary.LittleEndian.PutUint64(output[8:16], r.burst)
+	binary.LittleEndian.PutUint64(output[16:24], r.fillTime)
+
+	return output
+}
+
+func (r *rateLimit) Unpack(b []byte) error {
+	if len(b) < rateLimitSizeBytes {
+		return errors.New("rate limit too short")
+	}
+
+	r.rate = binary.LittleEndian.Uint64(b[0:8])
+	r.burst = binary.LittleEndian.Uint64(b[8:16])
+	r.fillTime = binary.LittleEndian.Uint64(b[16:24])
+
+	return nil
+}
+
+func newRateLimit(limit config.RateLimit) rateLimit {
+	r := rateLimit{
+		rate:  limit.BitsPerSecond / 8,
+		burst: limit.Burst() / 8,
+	}
+
+	// burst * 1e9 may overflow a uint64
+	fillTime := new(big.Int).SetUint64(r.burst)
+	fillTime.Mul(fillTime, big.NewInt(int64(time.Second)))
+	fillTime.Div(fillTime, new(big.Int).SetUint64(r.rate))
+
+	r.fillTime = fillTime.Uint64()
+
+	return r
+}
+
+// Sets the users rate limit, or removes it if limit is nil. The users token bucket is reset if the limit changed
+func setRateLimit(userid [20]byte, limit *config.RateLimit) error {
+	var current rateLimit
+	currentBytes, err := xdpObjects.UserRateLimits.LookupBytes(userid)
+	if err != nil {
+		return err
+	}
+
+	if currentBytes != nil {
+		if err := current.Unpack(currentBytes); err != nil {
+			return err
+		}
+	}
+
+	if limit == nil {
+		err = xdpObjects.UserRateLimits.Delete(userid)
+		if err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+			return errors.New("removing user rate limit failed: " + err.Error())
+		}
+	} else {
+		newLimit := newRateLimit(*limit)
+		if currentBytes != nil && newLimit == current {
+			return nil
+		}
+
+		err = xdpObjects.UserRateLimits.Put(userid, newLimit.Bytes())
+		if err != nil {
+			return mapFullError(err, "user rate limit", "Firewall.MaxUsers", xdpObjects.UserRateLimits)
+		}
+	}
+
+	// The xdp program creates a full bucket on the next packet
+	err = xdpObjects.RateLimitBuckets.Delete(userid)
+	if err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+		return errors.New("removing user rate limit bucket failed: " + err.Error())
+	}
+
+	return nil
+}
+
+// The users rate limit in the firewall, nil if they are not limited
+func getRateLimit(userid [20]byte) (*config.RateLimit, error) {
+	limitBytes, err := xdpObjects.UserRateLimits.LookupBytes(userid)
+	if err != nil {
+		return nil, err
+	}
+
+	if limitBytes == nil {
+		return nil, nil
+	}
+
+	var limit rateLimit
+	if err := limit.Unpack(limitBytes); err != nil {
+		return nil, err
+	}
+
+	return &config.RateLimit{
+		BitsPerSecond: limit.rate * 8,
+		BurstBits:     limit.burst * 8,
+	}, nil
+}
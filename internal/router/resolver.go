@@ -0,0 +1,529 @@
+package router
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/NHAS/wag/internal/config"
+	"github.com/NHAS/wag/internal/data"
+	"github.com/NHAS/wag/internal/routetypes"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Domains in acls are resolved when a users rules are added to the firewall. The results are cached here, and re-resolved when their records expire
+// If a domain now resolves to different addresses, only the users whose acls use that domain have their firewall rules rebuilt
+
+const (
+	domainCheckInterval  = 5 * time.Second
+	dnsQueryTimeout      = 3 * time.Second
+	maxResolutionHistory = 100
+)
+
+type resolvedDomain struct {
+	addresses []net.IP
+	expiry    time.Time
+}
+
+// DomainResolution records a domain resolving to a different set of addresses, or failing to resolve
+type DomainResolution struct {
+	Time   time.Time
+	Domain string
+
+	Added   []string `json:",omitempty"`
+	Removed []string `json:",omitempty"`
+
+	// Users whose firewall rules were updated
+	Users []string `json:",omitempty"`
+
+	Error string `json:",omitempty"`
+}
+
+// DomainStatus is the current addresses of a domain used in acls
+type DomainStatus struct {
+	Domain    string
+	Addresses []string
+	Expiry    time.Time
+}
+
+type DomainResolutions struct {
+	Domains []DomainStatus
+	History []DomainResolution
+}
+
+var (
+	resolverLock      sync.Mutex
+	resolvedDomains   = map[string]*resolvedDomain{}
+	resolutionHistory []DomainResolution
+
+	resolverStop chan struct{}
+
+	// Resolves a domain and returns how long the addresses may be cached for
+	lookupDomain = lookupWithTTL
+)
+
+func startDomainResolver() {
+	if config.Values().Firewall.DomainRefreshSeconds < 0 {
+		return
+	}
+
+	routetypes.Resolver = cachedLookup
+
+	resolverStop = make(chan struct{})
+	go func(stop chan struct{}) {
+		ticker := time.NewTicker(domainCheckInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case now := <-ticker.C:
+				refreshDomains(now)
+			}
+		}
+	}(resolverStop)
+}
+
+func stopDomainResolver() {
+	if resolverStop != nil {
+		close(resolverStop)
+		resolverStop = nil
+	}
+
+	routetypes.Resolver = net.LookupIP
+
+	clearResolvedDomains()
+}
+
+// Forget all resolved domains, so they are looked up again the next time rules are parsed
+func clearResolvedDomains() {
+	resolverLock.Lock()
+	defer resolverLock.Unlock()
+
+	resolvedDomains = map[string]*resolvedDomain{}
+}
+
+// Used as the routetypes resolver, returns the cached addresses of a domain which are kept up to date by refreshDomains
+func cachedLookup(domain string) ([]net.IP, error) {
+	resolverLock.Lock()
+	entry, ok := resolvedDomains[domain]
+	resolverLock.Unlock()
+
+	if ok {
+		return entry.addresses, nil
+	}
+
+	addresses, ttl, err := lookupDomain(domain)
+	if err != nil {
+		return nil, err
+	}
+
+	resolverLock.Lock()
+	defer resolverLock.Unlock()
+
+	resolvedDomains[domain] = &resolvedDomain{addresses: addresses, expiry: time.Now().Add(domainTTL(ttl))}
+
+	return addresses, nil
+}
+
+// Clamps a record TTL to Firewall.DomainMinTTLSeconds and Firewall.DomainMaxTTLSeconds
+func domainTTL(ttl time.Duration) time.Duration {
+	firewall := config.Values().Firewall
+
+	if minimum := time.Duration(firewall.DomainMinTTLSeconds) * time.Second; ttl < minimum {
+		return minimum
+	}
+
+	if maximum := time.Duration(firewall.DomainMaxTTLSeconds) * time.Second; ttl > maximum {
+		return maximum
+	}
+
+	return ttl
+}
+
+// Re-resolve every domain that has expired by now, and rebuild the rules of users affected by any changes
+func refreshDomains(now time.Time) {
+
+	resolverLock.Lock()
+	expired := []string{}
+	for domain, entry := range resolvedDomains {
+		if !now.Before(entry.expiry) {
+			expired = append(expired, domain)
+		}
+	}
+	resolverLock.Unlock()
+
+	if len(expired) == 0 {
+		return
+	}
+
+	users, err := data.GetAllUsers()
+	if err != nil {
+		log.Println("unable to get users to refresh acl domains: ", err)
+		return
+	}
+
+	// Domains that are still used by someones acls, anything else is dropped from the cache rather than being resolved
+	usedBy := map[string][]string{}
+	for _, user := range users {
+		acl := config.GetEffectiveAcl(user.Username)
+		for _, domain := range routetypes.Domains(acl.Mfa, acl.Allow, acl.Deny) {
+			usedBy[domain] = append(usedBy[domain], user.Username)
+		}
+	}
+
+	sort.Strings(expired)
+
+	changed := []*DomainResolution{}
+	for _, domain := range expired {
+		if len(usedBy[domain]) == 0 {
+			resolverLock.Lock()
+			delete(resolvedDomains, domain)
+			resolverLock.Unlock()
+			continue
+		}
+
+		addresses, ttl, err := lookupDomain(domain)
+
+		resolverLock.Lock()
+		entry, ok := resolvedDomains[domain]
+		if !ok {
+			resolverLock.Unlock()
+			continue
+		}
+
+		if err != nil {
+			// Keep the previous addresses, a dns outage shouldnt change what users can access
+			entry.expiry = now.Add(domainTTL(0))
+			recordResolution(DomainResolution{Time: now, Domain: domain, Error: err.Error()})
+			resolverLock.Unlock()
+			continue
+		}
+
+		entry.expiry = now.Add(domainTTL(ttl))
+
+		added, removed := diffKeys(entry.addresses, addresses)
+		if len(added) != 0 || len(removed) != 0 {
+			entry.addresses = addresses
+			changed = append(changed, &DomainResolution{Time: now, Domain: domain, Added: added, Removed: removed})
+		}
+		resolverLock.Unlock()
+	}
+
+	if len(changed) == 0 {
+		return
+	}
+
+	affectedUsers := map[string]bool{}
+	for _, resolution := range changed {
+		for _, username := range usedBy[resolution.Domain] {
+			affectedUsers[username] = true
+		}
+	}
+
+	// Rules are built before taking the firewall lock, as parsing them may need to resolve domains that are not cached
+	type update struct {
+		userid   [20]byte
+		acls     config.Acl
+		policies userPolicies
+	}
+
+	updates := map[string]update{}
+	for username := range affectedUsers {
+		acls := config.GetEffectiveAcl(username)
+
+		rules, err := routetypes.ParseRules(acls.Mfa, acls.Allow, acls.Deny)
+		if err == nil {
+			var policies userPolicies
+			policies, err = buildPolicies(rules)
+			updates[username] = update{userid: sha1.Sum([]byte(username)), acls: acls, policies: policies}
+		}
+
+		if err != nil {
+			log.Println("unable to build firewall rules for", username, "after acl domain changed address: ", err)
+		}
+	}
+
+	lock.Lock()
+	updated := map[string]bool{}
+	for username, u := range updates {
+		// The user may have been removed while the rules were being built
+		if xdpUserExists(u.userid) != nil {
+			u.policies.routes.Close()
+			continue
+		}
+
+		if err := setPolicies(u.userid, u.policies, u.acls); err != nil {
+			log.Println("unable to update firewall rules for", username, "after acl domain changed address: ", err)
+			continue
+		}
+		updated[username] = true
+	}
+	lock.Unlock()
+
+	resolverLock.Lock()
+	defer resolverLock.Unlock()
+
+	for _, resolution := range changed {
+		for _, username := range usedBy[resolution.Domain] {
+			if updated[username] {
+				resolution.Users = append(resolution.Users, username)
+			}
+		}
+		sort.Strings(resolution.Users)
+
+		log.Printf("acl domain %s changed address, added: %v removed: %v, updated users: %v", resolution.Domain, resolution.Added, resolution.Removed, resolution.Users)
+		recordResolution(*resolution)
+	}
+}
+
+// Must be called with resolverLock held
+func recordResolution(resolution DomainResolution) {
+	resolutionHistory = append(resolutionHistory, resolution)
+	if len(resolutionHistory) > maxResolutionHistory {
+		resolutionHistory = resolutionHistory[len(resolutionHistory)-maxResolutionHistory:]
+	}
+}
+
+// Compare the firewall keys that two sets of addresses produce
+func diffKeys(previous, current []net.IP) (added, removed []string) {
+	toKeys := func(addresses []net.IP) map[routetypes.Key]bool {
+		keys := map[routetypes.Key]bool{}
+		for _, address := range addresses {
+			if address.To4() != nil {
+				keys[routetypes.NewKey(address.To4(), 32)] = true
+				continue
+			}
+			keys[routetypes.NewKey(address.To16(), 128)] = true
+		}
+		return keys
+	}
+
+	previousKeys, currentKeys := toKeys(previous), toKeys(current)
+
+	for key := range currentKeys {
+		if !previousKeys[key] {
+			added = append(added, key.String())
+		}
+	}
+
+	for key := range previousKeys {
+		if !currentKeys[key] {
+			removed = append(removed, key.String())
+		}
+	}
+
+	sort.Strings(added)
+	sort.Strings(removed)
+
+	return
+}
+
+// GetDomainResolutions returns the current addresses of domains used in acls, and the history of them changing
+func GetDomainResolutions() DomainResolutions {
+	resolverLock.Lock()
+	defer resolverLock.Unlock()
+
+	result := DomainResolutions{
+		Domains: []DomainStatus{},
+		History: append([]DomainResolution{}, resolutionHistory...),
+	}
+
+	for domain, entry := range resolvedDomains {
+		status := DomainStatus{
+			Domain: domain,
+			Expiry: entry.expiry,
+		}
+
+		for _, address := range entry.addresses {
+			status.Addresses = append(status.Addresses, address.String())
+		}
+
+		result.Domains = append(result.Domains, status)
+	}
+
+	sort.Slice(result.Domains, func(i, j int) bool {
+		return result.Domains[i].Domain < result.Domains[j].Domain
+	})
+
+	return result
+}
+
+// Look up a domain with the system nameservers directly so that record TTLs are known, the go resolver doesnt expose them.
+// If that fails the system resolver is used (which also handles /etc/hosts and search domains) and the configured refresh interval is used instead
+func lookupWithTTL(domain string) ([]net.IP, time.Duration, error) {
+
+	addresses, ttl, err := queryNameservers(domain)
+	if err == nil && len(addresses) > 0 {
+		return addresses, ttl, nil
+	}
+
+	addresses, err = net.LookupIP(domain)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return addresses, time.Duration(config.Values().Firewall.DomainRefreshSeconds) * time.Second, nil
+}
+
+// Returns the host:port of each nameserver in /etc/resolv.conf
+func nameservers() (servers []string, err error) {
+	f, err := os.Open("/etc/resolv.conf")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			servers = append(servers, net.JoinHostPort(fields[1], "53"))
+		}
+	}
+
+	if len(servers) == 0 {
+		return nil, errors.New("no nameservers in /etc/resolv.conf")
+	}
+
+	return servers, scanner.Err()
+}
+
+func queryNameservers(domain string) (addresses []net.IP, ttl time.Duration, err error) {
+	servers, err := nameservers()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	name, err := dnsmessage.NewName(strings.TrimSuffix(domain, ".") + ".")
+	if err != nil {
+		return nil, 0, err
+	}
+
+	for _, server := range servers {
+		addresses, ttl, err = queryNameserver(server, name)
+		if err == nil {
+			return addresses, ttl, nil
+		}
+	}
+
+	return nil, 0, err
+}
+
+// Query both A and AAAA records, the TTL is the lowest of all the answers (including any CNAMEs). A query with no answers uses the negative caching TTL
+// of the zones SOA record instead, so a record being added is noticed. If there are no TTLs at all Firewall.DomainRefreshSeconds is used
+func queryNameserver(server string, name dnsmessage.Name) (addresses []net.IP, ttl time.Duration, err error) {
+
+	var (
+		minTTL uint32
+		found  bool
+	)
+
+	lowest := func(recordTTL uint32) {
+		if !found || recordTTL < minTTL {
+			minTTL = recordTTL
+			found = true
+		}
+	}
+
+	for _, recordType := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		response, err := query(server, name, recordType)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		for _, answer := range response.Answers {
+			switch body := answer.Body.(type) {
+			case *dnsmessage.AResource:
+				addresses = append(addresses, net.IP(append([]byte{}, body.A[:]...)))
+			case *dnsmessage.AAAAResource:
+				addresses = append(addresses, net.IP(append([]byte{}, body.AAAA[:]...)))
+			}
+
+			lowest(answer.Header.TTL)
+		}
+
+		if len(response.Answers) != 0 {
+			continue
+		}
+
+		for _, authority := range response.Authorities {
+			if soa, ok := authority.Body.(*dnsmessage.SOAResource); ok {
+				// RFC 2308, negative answers are cached for the lower of the SOA records TTL and its minimum field
+				lowest(authority.Header.TTL)
+				lowest(soa.MinTTL)
+			}
+		}
+	}
+
+	if !found {
+		return addresses, time.Duration(config.Values().Firewall.DomainRefreshSeconds) * time.Second, nil
+	}
+
+	return addresses, time.Duration(minTTL) * time.Second, nil
+}
+
+func query(server string, name dnsmessage.Name, recordType dnsmessage.Type) (*dnsmessage.Message, error) {
+
+	var id uint16
+	if err := binary.Read(rand.Reader, binary.LittleEndian, &id); err != nil {
+		return nil, err
+	}
+
+	request, err := (&dnsmessage.Message{
+		Header: dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{
+			{Name: name, Type: recordType, Class: dnsmessage.ClassINET},
+		},
+	}).Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.DialTimeout("udp", server, dnsQueryTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(dnsQueryTimeout))
+
+	if _, err := conn.Write(request); err != nil {
+		return nil, err
+	}
+
+	buffer := make([]byte, 4096)
+	for {
+		n, err := conn.Read(buffer)
+		if err != nil {
+			return nil, err
+		}
+
+		var response dnsmessage.Message
+		if err := response.Unpack(buffer[:n]); err != nil || response.ID != id || !response.Response {
+			// Not a reply to our query, keep waiting until the deadline
+			continue
+		}
+
+		if response.Truncated {
+			return nil, errors.New("dns response was truncated")
+		}
+
+		if response.RCode != dnsmessage.RCodeSuccess {
+			return nil, fmt.Errorf("dns query for %s failed: %s", name, response.RCode)
+		}
+
+		return &response, nil
+	}
+}
@@ -0,0 +1,138 @@
+package router
+
+import (
+	"math"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/NHAS/wag/internal/config"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// startDnsServer runs a stand in nameserver for the wag.test zone, returning its address
+//
+//	address.wag.test has an A record with a TTL of 120 and no AAAA records
+//	cname.wag.test only has a CNAME to a name with no addresses
+//	empty.wag.test has no records, and the response has no SOA
+func startDnsServer(t *testing.T) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+	})
+
+	soa := dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName("wag.test."), Type: dnsmessage.TypeSOA, Class: dnsmessage.ClassINET, TTL: 600},
+		Body: &dnsmessage.SOAResource{
+			NS:     dnsmessage.MustNewName("ns.wag.test."),
+			MBox:   dnsmessage.MustNewName("admin.wag.test."),
+			MinTTL: 60,
+		},
+	}
+
+	go func() {
+		buffer := make([]byte, 4096)
+		for {
+			n, from, err := conn.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+
+			var request dnsmessage.Message
+			if err := request.Unpack(buffer[:n]); err != nil || len(request.Questions) != 1 {
+				continue
+			}
+
+			question := request.Questions[0]
+			response := dnsmessage.Message{
+				Header:    dnsmessage.Header{ID: request.ID, Response: true},
+				Questions: request.Questions,
+			}
+
+			switch question.Name.String() {
+			case "address.wag.test.":
+				if question.Type == dnsmessage.TypeA {
+					response.Answers = append(response.Answers, dnsmessage.Resource{
+						Header: dnsmessage.ResourceHeader{Name: question.Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 120},
+						Body:   &dnsmessage.AResource{A: [4]byte{10, 0, 0, 1}},
+					})
+					break
+				}
+
+				response.Authorities = append(response.Authorities, soa)
+
+			case "cname.wag.test.":
+				response.Answers = append(response.Answers, dnsmessage.Resource{
+					Header: dnsmessage.ResourceHeader{Name: question.Name, Type: dnsmessage.TypeCNAME, Class: dnsmessage.ClassINET, TTL: 300},
+					Body:   &dnsmessage.CNAMEResource{CNAME: dnsmessage.MustNewName("nothing.wag.test.")},
+				})
+			}
+
+			packed, err := response.Pack()
+			if err != nil {
+				continue
+			}
+
+			conn.WriteTo(packed, from)
+		}
+	}()
+
+	return conn.LocalAddr().String()
+}
+
+func TestQueryNameserverTTL(t *testing.T) {
+	if err := config.Load("../config/test_in_memory_db.json"); err != nil {
+		t.Fatal(err)
+	}
+
+	server := startDnsServer(t)
+
+	for _, test := range []struct {
+		domain    string
+		addresses int
+		ttl       time.Duration
+	}{
+		// The missing AAAA record is negatively cached for the SOA minimum, which is lower than the A records TTL
+		{"address.wag.test.", 1, 60 * time.Second},
+		{"cname.wag.test.", 0, 300 * time.Second},
+		{"empty.wag.test.", 0, time.Duration(config.Values().Firewall.DomainRefreshSeconds) * time.Second},
+	} {
+		addresses, ttl, err := queryNameserver(server, dnsmessage.MustNewName(test.domain))
+		if err != nil {
+			t.Fatalf("%s: %s", test.domain, err)
+		}
+
+		if len(addresses) != test.addresses {
+			t.Fatalf("%s: expected %d addresses got: %v", test.domain, test.addresses, addresses)
+		}
+
+		if ttl != test.ttl {
+			t.Fatalf("%s: expected ttl %s got %s", test.domain, test.ttl, ttl)
+		}
+	}
+}
+
+func TestDomainTTLBounds(t *testing.T) {
+	if err := config.Load("../config/test_in_memory_db.json"); err != nil {
+		t.Fatal(err)
+	}
+
+	firewall := config.Values().Firewall
+	minimum := time.Duration(firewall.DomainMinTTLSeconds) * time.Second
+	maximum := time.Duration(firewall.DomainMaxTTLSeconds) * time.Second
+
+	if ttl := domainTTL(0); ttl != minimum {
+		t.Fatalf("zero ttl should be raised to %s, got %s", minimum, ttl)
+	}
+
+	if ttl := domainTTL(time.Duration(math.MaxUint32) * time.Second); ttl != maximum {
+		t.Fatalf("largest possible ttl should be lowered to %s, got %s", maximum, ttl)
+	}
+
+	if ttl := domainTTL(minimum + time.Second); ttl != minimum+time.Second {
+		t.Fatalf("ttl within bounds should not be changed, got %s", ttl)
+	}
+}
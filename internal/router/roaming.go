@@ -0,0 +1,243 @@
+package router
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"github.com/NHAS/wag/internal/config"
+	"github.com/NHAS/wag/internal/data"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// Wireguard moves a peer to whatever endpoint its last authenticated packet came from, so a device that changes network (or a stolen key used from
+// somewhere else) shows up as an endpoint change. The watcher keeps the last endpoint and handshake of each peer in memory, so the database is only used
+// when a peer is new or has moved, and applies the roaming policy to decide whether the devices session is kept
+//
+// Gateways cannot complete mfa, instead they are authorised each time they complete a new wireguard handshake, as that proves they have the devices keys
+
+// Wireguard rejects sessions older than this, so a handshake this old is not from a connected peer
+const wireguardRejectAfter = 180 * time.Second
+
+type peerEndpoint struct {
+	endpoint      *net.UDPAddr
+	lastHandshake time.Time
+
+	address string
+	gateway bool
+}
+
+// pollEndpoints reads the peers of the wireguard device every Roaming.CheckIntervalMilliseconds. Wireguard has no notification of endpoint changes, and
+// moves a peer on any authenticated packet rather than only on handshakes, so polling is the only way to see every move. Peers whose endpoint and
+// handshake have not changed are skipped without looking at the database
+func pollEndpoints(errs chan<- error) {
+	peers := map[wgtypes.Key]peerEndpoint{}
+
+	startup := true
+	for {
+		dev, err := ctrl.Device(config.Values().Wireguard.DevName)
+		if err != nil {
+			errs <- fmt.Errorf("endpoint watcher: %s", err)
+			return
+		}
+
+		current := make(map[wgtypes.Key]bool, len(dev.Peers))
+		for _, p := range dev.Peers {
+			current[p.PublicKey] = true
+
+			known, ok := peers[p.PublicKey]
+			if ok && sameEndpoint(known.endpoint, p.Endpoint) && known.lastHandshake.Equal(p.LastHandshakeTime) {
+				continue
+			}
+
+			state := known
+			if ok && sameEndpoint(known.endpoint, p.Endpoint) {
+				state.lastHandshake = p.LastHandshakeTime
+			} else {
+				state, err = peerMoved(p, known, ok, startup)
+				if err != nil {
+					log.Println(err)
+					delete(peers, p.PublicKey)
+					continue
+				}
+			}
+
+			if state.gateway && p.LastHandshakeTime.After(known.lastHandshake) && time.Since(p.LastHandshakeTime) < wireguardRejectAfter {
+				authoriseGateway(state.address)
+			}
+
+			peers[p.PublicKey] = state
+		}
+
+		for key := range peers {
+			if !current[key] {
+				delete(peers, key)
+			}
+		}
+
+		startup = false
+
+		time.Sleep(time.Duration(config.Values().Roaming.CheckIntervalMilliseconds) * time.Millisecond)
+	}
+}
+
+// Handles a peer that is new to the watcher or has a different endpoint, returns what the watcher should remember about it
+func peerMoved(p wgtypes.Peer, known peerEndpoint, isKnown, startup bool) (peerEndpoint, error) {
+	address := peerAddress(p)
+	if address == nil {
+		// Remembered so the warning is only logged once
+		log.Println("Warning, peer ", p.PublicKey.String(), " has no ipv4 address in AllowedIPs, which is not supported")
+		return peerEndpoint{endpoint: p.Endpoint, lastHandshake: p.LastHandshakeTime}, nil
+	}
+
+	ip := address.String()
+
+	d, err := data.GetDeviceByAddress(ip)
+	if err != nil {
+		if err := Deauthenticate(ip); err != nil {
+			log.Println(ip, "unable to remove forwards for device: ", err)
+		}
+
+		return peerEndpoint{}, fmt.Errorf("unable to get previous device endpoint for %s: %s", ip, err)
+	}
+
+	// The last endpoint recorded for the device, which may be from before wag was restarted
+	if !isKnown {
+		known = peerEndpoint{endpoint: d.Endpoint, lastHandshake: p.LastHandshakeTime}
+	}
+
+	state := peerEndpoint{endpoint: p.Endpoint, lastHandshake: p.LastHandshakeTime, address: ip, gateway: d.IsGateway()}
+	if sameEndpoint(state.endpoint, known.endpoint) || p.Endpoint == nil {
+		return state, nil
+	}
+
+	err = data.UpdateDeviceEndpoint(ip, p.Endpoint)
+	if err != nil {
+		log.Println(ip, "unable to update device endpoint: ", err)
+	}
+
+	// Dont try and remove rules if we've just started, and a device getting its first endpoint has not moved
+	if startup || known.endpoint == nil {
+		return state, nil
+	}
+
+	allowed, reason := roamingAllowed(d.Endpoint, p.Endpoint, known.lastHandshake, time.Now())
+	if d.IsGateway() {
+		// Gateways are authorised again by their next handshake, so removing their session would only interrupt the hosts behind them
+		allowed, reason = true, "gateway"
+	}
+
+	log.Println(ip, "endpoint changed", endpointString(known.endpoint), "->", endpointString(state.endpoint), "session kept:", allowed, "("+reason+")")
+
+	err = data.AddRoamingEvent(data.RoamingEvent{
+		Time:             time.Now(),
+		Username:         d.Username,
+		Address:          ip,
+		PreviousEndpoint: endpointString(known.endpoint),
+		Endpoint:         endpointString(state.endpoint),
+		Allowed:          allowed,
+		Reason:           reason,
+	})
+	if err != nil {
+		log.Println(ip, "unable to record roaming event: ", err)
+	}
+
+	if !allowed {
+		if err := Deauthenticate(ip); err != nil {
+			log.Println(ip, "unable to remove forwards for device: ", err)
+		}
+	}
+
+	return state, nil
+}
+
+// Authorises a gateway that has completed a new handshake, unless it has been locked
+func authoriseGateway(address string) {
+	d, err := data.GetDeviceByAddress(address)
+	if err != nil {
+		log.Println(address, "unable to get gateway: ", err)
+		return
+	}
+
+	if d.Attempts > config.Values().Lockout {
+		return
+	}
+
+	if err := SetAuthorized(address, d.Username); err != nil {
+		log.Println(address, "unable to authorise gateway: ", err)
+	}
+}
+
+// Decides whether a device keeps its session when its endpoint moves from previous to current, with the reason
+func roamingAllowed(previous, current *net.UDPAddr, lastHandshake, now time.Time) (bool, string) {
+	roaming := config.Values().Roaming
+
+	switch roaming.Policy {
+	case config.RoamingSameNetwork:
+		if previous == nil {
+			return false, "previous endpoint unknown"
+		}
+
+		if sameSubnet(previous.IP, current.IP) {
+			return true, "same subnet"
+		}
+
+		for name, networks := range roaming.AllowedRanges {
+			if containedBy(networks, previous.IP) && containedBy(networks, current.IP) {
+				return true, "both in allowed cidrs " + name
+			}
+		}
+
+		return false, "different network"
+
+	case config.RoamingGrace:
+		grace := time.Duration(roaming.GraceSeconds) * time.Second
+		if !lastHandshake.IsZero() && now.Sub(lastHandshake) <= grace {
+			return true, "within grace window"
+		}
+
+		return false, "no recent handshake from previous endpoint"
+	}
+
+	return false, "endpoint changed"
+}
+
+// Whether both addresses are in the same /24 for ipv4, or /64 for ipv6
+func sameSubnet(a, b net.IP) bool {
+	if a.To4() != nil && b.To4() != nil {
+		return a.To4().Mask(net.CIDRMask(24, 32)).Equal(b.To4().Mask(net.CIDRMask(24, 32)))
+	}
+
+	if a.To4() == nil && b.To4() == nil {
+		return a.Mask(net.CIDRMask(64, 128)).Equal(b.Mask(net.CIDRMask(64, 128)))
+	}
+
+	return false
+}
+
+func containedBy(networks []*net.IPNet, address net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(address) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func sameEndpoint(a, b *net.UDPAddr) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+
+	return a.Port == b.Port && a.IP.Equal(b.IP) && a.Zone == b.Zone
+}
+
+func endpointString(endpoint *net.UDPAddr) string {
+	if endpoint == nil {
+		return ""
+	}
+
+	return endpoint.String()
+}
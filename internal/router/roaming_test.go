@@ -0,0 +1,81 @@
+package router
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/NHAS/wag/internal/config"
+)
+
+func endpoint(address string) *net.UDPAddr {
+	addr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		panic(err)
+	}
+
+	return addr
+}
+
+func TestRoamingDeauthenticate(t *testing.T) {
+	if err := config.Load("../config/test_in_memory_db.json"); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	if allowed, _ := roamingAllowed(endpoint("1.1.1.1:4000"), endpoint("1.1.1.2:4000"), now, now); allowed {
+		t.Fatal("default roaming policy should deauthenticate on any endpoint change")
+	}
+}
+
+func TestRoamingSameNetwork(t *testing.T) {
+	if err := config.Load("../config/test_roaming_same_network.json"); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+
+	for _, test := range []struct {
+		previous, current string
+		allowed           bool
+	}{
+		{"192.168.1.5:4000", "192.168.1.200:5000", true},
+		{"192.168.1.5:4000", "192.168.2.5:4000", false},
+		{"[fd00:1:2:3::1]:4000", "[fd00:1:2:3::ffff]:4000", true},
+		{"[fd00:1:2:3::1]:4000", "[fd00:1:2:4::1]:4000", false},
+		{"192.168.1.5:4000", "[fd00:1:2:3::1]:4000", false},
+		// Both in the carrier allow-list, but in different cidrs
+		{"1.121.4.4:4000", "101.170.9.9:4000", true},
+		{"1.121.4.4:4000", "8.8.8.8:4000", false},
+	} {
+		allowed, reason := roamingAllowed(endpoint(test.previous), endpoint(test.current), now, now)
+		if allowed != test.allowed {
+			t.Fatalf("moving from %s to %s should be allowed: %t, got %t (%s)", test.previous, test.current, test.allowed, allowed, reason)
+		}
+	}
+
+	if allowed, _ := roamingAllowed(nil, endpoint("192.168.1.5:4000"), now, now); allowed {
+		t.Fatal("roaming from an unknown endpoint should not be allowed")
+	}
+}
+
+func TestRoamingGrace(t *testing.T) {
+	if err := config.Load("../config/test_roaming_grace.json"); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	previous, current := endpoint("192.168.1.5:4000"), endpoint("8.8.8.8:4000")
+
+	if allowed, _ := roamingAllowed(previous, current, now.Add(-10*time.Second), now); !allowed {
+		t.Fatal("moving shortly after a handshake from the previous endpoint should be allowed")
+	}
+
+	if allowed, _ := roamingAllowed(previous, current, now.Add(-time.Minute), now); allowed {
+		t.Fatal("moving after the grace window should not be allowed")
+	}
+
+	if allowed, _ := roamingAllowed(previous, current, time.Time{}, now); allowed {
+		t.Fatal("moving without a handshake from the previous endpoint should not be allowed")
+	}
+}
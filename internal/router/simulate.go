@@ -0,0 +1,261 @@
+package router
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/NHAS/wag/internal/config"
+	"github.com/NHAS/wag/internal/routetypes"
+	"github.com/cilium/ebpf"
+)
+
+// A packet can be simulated by running it through the xdp program with a struct verdict as the packets metadata
+// The program checks it against the current firewall state without changing anything, and fills in the verdict
+
+const (
+	verdictSizeBytes = 28
+
+	// Source port of simulated packets
+	simulatedSourcePort = 49152
+)
+
+// SimulationResult is what the firewall decided for a simulated packet sent by a device
+type SimulationResult struct {
+	Device string
+
+	Source          string
+	Destination     string
+	DestinationPort uint16
+	Protocol        uint32
+
+	Allowed bool
+	Reason  string `json:",omitempty"`
+
+	// The route and policy that decided the packet, empty if none matched
+	Route  string `json:",omitempty"`
+	Policy string `json:",omitempty"`
+
+	// Whether the device is authorised, or why not
+	Session string
+}
+
+// The C struct xdp_md, used as the context of simulated packets
+type xdpContext struct {
+	Data           uint32
+	DataEnd        uint32
+	DataMeta       uint32
+	IngressIfindex uint32
+	RxQueueIndex   uint32
+	EgressIfindex  uint32
+}
+
+// Simulate sends a packet from each of the users devices to destination through the firewall, and reports whether it would be allowed and why
+// For icmp and icmpv6 the packet is an echo request and port is ignored
+func Simulate(username string, destination net.IP, port uint16, protocol string) ([]SimulationResult, error) {
+	proto, err := routetypes.ParseProtocol(protocol)
+	if err != nil {
+		return nil, err
+	}
+
+	if destination == nil {
+		return nil, errors.New("destination address is not set")
+	}
+
+	lock.RLock()
+	defer lock.RUnlock()
+
+	userid := sha1.Sum([]byte(username))
+
+	var (
+		deviceAddr  [4]byte
+		deviceBytes []byte
+	)
+
+	results := []SimulationResult{}
+
+	deviceIter := xdpObjects.Devices.Iterate()
+	for deviceIter.Next(&deviceAddr, &deviceBytes) {
+		var device fwentry
+		if err := device.Unpack(deviceBytes); err != nil {
+			return nil, err
+		}
+
+		if device.user_id != userid {
+			continue
+		}
+
+		source := net.IP(deviceAddr[:])
+		if destination.To4() == nil {
+			source = config.TunnelIPv6Address(source)
+			if source == nil {
+				return nil, errors.New("cannot simulate packets to ipv6 addresses as ipv6 tunnel addresses are not enabled")
+			}
+		}
+
+		result, err := simulate(source, destination, port, proto)
+		if err != nil {
+			return nil, err
+		}
+
+		result.Device = net.IP(deviceAddr[:]).String()
+		result.Session = deviceSessionState(device)
+
+		results = append(results, result)
+	}
+
+	if deviceIter.Err() != nil {
+		return nil, errors.New("iterating devices: " + deviceIter.Err().Error())
+	}
+
+	if len(results) == 0 {
+		return nil, fmt.Errorf("user %q has no devices", username)
+	}
+
+	return results, nil
+}
+
+// Runs a single simulated packet through the xdp program, must be called with lock held
+func simulate(source, destination net.IP, port, proto uint16) (result SimulationResult, err error) {
+	result.Source = source.String()
+	result.Destination = destination.String()
+	result.Protocol = uint32(proto)
+
+	if proto == routetypes.TCP || proto == routetypes.UDP || proto == routetypes.SCTP {
+		result.DestinationPort = port
+	}
+
+	packet := simulatedPacket(source, destination, port, proto)
+
+	verdict := make([]byte, verdictSizeBytes)
+	binary.LittleEndian.PutUint32(verdict[0:4], 1)
+
+	input := append(verdict, packet...)
+	output := make([]byte, len(input))
+
+	_, err = xdpObjects.XdpWagFirewall.Run(&ebpf.RunOptions{
+		Data:    input,
+		DataOut: output,
+		Context: xdpContext{Data: verdictSizeBytes, DataEnd: uint32(len(input))},
+	})
+	if err != nil {
+		return result, fmt.Errorf("running simulated packet: %s", err)
+	}
+
+	if binary.LittleEndian.Uint32(output[0:4]) != 1 {
+		return result, errors.New("xdp program did not return a verdict for the simulated packet")
+	}
+
+	result.Allowed = binary.LittleEndian.Uint32(output[4:8]) != 0
+	if !result.Allowed {
+		result.Reason = dropReason(binary.LittleEndian.Uint32(output[8:12]))
+	}
+
+	var policy routetypes.Policy
+	if err := policy.Unpack(output[16:28]); err != nil {
+		return result, err
+	}
+
+	if policy.PolicyType == routetypes.STOP {
+		return result, nil
+	}
+
+	result.Policy = policy.String()
+
+	// The policy may belong to the destination device, if the packet was allowed as a reply to traffic it sent
+	decidingDevice := net.IP(output[12:16])
+	routeAddress := destination
+	if !decidingDevice.Equal(net.IP(source.To16()[12:16])) {
+		routeAddress = source
+	}
+
+	owner, err := deviceUserID(decidingDevice.String())
+	if err != nil {
+		return result, err
+	}
+
+	result.Route, err = matchingRoute(owner, routeAddress)
+	return result, err
+}
+
+// Builds an ipv4 or ipv6 packet with just enough of the transport header for the xdp program
+func simulatedPacket(source, destination net.IP, port, proto uint16) []byte {
+	payload := make([]byte, 20)
+
+	switch proto {
+	case routetypes.ICMP:
+		payload[0] = 8 // echo request
+	case routetypes.ICMPV6:
+		payload[0] = 128 // echo request
+	default:
+		binary.BigEndian.PutUint16(payload[0:2], simulatedSourcePort)
+		binary.BigEndian.PutUint16(payload[2:4], port)
+	}
+
+	if destination.To4() != nil {
+		header := make([]byte, 20)
+		header[0] = 4<<4 | 5
+		binary.BigEndian.PutUint16(header[2:4], uint16(len(header)+len(payload)))
+		header[8] = 64
+		header[9] = byte(proto)
+		copy(header[12:16], source.To4())
+		copy(header[16:20], destination.To4())
+
+		return append(header, payload...)
+	}
+
+	header := make([]byte, 40)
+	header[0] = 6 << 4
+	binary.BigEndian.PutUint16(header[4:6], uint16(len(payload)))
+	header[6] = byte(proto)
+	header[7] = 64
+	copy(header[8:24], source.To16())
+	copy(header[24:40], destination.To16())
+
+	return append(header, payload...)
+}
+
+// The most specific of the users routes that contains address
+func matchingRoute(userid [20]byte, address net.IP) (string, error) {
+	var innerMapID ebpf.MapID
+	if err := xdpObjects.PoliciesTable.Lookup(userid, &innerMapID); err != nil {
+		return "", nil
+	}
+
+	innerMap, err := ebpf.NewMapFromID(innerMapID)
+	if err != nil {
+		return "", fmt.Errorf("map from id: %s", err)
+	}
+	defer innerMap.Close()
+
+	var (
+		k        routetypes.Key
+		policies [routetypes.MAX_POLICIES]routetypes.Policy
+
+		best  routetypes.Key
+		found bool
+	)
+
+	target := routetypes.Key{Prefixlen: 128}
+	copy(target.IP[:], address.To16())
+
+	innerIter := innerMap.Iterate()
+	for innerIter.Next(&k, &policies) {
+		if k.Contains(target) && (!found || k.Prefixlen > best.Prefixlen) {
+			best = k
+			found = true
+		}
+	}
+
+	if innerIter.Err() != nil {
+		return "", innerIter.Err()
+	}
+
+	if !found {
+		return "", nil
+	}
+
+	return best.String(), nil
+}
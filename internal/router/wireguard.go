@@ -1,12 +1,12 @@
 package router
 
 import (
-	"bytes"
+	"crypto/sha1"
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"log"
 	"net"
-	"sort"
 	"time"
 	"unsafe"
 
@@ -15,8 +15,6 @@ import (
 	"github.com/mdlayher/netlink"
 	"golang.org/x/sys/unix"
 
-	"github.com/NHAS/wag/internal/utils"
-
 	"golang.zx2c4.com/wireguard/wgctrl"
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
@@ -73,6 +71,13 @@ func setupWireguard() error {
 			return err
 		}
 
+		if config.Values().Wireguard.Range6 != nil {
+			err = setIp(conn, config.Values().Wireguard.DevName, net.IPNet{IP: config.Values().Wireguard.ServerAddress6, Mask: config.Values().Wireguard.Range6.Mask})
+			if err != nil {
+				return err
+			}
+		}
+
 		key, err := wgtypes.ParseKey(config.Values().Wireguard.PrivateKey)
 		if err != nil {
 			return err
@@ -99,13 +104,16 @@ func setupWireguard() error {
 
 		keepalive := time.Duration(time.Duration(config.Values().Wireguard.PersistentKeepAlive)) * time.Second
 
-		_, network, _ := net.ParseCIDR(device.Address + "/32")
+		allowedIPs, err := peerAllowedIPs(device.Address, device.Routes)
+		if err != nil {
+			return errors.New("setup wireguard device address: " + err.Error())
+		}
 
 		c.Peers = append(c.Peers, wgtypes.PeerConfig{
 			PublicKey:                   pk,
 			PersistentKeepaliveInterval: &keepalive,
 			ReplaceAllowedIPs:           true,
-			AllowedIPs:                  []net.IPNet{*network},
+			AllowedIPs:                  allowedIPs,
 			Endpoint:                    device.Endpoint,
 			PresharedKey:                psk,
 		})
@@ -122,6 +130,12 @@ func setupWireguard() error {
 
 	}
 
+	for _, device := range devices {
+		if err := setGatewayRoutes(device.Routes, true); err != nil {
+			return fmt.Errorf("cannot add routes for gateway %s: %v", device.Address, err)
+		}
+	}
+
 	return nil
 }
 
@@ -157,10 +171,27 @@ func RemovePeer(publickey, address string) error {
 		Remove:    true,
 	})
 
+	owner, ownerErr := deviceUserID(address)
+
+	// Must be read before the device is removed from the firewall
+	gatewayRoutes, routesErr := xdpGatewayRoutes()
+
 	// Try all removals, if any work then the device is effectively blocked
 	err1 := ctrl.ConfigureDevice(config.Values().Wireguard.DevName, c)
 	err2 := xdpRemoveDevice(address)
 
+	if routesErr == nil {
+		if err := setGatewayRoutes(gatewayRoutes[address], false); err != nil {
+			log.Println("unable to remove routes for gateway: ", err)
+		}
+	}
+
+	if ownerErr == nil && err2 == nil {
+		if err := refreshPeerRules(owner); err != nil {
+			log.Println("unable to remove device from rules that use it: ", err)
+		}
+	}
+
 	if err1 != nil {
 		return err1
 	}
@@ -195,7 +226,7 @@ func ReplacePeer(device data.Device, newPublicKey wgtypes.Key) error {
 		return err
 	}
 
-	_, network, err := net.ParseCIDR(device.Address + "/32")
+	allowedIPs, err := peerAllowedIPs(device.Address, device.Routes)
 	if err != nil {
 		return err
 	}
@@ -204,7 +235,7 @@ func ReplacePeer(device data.Device, newPublicKey wgtypes.Key) error {
 		{
 			PublicKey:         newPublicKey,
 			ReplaceAllowedIPs: true,
-			AllowedIPs:        []net.IPNet{*network},
+			AllowedIPs:        allowedIPs,
 		},
 	}
 
@@ -225,47 +256,26 @@ func ListPeers() ([]wgtypes.Peer, error) {
 	return dev.Peers, err
 }
 
-// AddPeer adds the device to wireguard
-func AddPeer(public wgtypes.Key, username string) (address string, psk string, err error) {
+// AddPeer adds the device to wireguard and the xdp firewall, the device must already have been given an address
+// If the device is a gateway the networks behind it are routed to it
+func AddPeer(device data.Device) error {
 
 	lock.Lock()
 	defer lock.Unlock()
 
-	dev, err := ctrl.Device(config.Values().Wireguard.DevName)
-	if err != nil {
-		return "", "", err
-	}
-
-	preshared_key, err := wgtypes.GenerateKey()
+	public, err := wgtypes.ParseKey(device.Publickey)
 	if err != nil {
-		return "", "", err
-	}
-
-	//Poor selection algorithm
-	//If we dont have any peers take the server tun address and increment that
-	newAddress := net.ParseIP(config.Values().Wireguard.ServerAddress.String())
-	if len(dev.Peers) > 0 {
-		addresses := make([]net.IP, 0, len(dev.Peers))
-		for _, peer := range dev.Peers {
-			addresses = append(addresses, net.ParseIP(utils.GetIP(peer.AllowedIPs[0].IP.String())))
-		}
-
-		// Find the last added address
-		sort.Slice(addresses, func(i, j int) bool {
-			return bytes.Compare(addresses[i], addresses[j]) < 0
-		})
-
-		newAddress = addresses[len(addresses)-1]
+		return err
 	}
 
-	newAddress, err = incrementIP(newAddress.String(), config.Values().Wireguard.Range.String())
+	presharedKey, err := wgtypes.ParseKey(device.PresharedKey)
 	if err != nil {
-		return "", "", err
+		return err
 	}
 
-	_, network, err := net.ParseCIDR(newAddress.String() + "/32")
+	allowedIPs, err := peerAllowedIPs(device.Address, device.Routes)
 	if err != nil {
-		return "", "", err
+		return err
 	}
 
 	var c wgtypes.Config
@@ -273,18 +283,33 @@ func AddPeer(public wgtypes.Key, username string) (address string, psk string, e
 		{
 			PublicKey:         public,
 			ReplaceAllowedIPs: true,
-			AllowedIPs:        []net.IPNet{*network},
-			PresharedKey:      &preshared_key,
+			AllowedIPs:        allowedIPs,
+			PresharedKey:      &presharedKey,
 		},
 	}
 
-	err = xdpAddDevice(username, newAddress.String())
+	err = xdpAddDevice(device.Username, device.Address)
 	if err != nil {
+		return err
+	}
+
+	if device.IsGateway() {
+		if err := xdpAddGateway(device.Address, device.Routes); err != nil {
+			return err
+		}
+	}
 
-		return "", "", err
+	// A failure here only affects the other users rules, so the device is still added
+	if err := refreshPeerRules(sha1.Sum([]byte(device.Username))); err != nil {
+		log.Println("unable to add device to rules that use it: ", err)
 	}
 
-	return newAddress.String(), preshared_key.String(), ctrl.ConfigureDevice(config.Values().Wireguard.DevName, c)
+	err = ctrl.ConfigureDevice(config.Values().Wireguard.DevName, c)
+	if err != nil {
+		return err
+	}
+
+	return setGatewayRoutes(device.Routes, true)
 }
 
 func GetPeerRealIp(address string) (string, error) {
@@ -294,7 +319,7 @@ func GetPeerRealIp(address string) (string, error) {
 	}
 
 	for _, peer := range dev.Peers {
-		if len(peer.AllowedIPs) == 1 && peer.AllowedIPs[0].IP.String() == address {
+		if peerAddress(peer).String() == address {
 			return peer.Endpoint.String(), nil
 		}
 	}
@@ -302,22 +327,67 @@ func GetPeerRealIp(address string) (string, error) {
 	return "", errors.New("not found")
 }
 
-func incrementIP(origIP, cidr string) (net.IP, error) {
-	ip := net.ParseIP(origIP)
-	_, ipNet, err := net.ParseCIDR(cidr)
+// peerAllowedIPs returns the wireguard allowed ips for a device, the ipv4 tunnel address, if enabled the ipv6 tunnel address and for gateways the networks behind them
+func peerAllowedIPs(address string, routes []string) ([]net.IPNet, error) {
+	_, network, err := net.ParseCIDR(address + "/32")
 	if err != nil {
-		return ip, err
+		return nil, err
+	}
+
+	allowedIPs := []net.IPNet{*network}
+
+	if ip6 := config.TunnelIPv6Address(network.IP); ip6 != nil {
+		allowedIPs = append(allowedIPs, net.IPNet{IP: ip6, Mask: net.CIDRMask(128, 128)})
 	}
-	for i := len(ip) - 1; i >= 0; i-- {
-		ip[i]++
-		if ip[i] != 0 {
-			break
+
+	for _, route := range routes {
+		_, network, err := net.ParseCIDR(route)
+		if err != nil {
+			return nil, fmt.Errorf("invalid gateway route %q: %s", route, err)
 		}
+
+		allowedIPs = append(allowedIPs, *network)
 	}
-	if !ipNet.Contains(ip) {
-		return ip, fmt.Errorf("overflowed CIDR while incrementing IP (ip: %s range: %s)", ip.String(), ipNet.String())
+
+	return allowedIPs, nil
+}
+
+// peerAddress returns the ipv4 tunnel address of a wireguard peer, which is what identifies the device
+// Gateways also have the networks behind them in their allowed ips, which are never in the tunnel range
+func peerAddress(peer wgtypes.Peer) net.IP {
+	for _, allowed := range peer.AllowedIPs {
+		if allowed.IP.To4() != nil && config.Values().Wireguard.Range.Contains(allowed.IP) {
+			return allowed.IP.To4()
+		}
 	}
-	return ip, nil
+
+	return nil
+}
+
+// Adds or removes kernel routes sending the networks behind a gateway to the wireguard device, if wag manages the device
+func setGatewayRoutes(routes []string, add bool) error {
+	if len(routes) == 0 || config.Values().Wireguard.External {
+		return nil
+	}
+
+	conn, err := netlink.Dial(unix.NETLINK_ROUTE, nil)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	for _, route := range routes {
+		_, network, err := net.ParseCIDR(route)
+		if err != nil {
+			return fmt.Errorf("invalid gateway route %q: %s", route, err)
+		}
+
+		if err := setRoute(conn, config.Values().Wireguard.DevName, *network, add); err != nil {
+			return fmt.Errorf("route %s: %s", route, err)
+		}
+	}
+
+	return nil
 }
 
 func addWg(c *netlink.Conn, name string, address net.IPNet, mtu int) error {
@@ -388,13 +458,23 @@ func setIp(c *netlink.Conn, name string, address net.IPNet) error {
 		Index:  uint32(iface.Index),
 	}
 
+	ip := address.IP.To4()
+	if ip == nil {
+		addrMsg.Family = unix.AF_INET6
+		ip = address.IP.To16()
+	}
+
 	preflen, _ := address.Mask.Size()
 	addrMsg.Prefixlen = uint8(preflen)
 
 	req.Data = addrMsg.Serialize()
 
 	ne := netlink.NewAttributeEncoder()
-	ne.Bytes(unix.IFA_LOCAL, address.IP[:4])
+	ne.Bytes(unix.IFA_LOCAL, ip)
+	if addrMsg.Family == unix.AF_INET6 {
+		// ipv6 addresses are only added to the routing table with IFA_ADDRESS set
+		ne.Bytes(unix.IFA_ADDRESS, ip)
+	}
 
 	msg, err := ne.Encode()
 	if err != nil {
@@ -419,6 +499,71 @@ func setIp(c *netlink.Conn, name string, address net.IPNet) error {
 	return nil
 }
 
+func setRoute(c *netlink.Conn, name string, route net.IPNet, add bool) error {
+
+	req := netlink.Message{
+		Header: netlink.Header{
+			Type:  unix.RTM_NEWROUTE,
+			Flags: netlink.Request | netlink.Create | netlink.Replace | netlink.Acknowledge,
+		},
+	}
+
+	if !add {
+		req.Header.Type = unix.RTM_DELROUTE
+		req.Header.Flags = netlink.Request | netlink.Acknowledge
+	}
+
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return fmt.Errorf("wireguard network iface %s does not exist: %s", name, err)
+	}
+
+	routeMsg := unix.RtMsg{
+		Family:   unix.AF_INET,
+		Table:    unix.RT_TABLE_MAIN,
+		Protocol: unix.RTPROT_STATIC,
+		Scope:    unix.RT_SCOPE_LINK,
+		Type:     unix.RTN_UNICAST,
+	}
+
+	ip := route.IP.To4()
+	if ip == nil {
+		routeMsg.Family = unix.AF_INET6
+		ip = route.IP.To16()
+	}
+
+	preflen, _ := route.Mask.Size()
+	routeMsg.Dst_len = uint8(preflen)
+
+	req.Data = (*(*[unix.SizeofRtMsg]byte)(unsafe.Pointer(&routeMsg)))[:]
+
+	ne := netlink.NewAttributeEncoder()
+	ne.Bytes(unix.RTA_DST, ip)
+	ne.Uint32(unix.RTA_OIF, uint32(iface.Index))
+
+	msg, err := ne.Encode()
+	if err != nil {
+		return fmt.Errorf("failed to encode: %v", err)
+	}
+
+	req.Data = append(req.Data, msg...)
+
+	resp, err := c.Execute(req)
+	if err != nil {
+		return fmt.Errorf("failed to execute message: %v", err)
+	}
+
+	switch resp[0].Header.Type {
+	case netlink.Error:
+		errCode := binary.LittleEndian.Uint32(resp[0].Data)
+		if errCode != 0 {
+			return errors.New("got netlink error: " + fmt.Sprintf("%d", errCode))
+		}
+	}
+
+	return nil
+}
+
 func delWg(c *netlink.Conn, name string) error {
 	infomsg := IfInfomsg{
 		Family: unix.AF_UNSPEC,
@@ -89,7 +89,19 @@ func TestWgAddRemove(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	address, _, err := AddPeer(pk, "toaster")
+	psk, err := wgtypes.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	device, err := data.AllocateDevice("toaster", pk.String(), psk.String(), "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	address := device.Address
+
+	err = AddPeer(device)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -18,7 +18,7 @@ A massive oversimplifcation of what is in this file.
                ┌───────────────────────────────┐             ┌───────────────────────────────────┐
                │      Inactivity Timeout       │             │           Devices                 │
                │                               │             │            map                    │
-               │       uint64 (minutes)        │             │     key: ipv4 (u32)               │
+               │       uint64 (minutes)        │             │     key: ipv4 tunnel addr (u32)   │
                │                               │             │     val: sizeof(struct device)    │
                └───────────────────────────────┘             │                 │                 │
                                                              └─────────────────┼─────────────────┘
@@ -29,17 +29,17 @@ A massive oversimplifcation of what is in this file.
             │                User                 │◄─────────────┼─ userid         char[20]   │
             │                                     │              │  sessionExpiry  uint64     │
             ├─────────────────────────────────────┤              │  lastPacketTime uint64     │
-            │           AccountLocked             │              │  deviceLock     uint32     │
-            │               uint32                │              └────────────────────────────┘
-            ├─────────────────────────────────────┤
+            │           AccountLocked             │              │  lastAuthTime   uint64     │
+            │               uint32                │              │  flags          uint32     │
+            ├─────────────────────────────────────┤              └────────────────────────────┘
             │           Public Routes LPM         │
-            │              key uint32             │             ┌─────────────────────────────┐
+            │       key ipv6 (or ipv4-mapped)     │             ┌─────────────────────────────┐
             │         value policies[128]─────────┼───────┐     │        policy struct        │
             │                                     │       │     │     policy_type uint16      │
             ├─────────────────────────────────────┤       ├────►│     lower_port  uint16      │
             │           MFA Routes LPM            │       │     │     upper_port  uint16      │
-            │              key uint32             │       │     │     proto       uint16      │
-            │         value policies[128] ────────┼───────┘     │                             │
+            │       key ipv6 (or ipv4-mapped)     │       │     │     proto       uint16      │
+            │         value policies[128] ────────┼───────┘     │     fresh_seconds uint32    │
             │                                     │             └─────────────────────────────┘
             └─────────────────────────────────────┘
 
@@ -53,15 +53,15 @@ A massive oversimplifcation of what is in this file.
 │                              │                                                                          │
 │                      ┌───────▼───────┐                                                                  │
 │                      │               │                                                       ┌────────┐ │
-│                      │  Decode IPv4  │                  if packet not ipv4                   │        │ │
+│                      │   Decode IP   │              if packet not ipv4 or ipv6               │        │ │
 │                      │               │  ─────────────────────────────────────────────────────►  DROP  │ │
 │                      │    Header     │                                                       │        │ │
 │                      │               │                                                       └────────┘ │
 │                      └───────┬───────┘                                                                  │
 │                              │                                                                          │
 │                              │                                                                          │
-│                   src : u32  │                                                                          │
-│                   dst : u32  │                                                                          │
+│     src : u8[16] (ipv6 addr) │  ipv4 addresses are ipv4-mapped (::ffff:a.b.c.d)                         │
+│     dst : u8[16] (ipv6 addr) │                                                                          │
 │                              │                                                                          │
 │                              │                                                                          │
 │                 ┌────────────▼─────────────┐                                                            │
@@ -91,7 +91,7 @@ A massive oversimplifcation of what is in this file.
 │                              │                                                                          │
 │                              │                                                                          │
 │ device.LastPacketTime : u64  │                                                                          │
-│                dst_ip : u32  │                                                                          │
+│             dst_ip : u8[16]  │                                                                          │
 │                              │                                                                          │
 │                              │                                                                          │
 │                              │                                                                          │
@@ -121,7 +121,7 @@ A massive oversimplifcation of what is in this file.
 */
 
 #define MAX_POLICIES 128
-#define MAX_MAP_ENTRIES 1024
+#define MAX_MAP_ENTRIES 1024 // Default size, userspace resizes maps from the Firewall config options before loading
 #define MAX_USERID_LENGTH 20 // Length of sha1 hash
 
 // These definitions are used for searching the trie structure to determine the type of rule we've got.
@@ -130,6 +130,44 @@ A massive oversimplifcation of what is in this file.
 #define PUBLIC 4
 #define RANGE 8   // Port & protocol range e.g 22-2000
 #define SINGLE 16 // Single port & protocol
+#define DENY 32   // Explicitly blocked, takes precedence over mfa and public
+
+// Device flags
+#define DEVICE_GATEWAY 1 // The device routes traffic for the networks in device_routes, and authorises itself by completing wireguard handshakes
+
+#define MAX_IPV6_EXT_HEADERS 4 // Number of ipv6 extension headers we will skip before giving up
+
+// Icmp message types, replies are matched against the rule for their request
+#define ICMP_ECHOREPLY 0
+#define ICMP_ECHO 8
+#define ICMP_TIMESTAMP 13
+#define ICMP_TIMESTAMPREPLY 14
+#define ICMPV6_ECHO_REQUEST 128
+#define ICMPV6_ECHO_REPLY 129
+#define ICMP_DEST_UNREACH 3
+#define ICMP_TIME_EXCEEDED 11
+#define ICMP_PARAMETERPROB 12
+#define ICMPV6_DEST_UNREACH 1
+#define ICMPV6_PARAMPROB 4
+
+// Indexes of the flow_timeouts array
+#define FLOW_TIMEOUT_TCP 0
+#define FLOW_TIMEOUT_UDP 1
+#define FLOW_TIMEOUT_OTHER 2
+
+// Reasons for a packet being dropped, reported in drop events
+#define DROP_NO_DEVICE 1      // Neither the source or destination is a known device
+#define DROP_NO_ACCOUNT 2     // The device belongs to a user that doesnt exist
+#define DROP_NO_ROUTE 3       // The destination doesnt match any route for the user
+#define DROP_NO_POLICY 4      // A route matched, but none of its policies matched the port/protocol
+#define DROP_UNAUTHORISED 5   // Matched an MFA policy, but the device is not authorised (or the session has expired)
+#define DROP_ACCOUNT_LOCKED 6 // Matched an MFA policy, but the users account is locked
+#define DROP_DENIED 7         // Matched a deny policy
+#define DROP_STALE_AUTH 8     // Matched an MFA policy that requires a fresh authentication, but the device authenticated too long ago
+#define DROP_NO_FLOW 9        // Traffic to a device that is not part of a flow the device started (or the flow timed out)
+#define DROP_RATE_LIMITED 10  // The user the device belongs to has sent or received more than their rate limit allows
+
+#define MAX_DROP_EVENTS_PER_SECOND 64 // Per cpu limit of drop events sent to userspace
 
 struct bpf_map_def
 {
@@ -146,6 +184,8 @@ enum
 {
     IPPROTO_IP = 0, /* Dummy protocol for TCP		*/
 #define IPPROTO_IP IPPROTO_IP
+    IPPROTO_HOPOPTS = 0, /* IPv6 hop-by-hop options	*/
+#define IPPROTO_HOPOPTS IPPROTO_HOPOPTS
     IPPROTO_ICMP = 1, /* Internet Control Message Protocol	*/
 #define IPPROTO_ICMP IPPROTO_ICMP
     IPPROTO_IGMP = 2, /* Internet Group Management Protocol	*/
@@ -168,6 +208,10 @@ enum
 #define IPPROTO_DCCP IPPROTO_DCCP
     IPPROTO_IPV6 = 41, /* IPv6-in-IPv4 tunnelling		*/
 #define IPPROTO_IPV6 IPPROTO_IPV6
+    IPPROTO_ROUTING = 43, /* IPv6 routing header		*/
+#define IPPROTO_ROUTING IPPROTO_ROUTING
+    IPPROTO_FRAGMENT = 44, /* IPv6 fragmentation header	*/
+#define IPPROTO_FRAGMENT IPPROTO_FRAGMENT
     IPPROTO_RSVP = 46, /* RSVP Protocol			*/
 #define IPPROTO_RSVP IPPROTO_RSVP
     IPPROTO_GRE = 47, /* Cisco GRE tunnels (rfc 1701,1702)	*/
@@ -176,6 +220,10 @@ enum
 #define IPPROTO_ESP IPPROTO_ESP
     IPPROTO_AH = 51, /* Authentication Header protocol	*/
 #define IPPROTO_AH IPPROTO_AH
+    IPPROTO_ICMPV6 = 58, /* ICMPv6			*/
+#define IPPROTO_ICMPV6 IPPROTO_ICMPV6
+    IPPROTO_DSTOPTS = 60, /* IPv6 destination options	*/
+#define IPPROTO_DSTOPTS IPPROTO_DSTOPTS
     IPPROTO_MTP = 92, /* Multicast Transport Protocol		*/
 #define IPPROTO_MTP IPPROTO_MTP
     IPPROTO_BEETPH = 94, /* IP option pseudo header for BEET	*/
@@ -220,6 +268,36 @@ struct iphdr
     /*The options start here. */
 };
 
+struct in6_addr
+{
+    union
+    {
+        __u8 u6_addr8[16];
+        __be32 u6_addr32[4];
+    } in6_u;
+};
+
+struct ipv6hdr
+{
+    __u8 priority : 4,
+        version : 4;
+    __u8 flow_lbl[3];
+
+    __be16 payload_len;
+    __u8 nexthdr;
+    __u8 hop_limit;
+
+    struct in6_addr saddr;
+    struct in6_addr daddr;
+};
+
+// Generic ipv6 extension header (hop-by-hop, routing, destination options), the fragment header is a fixed 8 bytes
+struct ipv6_opt_hdr
+{
+    __u8 nexthdr;
+    __u8 hdrlen; // In 8 octet units, not including the first 8 octets
+};
+
 struct udphdr
 {
     __be16 source;
@@ -275,21 +353,33 @@ struct device
 {
     __u64 sessionExpiry;
     __u64 lastPacketTime;
+    __u64 lastAuthTime; // When the device last completed MFA, for policies that require step up authentication
 
     // Hash of username (sha1 20 bytes)
     // Essentially allows us to compress all usernames, if collisions are a problem in the future we'll move to sha256 or xxhash
     char user_id[MAX_USERID_LENGTH];
 
-    __u32 PAD;
+    __u32 flags;
 
 } __attribute__((__packed__));
 
+// Traffic counters, kept per cpu so there is no contention between cpus when updating them
+struct counters
+{
+    __u64 pass_packets;
+    __u64 pass_bytes;
+
+    __u64 drop_packets;
+    __u64 drop_bytes;
+};
+
+// Both ipv4 and ipv6 addresses are stored as ipv6 addresses, ipv4 addresses are ipv4-mapped (::ffff:a.b.c.d)
 struct ip
 {
-    __u32 src_ip;
+    struct in6_addr src_ip;
     __u16 src_port;
 
-    __u32 dst_ip;
+    struct in6_addr dst_ip;
     __u16 dst_port;
 
     __u32 proto;
@@ -316,10 +406,10 @@ struct bpf_map_def SEC("maps") account_locked = {
 // Two tables of the same construction
 
 // Inner map is a LPM tri, so we use this as the key
-struct ip4_trie_key
+struct ip_trie_key
 {
     __u32 prefixlen; // first member must be u32
-    __u32 addr;
+    struct in6_addr addr;
 } __attribute__((__packed__));
 
 struct policy
@@ -328,8 +418,84 @@ struct policy
     __u16 proto;
     __u16 lower_port;
     __u16 upper_port;
+    __u32 fresh_seconds; // MFA policies only, 0 if any valid session is enough
 } __attribute__((__packed__));
 
+// The outcome of checking a packet
+// Userspace can simulate a packet by running it through the program with a verdict as the xdp metadata, it is filled in and returned in the metadata
+struct verdict
+{
+    // Simulated packets are checked against the current state but do not change it (sessions, flows, counters, rate limits or drop events)
+    __u32 simulated;
+
+    __u32 decision;
+    __u32 reason; // DROP_* if the packet was dropped
+
+    // ipv4 tunnel address of the device whose policies decided the packet
+    __u32 device;
+
+    // The policy that decided the packet, zero if no policy matched
+    struct policy policy;
+};
+
+// Per device (ipv4 tunnel address) traffic counters
+struct bpf_map_def SEC("maps") device_counters = {
+    .type = BPF_MAP_TYPE_PERCPU_HASH,
+    .max_entries = MAX_MAP_ENTRIES,
+    .key_size = sizeof(__u32),
+    .value_size = sizeof(struct counters),
+    .map_flags = 0,
+};
+
+// Per user (hashed username) traffic counters, the aggregate of all of a users devices
+struct bpf_map_def SEC("maps") user_counters = {
+    .type = BPF_MAP_TYPE_PERCPU_HASH,
+    .max_entries = MAX_MAP_ENTRIES,
+    .key_size = MAX_USERID_LENGTH,
+    .value_size = sizeof(struct counters),
+    .map_flags = 0,
+};
+
+// Drop events sent to userspace
+struct drop_event
+{
+    struct in6_addr src;
+    struct in6_addr dst;
+
+    // ipv4 tunnel address of the device involved, 0 if there was no device
+    __u32 device;
+
+    __u16 src_port;
+    __u16 dst_port;
+
+    __u32 proto;
+    __u32 reason;
+
+    // Number of drops on this cpu that were not reported due to rate limiting, since the last event
+    __u64 suppressed;
+};
+
+struct bpf_map_def SEC("maps") drop_events = {
+    .type = BPF_MAP_TYPE_RINGBUF,
+    .max_entries = 1 << 18,
+};
+
+struct drop_event_limit
+{
+    __u64 window_start;
+    __u64 sent;
+    __u64 suppressed;
+};
+
+// Per cpu rate limit for drop events, allows MAX_DROP_EVENTS_PER_SECOND per second
+struct bpf_map_def SEC("maps") drop_event_limiter = {
+    .type = BPF_MAP_TYPE_PERCPU_ARRAY,
+    .max_entries = 1,
+    .key_size = sizeof(__u32),
+    .value_size = sizeof(struct drop_event_limit),
+    .map_flags = 0,
+};
+
 // Hahed username to LPM trie, value size *has* to be u32 as this is a HASH of MAPS
 struct bpf_map_def SEC("maps") policies_table = {
     .type = BPF_MAP_TYPE_HASH_OF_MAPS,
@@ -350,9 +516,114 @@ struct bpf_map_def SEC("maps") inactivity_timeout_minutes = {
     .map_flags = 0,
 };
 
+// Per user inactivity timeout in nano seconds, from group or user policies. If a user isnt in this map the global timeout is used
+struct bpf_map_def SEC("maps") user_inactivity_timeout = {
+    .type = BPF_MAP_TYPE_HASH,
+    .max_entries = MAX_MAP_ENTRIES,
+    .key_size = MAX_USERID_LENGTH,
+    .value_size = sizeof(__u64),
+    .map_flags = 0,
+};
+
+// The ipv6 prefix that wireguard device ipv6 addresses are allocated from, the lower 32 bits of a devices address is its ipv4 address
+// If this is all zeros, then ipv6 tunnel addresses are disabled
+struct bpf_map_def SEC("maps") tunnel_prefix6 = {
+    .type = BPF_MAP_TYPE_ARRAY,
+    .max_entries = 1,
+    .key_size = sizeof(__u32),
+    .value_size = sizeof(struct in6_addr),
+    .map_flags = 0,
+};
+
+// The networks behind gateway devices, the value is the ipv4 tunnel address of the gateway
+// Hosts in these networks are treated as the gateway, so the gateways policies apply to them
+struct bpf_map_def SEC("maps") device_routes = {
+    .type = BPF_MAP_TYPE_LPM_TRIE,
+    .max_entries = MAX_MAP_ENTRIES,
+    .key_size = sizeof(struct ip_trie_key),
+    .value_size = sizeof(__u32),
+    .map_flags = BPF_F_NO_PREALLOC,
+};
+
+// A connection started by a device, keyed from the devices side so that return traffic can be matched to it
+// Ports are in network byte order, for icmp both are the request type and code (type << 8 | code) and 0 for other protocols without ports
+struct flow_key
+{
+    struct in6_addr device;
+    struct in6_addr remote;
+
+    __u16 device_port;
+    __u16 remote_port;
+
+    __u32 proto;
+};
+
+struct flow
+{
+    __u64 created;
+    __u64 last_seen;
+};
+
+// Flows started by devices, return traffic to a device is only allowed if it is part of one of these
+// When the map is full the least recently used flows are replaced
+struct bpf_map_def SEC("maps") flows = {
+    .type = BPF_MAP_TYPE_LRU_HASH,
+    .max_entries = MAX_MAP_ENTRIES,
+    .key_size = sizeof(struct flow_key),
+    .value_size = sizeof(struct flow),
+    .map_flags = 0,
+};
+
+// How long after the last packet return traffic is allowed for a flow, in nano seconds. Indexed by FLOW_TIMEOUT_*
+struct bpf_map_def SEC("maps") flow_timeouts = {
+    .type = BPF_MAP_TYPE_ARRAY,
+    .max_entries = 3,
+    .key_size = sizeof(__u32),
+    .value_size = sizeof(__u64),
+    .map_flags = 0,
+};
+
+#define NS_PER_SECOND 1000000000ULL
+
+// A users rate limit from their policies, in bytes
+struct rate_limit
+{
+    __u64 rate;  // bytes per second
+    __u64 burst; // maximum size of the token bucket
+
+    // Nano seconds for an empty bucket to refill to burst, calculated by userspace so that refilling cannot overflow
+    __u64 fill_time;
+};
+
+struct token_bucket
+{
+    // May go negative by at most one packet, as a packet is allowed whenever there are tokens left
+    __s64 tokens;
+    __u64 last_update;
+};
+
+// Per user rate limits, users that are not in this map are not limited
+struct bpf_map_def SEC("maps") user_rate_limits = {
+    .type = BPF_MAP_TYPE_HASH,
+    .max_entries = MAX_MAP_ENTRIES,
+    .key_size = MAX_USERID_LENGTH,
+    .value_size = sizeof(struct rate_limit),
+    .map_flags = 0,
+};
+
+// Token buckets for users with rate limits, shared between all of a users devices
+// Created by the xdp program on the first packet, userspace removes them when a users limit changes so they start full
+struct bpf_map_def SEC("maps") rate_limit_buckets = {
+    .type = BPF_MAP_TYPE_HASH,
+    .max_entries = MAX_MAP_ENTRIES,
+    .key_size = MAX_USERID_LENGTH,
+    .value_size = sizeof(struct token_bucket),
+    .map_flags = 0,
+};
+
 /*
-Attempt to parse the IPv4 source address from the packet.
-Returns 0 if there is no IPv4 header field; otherwise returns non-zero.
+Attempt to parse the IPv4 or IPv6 source and destination address from the packet.
+Returns 0 if there is no IPv4 or IPv6 header field; otherwise returns non-zero.
 */
 
 #define MAX_PACKET_OFF 0xffff
@@ -372,17 +643,73 @@ static __always_inline int parse_ip_src_dst_addr(struct xdp_md *ctx, struct ip *
         return 0;
     }
 
-    // We dont support ipv6
-    if (ip->version != 4)
+    __u64 ip_header_length = 0;
+    __u8 protocol = 0;
+
+    switch (ip->version)
     {
+    case 4:
+    {
+        protocol = ip->protocol;
+
+        ip_header_length = (ip->ihl * 4);
+
+        // Return the source IP address in network byte order, as an ipv4-mapped address
+        ip_info->src_ip.in6_u.u6_addr32[2] = bpf_htonl(0x0000ffff);
+        ip_info->src_ip.in6_u.u6_addr32[3] = ip->saddr;
+
+        ip_info->dst_ip.in6_u.u6_addr32[2] = bpf_htonl(0x0000ffff);
+        ip_info->dst_ip.in6_u.u6_addr32[3] = ip->daddr;
+
+        break;
+    }
+    case 6:
+    {
+        struct ipv6hdr *ip6 = data;
+        if ((void *)(ip6 + 1) > data_end)
+        {
+            return 0;
+        }
+
+        protocol = ip6->nexthdr;
+        ip_header_length = sizeof(*ip6);
+
+        ip_info->src_ip = ip6->saddr;
+        ip_info->dst_ip = ip6->daddr;
+
+        // Skip over any extension headers to find the upper layer protocol
+        for (int i = 0; i < MAX_IPV6_EXT_HEADERS; i++)
+        {
+            if (protocol != IPPROTO_HOPOPTS && protocol != IPPROTO_ROUTING && protocol != IPPROTO_DSTOPTS && protocol != IPPROTO_FRAGMENT)
+            {
+                break;
+            }
+
+            if (ip_header_length > MAX_PACKET_OFF)
+            {
+                return 0;
+            }
+
+            struct ipv6_opt_hdr *opt = (data + ip_header_length);
+            if ((void *)(opt + 1) > data_end)
+            {
+                return 0;
+            }
+
+            ip_header_length += (protocol == IPPROTO_FRAGMENT) ? 8 : (opt->hdrlen + 1) * 8;
+            protocol = opt->nexthdr;
+        }
+
+        break;
+    }
+    default:
         return 0;
     }
 
-    ip_info->proto = ip->protocol;
+    ip_info->proto = protocol;
     ip_info->dst_port = 0;
     ip_info->src_port = 0;
 
-    __u64 ip_header_length = (ip->ihl * 4);
     if (ip_header_length > MAX_PACKET_OFF)
     {
         return 0;
@@ -393,7 +720,7 @@ static __always_inline int parse_ip_src_dst_addr(struct xdp_md *ctx, struct ip *
         return 0;
     }
 
-    switch (ip->protocol)
+    switch (protocol)
     {
 
     case IPPROTO_UDP:
@@ -427,7 +754,23 @@ static __always_inline int parse_ip_src_dst_addr(struct xdp_md *ctx, struct ip *
 
         break;
     }
+    case IPPROTO_SCTP:
+    {
+        // The sctp common header starts with the source and destination ports, in the same layout as udp
+        struct udphdr *sctph = (data + ip_header_length);
+
+        if (sctph + 1 > (struct udphdr *)data_end)
+        {
+            return 0;
+        }
+
+        ip_info->dst_port = sctph->dest;
+        ip_info->src_port = sctph->source;
+
+        break;
+    }
     case IPPROTO_ICMP:
+    case IPPROTO_ICMPV6:
     {
         struct icmphdr *icmph = (data + ip_header_length);
 
@@ -436,84 +779,308 @@ static __always_inline int parse_ip_src_dst_addr(struct xdp_md *ctx, struct ip *
             return 0;
         }
 
+        // Icmp has no ports, so the message type and code are used in their place (type << 8 | code) so that policies can match specific messages
+        ip_info->dst_port = bpf_htons((icmph->type << 8) | icmph->code);
+        ip_info->src_port = ip_info->dst_port;
+
         break;
     }
     }
 
-    // Return the source IP address in network byte order.
-    ip_info->src_ip = (__u32)(ip->saddr);
-    ip_info->dst_ip = (__u32)(ip->daddr);
-
     return 1;
 }
 
-static __always_inline int conntrack(struct ip *ip_info)
+/*
+Replies coming back to a device must be part of a flow it started, and are also checked against the same rules as the request the device sent.
+For icmp the reply is a different message type, so echo and timestamp replies are treated as the request they answer.
+type_code is in host byte order (type << 8 | code)
+*/
+static __always_inline __u16 icmp_reply_as_request(__u32 proto, __u16 type_code)
 {
+    __u8 type = type_code >> 8;
 
-    __u32 address = ip_info->dst_ip;
-    __u16 port = ip_info->dst_port;
+    if (proto == IPPROTO_ICMP && (type == ICMP_ECHOREPLY || type == ICMP_TIMESTAMPREPLY))
+    {
+        return ((type == ICMP_ECHOREPLY ? ICMP_ECHO : ICMP_TIMESTAMP) << 8) | (type_code & 0xff);
+    }
 
-    // Determine which address is our device
-    struct device *current_device = bpf_map_lookup_elem(&devices, &ip_info->src_ip);
-    if (current_device == NULL)
+    if (proto == IPPROTO_ICMPV6 && type == ICMPV6_ECHO_REPLY)
+    {
+        return (ICMPV6_ECHO_REQUEST << 8) | (type_code & 0xff);
+    }
+
+    return type_code;
+}
+
+/*
+Whether an address is in the ipv6 prefix that device tunnel addresses are allocated from
+*/
+static __always_inline int in_tunnel_prefix6(struct in6_addr *address)
+{
+    __u32 index = 0;
+    struct in6_addr *prefix = bpf_map_lookup_elem(&tunnel_prefix6, &index);
+    if (prefix == NULL)
+    {
+        return 0;
+    }
+
+    // ipv6 is not enabled for the tunnel
+    if (prefix->in6_u.u6_addr32[0] == 0 && prefix->in6_u.u6_addr32[1] == 0 && prefix->in6_u.u6_addr32[2] == 0)
+    {
+        return 0;
+    }
+
+    return address->in6_u.u6_addr32[0] == prefix->in6_u.u6_addr32[0] &&
+           address->in6_u.u6_addr32[1] == prefix->in6_u.u6_addr32[1] &&
+           address->in6_u.u6_addr32[2] == prefix->in6_u.u6_addr32[2];
+}
+
+/*
+Returns the ipv4 tunnel address of the device that an address belongs to, or 0 if it does not belong to a device.
+Devices are keyed by their ipv4 tunnel address, a devices ipv6 tunnel address (if enabled) is the tunnel prefix with the ipv4 address as the lower 32 bits.
+So both ipv4-mapped and tunnel ipv6 addresses resolve to the same device. Addresses in the networks behind a gateway resolve to the gateway
+*/
+static __always_inline __u32 lookup_device(struct in6_addr *address)
+{
+    __u32 device_address = address->in6_u.u6_addr32[3];
+
+    int ipv4_mapped = address->in6_u.u6_addr32[0] == 0 && address->in6_u.u6_addr32[1] == 0 && address->in6_u.u6_addr32[2] == bpf_htonl(0x0000ffff);
+    if ((ipv4_mapped || in_tunnel_prefix6(address)) && bpf_map_lookup_elem(&devices, &device_address) != NULL)
+    {
+        return device_address;
+    }
+
+    struct ip_trie_key key = {0};
+    key.addr = *address;
+    key.prefixlen = 128;
+
+    __u32 *gateway_address = bpf_map_lookup_elem(&device_routes, &key);
+    if (gateway_address == NULL)
+    {
+        return 0;
+    }
+
+    device_address = *gateway_address;
+
+    struct device *gateway = bpf_map_lookup_elem(&devices, &device_address);
+    if (gateway == NULL || !(gateway->flags & DEVICE_GATEWAY))
     {
-        current_device = bpf_map_lookup_elem(&devices, &ip_info->dst_ip);
-        if (current_device == NULL)
+        return 0;
+    }
+
+    return device_address;
+}
+
+static __always_inline void update_counters(void *map, void *key, int passed, __u64 bytes)
+{
+    struct counters *current_counters = bpf_map_lookup_elem(map, key);
+    if (current_counters == NULL)
+    {
+        struct counters new_counters = {0};
+        bpf_map_update_elem(map, key, &new_counters, BPF_NOEXIST);
+
+        current_counters = bpf_map_lookup_elem(map, key);
+        if (current_counters == NULL)
         {
-            return 0;
+            return;
         }
+    }
+
+    // Per cpu map, so no need for atomic operations
+    if (passed)
+    {
+        current_counters->pass_packets++;
+        current_counters->pass_bytes += bytes;
+    }
+    else
+    {
+        current_counters->drop_packets++;
+        current_counters->drop_bytes += bytes;
+    }
+}
+
+/*
+Update the device and user traffic counters for a packet.
+This is a global (non-inlined) function so the verifier checks it once, rather than for every path out of conntrack
+*/
+__attribute__((noinline)) int account_packet(__u32 device_address, int passed, __u64 bytes)
+{
+    struct device *current_device = bpf_map_lookup_elem(&devices, &device_address);
+    if (current_device == NULL)
+    {
+        return 0;
+    }
+
+    update_counters(&device_counters, &device_address, passed, bytes);
+    update_counters(&user_counters, current_device->user_id, passed, bytes);
+
+    return 0;
+}
+
+/*
+Checks whether a policy applies to a packet, packet is (proto << 32 | any_proto_port << 16 | port).
+A global function so that the verifier only checks it once, rather than for every policy in the conntrack loop
+*/
+__attribute__((noinline)) int policy_matches(__u16 policy_type, __u16 proto, __u16 lower_port, __u16 upper_port, __u64 packet)
+{
+    __u32 packet_proto = packet >> 32;
+    __u16 port = (proto == 0) ? ((packet >> 16) & 0xffff) : (packet & 0xffff);
+
+    //      0 = ANY
+    // If we match the protocol,
+    //      If type is SINGLE and the port is either any, or equal
+    //      OR
+    //      If type is RANGE and the port is within bounds
+    // icmp policies for any message also apply to icmpv6, icmp policies for specific messages are created for both versions by userspace
+    return (proto == 0 || proto == packet_proto || (proto == IPPROTO_ICMP && packet_proto == IPPROTO_ICMPV6 && policy_type & SINGLE)) &&
+           ((policy_type & SINGLE && (lower_port == 0 || lower_port == port)) ||
+            (policy_type & RANGE && (lower_port <= port && upper_port >= port)));
+}
 
+/*
+Send a rate limited drop event to userspace.
+Again a global function so that the verifier only checks it once
+*/
+__attribute__((noinline)) int emit_drop_event(struct ip *ip_info, __u32 device_address, __u32 reason)
+{
+    if (ip_info == NULL)
+    {
+        return 0;
+    }
+
+    __u32 index = 0;
+    struct drop_event_limit *limit = bpf_map_lookup_elem(&drop_event_limiter, &index);
+    if (limit == NULL)
+    {
+        return 0;
+    }
+
+    __u64 currentTime = bpf_ktime_get_ns();
+    if (currentTime - limit->window_start >= 1000000000)
+    {
+        limit->window_start = currentTime;
+        limit->sent = 0;
+    }
+
+    if (limit->sent >= MAX_DROP_EVENTS_PER_SECOND)
+    {
+        limit->suppressed++;
+        return 0;
+    }
+
+    struct drop_event *event = bpf_ringbuf_reserve(&drop_events, sizeof(struct drop_event), 0);
+    if (event == NULL)
+    {
+        limit->suppressed++;
+        return 0;
+    }
+
+    event->src = ip_info->src_ip;
+    event->dst = ip_info->dst_ip;
+    event->device = device_address;
+    event->src_port = bpf_ntohs(ip_info->src_port);
+    event->dst_port = bpf_ntohs(ip_info->dst_port);
+    event->proto = ip_info->proto;
+    event->reason = reason;
+    event->suppressed = limit->suppressed;
+
+    limit->sent++;
+    limit->suppressed = 0;
+
+    bpf_ringbuf_submit(event, 0);
+
+    return 0;
+}
+
+/*
+Checks a packet against the policies of one of the devices involved in it.
+device_is_src is whether the device sent the packet, if not the packet is checked as if it were a reply to traffic the device sent.
+If the packet is not allowed, the reason is written to the verdict, along with the policy that decided the packet
+A global function so that the verifier only checks it once, even though conntrack may check the policies of both devices
+*/
+__attribute__((noinline)) int device_policies_allow(struct ip *ip_info, __u32 device_address, int device_is_src, struct verdict *verdict)
+{
+    if (ip_info == NULL || verdict == NULL)
+    {
+        return 0;
+    }
+
+    verdict->device = device_address;
+
+    struct device *current_device = bpf_map_lookup_elem(&devices, &device_address);
+    if (current_device == NULL)
+    {
+        verdict->reason = DROP_NO_DEVICE;
+        return 0;
+    }
+
+    struct in6_addr address = ip_info->dst_ip;
+    __u16 port = bpf_ntohs(ip_info->dst_port);
+
+    if (!device_is_src)
+    {
         // Our device is the dst, so what we need to check in the firewall is the src
         address = ip_info->src_ip;
-        port = ip_info->src_port;
+        port = icmp_reply_as_request(ip_info->proto, bpf_ntohs(ip_info->src_port));
     }
 
-    port = bpf_ntohs(port);
+    // Protocols without ports only match port based policies for any protocol if they allow every port, as the port is not meaningful for them
+    __u64 any_proto_port = (ip_info->proto == IPPROTO_TCP || ip_info->proto == IPPROTO_UDP || ip_info->proto == IPPROTO_SCTP) ? port : 0;
+
+    __u64 packet = ((__u64)ip_info->proto << 32) | (any_proto_port << 16) | port;
 
     // Check if the account exists
     __u32 *isAccountLocked = bpf_map_lookup_elem(&account_locked, current_device->user_id);
     if (isAccountLocked == NULL)
     {
+        verdict->reason = DROP_NO_ACCOUNT;
         return 0;
     }
 
-    // // Our userland defined inactivity timeout
-    __u32 index = 0;
-    __u64 *inactivity_timeout = bpf_map_lookup_elem(&inactivity_timeout_minutes, &index);
+    // // Our userland defined inactivity timeout, policies may override the global value per user
+    __u64 *inactivity_timeout = bpf_map_lookup_elem(&user_inactivity_timeout, current_device->user_id);
     if (inactivity_timeout == NULL)
     {
-        return 0;
+        __u32 index = 0;
+        inactivity_timeout = bpf_map_lookup_elem(&inactivity_timeout_minutes, &index);
+        if (inactivity_timeout == NULL)
+        {
+            return 0;
+        }
     }
 
     __u64 currentTime = bpf_ktime_get_ns();
 
     // If the inactivity timeout is not disabled and users session has timed out
-    __u8 isTimedOut = (*inactivity_timeout != __UINT64_MAX__ && ((currentTime - current_device->lastPacketTime) >= *inactivity_timeout));
+    // Gateways are kept authorised by their wireguard handshakes instead, so they do not time out
+    __u8 isTimedOut = (!(current_device->flags & DEVICE_GATEWAY) && *inactivity_timeout != __UINT64_MAX__ && ((currentTime - current_device->lastPacketTime) >= *inactivity_timeout));
 
-    struct ip4_trie_key key = {0};
+    struct ip_trie_key key = {0};
 
     key.addr = address;
-    key.prefixlen = 32;
+    key.prefixlen = 128;
 
     // The inner maps must be a LPM trie
 
-    // Order of preference is MFA -> Public, just in case someone adds multiple entries for the same route to make sure accidental exposure is less likely
+    // Order of preference is Deny -> MFA -> Public, just in case someone adds multiple entries for the same route to make sure accidental exposure is less likely
     // If the key is a match for the LPM in the public table
     void *user_policies = bpf_map_lookup_elem(&policies_table, current_device->user_id);
 
     struct policy *applicable_policies = (user_policies != NULL) ? bpf_map_lookup_elem(user_policies, &key) : NULL;
     if (applicable_policies == NULL)
     {
+        verdict->reason = DROP_NO_ROUTE;
         return 0;
     }
 
-    if (!isTimedOut)
+    if (!isTimedOut && !verdict->simulated)
     {
         // Doesnt matter that this isnt thread safe
         current_device->lastPacketTime = currentTime;
     }
 
     int decision = 0;
+    verdict->reason = DROP_NO_POLICY;
     for (__u16 i = 0; i < MAX_POLICIES; i++)
     {
 
@@ -526,29 +1093,53 @@ static __always_inline int conntrack(struct ip *ip_info)
             return decision;
         }
 
-        //      0 = ANY
-        // If we match the protocol,
-        //      If type is SINGLE and the port is either any, or equal
-        //      OR
-        //      If type is RANGE and the port is within bounds
-        if ((policy.proto == 0 || policy.proto == ip_info->proto) &&
-            ((policy.policy_type & SINGLE && (policy.lower_port == 0 || policy.lower_port == port)) ||
-             (policy.policy_type & RANGE && (policy.lower_port <= port && policy.upper_port >= port))))
+        if (policy_matches(policy.policy_type, policy.proto, policy.lower_port, policy.upper_port, packet))
         {
+            verdict->policy = policy;
+
+            // Deny policies are always sorted first by userspace, so they are seen before any mfa or public match
+            if (policy.policy_type & DENY)
+            {
+                verdict->reason = DROP_DENIED;
+                return 0;
+            }
+
             if (policy.policy_type & PUBLIC)
             {
                 // If a public route matches, it may still be overriden by a MFA policy so we have to check all policies
                 decision = 1;
+                verdict->reason = 0;
             }
             else
             {
                 // MFA restrictions take precedence, so if we match an MFA policy under this route
                 // Then we can fail/succeed fast
 
+                if (*isAccountLocked)
+                {
+                    verdict->reason = DROP_ACCOUNT_LOCKED;
+                    return 0;
+                }
+
+                verdict->reason = DROP_UNAUTHORISED;
+
                 // If device does not belong to a locked account, the device itself isnt locked and if it isnt timed out
-                return (!*isAccountLocked && !isTimedOut && current_device->sessionExpiry != 0 &&
-                        // If either max session lifetime is disabled, or it is before the max lifetime of the session
-                        (current_device->sessionExpiry == __UINT64_MAX__ || currentTime < current_device->sessionExpiry));
+                if (!(!isTimedOut && current_device->sessionExpiry != 0 &&
+                      // If either max session lifetime is disabled, or it is before the max lifetime of the session
+                      (current_device->sessionExpiry == __UINT64_MAX__ || currentTime < current_device->sessionExpiry)))
+                {
+                    return 0;
+                }
+
+                // Step up authentication, the route requires that the device authenticated recently
+                if (policy.fresh_seconds != 0 && (currentTime - current_device->lastAuthTime) >= (__u64)policy.fresh_seconds * 1000000000)
+                {
+                    verdict->reason = DROP_STALE_AUTH;
+                    return 0;
+                }
+
+                verdict->reason = 0;
+                return 1;
             }
         }
     }
@@ -556,16 +1147,331 @@ static __always_inline int conntrack(struct ip *ip_info)
     return 0;
 }
 
+/*
+Errors sent back about packets a device sent (e.g destination unreachable, or ipv6 packet too big) are never part of a flow, so they are allowed by policy alone
+type_code is in host byte order (type << 8 | code)
+*/
+static __always_inline int icmp_is_error(__u32 proto, __u16 type_code)
+{
+    __u8 type = type_code >> 8;
+
+    if (proto == IPPROTO_ICMP)
+    {
+        return type == ICMP_DEST_UNREACH || type == ICMP_TIME_EXCEEDED || type == ICMP_PARAMETERPROB;
+    }
+
+    return proto == IPPROTO_ICMPV6 && type >= ICMPV6_DEST_UNREACH && type <= ICMPV6_PARAMPROB;
+}
+
+/*
+Records a flow for a packet a device sent (device_is_src), or checks that a packet sent to a device is part of a flow it started.
+Returns whether the packet is allowed, if it is not the reason is written to the verdict. Simulated packets do not create or update flows
+A global function so that the verifier only checks it once
+*/
+__attribute__((noinline)) int track_flow(struct ip *ip_info, int device_is_src, struct verdict *verdict)
+{
+    if (ip_info == NULL || verdict == NULL)
+    {
+        return 0;
+    }
+
+    struct flow_key key = {0};
+    key.proto = ip_info->proto;
+
+    if (device_is_src)
+    {
+        key.device = ip_info->src_ip;
+        key.remote = ip_info->dst_ip;
+        key.device_port = ip_info->src_port;
+        key.remote_port = ip_info->dst_port;
+    }
+    else
+    {
+        key.device = ip_info->dst_ip;
+        key.remote = ip_info->src_ip;
+        key.device_port = ip_info->dst_port;
+        key.remote_port = ip_info->src_port;
+    }
+
+    __u32 timeout_index = FLOW_TIMEOUT_OTHER;
+    switch (ip_info->proto)
+    {
+    case IPPROTO_TCP:
+        timeout_index = FLOW_TIMEOUT_TCP;
+        break;
+    case IPPROTO_UDP:
+        timeout_index = FLOW_TIMEOUT_UDP;
+        break;
+    case IPPROTO_SCTP:
+        break;
+    case IPPROTO_ICMP:
+    case IPPROTO_ICMPV6:
+    {
+        // Replies are a different message type to the request, so flows are recorded as the request
+        __u16 type_code = icmp_reply_as_request(ip_info->proto, bpf_ntohs(ip_info->src_port));
+        if (!device_is_src && icmp_is_error(ip_info->proto, type_code))
+        {
+            return 1;
+        }
+
+        key.device_port = bpf_htons(type_code);
+        key.remote_port = key.device_port;
+        break;
+    }
+    default:
+        key.device_port = 0;
+        key.remote_port = 0;
+    }
+
+    __u64 currentTime = bpf_ktime_get_ns();
+
+    __u64 *timeout = bpf_map_lookup_elem(&flow_timeouts, &timeout_index);
+    if (timeout == NULL)
+    {
+        return 0;
+    }
+
+    struct flow *current_flow = bpf_map_lookup_elem(&flows, &key);
+
+    if (device_is_src)
+    {
+        if (verdict->simulated)
+        {
+            return 1;
+        }
+
+        if (current_flow == NULL)
+        {
+            struct flow new_flow = {
+                .created = currentTime,
+                .last_seen = currentTime,
+            };
+
+            bpf_map_update_elem(&flows, &key, &new_flow, BPF_ANY);
+            return 1;
+        }
+
+        // Sending again after the flow has timed out starts a new one
+        if (currentTime - current_flow->last_seen >= *timeout)
+        {
+            current_flow->created = currentTime;
+        }
+
+        current_flow->last_seen = currentTime;
+        return 1;
+    }
+
+    if (current_flow == NULL || currentTime - current_flow->last_seen >= *timeout)
+    {
+        verdict->reason = DROP_NO_FLOW;
+        return 0;
+    }
+
+    if (verdict->simulated)
+    {
+        return 1;
+    }
+
+    // Doesnt matter that this isnt thread safe
+    current_flow->last_seen = currentTime;
+
+    return 1;
+}
+
+/*
+Takes bytes from the token bucket of the user that owns the device, returns 0 if the user is over their rate limit.
+The bucket is shared between cpus, refills may race but at worst that allows slightly more than the limit through
+Simulated packets only check whether the bucket has tokens left
+*/
+__attribute__((noinline)) int rate_limit_allows(__u32 device_address, __u64 bytes, int simulated)
+{
+    struct device *current_device = bpf_map_lookup_elem(&devices, &device_address);
+    if (current_device == NULL)
+    {
+        return 1;
+    }
+
+    struct rate_limit *limit = bpf_map_lookup_elem(&user_rate_limits, current_device->user_id);
+    if (limit == NULL || limit->rate == 0)
+    {
+        return 1;
+    }
+
+    __u64 now = bpf_ktime_get_ns();
+
+    struct token_bucket *bucket = bpf_map_lookup_elem(&rate_limit_buckets, current_device->user_id);
+    if (bucket == NULL && simulated)
+    {
+        return 1;
+    }
+
+    if (bucket == NULL)
+    {
+        struct token_bucket new_bucket = {
+            .tokens = limit->burst,
+            .last_update = now,
+        };
+
+        bpf_map_update_elem(&rate_limit_buckets, current_device->user_id, &new_bucket, BPF_NOEXIST);
+
+        bucket = bpf_map_lookup_elem(&rate_limit_buckets, current_device->user_id);
+        if (bucket == NULL)
+        {
+            return 1;
+        }
+    }
+
+    __u64 last_update = bucket->last_update;
+    if (now > last_update)
+    {
+        __u64 elapsed = now - last_update;
+
+        __s64 tokens = limit->burst;
+        if (elapsed < limit->fill_time)
+        {
+            // elapsed * rate / NS_PER_SECOND, split so that the multiplication cannot overflow
+            tokens = bucket->tokens + (elapsed / NS_PER_SECOND) * limit->rate + ((elapsed % NS_PER_SECOND) * limit->rate) / NS_PER_SECOND;
+            if (tokens > (__s64)limit->burst)
+            {
+                tokens = limit->burst;
+            }
+        }
+
+        if (simulated)
+        {
+            return tokens > 0;
+        }
+
+        bucket->tokens = tokens;
+        bucket->last_update = now;
+    }
+
+    if (simulated)
+    {
+        return bucket->tokens > 0;
+    }
+
+    if (bucket->tokens <= 0)
+    {
+        return 0;
+    }
+
+    __sync_fetch_and_add(&bucket->tokens, -(__s64)bytes);
+
+    return 1;
+}
+
+/*
+Checks whether the packet should be allowed.
+If a device is involved with the packet, its ipv4 tunnel address is written to device_address (the source device, if both are devices)
+For hosts behind a gateway that is the address of the gateway
+If the packet is not allowed, the reason is written to the verdict
+*/
+static __always_inline int conntrack(struct ip *ip_info, __u32 *device_address, struct verdict *verdict)
+{
+    // Determine which address is our device
+    __u32 src_device = lookup_device(&ip_info->src_ip);
+    __u32 dst_device = lookup_device(&ip_info->dst_ip);
+
+    if (src_device == 0)
+    {
+        if (dst_device == 0)
+        {
+            verdict->reason = DROP_NO_DEVICE;
+            return 0;
+        }
+
+        // Traffic to a device must still be allowed by its policies (e.g the session may have expired), and be part of a flow the device started
+        *device_address = dst_device;
+        return device_policies_allow(ip_info, *device_address, 0, verdict) && track_flow(ip_info, 0, verdict);
+    }
+
+    *device_address = src_device;
+    if (device_policies_allow(ip_info, *device_address, 1, verdict))
+    {
+        return track_flow(ip_info, 1, verdict);
+    }
+
+    if (dst_device == 0)
+    {
+        return 0;
+    }
+
+    // Traffic between two devices is also allowed if it is a reply to a flow the destination device started
+    // The reason the source device was denied is kept, as that is the direction the packet was sent in
+    struct verdict reply = {0};
+    reply.simulated = verdict->simulated;
+
+    if (!(device_policies_allow(ip_info, dst_device, 0, &reply) && track_flow(ip_info, 0, &reply)))
+    {
+        return 0;
+    }
+
+    *verdict = reply;
+    return 1;
+}
+
 SEC("xdp")
 int xdp_wag_firewall(struct xdp_md *ctx)
 {
+    void *data = (void *)(long)ctx->data;
+
+    // Only packets simulated by userspace have metadata
+    struct verdict *simulation = (void *)(long)ctx->data_meta;
+    if ((void *)(simulation + 1) > data)
+    {
+        simulation = NULL;
+    }
+
     struct ip ip_info = {0};
     if (!parse_ip_src_dst_addr(ctx, &ip_info))
     {
         return XDP_DROP;
     }
 
-    if (conntrack(&ip_info))
+    // 0.0.0.0 is never a device address
+    __u32 device_address = 0;
+
+    struct verdict verdict = {0};
+    verdict.simulated = simulation != NULL;
+
+    int decision = conntrack(&ip_info, &device_address, &verdict);
+
+    __u64 bytes = ctx->data_end - ctx->data;
+
+    if (decision && device_address != 0 && !rate_limit_allows(device_address, bytes, verdict.simulated))
+    {
+        decision = 0;
+        verdict.reason = DROP_RATE_LIMITED;
+    }
+
+    if (simulation != NULL)
+    {
+        // The packet pointers must be checked again after calling functions that take the context
+        data = (void *)(long)ctx->data;
+        simulation = (void *)(long)ctx->data_meta;
+        if ((void *)(simulation + 1) > data)
+        {
+            return XDP_DROP;
+        }
+
+        verdict.decision = decision;
+        *simulation = verdict;
+
+        return decision ? XDP_PASS : XDP_DROP;
+    }
+
+    if (device_address != 0)
+    {
+        account_packet(device_address, decision, bytes);
+    }
+
+    if (!decision)
+    {
+        emit_drop_event(&ip_info, device_address, verdict.reason);
+    }
+
+    if (decision)
     {
         return XDP_PASS;
     }
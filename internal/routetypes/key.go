@@ -1,26 +1,52 @@
 package routetypes
 
 import (
+	"bytes"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"net"
 )
 
+// IPv4 addresses are stored as ipv4-mapped ipv6 addresses (::ffff:a.b.c.d) so that both address families can share the same LPM trie
+var v4InV6Prefix = []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0xff, 0xff}
+
 type Key struct {
 
 	// first member must be a prefix u32 wide
 	// rest can are arbitrary
 	Prefixlen uint32
-	IP        [4]byte
+	IP        [16]byte
+}
+
+// NewKey creates a trie key from an address and prefix length, ipv4 addresses have their prefix length adjusted to cover the ipv4-mapped address
+func NewKey(ip net.IP, prefixlen int) Key {
+	var k Key
+
+	if ip.To4() != nil {
+		prefixlen += 96
+	}
+
+	k.Prefixlen = uint32(prefixlen)
+	copy(k.IP[:], ip.To16())
+
+	return k
+}
+
+func (l *Key) isIPv4() bool {
+	return bytes.Equal(l.IP[:12], v4InV6Prefix) && l.Prefixlen >= 96
 }
 
 func (l *Key) AsIP() net.IP {
-	return net.IP(l.IP[:]).To4()
+	if l.isIPv4() {
+		return net.IP(l.IP[:]).To4()
+	}
+
+	return net.IP(l.IP[:])
 }
 
 func (l Key) Bytes() []byte {
-	output := make([]byte, 8)
+	output := make([]byte, 20)
 	binary.LittleEndian.PutUint32(output[0:4], l.Prefixlen)
 	copy(output[4:], l.IP[:])
 
@@ -28,32 +54,32 @@ func (l Key) Bytes() []byte {
 }
 
 func (l *Key) Unpack(b []byte) error {
-	if len(b) != 8 {
+	if len(b) != 20 {
 		return errors.New("too short")
 	}
 
 	l.Prefixlen = binary.LittleEndian.Uint32(b[:4])
 
-	copy(l.IP[:], b[4:8])
+	copy(l.IP[:], b[4:20])
 
 	return nil
 }
 
+// Contains reports whether other is the same as, or a more specific prefix of, this key
+func (l Key) Contains(other Key) bool {
+	if other.Prefixlen < l.Prefixlen {
+		return false
+	}
+
+	network := net.IPNet{IP: l.IP[:], Mask: net.CIDRMask(int(l.Prefixlen), 128)}
+
+	return network.Contains(other.IP[:])
+}
+
 func (l Key) String() string {
-	return fmt.Sprintf("%s/%d", net.IP(l.IP[:]).To4().String(), l.Prefixlen)
-}
-
-func lookupProtocol(t uint16) string {
-	switch t {
-	case ANY:
-		return "any"
-	case TCP:
-		return "tcp"
-	case UDP:
-		return "udp"
-	case ICMP:
-		return "icmp"
-	default:
-		return fmt.Sprintf("unknown(%d)", t)
+	if l.isIPv4() {
+		return fmt.Sprintf("%s/%d", l.AsIP().String(), l.Prefixlen-96)
 	}
+
+	return fmt.Sprintf("%s/%d", l.AsIP().String(), l.Prefixlen)
 }
@@ -3,17 +3,34 @@ package routetypes
 import (
 	"errors"
 	"fmt"
+	"math"
 	"net"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 )
 
+// Resolver looks up the addresses of domains used in rules, it is replaced by the firewall so that domains are re-resolved as their records expire
+var Resolver func(domain string) ([]net.IP, error) = net.LookupIP
+
+// PeerResolver looks up the tunnel addresses of the devices belonging to the user (user:<name>) or group (group:<name>) used in a rule
+// It is replaced by the firewall, until then peer targets have no devices
+var PeerResolver func(target string) ([]net.IP, error) = func(target string) ([]net.IP, error) {
+	return nil, nil
+}
+
 const (
 	MAX_POLICIES = 128
 
-	ICMP = 1  // Internet Control Message
-	TCP  = 6  // Transmission Control
-	UDP  = 17 // User Datagram
+	ICMP   = 1   // Internet Control Message
+	TCP    = 6   // Transmission Control
+	UDP    = 17  // User Datagram
+	GRE    = 47  // Generic Routing Encapsulation
+	ESP    = 50  // Encapsulating Security Payload
+	AH     = 51  // Authentication Header
+	ICMPV6 = 58  // Internet Control Message for IPv6
+	SCTP   = 132 // Stream Control Transmission
 )
 
 type Rule struct {
@@ -24,48 +41,48 @@ type Rule struct {
 	Values      []Policy
 }
 
-func ParseRules(mfa, public []string) (result []Rule, err error) {
+func ParseRules(mfa, public, deny []string) (result []Rule, err error) {
 
 	cache := map[string]int{}
-	// Add
-	for _, rule := range mfa {
-		r, err := parseRule(0, rule)
-		if err != nil {
-			return nil, err
-		}
 
-		for i := range r.Keys {
-			if index, ok := cache[r.Keys[i].String()]; ok {
-				// Maybe do deduplication here? But I'll resolve this if it ever becomes an issue for someone
-				result[index].Values = append(result[index].Values, r.Values...)
-				continue
+	for _, ruleSet := range []struct {
+		restrictionType PolicyType
+		rules           []string
+	}{
+		{0, mfa},
+		{PUBLIC, public},
+		{DENY, deny},
+	} {
+		for _, rule := range ruleSet.rules {
+			r, err := parseRule(ruleSet.restrictionType, rule)
+			if err != nil {
+				return nil, err
 			}
 
-			result = append(result, r)
-			cache[r.Keys[i].String()] = len(result) - 1
-		}
-	}
-
-	for _, rule := range public {
-		r, err := parseRule(PUBLIC, rule)
-		if err != nil {
-			return nil, err
-		}
+			for i := range r.Keys {
+				if index, ok := cache[r.Keys[i].String()]; ok {
+					// Maybe do deduplication here? But I'll resolve this if it ever becomes an issue for someone
+					result[index].Values = append(result[index].Values, r.Values...)
+					continue
+				}
 
-		for i := range r.Keys {
-			if index, ok := cache[r.Keys[i].String()]; ok {
-				// Maybe do deduplication here? But I'll resolve this if it ever becomes an issue for someone
-				result[index].Values = append(result[index].Values, r.Values...)
-				continue
+				// Each key gets its own rule and copy of the policies, as keys are merged with other rules and inherit deny policies separately
+				result = append(result, Rule{
+					Keys:   []Key{r.Keys[i]},
+					Values: append([]Policy(nil), r.Values...),
+				})
+				cache[r.Keys[i].String()] = len(result) - 1
 			}
-
-			result = append(result, r)
-			cache[r.Keys[i].String()] = len(result) - 1
 		}
 	}
+
+	if len(deny) > 0 {
+		inheritDenyPolicies(result)
+	}
+
 	for i := range result {
 		if len(result[i].Values) > MAX_POLICIES {
-			return nil, errors.New("number of policies defined was greather than max")
+			return nil, fmt.Errorf("route %s has %d policies, the maximum number of policies for a single route is %d", result[i].Keys[0], len(result[i].Values), MAX_POLICIES)
 		}
 
 		temp := make([]Policy, 0, MAX_POLICIES)
@@ -79,6 +96,80 @@ func ParseRules(mfa, public []string) (result []Rule, err error) {
 	return
 }
 
+// The xdp firewall only looks at the policies of the longest matching prefix, so deny rules need to be merged with the rules that overlap them.
+// A deny rule inherits the mfa and public policies of the most specific rule that contains it, which is the rule that would have matched without
+// the deny (so 10.0.0.0/8 allowed, 10.0.5.0/24 22/tcp denied still allows the rest of 10.0.5.0/24, but a 10.0.0.0/16 rule in between is used
+// instead of the /8). Every deny rule is copied into every more specific rule it contains.
+// Within a rule, deny policies are placed first as they take precedence: Deny -> MFA -> Public
+// ParseRules gives each rule a single key
+func inheritDenyPolicies(rules []Rule) {
+
+	original := make([][]Policy, len(rules))
+	for i := range rules {
+		original[i] = rules[i].Values
+	}
+
+	covers := func(outer, inner Rule) bool {
+		return outer.Keys[0].Prefixlen < inner.Keys[0].Prefixlen && outer.Keys[0].Contains(inner.Keys[0])
+	}
+
+	// Less specific rules are finished first, so a deny rule inside another deny rule inherits the allow policies that rule inherited
+	order := make([]int, len(rules))
+	for i := range order {
+		order[i] = i
+	}
+
+	sort.SliceStable(order, func(a, b int) bool {
+		return rules[order[a]].Keys[0].Prefixlen < rules[order[b]].Keys[0].Prefixlen
+	})
+
+	for _, i := range order {
+		// original holds the values of every rule, so they must not be changed in place
+		values := append([]Policy(nil), rules[i].Values...)
+
+		hasDeny := false
+		for _, policy := range original[i] {
+			if policy.Is(DENY) {
+				hasDeny = true
+				break
+			}
+		}
+
+		nearest := -1
+		for j := range rules {
+			if i == j || !covers(rules[j], rules[i]) {
+				continue
+			}
+
+			// A less specific deny always applies
+			for _, policy := range original[j] {
+				if policy.Is(DENY) {
+					values = append(values, policy)
+				}
+			}
+
+			if nearest == -1 || rules[j].Keys[0].Prefixlen > rules[nearest].Keys[0].Prefixlen {
+				nearest = j
+			}
+		}
+
+		// A less specific allow only matters if this rule would otherwise hide it, and only the rule that would have matched is hidden
+		if hasDeny && nearest != -1 {
+			for _, policy := range rules[nearest].Values {
+				if !policy.Is(DENY) {
+					values = append(values, policy)
+				}
+			}
+		}
+
+		sort.SliceStable(values, func(a, b int) bool {
+			return values[a].Is(DENY) && !values[b].Is(DENY)
+		})
+
+		rules[i].Values = values
+	}
+}
+
 func AclsToRoutes(rules []string) (routes []string, err error) {
 
 	for _, rule := range rules {
@@ -87,6 +178,11 @@ func AclsToRoutes(rules []string) (routes []string, err error) {
 			return nil, errors.New("could not split correct number of rules")
 		}
 
+		// Device addresses change as devices are added and removed, so they cant be given to clients as routes
+		if IsPeerTarget(ruleParts[0]) {
+			continue
+		}
+
 		keys, err := parseKeys(ruleParts[0])
 		if err != nil {
 			return rules, errors.New("could not parse address " + ruleParts[0] + " err: " + err.Error())
@@ -100,6 +196,55 @@ func AclsToRoutes(rules []string) (routes []string, err error) {
 	return
 }
 
+// Domains returns the domain names used as addresses in rules, without resolving them
+func Domains(rules ...[]string) (domains []string) {
+	seen := map[string]bool{}
+	for _, ruleSet := range rules {
+		for _, rule := range ruleSet {
+			ruleParts := strings.Fields(rule)
+			if len(ruleParts) < 1 || seen[ruleParts[0]] || IsPeerTarget(ruleParts[0]) {
+				continue
+			}
+
+			if net.ParseIP(ruleParts[0]) != nil {
+				continue
+			}
+
+			if _, _, err := net.ParseCIDR(ruleParts[0]); err == nil {
+				continue
+			}
+
+			seen[ruleParts[0]] = true
+			domains = append(domains, ruleParts[0])
+		}
+	}
+
+	return
+}
+
+// IsPeerTarget returns whether the address of a rule refers to the devices of a user or group, rather than a network or domain
+func IsPeerTarget(address string) bool {
+	return strings.HasPrefix(address, "user:") || strings.HasPrefix(address, "group:")
+}
+
+// PeerTargets returns the users and groups used as addresses in rules, e.g user:jim or group:build-agents
+func PeerTargets(rules ...[]string) (targets []string) {
+	seen := map[string]bool{}
+	for _, ruleSet := range rules {
+		for _, rule := range ruleSet {
+			ruleParts := strings.Fields(rule)
+			if len(ruleParts) < 1 || seen[ruleParts[0]] || !IsPeerTarget(ruleParts[0]) {
+				continue
+			}
+
+			seen[ruleParts[0]] = true
+			targets = append(targets, ruleParts[0])
+		}
+	}
+
+	return
+}
+
 func parseRule(restrictionType PolicyType, rule string) (rules Rule, err error) {
 	ruleParts := strings.Fields(rule)
 	if len(ruleParts) < 1 {
@@ -115,26 +260,56 @@ func parseRule(restrictionType PolicyType, rule string) (rules Rule, err error)
 
 	rules.Values = []Policy{}
 
+	// Freshness qualifiers apply to all services in the rule, e.g 10.1.2.3 22/tcp fresh=15m
+	var freshSeconds uint32
+	services := []string{}
+	for _, field := range ruleParts[1:] {
+		if !strings.HasPrefix(field, "fresh=") {
+			services = append(services, field)
+			continue
+		}
+
+		if restrictionType != 0 {
+			return rules, errors.New("fresh= can only be used on mfa rules: " + rule)
+		}
+
+		freshness, err := time.ParseDuration(strings.TrimPrefix(field, "fresh="))
+		if err != nil {
+			return rules, errors.New("could not parse freshness duration: " + field)
+		}
+
+		if freshness < time.Second || freshness.Seconds() > math.MaxUint32 {
+			return rules, errors.New("freshness duration out of range: " + field)
+		}
+
+		freshSeconds = uint32(freshness.Seconds())
+	}
+	ruleParts = append(ruleParts[:1], services...)
+
 	if len(ruleParts) == 1 {
 		// If the user has only defined one address and no ports this counts as an any/any rule
 
 		rules.Values = append(rules.Values, Policy{
-			PolicyType: uint16(restrictionType) | SINGLE,
-			Proto:      ANY,
-			LowerPort:  ANY,
+			PolicyType:   uint16(restrictionType) | SINGLE,
+			Proto:        ANY,
+			LowerPort:    ANY,
+			FreshSeconds: freshSeconds,
 		})
 
 	} else {
 
 		for _, field := range ruleParts[1:] {
-			policy, err := parseService(field)
+			policies, err := parseService(field)
 			if err != nil {
 				return rules, err
 			}
 
-			policy.PolicyType = uint16(restrictionType) | policy.PolicyType
+			for _, policy := range policies {
+				policy.PolicyType = uint16(restrictionType) | policy.PolicyType
+				policy.FreshSeconds = freshSeconds
 
-			rules.Values = append(rules.Values, policy)
+				rules.Values = append(rules.Values, policy)
+			}
 		}
 	}
 
@@ -151,49 +326,74 @@ func parseKeys(address string) (keys []Key, err error) {
 
 		maskLength, _ := ip.Mask.Size()
 
-		keys = append(keys,
-			Key{
-				Prefixlen: uint32(maskLength),
-				IP:        [4]byte{ip.IP.To4()[0], ip.IP.To4()[1], ip.IP.To4()[2], ip.IP.To4()[3]},
-			},
-		)
+		keys = append(keys, NewKey(ip.IP, maskLength))
 	}
 
 	return
 }
 
-func ValidateRules(mfa, public []string) error {
-	_, err := ParseRules(mfa, public)
+func ValidateRules(mfa, public, deny []string) error {
+	_, err := ParseRules(mfa, public, deny)
 	return err
 }
 
-func parseService(service string) (Policy, error) {
-	parts := strings.Split(service, "/")
+func parseService(service string) ([]Policy, error) {
+	parts := strings.Split(strings.ToLower(service), "/")
 	if len(parts) == 1 {
-		// are declarations like `icmp` which dont have a port
-		switch parts[0] {
-		case "icmp":
+		// are declarations like `icmp` or `gre` which dont have a port
+		proto, ok := protocolNames[parts[0]]
+		if !ok || hasPorts(proto) {
+			return nil, errors.New("malformed port/service declaration: " + service)
+		}
 
-			return Policy{
+		return []Policy{
+			{
 				PolicyType: SINGLE,
-				Proto:      ICMP,
+				Proto:      proto,
 				LowerPort:  0,
-			}, nil
+			},
+		}, nil
+	}
+
+	if len(parts) != 2 {
+		return nil, errors.New("malformed port/service declaration: " + service)
+	}
 
-		default:
-			return Policy{}, errors.New("malformed port/service declaration: " + service)
+	port, proto := parts[0], parts[1]
+
+	switch port {
+	case "icmp", "icmpv6":
+		return parseICMP(port, proto)
+
+	case "proto":
+		// Any traffic of an ip protocol, e.g proto/47 or proto/gre
+		number, err := ParseProtocol(proto)
+		if err != nil {
+			return nil, err
 		}
 
+		return []Policy{
+			{
+				PolicyType: SINGLE,
+				Proto:      number,
+				LowerPort:  0,
+			},
+		}, nil
 	}
 
-	portRange := strings.Split(parts[0], "-")
-	proto := strings.ToLower(parts[1])
+	// Protocols with ports may also be written protocol first, e.g sctp/3868 is the same as 3868/sctp
+	if number, ok := protocolNames[port]; ok && hasPorts(number) {
+		port, proto = proto, port
+	}
+
+	portRange := strings.Split(port, "-")
 	if len(portRange) == 1 {
-		br, err := parseSinglePort(parts[0], proto)
-		return br, err
+		br, err := parseSinglePort(port, proto)
+		return []Policy{br}, err
 	}
 
-	return parsePortRange(portRange[0], portRange[1], proto)
+	br, err := parsePortRange(portRange[0], portRange[1], proto)
+	return []Policy{br}, err
 }
 
 func parsePortRange(lowerPort, upperPort, proto string) (Policy, error) {
@@ -222,17 +422,12 @@ func parsePortRange(lowerPort, upperPort, proto string) (Policy, error) {
 			UpperPort: uint16(upperPortNum),
 		}, nil
 
-	case "tcp", "udp":
-
-		service := TCP
-		if proto == "udp" {
-			service = UDP
-		}
+	case "tcp", "udp", "sctp":
 
 		return Policy{
 			PolicyType: RANGE,
 
-			Proto:     uint16(service),
+			Proto:     protocolNames[proto],
 			LowerPort: uint16(lowerPortNum),
 			UpperPort: uint16(upperPortNum),
 		}, nil
@@ -257,16 +452,11 @@ func parseSinglePort(port, proto string) (Policy, error) {
 			LowerPort:  uint16(portNumber),
 		}, nil
 
-	case "tcp", "udp":
-
-		service := TCP
-		if proto == "udp" {
-			service = UDP
-		}
+	case "tcp", "udp", "sctp":
 
 		return Policy{
 			PolicyType: SINGLE,
-			Proto:      uint16(service),
+			Proto:      protocolNames[proto],
 			LowerPort:  uint16(portNumber),
 		}, nil
 	}
@@ -276,6 +466,20 @@ func parseSinglePort(port, proto string) (Policy, error) {
 
 func parseAddress(address string) (resultAddresses []net.IPNet, err error) {
 
+	if IsPeerTarget(address) {
+		if address == "user:" || address == "group:" {
+			return nil, errors.New("no user or group name in " + address)
+		}
+
+		// A user or group with no devices is not an error, devices may be added later
+		addresses, err := PeerResolver(address)
+		if err != nil {
+			return nil, fmt.Errorf("unable to get devices of %s: %s", address, err)
+		}
+
+		return hostAddresses(addresses), nil
+	}
+
 	ip := net.ParseIP(address)
 	if ip == nil {
 
@@ -283,7 +487,7 @@ func parseAddress(address string) (resultAddresses []net.IPNet, err error) {
 		if err != nil {
 
 			//If we suspect this is a domain
-			addresses, err := net.LookupIP(address)
+			addresses, err := Resolver(address)
 			if err != nil {
 				return nil, fmt.Errorf("unable to resolve address from: %s", address)
 			}
@@ -292,29 +496,41 @@ func parseAddress(address string) (resultAddresses []net.IPNet, err error) {
 				return nil, fmt.Errorf("no addresses for %s", address)
 			}
 
-			addedSomething := false
-			for _, addr := range addresses {
-				if addr.To4() != nil {
-					addedSomething = true
-					resultAddresses = append(resultAddresses, net.IPNet{IP: addr.To4(), Mask: net.IPv4Mask(255, 255, 255, 255)})
-				}
-			}
-
-			if !addedSomething {
-				return nil, fmt.Errorf("no addresses for domain %s were added, potentially because they were all ipv6 which is unsupported", address)
-			}
-
-			return resultAddresses, nil
+			return hostAddresses(addresses), nil
 		}
 
 		return []net.IPNet{*cidr}, nil
 	}
 
-	// /32
+	if ip.To4() != nil {
+		// /32
+		return []net.IPNet{
+			{
+				IP:   ip.To4(),
+				Mask: net.CIDRMask(32, 32),
+			},
+		}, nil
+	}
+
+	// /128
 	return []net.IPNet{
 		{
-			IP:   ip.To4(),
-			Mask: net.IPv4Mask(255, 255, 255, 255),
+			IP:   ip.To16(),
+			Mask: net.CIDRMask(128, 128),
 		},
 	}, nil
 }
+
+// Converts addresses to /32 or /128 networks
+func hostAddresses(addresses []net.IP) (resultAddresses []net.IPNet) {
+	for _, addr := range addresses {
+		if addr.To4() != nil {
+			resultAddresses = append(resultAddresses, net.IPNet{IP: addr.To4(), Mask: net.CIDRMask(32, 32)})
+			continue
+		}
+
+		resultAddresses = append(resultAddresses, net.IPNet{IP: addr.To16(), Mask: net.CIDRMask(128, 128)})
+	}
+
+	return
+}
@@ -3,6 +3,7 @@ package routetypes
 import (
 	"fmt"
 	"net"
+	"strings"
 	"testing"
 )
 
@@ -46,10 +47,7 @@ func checkPolicy(reality Policy, expectedValue Policy) error {
 
 func TestParseEasyRules(t *testing.T) {
 
-	expected := Key{
-		IP:        [4]byte{1, 1, 1, 1},
-		Prefixlen: 32,
-	}
+	expected := NewKey(net.ParseIP("1.1.1.1"), 32)
 
 	expectedValue := Policy{
 		PolicyType: SINGLE,
@@ -125,10 +123,7 @@ func TestParseSimpleSingles(t *testing.T) {
 		t.Fatal("expected to define 4 policies got: ", len(br.Values))
 	}
 
-	expectedKey := Key{
-		Prefixlen: 32,
-		IP:        [4]byte{1, 2, 1, 2},
-	}
+	expectedKey := NewKey(net.ParseIP("1.2.1.2"), 32)
 
 	expectedValues := []Policy{
 		{
@@ -154,14 +149,14 @@ func TestParseSimpleSingles(t *testing.T) {
 	}
 
 	for _, key := range br.Keys {
-		if len(key.Bytes()) != 8 {
-			t.Fatal("rules generated key was not 8 bytes")
+		if len(key.Bytes()) != 20 {
+			t.Fatal("rules generated key was not 20 bytes")
 		}
 	}
 
 	for _, policy := range br.Values {
-		if len(policy.Bytes()) != 8 {
-			t.Fatal("policy generated was not 8 bytes")
+		if len(policy.Bytes()) != PolicySize {
+			t.Fatal("policy generated was not the correct size")
 		}
 	}
 
@@ -208,10 +203,7 @@ func TestParsePortRange(t *testing.T) {
 		t.Fatal("expected to define 1 policies for key got: ", len(br.Values))
 	}
 
-	expected := Key{
-		Prefixlen: 32,
-		IP:        [4]byte{1, 3, 1, 3},
-	}
+	expected := NewKey(net.ParseIP("1.3.1.3"), 32)
 
 	expectedValue := Policy{
 		PolicyType: RANGE,
@@ -233,10 +225,7 @@ func TestParsePortRange(t *testing.T) {
 		t.Fatal("failed to parse 1.4.1.4", err)
 	}
 
-	expected = Key{
-		Prefixlen: 32,
-		IP:        [4]byte{1, 4, 1, 4},
-	}
+	expected = NewKey(net.ParseIP("1.4.1.4"), 32)
 
 	expectedValue = Policy{
 		PolicyType: RANGE,
@@ -275,6 +264,46 @@ func TestParsePortRange(t *testing.T) {
 
 }
 
+func TestParseIPv6Rules(t *testing.T) {
+	br, err := parseRule(0, "2001:db8::/32 443/tcp")
+	if err != nil {
+		t.Fatal("failed to parse 2001:db8::/32", err)
+	}
+
+	if len(br.Keys) != 1 {
+		t.Fatal("expected to define 1 key got: ", len(br.Keys))
+	}
+
+	if err := checkKey(br.Keys[0], NewKey(net.ParseIP("2001:db8::"), 32)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := checkPolicy(br.Values[0], Policy{PolicyType: SINGLE, Proto: TCP, LowerPort: 443}); err != nil {
+		t.Fatal(err)
+	}
+
+	br, err = parseRule(0, "2001:db8::1")
+	if err != nil {
+		t.Fatal("failed to parse 2001:db8::1", err)
+	}
+
+	if err := checkKey(br.Keys[0], NewKey(net.ParseIP("2001:db8::1"), 128)); err != nil {
+		t.Fatal(err)
+	}
+
+	routes, err := AclsToRoutes([]string{"2001:db8::1", "2001:db8:1::/48 22/tcp", "1.1.1.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"2001:db8::1/128", "2001:db8:1::/48", "1.1.1.1/32"}
+	for i := range expected {
+		if routes[i] != expected[i] {
+			t.Fatal("Expected: ", expected[i], " got ", routes[i])
+		}
+	}
+}
+
 func TestParseDomainRules(t *testing.T) {
 	_, err := parseRule(0, "google.com 443/tcp")
 	if err != nil {
@@ -282,6 +311,89 @@ func TestParseDomainRules(t *testing.T) {
 	}
 }
 
+func TestDomains(t *testing.T) {
+	domains := Domains([]string{"example.com 443/tcp", "10.0.0.1", "10.0.0.0/8 22/tcp"}, []string{"example.com", "internal.example.com", "2001:db8::1"})
+
+	if len(domains) != 2 || domains[0] != "example.com" || domains[1] != "internal.example.com" {
+		t.Fatal("expected only the unique domains to be returned, got: ", domains)
+	}
+}
+
+func TestParseWithResolver(t *testing.T) {
+	defer func(original func(string) ([]net.IP, error)) {
+		Resolver = original
+	}(Resolver)
+
+	Resolver = func(domain string) ([]net.IP, error) {
+		return []net.IP{net.ParseIP("10.1.1.1"), net.ParseIP("2001:db8::2")}, nil
+	}
+
+	rule, err := parseRule(0, "service.internal 443/tcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rule.Keys) != 2 || rule.Keys[0].String() != "10.1.1.1/32" || rule.Keys[1].String() != "2001:db8::2/128" {
+		t.Fatal("rule did not use the addresses from the resolver: ", rule.Keys)
+	}
+}
+
+func TestParsePeerRules(t *testing.T) {
+	defer func(original func(string) ([]net.IP, error)) {
+		PeerResolver = original
+	}(PeerResolver)
+
+	PeerResolver = func(target string) ([]net.IP, error) {
+		if target == "group:build-agents" {
+			return []net.IP{net.ParseIP("192.168.1.2"), net.ParseIP("fd00::c0a8:102")}, nil
+		}
+
+		return nil, nil
+	}
+
+	rules, err := ParseRules(nil, []string{"group:build-agents 22/tcp", "user:nodevices 22/tcp", "10.0.0.1"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := map[string]bool{}
+	for _, rule := range rules {
+		for _, key := range rule.Keys {
+			keys[key.String()] = true
+		}
+	}
+
+	if len(keys) != 3 || !keys["192.168.1.2/32"] || !keys["fd00::c0a8:102/128"] || !keys["10.0.0.1/32"] {
+		t.Fatal("peer rules did not use the device addresses: ", keys)
+	}
+
+	if rules[0].Values[0].Proto != TCP || rules[0].Values[0].LowerPort != 22 {
+		t.Fatal("peer rule had the wrong policy: ", rules[0].Values[0])
+	}
+
+	if _, err := parseRule(0, "group: 22/tcp"); err == nil {
+		t.Fatal("should fail to parse a group with no name")
+	}
+
+	targets := PeerTargets([]string{"group:build-agents 22/tcp", "10.0.0.1", "user:jim"}, []string{"group:build-agents"})
+	if len(targets) != 2 || targets[0] != "group:build-agents" || targets[1] != "user:jim" {
+		t.Fatal("expected only the unique peer targets to be returned, got: ", targets)
+	}
+
+	if domains := Domains([]string{"group:build-agents 22/tcp", "user:jim"}); len(domains) != 0 {
+		t.Fatal("peer targets should not be treated as domains: ", domains)
+	}
+
+	routes, err := AclsToRoutes([]string{"group:build-agents 22/tcp", "10.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(routes) != 1 || routes[0] != "10.0.0.1/32" {
+		t.Fatal("peer targets should not be given as routes: ", routes)
+	}
+}
+
 func TestParseMalformed(t *testing.T) {
 	_, err := parseRule(0, "")
 	if err == nil {
@@ -323,9 +435,271 @@ func TestParseMalformed(t *testing.T) {
 		"4.4.4.4",
 		"a",
 		"1.1.1.1/23 43/tcp a",
-	}, []string{}); err == nil {
+	}, []string{}, nil); err == nil {
 		t.Fatal("validate should fail if any rule is invalid")
 
 	}
 
 }
+
+func TestParseDenyRules(t *testing.T) {
+
+	rules, err := ParseRules([]string{"192.168.0.0/16 443/tcp"}, []string{"10.0.0.0/8"}, []string{"10.0.5.0/24 22/tcp", "192.168.0.0/16 8443/tcp"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rules) != 3 {
+		t.Fatal("expected 3 rules got: ", len(rules))
+	}
+
+	for _, rule := range rules {
+		policies := rule.Values[:rule.NumPolicies]
+
+		switch rule.Keys[0].String() {
+		case "10.0.0.0/8":
+			if len(policies) != 1 || policies[0].Is(DENY) {
+				t.Fatal("less specific allow should not inherit a more specific deny: ", policies)
+			}
+
+		case "10.0.5.0/24":
+			expected := []Policy{
+				{PolicyType: DENY | SINGLE, Proto: TCP, LowerPort: 22},
+				{PolicyType: PUBLIC | SINGLE, Proto: ANY, LowerPort: ANY},
+			}
+
+			if len(policies) != len(expected) {
+				t.Fatal("deny rule should inherit the less specific allow rule: ", policies)
+			}
+
+			for i := range expected {
+				if policies[i] != expected[i] {
+					t.Fatalf("policy %d was incorrect, expected %s got %s", i, expected[i], policies[i])
+				}
+			}
+
+		case "192.168.0.0/16":
+			if len(policies) != 2 || !policies[0].Is(DENY) || policies[1].Is(DENY) {
+				t.Fatal("deny policies should come first: ", policies)
+			}
+
+		default:
+			t.Fatal("unexpected key: ", rule.Keys[0].String())
+		}
+	}
+
+	if !strings.HasPrefix(Policy{PolicyType: DENY | SINGLE, Proto: TCP, LowerPort: 22}.String(), "deny") {
+		t.Fatal("deny policy should be displayed as deny")
+	}
+}
+
+func TestParseDenyRulesMultipleKeys(t *testing.T) {
+	defer func(original func(string) ([]net.IP, error)) {
+		PeerResolver = original
+	}(PeerResolver)
+
+	PeerResolver = func(target string) ([]net.IP, error) {
+		return []net.IP{net.ParseIP("10.0.5.10"), net.ParseIP("10.0.5.11")}, nil
+	}
+
+	rules, err := ParseRules([]string{"group:devs 22/tcp 80/tcp 443/tcp"}, []string{"10.0.0.0/8"}, []string{"10.0.5.0/24 3306/tcp"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deviceRule := []Policy{
+		{PolicyType: DENY | SINGLE, Proto: TCP, LowerPort: 3306},
+		{PolicyType: SINGLE, Proto: TCP, LowerPort: 22},
+		{PolicyType: SINGLE, Proto: TCP, LowerPort: 80},
+		{PolicyType: SINGLE, Proto: TCP, LowerPort: 443},
+	}
+
+	expected := map[string][]Policy{
+		"10.0.5.10/32": deviceRule,
+		"10.0.5.11/32": deviceRule,
+		"10.0.0.0/8": {
+			{PolicyType: PUBLIC | SINGLE, Proto: ANY, LowerPort: ANY},
+		},
+		"10.0.5.0/24": {
+			{PolicyType: DENY | SINGLE, Proto: TCP, LowerPort: 3306},
+			{PolicyType: PUBLIC | SINGLE, Proto: ANY, LowerPort: ANY},
+		},
+	}
+
+	if len(rules) != len(expected) {
+		t.Fatalf("expected %d rules got: %d", len(expected), len(rules))
+	}
+
+	for _, rule := range rules {
+		if len(rule.Keys) != 1 {
+			t.Fatal("expected each rule to have a single key, got: ", rule.Keys)
+		}
+
+		key := rule.Keys[0].String()
+		policies := rule.Values[:rule.NumPolicies]
+
+		if len(policies) != len(expected[key]) {
+			t.Fatalf("%s had policies %v, expected %v", key, policies, expected[key])
+		}
+
+		for i := range policies {
+			if policies[i] != expected[key][i] {
+				t.Fatalf("%s policy %d was incorrect, expected %s got %s", key, i, expected[key][i], policies[i])
+			}
+		}
+	}
+}
+
+func TestParseNestedDenyRules(t *testing.T) {
+
+	rules, err := ParseRules([]string{"10.0.0.0/16 443/tcp"}, []string{"10.0.0.0/8"}, []string{"10.0.5.0/24 22/tcp", "10.0.5.0/28 8080/tcp"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Without the denies 10.0.5.0/24 matches the /16, so the /8 public rule must not be inherited or 10.0.5.1:80 would become reachable
+	expected := map[string][]Policy{
+		"10.0.0.0/8": {
+			{PolicyType: PUBLIC | SINGLE, Proto: ANY, LowerPort: ANY},
+		},
+		"10.0.0.0/16": {
+			{PolicyType: SINGLE, Proto: TCP, LowerPort: 443},
+		},
+		"10.0.5.0/24": {
+			{PolicyType: DENY | SINGLE, Proto: TCP, LowerPort: 22},
+			{PolicyType: SINGLE, Proto: TCP, LowerPort: 443},
+		},
+		"10.0.5.0/28": {
+			{PolicyType: DENY | SINGLE, Proto: TCP, LowerPort: 8080},
+			{PolicyType: DENY | SINGLE, Proto: TCP, LowerPort: 22},
+			{PolicyType: SINGLE, Proto: TCP, LowerPort: 443},
+		},
+	}
+
+	if len(rules) != len(expected) {
+		t.Fatalf("expected %d rules got: %d", len(expected), len(rules))
+	}
+
+	for _, rule := range rules {
+		key := rule.Keys[0].String()
+		policies := rule.Values[:rule.NumPolicies]
+
+		if len(policies) != len(expected[key]) {
+			t.Fatalf("%s had policies %v, expected %v", key, policies, expected[key])
+		}
+
+		for i := range policies {
+			if policies[i] != expected[key][i] {
+				t.Fatalf("%s policy %d was incorrect, expected %s got %s", key, i, expected[key][i], policies[i])
+			}
+		}
+	}
+}
+
+func TestParseFreshRules(t *testing.T) {
+
+	rules, err := ParseRules([]string{"10.1.2.3 22/tcp fresh=15m", "10.1.2.4 fresh=1h"}, []string{"10.1.2.5"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, rule := range rules {
+		policies := rule.Values[:rule.NumPolicies]
+		if len(policies) != 1 {
+			t.Fatal("expected 1 policy got: ", policies)
+		}
+
+		var expected Policy
+		switch rule.Keys[0].String() {
+		case "10.1.2.3/32":
+			expected = Policy{PolicyType: SINGLE, Proto: TCP, LowerPort: 22, FreshSeconds: 900}
+		case "10.1.2.4/32":
+			expected = Policy{PolicyType: SINGLE, Proto: ANY, LowerPort: ANY, FreshSeconds: 3600}
+		case "10.1.2.5/32":
+			expected = Policy{PolicyType: PUBLIC | SINGLE, Proto: ANY, LowerPort: ANY}
+		default:
+			t.Fatal("unexpected key: ", rule.Keys[0].String())
+		}
+
+		if policies[0] != expected {
+			t.Fatalf("policy was incorrect, expected %s got %s", expected, policies[0])
+		}
+	}
+
+	if !strings.HasSuffix(Policy{PolicyType: SINGLE, Proto: TCP, LowerPort: 22, FreshSeconds: 900}.String(), "fresh=15m0s") {
+		t.Fatal("freshness should be displayed")
+	}
+
+	malformed := [][3][]string{
+		{nil, {"10.1.2.3 22/tcp fresh=15m"}, nil},
+		{nil, nil, {"10.1.2.3 fresh=15m"}},
+		{{"10.1.2.3 fresh=fifteen"}, nil, nil},
+		{{"10.1.2.3 fresh=-1m"}, nil, nil},
+	}
+
+	for _, m := range malformed {
+		if _, err := ParseRules(m[0], m[1], m[2]); err == nil {
+			t.Fatal("should have failed to parse: ", m)
+		}
+	}
+}
+
+func TestParseProtocols(t *testing.T) {
+
+	tests := map[string][]Policy{
+		"icmp/echo-request": {
+			{PolicyType: RANGE, Proto: ICMP, LowerPort: 8 << 8, UpperPort: 8<<8 | 255},
+			{PolicyType: RANGE, Proto: ICMPV6, LowerPort: 128 << 8, UpperPort: 128<<8 | 255},
+		},
+		"icmp/3:4":                     {{PolicyType: RANGE, Proto: ICMP, LowerPort: 3<<8 | 4, UpperPort: 3<<8 | 4}},
+		"icmpv6/packet-too-big":        {{PolicyType: RANGE, Proto: ICMPV6, LowerPort: 2 << 8, UpperPort: 2<<8 | 255}},
+		"icmp/timestamp-request":       {{PolicyType: RANGE, Proto: ICMP, LowerPort: 13 << 8, UpperPort: 13<<8 | 255}},
+		"proto/47":                     {{PolicyType: SINGLE, Proto: GRE}},
+		"proto/esp":                    {{PolicyType: SINGLE, Proto: ESP}},
+		"gre":                          {{PolicyType: SINGLE, Proto: GRE}},
+		"sctp/3868":                    {{PolicyType: SINGLE, Proto: SCTP, LowerPort: 3868}},
+		"3868/sctp":                    {{PolicyType: SINGLE, Proto: SCTP, LowerPort: 3868}},
+		"3868-3870/sctp":               {{PolicyType: RANGE, Proto: SCTP, LowerPort: 3868, UpperPort: 3870}},
+		"icmp":                         {{PolicyType: SINGLE, Proto: ICMP}},
+		"icmp/packet-too-big":          {{PolicyType: RANGE, Proto: ICMPV6, LowerPort: 2 << 8, UpperPort: 2<<8 | 255}},
+		"22/tcp":                       {{PolicyType: SINGLE, Proto: TCP, LowerPort: 22}},
+		"icmpv6/neighbor-solicitation": {{PolicyType: RANGE, Proto: ICMPV6, LowerPort: 135 << 8, UpperPort: 135<<8 | 255}},
+	}
+
+	for service, expected := range tests {
+		rule, err := parseRule(PUBLIC, "10.0.0.1 "+service)
+		if err != nil {
+			t.Fatal(service, ": ", err)
+		}
+
+		if len(rule.Values) != len(expected) {
+			t.Fatal(service, ": expected ", len(expected), " policies got: ", rule.Values)
+		}
+
+		for i := range expected {
+			expected[i].PolicyType |= PUBLIC
+			if rule.Values[i] != expected[i] {
+				t.Fatalf("%s: expected %s got %s", service, expected[i], rule.Values[i])
+			}
+		}
+	}
+
+	for _, malformed := range []string{"proto/256", "proto/0", "proto/tunnel", "icmp/not-a-message", "icmp/256", "icmp/3:300", "icmpv6/timestamp-request", "tcp", "gre/22"} {
+		if _, err := parseRule(PUBLIC, "10.0.0.1 "+malformed); err == nil {
+			t.Fatal("should have failed to parse: ", malformed)
+		}
+	}
+
+	rendered := map[Policy]string{
+		{PolicyType: PUBLIC | RANGE, Proto: ICMP, LowerPort: 8 << 8, UpperPort: 8<<8 | 255}: "public(12) icmp/echo-request",
+		{PolicyType: RANGE, Proto: ICMPV6, LowerPort: 1<<8 | 4, UpperPort: 1<<8 | 4}:        "mfa(8) icmpv6/destination-unreachable:4",
+		{PolicyType: SINGLE, Proto: GRE}:                                                    "mfa(16) any/gre",
+		{PolicyType: SINGLE, Proto: 99}:                                                     "mfa(16) any/proto(99)",
+	}
+
+	for policy, expected := range rendered {
+		if policy.String() != expected {
+			t.Fatalf("expected %q got %q", expected, policy.String())
+		}
+	}
+}
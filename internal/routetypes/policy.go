@@ -4,6 +4,7 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"time"
 )
 
 type PolicyType uint16
@@ -16,16 +17,19 @@ const (
 
 	RANGE
 	SINGLE
+
+	DENY // Explicitly block matching traffic, takes precedence over both mfa and public policies
 )
 
 // Format
 /*
-struct range
+struct policy
 {
 	__u16 policy_type;
     __u16 proto;
     __u16 lower_port;
     __u16 upper_port;
+    __u32 fresh_seconds;
 };
 */
 type Policy struct {
@@ -33,8 +37,14 @@ type Policy struct {
 	Proto      uint16
 	LowerPort  uint16
 	UpperPort  uint16
+
+	// For mfa policies, the maximum number of seconds since the device authenticated (step-up authentication), 0 if any valid session is enough
+	FreshSeconds uint32
 }
 
+// Size in bytes of a marshalled policy
+const PolicySize = 12
+
 func (p *Policy) Is(pt PolicyType) bool {
 	if p.PolicyType == 0 && pt == 0 {
 		return true
@@ -43,18 +53,20 @@ func (p *Policy) Is(pt PolicyType) bool {
 	return p.PolicyType&uint16(pt) != 0
 }
 func (r Policy) Bytes() []byte {
-	output := make([]byte, 8)
+	output := make([]byte, PolicySize)
 	binary.LittleEndian.PutUint16(output, r.PolicyType)
 	binary.LittleEndian.PutUint16(output[2:], r.Proto)
 
 	binary.LittleEndian.PutUint16(output[4:], r.LowerPort)
 	binary.LittleEndian.PutUint16(output[6:], r.UpperPort)
 
+	binary.LittleEndian.PutUint32(output[8:], r.FreshSeconds)
+
 	return output
 }
 
 func (r *Policy) Unpack(b []byte) error {
-	if len(b) < 8 {
+	if len(b) < PolicySize {
 		return errors.New("too short")
 	}
 
@@ -64,6 +76,8 @@ func (r *Policy) Unpack(b []byte) error {
 	r.LowerPort = binary.LittleEndian.Uint16(b[4:])
 	r.UpperPort = binary.LittleEndian.Uint16(b[6:])
 
+	r.FreshSeconds = binary.LittleEndian.Uint32(b[8:])
+
 	return nil
 }
 
@@ -75,20 +89,33 @@ func (r Policy) String() string {
 		restrictionType = "public"
 	}
 
+	if r.Is(DENY) {
+		restrictionType = "deny"
+	}
+
 	if r.Is(STOP) {
 		return "stop"
 	}
 
+	fresh := ""
+	if r.FreshSeconds != 0 {
+		fresh = fmt.Sprintf(" fresh=%s", time.Duration(r.FreshSeconds)*time.Second)
+	}
+
 	if r.Is(SINGLE) {
 		port := fmt.Sprintf("%d", r.LowerPort)
 		if r.LowerPort == 0 {
 			port = "any"
 		}
-		return fmt.Sprintf("%s(%d) %s/%s", restrictionType, r.PolicyType, port, lookupProtocol(r.Proto))
+		return fmt.Sprintf("%s(%d) %s/%s%s", restrictionType, r.PolicyType, port, lookupProtocol(r.Proto), fresh)
+	}
+
+	if r.Is(RANGE) && (r.Proto == ICMP || r.Proto == ICMPV6) {
+		return fmt.Sprintf("%s(%d) %s%s", restrictionType, r.PolicyType, icmpString(r), fresh)
 	}
 
 	if r.Is(RANGE) {
-		return fmt.Sprintf("%s(%d) %d-%d/%s", restrictionType, r.PolicyType, r.LowerPort, r.UpperPort, lookupProtocol(r.Proto))
+		return fmt.Sprintf("%s(%d) %d-%d/%s%s", restrictionType, r.PolicyType, r.LowerPort, r.UpperPort, lookupProtocol(r.Proto), fresh)
 	}
 
 	return "unknown policy"
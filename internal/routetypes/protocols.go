@@ -0,0 +1,146 @@
+package routetypes
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// IP protocols that can be used by name in rules, any other protocol can be given by number with proto/<number>
+var protocolNames = map[string]uint16{
+	"tcp":    TCP,
+	"udp":    UDP,
+	"sctp":   SCTP,
+	"icmp":   ICMP,
+	"icmpv6": ICMPV6,
+	"gre":    GRE,
+	"esp":    ESP,
+	"ah":     AH,
+}
+
+// ICMP message types that can be used by name, -1 if the message doesnt exist for that version of icmp
+var icmpTypeNames = map[string]struct{ v4, v6 int }{
+	"echo-reply":              {0, 129},
+	"destination-unreachable": {3, 1},
+	"source-quench":           {4, -1},
+	"redirect":                {5, 137},
+	"echo-request":            {8, 128},
+	"router-advertisement":    {9, 134},
+	"router-solicitation":     {10, 133},
+	"time-exceeded":           {11, 3},
+	"parameter-problem":       {12, 4},
+	"timestamp-request":       {13, -1},
+	"timestamp-reply":         {14, -1},
+	"packet-too-big":          {-1, 2},
+	"neighbor-solicitation":   {-1, 135},
+	"neighbor-advertisement":  {-1, 136},
+}
+
+// Protocols that have ports, anything else can only be matched by protocol
+func hasPorts(proto uint16) bool {
+	return proto == TCP || proto == UDP || proto == SCTP
+}
+
+func lookupProtocol(t uint16) string {
+	if t == ANY {
+		return "any"
+	}
+
+	for name, proto := range protocolNames {
+		if proto == t {
+			return name
+		}
+	}
+
+	return fmt.Sprintf("proto(%d)", t)
+}
+
+// ParseProtocol returns the ip protocol number of a protocol name (e.g tcp) or number
+func ParseProtocol(proto string) (uint16, error) {
+	if number, ok := protocolNames[proto]; ok {
+		return number, nil
+	}
+
+	number, err := strconv.Atoi(proto)
+	if err != nil || number < 1 || number > 255 {
+		return 0, errors.New("unknown protocol: " + proto)
+	}
+
+	return uint16(number), nil
+}
+
+// The firewall has no ports for icmp, instead the message type and code are used in their place (type << 8 | code)
+// So matching a message type is a range over all of its codes
+func icmpPolicy(proto uint16, messageType, lowerCode, upperCode int) Policy {
+	return Policy{
+		PolicyType: RANGE,
+		Proto:      proto,
+		LowerPort:  uint16(messageType<<8 | lowerCode),
+		UpperPort:  uint16(messageType<<8 | upperCode),
+	}
+}
+
+// Parse icmp/<type>[:<code>] and icmpv6/<type>[:<code>], where type is a name or number
+// Named types apply to both icmp and icmpv6 when used with icmp, as the plain icmp service does
+func parseICMP(proto, message string) (policies []Policy, err error) {
+
+	typePart, codePart, hasCode := strings.Cut(message, ":")
+
+	lowerCode, upperCode := 0, 255
+	if hasCode {
+		lowerCode, err = strconv.Atoi(codePart)
+		if err != nil || lowerCode < 0 || lowerCode > 255 {
+			return nil, errors.New("invalid icmp code: " + message)
+		}
+		upperCode = lowerCode
+	}
+
+	if names, ok := icmpTypeNames[typePart]; ok {
+		if proto == "icmp" && names.v4 != -1 {
+			policies = append(policies, icmpPolicy(ICMP, names.v4, lowerCode, upperCode))
+		}
+
+		if names.v6 != -1 {
+			policies = append(policies, icmpPolicy(ICMPV6, names.v6, lowerCode, upperCode))
+		}
+
+		if len(policies) == 0 {
+			return nil, fmt.Errorf("%s does not have the message type %s", proto, typePart)
+		}
+
+		return policies, nil
+	}
+
+	messageType, err := strconv.Atoi(typePart)
+	if err != nil || messageType < 0 || messageType > 255 {
+		return nil, errors.New("unknown icmp message type: " + message)
+	}
+
+	return []Policy{icmpPolicy(protocolNames[proto], messageType, lowerCode, upperCode)}, nil
+}
+
+// Renders icmp policies in the same format they are written in rules, e.g icmp/echo-request or icmpv6/1:4
+func icmpString(p Policy) string {
+	proto := lookupProtocol(p.Proto)
+	messageType := int(p.LowerPort >> 8)
+
+	message := strconv.Itoa(messageType)
+	for name, types := range icmpTypeNames {
+		if (p.Proto == ICMP && types.v4 == messageType) || (p.Proto == ICMPV6 && types.v6 == messageType) {
+			message = name
+			break
+		}
+	}
+
+	lowerCode, upperCode := p.LowerPort&0xff, p.UpperPort&0xff
+	if lowerCode == 0 && upperCode == 255 {
+		return fmt.Sprintf("%s/%s", proto, message)
+	}
+
+	if lowerCode == upperCode {
+		return fmt.Sprintf("%s/%s:%d", proto, message, lowerCode)
+	}
+
+	return fmt.Sprintf("%s/%s:%d-%d", proto, message, lowerCode, upperCode)
+}
@@ -12,11 +12,13 @@ func TestPolicyMarshalAndUnmarshal(t *testing.T) {
 		Proto:      4444,
 		LowerPort:  2222,
 		UpperPort:  6666,
+
+		FreshSeconds: 900,
 	}
 
 	b := a.Bytes()
-	if len(b)%8 != 0 {
-		t.Fatal("the length of the marshalled bytes is not divisible by 8: ", len(b))
+	if len(b)%PolicySize != 0 {
+		t.Fatal("the length of the marshalled bytes is not divisible by the policy size: ", len(b))
 	}
 
 	var c Policy
@@ -40,18 +42,19 @@ func TestPolicyMarshalAndUnmarshal(t *testing.T) {
 		t.Fatal("the unpacked protocol number was incorrect: expected: ", a.Proto, " got: ", c.Proto)
 	}
 
+	if c.FreshSeconds != a.FreshSeconds {
+		t.Fatal("the unpacked freshness was incorrect: expected: ", a.FreshSeconds, " got: ", c.FreshSeconds)
+	}
+
 }
 
 func TestKeyMarshalAndUnmarshal(t *testing.T) {
 
-	a := Key{
-		Prefixlen: 16,
-		IP:        [4]byte{11, 11, 11, 11},
-	}
+	a := NewKey(net.ParseIP("11.11.11.11"), 16)
 
 	b := a.Bytes()
-	if len(b)%8 != 0 {
-		t.Fatal("the length of the marshalled bytes is not divisible by 8: ", len(b))
+	if len(b) != 20 {
+		t.Fatal("the length of the marshalled bytes is not 20: ", len(b))
 	}
 
 	var c Key
@@ -68,3 +71,34 @@ func TestKeyMarshalAndUnmarshal(t *testing.T) {
 	}
 
 }
+
+func TestIPv6KeyMarshalAndUnmarshal(t *testing.T) {
+
+	a := NewKey(net.ParseIP("2001:db8::1"), 64)
+
+	var c Key
+	if err := c.Unpack(a.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+
+	if c.Prefixlen != 64 {
+		t.Fatal("the unpacked Prefixlen was incorrect: expected: 64 got: ", c.Prefixlen)
+	}
+
+	if !net.IP.Equal(c.AsIP(), net.ParseIP("2001:db8::1")) {
+		t.Fatal("the ip address did not unmarshal correctly: expected: 2001:db8::1 got: ", c.AsIP())
+	}
+
+	if c.String() != "2001:db8::1/64" {
+		t.Fatal("the key string was incorrect: expected: 2001:db8::1/64 got: ", c.String())
+	}
+
+	v4 := NewKey(net.ParseIP("11.11.11.11"), 16)
+	if v4.Prefixlen != 112 {
+		t.Fatal("ipv4 keys should be stored as ipv4-mapped addresses, expected prefix length 112 got: ", v4.Prefixlen)
+	}
+
+	if v4.String() != "11.11.11.11/16" {
+		t.Fatal("the ipv4 key string was incorrect: expected: 11.11.11.11/16 got: ", v4.String())
+	}
+}
@@ -3,6 +3,7 @@ package users
 import (
 	"errors"
 	"fmt"
+	"log"
 	"net"
 
 	"github.com/NHAS/wag/internal/config"
@@ -36,8 +37,7 @@ func (u *user) ResetMfa() error {
 		}
 	}
 
-	// the MFA column is marked as "unique" so just set it as the username as that is also unique
-	err = data.SetUserMfa(u.Username, u.Username, authenticators.UnsetMFA)
+	err = data.DeleteAllMFAFactors(u.Username)
 	if err != nil {
 		return err
 	}
@@ -45,6 +45,58 @@ func (u *user) ResetMfa() error {
 	return u.UnenforceMFA()
 }
 
+// DeleteMFAFactor removes one of the users mfa methods and deauthenticates their devices, as they may have authorised with it
+func (u *user) DeleteMFAFactor(mfaType string) error {
+
+	devices, err := u.GetDevices()
+	if err != nil {
+		return err
+	}
+
+	for _, device := range devices {
+		err := router.Deauthenticate(device.Address)
+		if err != nil {
+			return err
+		}
+	}
+
+	return data.DeleteMFAFactor(u.Username, mfaType)
+}
+
+func (u *user) GetMFAFactors() ([]data.MFAFactor, error) {
+	return data.GetMFAFactors(u.Username)
+}
+
+// GenerateRecoveryCodes replaces the users recovery codes, the codes are only returned here
+func (u *user) GenerateRecoveryCodes() ([]string, error) {
+	return data.GenerateRecoveryCodes(u.Username)
+}
+
+// GetEnrolledMFATypes returns the methods the user can authorise with, their primary method first
+func (u *user) GetEnrolledMFATypes() []string {
+	types, err := data.GetEnrolledMFATypes(u.Username)
+	if err != nil {
+		return nil
+	}
+
+	return types
+}
+
+// CanRegisterMFA returns an error if the user cannot register mfaType from device. Until the user has enrolled a method any device can register one, after that
+// only a device that has recently authorised can add another method, so whoever has one of the users devices cannot add their own
+func (u *user) CanRegisterMFA(device, mfaType string) error {
+	if u.IsEnforcingMFA() && (!router.IsAuthed(device) || router.RequiresStepUp(device)) {
+		return errors.New("device must be authorised to register another mfa method")
+	}
+
+	factor, err := data.GetMFAFactor(u.Username, mfaType)
+	if err == nil && factor.IsEnrolled() {
+		return errors.New(mfaType + " is already registered")
+	}
+
+	return nil
+}
+
 func (u *user) SetDeviceAuthAttempts(address string, number int) error {
 	return data.SetDeviceAuthenticationAttempts(u.Username, address, number)
 }
@@ -81,14 +133,32 @@ func (u *user) GetDevicePresharedKey(address string) (presharedKey string, err e
 	return device.PresharedKey, nil
 }
 
-func (u *user) AddDevice(publickey wgtypes.Key) (device data.Device, err error) {
+// AddDevice gives the device an address and adds it to wireguard, if address is set the device is given that address or an error is returned
+// If routes are set the device is added as a gateway for the networks behind it
+func (u *user) AddDevice(publickey wgtypes.Key, address string, routes []string) (device data.Device, err error) {
+
+	psk, err := wgtypes.GenerateKey()
+	if err != nil {
+		return data.Device{}, err
+	}
 
-	address, psk, err := router.AddPeer(publickey, u.Username)
+	device, err = data.AllocateDevice(u.Username, publickey.String(), psk.String(), address, routes)
 	if err != nil {
 		return data.Device{}, err
 	}
 
-	return data.AddDevice(u.Username, address, publickey.String(), psk)
+	err = router.AddPeer(device)
+	if err != nil {
+		// Undo whatever was added, so the address can be given out again
+		router.RemovePeer(device.Publickey, device.Address)
+		if err := data.DeleteDevice(u.Username, device.Address); err != nil {
+			log.Println("unable to remove device that could not be added to wireguard: ", err)
+		}
+
+		return data.Device{}, err
+	}
+
+	return device, nil
 }
 
 func (u *user) DeleteDevice(address string) (err error) {
@@ -177,7 +247,14 @@ func (u *user) Delete() error {
 		return err
 	}
 
-	return data.DeleteUser(u.Username)
+	err = data.DeleteUser(u.Username)
+	if err != nil {
+		return err
+	}
+
+	config.SetIdentityGroups(u.Username, nil)
+
+	return nil
 }
 
 func (u *user) Authenticate(device, mfaType string, authenticator authenticators.AuthenticatorFunc) error {
@@ -188,7 +265,7 @@ func (u *user) Authenticate(device, mfaType string, authenticator authenticators
 		return err
 	}
 
-	mfa, userMfaType, attempts, locked, err := data.GetAuthenticationDetails(u.Username, device)
+	factor, attempts, locked, err := data.GetAuthenticationDetails(u.Username, device, mfaType)
 	if err != nil {
 		return err
 	}
@@ -201,15 +278,45 @@ func (u *user) Authenticate(device, mfaType string, authenticator authenticators
 		return errors.New("account is locked")
 	}
 
-	if userMfaType != mfaType {
-		return errors.New("authenticator " + mfaType + " used for user with " + userMfaType)
+	enrolling := false
+	switch {
+	case mfaType == authenticators.RecoveryMFA:
+		// Recovery codes stand in for the users methods, so cannot be used until they have registered one
+		if !u.IsEnforcingMFA() {
+			return errors.New("recovery code used for user without mfa registered")
+		}
+
+	case factor.Type == "":
+		return errors.New("authenticator " + mfaType + " used for user without it registered")
+
+	case !factor.IsEnrolled():
+		// Methods that are not enrolled can only be used to complete their registration
+		if err := u.CanRegisterMFA(device, mfaType); err != nil {
+			return err
+		}
+
+		enrolling = true
 	}
 
-	if err := authenticator(mfa, u.Username); err != nil {
+	if err := authenticator(factor.Secret, u.Username); err != nil {
+		if errors.Is(err, authenticators.ErrChallenged) {
+			// Only the users answer to the challenge can be a failed attempt
+			if err := data.DecrementAuthenticationAttempt(u.Username, device); err != nil {
+				return fmt.Errorf("%s %s unable to undo mfa attempt after challenge: %s", u.Username, device, err)
+			}
+		}
+
 		return err
 	}
 
 	// Device has now successfully authenticated
+	if enrolling {
+		err := data.EnrolMFAFactor(u.Username, mfaType)
+		if err != nil {
+			return fmt.Errorf("%s %s failed to enrol %s: %s", u.Username, device, mfaType, err)
+		}
+	}
+
 	if !u.IsEnforcingMFA() {
 		err := u.EnforceMFA()
 		if err != nil {
@@ -239,8 +346,8 @@ func (u *user) Deauthenticate(device string) error {
 	return router.Deauthenticate(device)
 }
 
-func (u *user) MFA() (string, error) {
-	url, err := data.GetMFASecret(u.Username)
+func (u *user) MFA(mfaType string) (string, error) {
+	url, err := data.GetMFASecret(u.Username, mfaType)
 	if err != nil {
 		return "", err
 	}
@@ -248,6 +355,7 @@ func (u *user) MFA() (string, error) {
 	return url, nil
 }
 
+// GetMFAType returns the users primary mfa method, the one they are prompted with first
 func (u *user) GetMFAType() string {
 	mType, err := data.GetMFAType(u.Username)
 
@@ -290,3 +398,66 @@ func GetUserFromAddress(address net.IP) (user, error) {
 
 	return user{ud.Username, ud.Locked, ud.Enforcing}, nil
 }
+
+// SetIdentityGroups records the groups the identity provider source says the user is a member of, replacing those it gave them before so removals take
+// effect. Authenticate refreshes the users acls once the authenticator succeeds, so this is expected to be called from an authenticator
+func SetIdentityGroups(username, source string, groups []string) error {
+	err := data.SetIdentityGroups(username, source, groups)
+	if err != nil {
+		return err
+	}
+
+	stored, err := data.GetIdentityGroups(username)
+	if err != nil {
+		return err
+	}
+
+	// The user may have been given groups by other sources too
+	var all []string
+	for _, group := range stored {
+		all = append(all, group.Group)
+	}
+
+	before := config.Values().Acls.GetUserGroups(username)
+
+	config.SetIdentityGroups(username, all)
+
+	// Other users rules may use the devices of a group the user joined or left as their address
+	changed := map[string]bool{}
+	for _, group := range before {
+		changed[group] = true
+	}
+
+	for _, group := range config.Values().Acls.GetUserGroups(username) {
+		if changed[group] {
+			delete(changed, group)
+			continue
+		}
+		changed[group] = true
+	}
+
+	if len(changed) == 0 {
+		return nil
+	}
+
+	return router.RefreshGroupPeerRules(changed)
+}
+
+// LoadIdentityGroups applies the groups identity providers gave users when they last authorised, so they are in effect after wag restarts
+func LoadIdentityGroups() error {
+	stored, err := data.GetAllIdentityGroups()
+	if err != nil {
+		return err
+	}
+
+	groups := map[string][]string{}
+	for _, group := range stored {
+		groups[group.Username] = append(groups[group.Username], group.Group)
+	}
+
+	for username := range groups {
+		config.SetIdentityGroups(username, groups[username])
+	}
+
+	return nil
+}
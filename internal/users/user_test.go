@@ -77,7 +77,7 @@ func TestAddDevice(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	device, err := user.AddDevice(pubkey)
+	device, err := user.AddDevice(pubkey, "", nil)
 	if err != nil {
 		t.Fatal("unable to add device:", err)
 	}
@@ -114,7 +114,7 @@ func TestDeleteDevice(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	device, err := user.AddDevice(pubkey)
+	device, err := user.AddDevice(pubkey, "", nil)
 	if err != nil {
 		t.Fatal("unable to add device:", err)
 	}
@@ -150,7 +150,7 @@ func TestDeleteUser(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	_, err = user.AddDevice(pubkey)
+	_, err = user.AddDevice(pubkey, "", nil)
 	if err != nil {
 		t.Fatal("unable to add device:", err)
 	}
@@ -160,7 +160,7 @@ func TestDeleteUser(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	_, err = user.AddDevice(pubkey2)
+	_, err = user.AddDevice(pubkey2, "", nil)
 	if err != nil {
 		t.Fatal("unable to add device:", err)
 	}
@@ -25,9 +25,28 @@ func GetIPFromRequest(r *http.Request) net.IP {
 
 		addresses := strings.Split(ips, ",")
 		if ips != "" && len(addresses) > 0 && net.ParseIP(addresses[0]) != nil {
-			return net.ParseIP(addresses[0]).To4()
+			return deviceAddress(net.ParseIP(addresses[0]))
 		}
 	}
 
-	return net.ParseIP(GetIP(r.RemoteAddr)).To4()
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = GetIP(r.RemoteAddr)
+	}
+
+	return deviceAddress(net.ParseIP(host))
+}
+
+// Devices are identified by their ipv4 tunnel address, so requests from a devices ipv6 tunnel address are mapped back to it
+func deviceAddress(ip net.IP) net.IP {
+	if ip == nil || ip.To4() != nil {
+		return ip.To4()
+	}
+
+	range6 := config.Values().Wireguard.Range6
+	if range6 != nil && range6.Contains(ip) {
+		return ip[12:16]
+	}
+
+	return nil
 }
@@ -1,12 +1,17 @@
 package authenticators
 
 import (
+	"errors"
 	"net/http"
 )
 
 // This is passed to the users.Authenticate(...) function
 type AuthenticatorFunc func(mfaSecret, username string) error
 
+// Returned (wrapped) by an AuthenticatorFunc when the user got this step right but must answer a further prompt, e.g a radius server asking for an otp
+// after the users password. It is not counted as a failed attempt, a wrong answer to the prompt is
+var ErrChallenged = errors.New("user was challenged for more input")
+
 // All supported mfa methods, altered in config based on users selection
 var MFA = map[string]Authenticator{}
 
@@ -16,6 +21,11 @@ const (
 	WebauthnMFA = "webauthn"
 	OidcMFA     = "oidc"
 	PamMFA      = "pam"
+	RadiusMFA   = "radius"
+	LdapMFA     = "ldap"
+
+	// Not a method users can register, recovery codes are used when a user cannot use any of their methods
+	RecoveryMFA = "recovery"
 )
 
 type Authenticator interface {
@@ -7,6 +7,7 @@ import (
 	"strings"
 
 	"github.com/NHAS/wag/internal/config"
+	"github.com/NHAS/wag/internal/data"
 	"github.com/NHAS/wag/internal/webserver/authenticators"
 )
 
@@ -26,6 +27,18 @@ func init() {
 	authenticators.MFA[authenticators.WebauthnMFA] = new(Webauthn)
 	authenticators.MFA[authenticators.OidcMFA] = new(Oidc)
 	authenticators.MFA[authenticators.PamMFA] = new(Pam)
+	authenticators.MFA[authenticators.RadiusMFA] = new(Radius)
+	authenticators.MFA[authenticators.LdapMFA] = new(Ldap)
+}
+
+// The number of methods the user can authorise with, so prompts only offer other methods when there are some
+func enrolledMethods(username string) int {
+	types, err := data.GetEnrolledMFATypes(username)
+	if err != nil {
+		return 0
+	}
+
+	return len(types)
 }
 
 func resultMessage(err error) (string, int) {
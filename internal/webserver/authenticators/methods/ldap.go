@@ -0,0 +1,358 @@
+package methods
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/NHAS/wag/internal/config"
+	"github.com/NHAS/wag/internal/data"
+	"github.com/NHAS/wag/internal/router"
+	"github.com/NHAS/wag/internal/users"
+	"github.com/NHAS/wag/internal/utils"
+	"github.com/NHAS/wag/internal/webserver/authenticators"
+	"github.com/NHAS/wag/internal/webserver/resources"
+	"github.com/go-ldap/ldap/v3"
+)
+
+type Ldap struct {
+}
+
+func (l *Ldap) Init(settings map[string]string) error {
+	return nil
+}
+
+func (l *Ldap) Type() string {
+	return authenticators.LdapMFA
+}
+
+func (l *Ldap) FriendlyName() string {
+	return "Directory Login"
+}
+
+func (l *Ldap) RegistrationAPI(w http.ResponseWriter, r *http.Request) {
+	clientTunnelIp := utils.GetIPFromRequest(r)
+
+	user, err := users.GetUserFromAddress(clientTunnelIp)
+	if err != nil {
+		log.Println("unknown", clientTunnelIp, "could not get associated device:", err)
+		http.Error(w, "Bad request", 400)
+		return
+	}
+
+	if err := user.CanRegisterMFA(clientTunnelIp.String(), l.Type()); err != nil {
+		log.Println(user.Username, clientTunnelIp, "tried to register", l.Type(), "mfa:", err)
+
+		http.Error(w, "Bad request", 400)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		err = data.SetUserMfa(user.Username, "LDAPauth", authenticators.LdapMFA)
+		if err != nil {
+			log.Println(user.Username, clientTunnelIp, "unable to save LDAP key to db:", err)
+			http.Error(w, "Unknown error", 500)
+			return
+		}
+
+		jsonResponse(w, user.Username, 200)
+
+	case "POST":
+		err = user.Authenticate(clientTunnelIp.String(), l.Type(), l.AuthoriseFunc(w, r))
+		msg, status := resultMessage(err)
+		jsonResponse(w, msg, status)
+
+		if err != nil {
+			log.Println(user.Username, clientTunnelIp, "failed to authorise: ", err.Error())
+			return
+		}
+
+		log.Println(user.Username, clientTunnelIp, "authorised")
+
+	default:
+		http.NotFound(w, r)
+		return
+	}
+}
+
+func (l *Ldap) AuthorisationAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.NotFound(w, r)
+		return
+	}
+
+	clientTunnelIp := utils.GetIPFromRequest(r)
+
+	if router.IsAuthed(clientTunnelIp.String()) && !router.RequiresStepUp(clientTunnelIp.String()) {
+		w.Header().Set("Content-Type", "text/html; charset=UTF-8")
+		resources.Render("success.html", w, nil)
+		return
+	}
+
+	user, err := users.GetUserFromAddress(clientTunnelIp)
+	if err != nil {
+		log.Println("unknown", clientTunnelIp, "could not get associated device:", err)
+		http.Error(w, "Bad request", 400)
+		return
+	}
+
+	if !user.IsEnforcingMFA() {
+		http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
+		return
+	}
+
+	err = user.Authenticate(clientTunnelIp.String(), l.Type(), l.AuthoriseFunc(w, r))
+
+	msg, status := resultMessage(err)
+	jsonResponse(w, msg, status)
+
+	if err != nil {
+		log.Println(user.Username, clientTunnelIp, "failed to authorise: ", err.Error())
+		return
+	}
+
+	log.Println(user.Username, clientTunnelIp, "authorised")
+}
+
+func (l *Ldap) AuthoriseFunc(w http.ResponseWriter, r *http.Request) authenticators.AuthenticatorFunc {
+	return func(mfaSecret, username string) error {
+		err := r.ParseForm()
+		if err != nil {
+			return err
+		}
+
+		directory, err := newLdapDirectory()
+		if err != nil {
+			return err
+		}
+
+		groups, err := directory.authenticate(username, r.FormValue("password"))
+		if err != nil {
+			return err
+		}
+
+		return directory.storeGroups(username, groups)
+	}
+}
+
+func (l *Ldap) MFAPromptUI(w http.ResponseWriter, r *http.Request, username, ip string) {
+	if err := resources.Render("prompt_mfa_ldap.html", w, &resources.Msg{
+		HelpMail:   config.Values().HelpMail,
+		NumMethods: enrolledMethods(username),
+	}); err != nil {
+		log.Println(username, ip, "unable to render ldap prompt template: ", err)
+	}
+}
+
+func (l *Ldap) RegistrationUI(w http.ResponseWriter, r *http.Request, username, ip string) {
+	if err := resources.Render("register_mfa_ldap.html", w, &resources.Msg{
+		HelpMail:   config.Values().HelpMail,
+		NumMethods: len(authenticators.MFA),
+	}); err != nil {
+		log.Println(username, ip, "unable to render ldap mfa template: ", err)
+	}
+}
+
+func (l *Ldap) LogoutPath() string {
+	return "/"
+}
+
+type ldapDirectory struct {
+	url       string
+	tlsConfig *tls.Config
+
+	bindDN       string
+	bindPassword string
+
+	baseDN     string
+	userFilter string
+
+	// Empty when groups are not synced
+	groupAttribute string
+
+	// Directory groups that are used as acl groups, any others the user is a member of are ignored
+	groupMap    []ldapGroupMapping
+	groupBaseDN *ldap.DN
+
+	timeout time.Duration
+}
+
+type ldapGroupMapping struct {
+	dn    *ldap.DN
+	group string
+}
+
+func newLdapDirectory() (*ldapDirectory, error) {
+	settings := config.Values().Authenticators.LDAP
+
+	u, err := url.Parse(settings.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	directory := &ldapDirectory{
+		url: settings.URL,
+		tlsConfig: &tls.Config{
+			ServerName: u.Hostname(),
+			MinVersion: tls.VersionTLS12,
+		},
+		bindDN:       settings.BindDN,
+		bindPassword: settings.BindPassword,
+		baseDN:       settings.BaseDN,
+		userFilter:   settings.UserFilter,
+		timeout:      time.Duration(settings.TimeoutSeconds) * time.Second,
+	}
+
+	if settings.SyncGroups {
+		directory.groupAttribute = settings.GroupAttribute
+
+		for groupDN, group := range settings.GroupMap {
+			dn, err := ldap.ParseDN(groupDN)
+			if err != nil {
+				return nil, errors.New("invalid ldap group dn " + groupDN + ": " + err.Error())
+			}
+
+			directory.groupMap = append(directory.groupMap, ldapGroupMapping{dn: dn, group: group})
+		}
+
+		if settings.GroupBaseDN != "" {
+			directory.groupBaseDN, err = ldap.ParseDN(settings.GroupBaseDN)
+			if err != nil {
+				return nil, errors.New("invalid ldap group base dn: " + err.Error())
+			}
+		}
+	}
+
+	if settings.CACertPath != "" {
+		pem, err := os.ReadFile(settings.CACertPath)
+		if err != nil {
+			return nil, errors.New("unable to read ldap ca certificates: " + err.Error())
+		}
+
+		directory.tlsConfig.RootCAs = x509.NewCertPool()
+		if !directory.tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no ldap ca certificates in " + settings.CACertPath)
+		}
+	}
+
+	return directory, nil
+}
+
+// connect only returns connections that are encrypted, plain ldap connections are upgraded with StartTLS
+func (d *ldapDirectory) connect() (*ldap.Conn, error) {
+	conn, err := ldap.DialURL(d.url, ldap.DialWithTLSConfig(d.tlsConfig), ldap.DialWithDialer(&net.Dialer{Timeout: d.timeout}))
+	if err != nil {
+		return nil, err
+	}
+
+	conn.SetTimeout(d.timeout)
+
+	if _, isTLS := conn.TLSConnectionState(); !isTLS {
+		if err := conn.StartTLS(d.tlsConfig); err != nil {
+			conn.Close()
+			return nil, errors.New("ldap StartTLS failed: " + err.Error())
+		}
+	}
+
+	return conn, nil
+}
+
+// authenticate finds the users entry, then binds as it with their password. Returns the acl groups of the users directory groups when they are synced
+func (d *ldapDirectory) authenticate(username, password string) ([]string, error) {
+	// An empty password would be an unauthenticated bind, which servers accept for any dn
+	if password == "" {
+		return nil, errors.New("empty ldap password")
+	}
+
+	conn, err := d.connect()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if d.bindDN != "" {
+		if err := conn.Bind(d.bindDN, d.bindPassword); err != nil {
+			return nil, errors.New("ldap search account bind failed: " + err.Error())
+		}
+	}
+
+	var attributes []string
+	if d.groupAttribute != "" {
+		attributes = append(attributes, d.groupAttribute)
+	}
+
+	result, err := conn.Search(ldap.NewSearchRequest(
+		d.baseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, int(d.timeout.Seconds()), false,
+		fmt.Sprintf(d.userFilter, ldap.EscapeFilter(username)),
+		attributes,
+		nil,
+	))
+	if err != nil {
+		return nil, errors.New("ldap user search failed: " + err.Error())
+	}
+
+	if len(result.Entries) != 1 {
+		return nil, fmt.Errorf("ldap user search for %s found %d entries, expected 1", username, len(result.Entries))
+	}
+
+	entry := result.Entries[0]
+	if err := conn.Bind(entry.DN, password); err != nil {
+		return nil, errors.New("ldap bind as " + entry.DN + " failed: " + err.Error())
+	}
+
+	if d.groupAttribute == "" {
+		return nil, nil
+	}
+
+	groups := []string{}
+	for _, groupDN := range entry.GetAttributeValues(d.groupAttribute) {
+		dn, err := ldap.ParseDN(groupDN)
+		if err != nil || len(dn.RDNs) == 0 || len(dn.RDNs[0].Attributes) == 0 {
+			log.Println(username, "has invalid ldap group dn:", groupDN)
+			continue
+		}
+
+		if group, ok := d.aclGroup(dn); ok {
+			groups = append(groups, group)
+		}
+	}
+
+	return groups, nil
+}
+
+// storeGroups replaces the acl groups the user was given by the directory. When groups are not synced any groups stored while they were are removed,
+// otherwise they would keep granting access as they are loaded each time wag starts
+func (d *ldapDirectory) storeGroups(username string, groups []string) error {
+	if d.groupAttribute == "" {
+		groups = nil
+	} else {
+		log.Println(username, "has directory groups: ", groups)
+	}
+
+	return users.SetIdentityGroups(username, authenticators.LdapMFA, groups)
+}
+
+// aclGroup returns the acl group of a directory group, groups that are not mapped or under the group base dn are not used as anyone able to create
+// a group elsewhere in the directory could otherwise grant access
+func (d *ldapDirectory) aclGroup(dn *ldap.DN) (string, bool) {
+	for _, mapping := range d.groupMap {
+		if mapping.dn.EqualFold(dn) {
+			return mapping.group, true
+		}
+	}
+
+	if d.groupBaseDN != nil && d.groupBaseDN.AncestorOfFold(dn) {
+		// CN=VPN Admins,OU=Groups,DC=example,DC=com is the group:VPN Admins acl group
+		return "group:" + dn.RDNs[0].Attributes[0].Value, true
+	}
+
+	return "", false
+}
@@ -0,0 +1,384 @@
+package methods
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/NHAS/wag/internal/config"
+	"github.com/NHAS/wag/internal/data"
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+)
+
+const (
+	ldapSearchDN       = "cn=wag,dc=example,dc=com"
+	ldapSearchPassword = "search password"
+	ldapUserDN         = "uid=toaster,ou=people,dc=example,dc=com"
+	ldapUserPassword   = "hunter2"
+
+	startTLSOID = "1.3.6.1.4.1.1466.20037"
+)
+
+var ldapUserGroups = []string{
+	"cn=VPN Admins,ou=groups,dc=example,dc=com",
+	"cn=developers,ou=wag,ou=groups,dc=example,dc=com",
+	"cn=admins,ou=printers,dc=example,dc=com",
+}
+
+// testDirectory is a stand in ldap server with a search account and a single user, toaster. Like most servers it requires tls before binds are made,
+// and only allows bound connections to search
+type testDirectory struct {
+	tlsConfig *tls.Config
+}
+
+func ldapResult(id int64, tag ber.Tag, code uint16, message string) *ber.Packet {
+	envelope := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+	envelope.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, ""))
+
+	result := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "")
+	result.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, code, ""))
+	result.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	result.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, message, ""))
+	envelope.AppendChild(result)
+
+	return envelope
+}
+
+func ldapEntry(id int64, dn string, attributes map[string][]string) *ber.Packet {
+	envelope := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+	envelope.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, ""))
+
+	entry := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "")
+	entry.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, dn, ""))
+
+	list := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+	for name, values := range attributes {
+		attribute := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+		attribute.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, ""))
+
+		set := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "")
+		for _, value := range values {
+			set.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, value, ""))
+		}
+		attribute.AppendChild(set)
+
+		list.AppendChild(attribute)
+	}
+	entry.AppendChild(list)
+	envelope.AppendChild(entry)
+
+	return envelope
+}
+
+func (td *testDirectory) serve(conn net.Conn, isTLS bool) {
+	defer conn.Close()
+
+	bound := false
+	for {
+		packet, err := ber.ReadPacket(conn)
+		if err != nil || len(packet.Children) < 2 {
+			return
+		}
+
+		id, _ := packet.Children[0].Value.(int64)
+		request := packet.Children[1]
+
+		var responses []*ber.Packet
+		switch request.Tag {
+		case ldap.ApplicationExtendedRequest:
+			if request.Children[0].Data.String() != startTLSOID || isTLS {
+				responses = append(responses, ldapResult(id, ldap.ApplicationExtendedResponse, ldap.LDAPResultProtocolError, "unsupported"))
+				break
+			}
+
+			conn.Write(ldapResult(id, ldap.ApplicationExtendedResponse, ldap.LDAPResultSuccess, "").Bytes())
+
+			conn = tls.Server(conn, td.tlsConfig)
+			isTLS = true
+			continue
+
+		case ldap.ApplicationBindRequest:
+			dn := request.Children[1].Data.String()
+			password := request.Children[2].Data.String()
+
+			code := uint16(ldap.LDAPResultInvalidCredentials)
+			switch {
+			case !isTLS:
+				code = ldap.LDAPResultConfidentialityRequired
+			case dn == ldapSearchDN && password == ldapSearchPassword, dn == ldapUserDN && password == ldapUserPassword:
+				code = ldap.LDAPResultSuccess
+			}
+
+			bound = code == ldap.LDAPResultSuccess
+			responses = append(responses, ldapResult(id, ldap.ApplicationBindResponse, code, ""))
+
+		case ldap.ApplicationSearchRequest:
+			if !bound {
+				responses = append(responses, ldapResult(id, ldap.ApplicationSearchResultDone, ldap.LDAPResultInsufficientAccessRights, "bind first"))
+				break
+			}
+
+			filter, err := ldap.DecompileFilter(request.Children[6])
+			if err == nil && filter == "(uid=toaster)" {
+				attributes := map[string][]string{}
+				for _, attribute := range request.Children[7].Children {
+					if attribute.Data.String() == "memberOf" {
+						attributes["memberOf"] = ldapUserGroups
+					}
+				}
+
+				responses = append(responses, ldapEntry(id, ldapUserDN, attributes))
+			}
+
+			responses = append(responses, ldapResult(id, ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess, ""))
+
+		case ldap.ApplicationUnbindRequest:
+			return
+
+		default:
+			return
+		}
+
+		for _, response := range responses {
+			if _, err := conn.Write(response.Bytes()); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// startTestDirectory starts the stand in server, returning its url and a pool that trusts its certificate
+func startTestDirectory(t *testing.T, ldaps bool) (string, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "ldap.example.com"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(certificate)
+
+	td := &testDirectory{
+		tlsConfig: &tls.Config{
+			Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+		},
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		listener.Close()
+	})
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			if ldaps {
+				conn = tls.Server(conn, td.tlsConfig)
+			}
+
+			go td.serve(conn, ldaps)
+		}
+	}()
+
+	scheme := "ldap://"
+	if ldaps {
+		scheme = "ldaps://"
+	}
+
+	return scheme + listener.Addr().String(), pool
+}
+
+func testLdapDirectory(address string, roots *x509.CertPool) *ldapDirectory {
+	return &ldapDirectory{
+		url: address,
+		tlsConfig: &tls.Config{
+			ServerName: "127.0.0.1",
+			RootCAs:    roots,
+		},
+		bindDN:       ldapSearchDN,
+		bindPassword: ldapSearchPassword,
+		baseDN:       "dc=example,dc=com",
+		userFilter:   "(uid=%s)",
+		timeout:      2 * time.Second,
+	}
+}
+
+func TestLdapAuthenticate(t *testing.T) {
+	for _, ldaps := range []bool{true, false} {
+		address, roots := startTestDirectory(t, ldaps)
+		directory := testLdapDirectory(address, roots)
+
+		groups, err := directory.authenticate("toaster", ldapUserPassword)
+		if err != nil {
+			t.Fatalf("%s: %s", address, err)
+		}
+
+		if groups != nil {
+			t.Fatalf("%s: returned groups when they are not synced: %v", address, groups)
+		}
+
+		for _, password := range []string{"wrong password", ""} {
+			if _, err := directory.authenticate("toaster", password); err == nil {
+				t.Fatalf("%s: accepted password %q", address, password)
+			}
+		}
+
+		// The username is escaped, so cannot match other entries
+		for _, username := range []string{"unknown", "*", "toaster)(uid=*"} {
+			if _, err := directory.authenticate(username, ldapUserPassword); err == nil {
+				t.Fatalf("%s: accepted user %q", address, username)
+			}
+		}
+
+		directory.bindPassword = "wrong password"
+		if _, err := directory.authenticate("toaster", ldapUserPassword); err == nil {
+			t.Fatalf("%s: searched with a search account that could not bind", address)
+		}
+	}
+}
+
+func TestLdapUntrustedServer(t *testing.T) {
+	for _, ldaps := range []bool{true, false} {
+		address, _ := startTestDirectory(t, ldaps)
+
+		if _, err := testLdapDirectory(address, x509.NewCertPool()).authenticate("toaster", ldapUserPassword); err == nil {
+			t.Fatalf("%s: sent password to server with untrusted certificate", address)
+		}
+	}
+}
+
+func TestLdapGroups(t *testing.T) {
+	address, roots := startTestDirectory(t, true)
+
+	directory := testLdapDirectory(address, roots)
+	directory.groupAttribute = "memberOf"
+
+	groups, err := directory.authenticate("toaster", ldapUserPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(groups) != 0 {
+		t.Fatal("used directory groups that were not mapped or under the group base dn: ", groups)
+	}
+
+	adminsDN, err := ldap.ParseDN("CN=VPN Admins,OU=Groups,DC=example,DC=com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	directory.groupMap = []ldapGroupMapping{{dn: adminsDN, group: "group:admins"}}
+	directory.groupBaseDN, err = ldap.ParseDN("ou=wag,ou=groups,dc=example,dc=com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	groups, err = directory.authenticate("toaster", ldapUserPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// cn=admins,ou=printers is outside the group base dn, so is not group:admins
+	expected := []string{"group:admins", "group:developers"}
+	if !reflect.DeepEqual(groups, expected) {
+		t.Fatalf("expected groups %v, got %v", expected, groups)
+	}
+}
+
+func TestLdapGroupsCleared(t *testing.T) {
+	if err := config.Load("../../../config/test_ldap.json"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := data.Load("file::memory:"); err != nil {
+		t.Fatal(err)
+	}
+
+	address, roots := startTestDirectory(t, true)
+
+	directory := testLdapDirectory(address, roots)
+	directory.groupAttribute = "memberOf"
+	directory.groupBaseDN, _ = ldap.ParseDN("ou=groups,dc=example,dc=com")
+
+	groups, err := directory.authenticate("toaster", ldapUserPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := directory.storeGroups("toaster", groups); err != nil {
+		t.Fatal(err)
+	}
+
+	stored, err := data.GetIdentityGroups("toaster")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(stored) != 2 {
+		t.Fatal("expected the users directory groups to be stored, got: ", stored)
+	}
+
+	// Turning off group sync removes the groups stored while it was on
+	directory.groupAttribute = ""
+
+	groups, err = directory.authenticate("toaster", ldapUserPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := directory.storeGroups("toaster", groups); err != nil {
+		t.Fatal(err)
+	}
+
+	stored, err = data.GetIdentityGroups("toaster")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(stored) != 0 {
+		t.Fatal("groups stored while syncing was enabled were not removed: ", stored)
+	}
+
+	for _, group := range config.Values().Acls.GetUserGroups("toaster") {
+		if group == "group:VPN Admins" || group == "group:developers" {
+			t.Fatal("user still has directory group: ", group)
+		}
+	}
+}
@@ -85,12 +85,6 @@ func (o *Oidc) FriendlyName() string {
 func (o *Oidc) RegistrationAPI(w http.ResponseWriter, r *http.Request) {
 	clientTunnelIp := utils.GetIPFromRequest(r)
 
-	if router.IsAuthed(clientTunnelIp.String()) {
-		w.Header().Set("Content-Type", "text/html; charset=UTF-8")
-		resources.Render("success.html", w, nil)
-		return
-	}
-
 	user, err := users.GetUserFromAddress(clientTunnelIp)
 	if err != nil {
 		log.Println("unknown", clientTunnelIp, "could not get associated device:", err)
@@ -98,8 +92,8 @@ func (o *Oidc) RegistrationAPI(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if user.IsEnforcingMFA() {
-		log.Println(user.Username, clientTunnelIp, "tried to re-register mfa despite already being registered")
+	if err := user.CanRegisterMFA(clientTunnelIp.String(), o.Type()); err != nil {
+		log.Println(user.Username, clientTunnelIp, "tried to register", o.Type(), "mfa:", err)
 
 		http.Error(w, "Bad request", 400)
 		return
@@ -130,12 +124,6 @@ func (o *Oidc) AuthorisationAPI(w http.ResponseWriter, r *http.Request) {
 
 	clientTunnelIp := utils.GetIPFromRequest(r)
 
-	if router.IsAuthed(clientTunnelIp.String()) {
-		w.Header().Set("Content-Type", "text/html; charset=UTF-8")
-		resources.Render("success.html", w, nil)
-		return
-	}
-
 	user, err := users.GetUserFromAddress(clientTunnelIp)
 	if err != nil {
 		log.Println("unknown", clientTunnelIp, "could not get associated device:", err)
@@ -143,6 +131,16 @@ func (o *Oidc) AuthorisationAPI(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// A user adding sso as another method is already authorised, but still has to complete the login to enrol it
+	factor, err := data.GetMFAFactor(user.Username, o.Type())
+	enrolling := err == nil && !factor.IsEnrolled()
+
+	if router.IsAuthed(clientTunnelIp.String()) && !router.RequiresStepUp(clientTunnelIp.String()) && !enrolling {
+		w.Header().Set("Content-Type", "text/html; charset=UTF-8")
+		resources.Render("success.html", w, nil)
+		return
+	}
+
 	marshalUserinfo := func(w http.ResponseWriter, r *http.Request, tokens *oidc.Tokens, state string, rp rp.RelyingParty, info oidc.UserInfo) {
 
 		groupsIntf, ok := tokens.IDTokenClaims.GetClaim(config.Values().Authenticators.OIDC.GroupsClaimName).([]interface{})
@@ -167,7 +165,7 @@ func (o *Oidc) AuthorisationAPI(w http.ResponseWriter, r *http.Request) {
 		}
 
 		// Will set enforcing on first use
-		err = user.Authenticate(clientTunnelIp.String(), user.GetMFAType(), func(issuerString, username string) error {
+		err = user.Authenticate(clientTunnelIp.String(), o.Type(), func(issuerString, username string) error {
 
 			var issuerDetails issuer
 			err := json.Unmarshal([]byte(issuerString), &issuerDetails)
@@ -183,9 +181,8 @@ func (o *Oidc) AuthorisationAPI(w http.ResponseWriter, r *http.Request) {
 				return errors.New("returned username did not equal device associated username")
 			}
 
-			config.AddVirtualUser(username, groups)
-
-			return nil
+			// Replaces the groups from the users last login, so groups they were removed from at the identity provider no longer apply
+			return users.SetIdentityGroups(username, o.Type(), groups)
 		})
 
 		if err != nil {
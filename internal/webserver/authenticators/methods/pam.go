@@ -35,12 +35,6 @@ func (t *Pam) FriendlyName() string {
 func (t *Pam) RegistrationAPI(w http.ResponseWriter, r *http.Request) {
 	clientTunnelIp := utils.GetIPFromRequest(r)
 
-	if router.IsAuthed(clientTunnelIp.String()) {
-		w.Header().Set("Content-Type", "text/html; charset=UTF-8")
-		resources.Render("success.html", w, nil)
-		return
-	}
-
 	user, err := users.GetUserFromAddress(clientTunnelIp)
 	if err != nil {
 		log.Println("unknown", clientTunnelIp, "could not get associated device:", err)
@@ -48,8 +42,8 @@ func (t *Pam) RegistrationAPI(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if user.IsEnforcingMFA() {
-		log.Println(user.Username, clientTunnelIp, "tried to re-register mfa despite already being registered")
+	if err := user.CanRegisterMFA(clientTunnelIp.String(), t.Type()); err != nil {
+		log.Println(user.Username, clientTunnelIp, "tried to register", t.Type(), "mfa:", err)
 
 		http.Error(w, "Bad request", 400)
 		return
@@ -93,7 +87,7 @@ func (t *Pam) AuthorisationAPI(w http.ResponseWriter, r *http.Request) {
 
 	clientTunnelIp := utils.GetIPFromRequest(r)
 
-	if router.IsAuthed(clientTunnelIp.String()) {
+	if router.IsAuthed(clientTunnelIp.String()) && !router.RequiresStepUp(clientTunnelIp.String()) {
 		w.Header().Set("Content-Type", "text/html; charset=UTF-8")
 		resources.Render("success.html", w, nil)
 		return
@@ -181,7 +175,7 @@ func (t *Pam) AuthoriseFunc(w http.ResponseWriter, r *http.Request) authenticato
 func (t *Pam) MFAPromptUI(w http.ResponseWriter, r *http.Request, username, ip string) {
 	if err := resources.Render("prompt_mfa_pam.html", w, &resources.Msg{
 		HelpMail:   config.Values().HelpMail,
-		NumMethods: len(authenticators.MFA),
+		NumMethods: enrolledMethods(username),
 	}); err != nil {
 		log.Println(username, ip, "unable to render pam prompt template: ", err)
 	}
@@ -0,0 +1,418 @@
+package methods
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/NHAS/wag/internal/config"
+	"github.com/NHAS/wag/internal/data"
+	"github.com/NHAS/wag/internal/router"
+	"github.com/NHAS/wag/internal/users"
+	"github.com/NHAS/wag/internal/utils"
+	"github.com/NHAS/wag/internal/webserver/authenticators"
+	"github.com/NHAS/wag/internal/webserver/resources"
+	"github.com/NHAS/wag/pkg/session"
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+	"layeh.com/radius/rfc2869"
+)
+
+type Radius struct {
+	sessions *session.SessionManager
+}
+
+// Sent instead of the usual result message when the radius server wants something else from the user, e.g the otp from their hardware token
+type radiusPrompt struct {
+	Challenge string
+}
+
+func (rd *Radius) Init(settings map[string]string) error {
+	rd.sessions = session.NewSessionManager()
+	return nil
+}
+
+func (rd *Radius) Type() string {
+	return authenticators.RadiusMFA
+}
+
+func (rd *Radius) FriendlyName() string {
+	return "RADIUS"
+}
+
+func (rd *Radius) RegistrationAPI(w http.ResponseWriter, r *http.Request) {
+	clientTunnelIp := utils.GetIPFromRequest(r)
+
+	user, err := users.GetUserFromAddress(clientTunnelIp)
+	if err != nil {
+		log.Println("unknown", clientTunnelIp, "could not get associated device:", err)
+		http.Error(w, "Bad request", 400)
+		return
+	}
+
+	if err := user.CanRegisterMFA(clientTunnelIp.String(), rd.Type()); err != nil {
+		log.Println(user.Username, clientTunnelIp, "tried to register", rd.Type(), "mfa:", err)
+
+		http.Error(w, "Bad request", 400)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		err = data.SetUserMfa(user.Username, "RADIUSauth", authenticators.RadiusMFA)
+		if err != nil {
+			log.Println(user.Username, clientTunnelIp, "unable to save RADIUS key to db:", err)
+			http.Error(w, "Unknown error", 500)
+			return
+		}
+
+		jsonResponse(w, user.Username, 200)
+
+	case "POST":
+		rd.authenticate(w, r, user.Username, user.Authenticate)
+
+	default:
+		http.NotFound(w, r)
+		return
+	}
+}
+
+func (rd *Radius) AuthorisationAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.NotFound(w, r)
+		return
+	}
+
+	clientTunnelIp := utils.GetIPFromRequest(r)
+
+	if router.IsAuthed(clientTunnelIp.String()) && !router.RequiresStepUp(clientTunnelIp.String()) {
+		w.Header().Set("Content-Type", "text/html; charset=UTF-8")
+		resources.Render("success.html", w, nil)
+		return
+	}
+
+	user, err := users.GetUserFromAddress(clientTunnelIp)
+	if err != nil {
+		log.Println("unknown", clientTunnelIp, "could not get associated device:", err)
+		http.Error(w, "Bad request", 400)
+		return
+	}
+
+	if !user.IsEnforcingMFA() {
+		http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
+		return
+	}
+
+	rd.authenticate(w, r, user.Username, user.Authenticate)
+}
+
+// authenticate sends the password the user posted to the radius servers. If a server challenges the user, the challenge is kept in a session and
+// the users response is sent back to that server with their next post
+func (rd *Radius) authenticate(w http.ResponseWriter, r *http.Request, username string, authenticate func(device, mfaType string, authenticator authenticators.AuthenticatorFunc) error) {
+	clientTunnelIp := utils.GetIPFromRequest(r)
+
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, "Bad request", 400)
+		return
+	}
+
+	var previous *radiusChallenge
+	if cookie, err := r.Cookie("radius"); err == nil {
+		sessionData, err := rd.sessions.GetSession(cookie.Value)
+		if err == nil {
+			previous, _ = sessionData.(*radiusChallenge)
+		}
+
+		rd.sessions.DeleteSession(cookie.Value)
+	}
+
+	var challenge *radiusChallenge
+	err = authenticate(clientTunnelIp.String(), rd.Type(), func(_, username string) error {
+		var err error
+		challenge, err = newRadiusClient().authenticate(username, r.FormValue("password"), previous)
+		if err != nil {
+			return err
+		}
+
+		if challenge != nil {
+			return fmt.Errorf("%w by radius server: %s", authenticators.ErrChallenged, challenge.message)
+		}
+
+		return nil
+	})
+
+	if challenge != nil {
+		http.SetCookie(w, &http.Cookie{
+			Name:     "radius",
+			Value:    rd.sessions.StartSession(challenge),
+			Path:     "/",
+			HttpOnly: true,
+		})
+
+		jsonResponse(w, radiusPrompt{Challenge: challenge.message}, http.StatusUnauthorized)
+
+		log.Println(username, clientTunnelIp, "was sent a challenge by the radius server")
+		return
+	}
+
+	msg, status := resultMessage(err)
+	jsonResponse(w, msg, status)
+
+	if err != nil {
+		log.Println(username, clientTunnelIp, "failed to authorise: ", err.Error())
+		return
+	}
+
+	log.Println(username, clientTunnelIp, "authorised")
+}
+
+func (rd *Radius) MFAPromptUI(w http.ResponseWriter, r *http.Request, username, ip string) {
+	if err := resources.Render("prompt_mfa_radius.html", w, &resources.Msg{
+		HelpMail:   config.Values().HelpMail,
+		NumMethods: enrolledMethods(username),
+	}); err != nil {
+		log.Println(username, ip, "unable to render radius prompt template: ", err)
+	}
+}
+
+func (rd *Radius) RegistrationUI(w http.ResponseWriter, r *http.Request, username, ip string) {
+	if err := resources.Render("register_mfa_radius.html", w, &resources.Msg{
+		HelpMail:   config.Values().HelpMail,
+		NumMethods: len(authenticators.MFA),
+	}); err != nil {
+		log.Println(username, ip, "unable to render radius mfa template: ", err)
+	}
+}
+
+func (rd *Radius) LogoutPath() string {
+	return "/"
+}
+
+type radiusServer struct {
+	address string
+	secret  []byte
+}
+
+type radiusClient struct {
+	// Tried in order until one of them answers
+	servers []radiusServer
+
+	// Send CHAP-Password rather than the PAP User-Password
+	chap bool
+
+	nasIdentifier string
+	timeout       time.Duration
+}
+
+// An Access-Challenge from a radius server. The state has to be sent back to the same server along with the users response
+type radiusChallenge struct {
+	username string
+	server   int
+	state    []byte
+	message  string
+}
+
+func newRadiusClient() *radiusClient {
+	settings := config.Values().Authenticators.RADIUS
+
+	client := &radiusClient{
+		chap:          settings.Protocol == "chap",
+		nasIdentifier: settings.NASIdentifier,
+		timeout:       time.Duration(settings.TimeoutSeconds) * time.Second,
+	}
+
+	for _, server := range settings.Servers {
+		client.servers = append(client.servers, radiusServer{address: server.Address, secret: []byte(server.Secret)})
+	}
+
+	return client
+}
+
+// authenticate sends an Access-Request for the user to the first server that answers, or if the user is responding to a challenge to the server that
+// sent it. The user is accepted if both the challenge and error are nil
+func (c *radiusClient) authenticate(username, password string, previous *radiusChallenge) (*radiusChallenge, error) {
+	if previous != nil && previous.username != username {
+		return nil, errors.New("radius challenge was sent to a different user")
+	}
+
+	exchange := radius.Client{
+		Retry: time.Second,
+	}
+
+	lastErr := errors.New("no radius servers configured")
+	for i, server := range c.servers {
+		if previous != nil && i != previous.server {
+			continue
+		}
+
+		request, err := c.request(server, username, password, previous)
+		if err != nil {
+			return nil, err
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+		response, err := exchange.Exchange(ctx, request, server.address)
+		cancel()
+		if err != nil {
+			log.Println(username, "radius server", server.address, "did not respond:", err)
+			lastErr = err
+			continue
+		}
+
+		// Without a Message-Authenticator the response can be forged by anyone who can tamper with the traffic (CVE-2024-3596, Blast-RADIUS)
+		if !checkMessageAuthenticator(response, request.Authenticator) {
+			return nil, errors.New("radius server " + server.address + " sent a response without a valid Message-Authenticator")
+		}
+
+		switch response.Code {
+		case radius.CodeAccessAccept:
+			return nil, nil
+
+		case radius.CodeAccessChallenge:
+			state := rfc2865.State_Get(response)
+			if len(state) == 0 {
+				return nil, errors.New("radius server " + server.address + " sent a challenge without a state")
+			}
+
+			return &radiusChallenge{
+				username: username,
+				server:   i,
+				state:    state,
+				message:  rfc2865.ReplyMessage_GetString(response),
+			}, nil
+
+		default:
+			return nil, errors.New("radius server " + server.address + " rejected user: " + response.Code.String())
+		}
+	}
+
+	return nil, errors.New("unable to reach any radius server: " + lastErr.Error())
+}
+
+func (c *radiusClient) request(server radiusServer, username, password string, previous *radiusChallenge) (*radius.Packet, error) {
+	request := radius.New(radius.CodeAccessRequest, server.secret)
+
+	// The Message-Authenticator goes first so that nothing an attacker adds to the packet can come before it, it is filled in once all the other attributes are set
+	request.Add(rfc2869.MessageAuthenticator_Type, make(radius.Attribute, md5.Size))
+
+	err := rfc2865.UserName_SetString(request, username)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.chap {
+		// CHAP-Password is the chap identifier followed by md5(identifier + password + challenge)
+		challenge := make([]byte, 17)
+		if _, err := rand.Read(challenge); err != nil {
+			return nil, err
+		}
+
+		identifier, challenge := challenge[0], challenge[1:]
+
+		hash := md5.New()
+		hash.Write([]byte{identifier})
+		hash.Write([]byte(password))
+		hash.Write(challenge)
+
+		err = rfc2865.CHAPPassword_Set(request, hash.Sum([]byte{identifier}))
+		if err != nil {
+			return nil, err
+		}
+
+		err = rfc2865.CHAPChallenge_Set(request, challenge)
+	} else {
+		err = rfc2865.UserPassword_SetString(request, password)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if c.nasIdentifier != "" {
+		err = rfc2865.NASIdentifier_SetString(request, c.nasIdentifier)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if previous != nil {
+		err = rfc2865.State_Set(request, previous.state)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = setMessageAuthenticator(request, request.Authenticator)
+	if err != nil {
+		return nil, err
+	}
+
+	return request, nil
+}
+
+// messageAuthenticator is the hmac-md5 of the packet keyed with its secret, with the Message-Authenticator zeroed. Responses are hashed with the
+// authenticator of the request they answer rather than their own
+func messageAuthenticator(packet *radius.Packet, authenticator [16]byte) ([]byte, error) {
+	zeroed := *packet
+	zeroed.Authenticator = authenticator
+	zeroed.Attributes = nil
+
+	for _, attribute := range packet.Attributes {
+		if attribute.Type == rfc2869.MessageAuthenticator_Type {
+			attribute = &radius.AVP{Type: attribute.Type, Attribute: make(radius.Attribute, md5.Size)}
+		}
+
+		zeroed.Attributes = append(zeroed.Attributes, attribute)
+	}
+
+	encoded, err := zeroed.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+
+	hash := hmac.New(md5.New, packet.Secret)
+	hash.Write(encoded)
+
+	return hash.Sum(nil), nil
+}
+
+// setMessageAuthenticator fills in the Message-Authenticator of the packet, adding one if it does not have one already
+func setMessageAuthenticator(packet *radius.Packet, authenticator [16]byte) error {
+	if _, ok := packet.Lookup(rfc2869.MessageAuthenticator_Type); !ok {
+		packet.Add(rfc2869.MessageAuthenticator_Type, make(radius.Attribute, md5.Size))
+	}
+
+	sum, err := messageAuthenticator(packet, authenticator)
+	if err != nil {
+		return err
+	}
+
+	for _, attribute := range packet.Attributes {
+		if attribute.Type == rfc2869.MessageAuthenticator_Type {
+			copy(attribute.Attribute, sum)
+		}
+	}
+
+	return nil
+}
+
+// checkMessageAuthenticator returns if the packet has exactly one Message-Authenticator and it is valid
+func checkMessageAuthenticator(packet *radius.Packet, authenticator [16]byte) bool {
+	values, err := rfc2869.MessageAuthenticator_Gets(packet)
+	if err != nil || len(values) != 1 {
+		return false
+	}
+
+	sum, err := messageAuthenticator(packet, authenticator)
+	if err != nil {
+		return false
+	}
+
+	return hmac.Equal(values[0], sum)
+}
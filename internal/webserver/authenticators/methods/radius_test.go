@@ -0,0 +1,230 @@
+package methods
+
+import (
+	"bytes"
+	"crypto/md5"
+	"net"
+	"testing"
+	"time"
+
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+	"layeh.com/radius/rfc2869"
+)
+
+const (
+	radiusSecret   = "testing123"
+	radiusPassword = "hunter2"
+	radiusOTP      = "123456"
+)
+
+// startRadiusServer runs a stand in radius server that accepts toaster with either pap or chap, and challenges tokenuser for an otp after their password.
+// Requests without a valid Message-Authenticator are rejected. Responses for unsigned and badsigned accept the user, but have no Message-Authenticator or an invalid one
+func startRadiusServer(t *testing.T, secret string) string {
+	challengeState := []byte("otp-challenge")
+
+	checkPassword := func(r *radius.Request, expected string) bool {
+		if chapPassword := rfc2865.CHAPPassword_Get(r.Packet); len(chapPassword) == 17 {
+			hash := md5.New()
+			hash.Write(chapPassword[:1])
+			hash.Write([]byte(expected))
+			hash.Write(rfc2865.CHAPChallenge_Get(r.Packet))
+
+			return bytes.Equal(hash.Sum(nil), chapPassword[1:])
+		}
+
+		return rfc2865.UserPassword_GetString(r.Packet) == expected
+	}
+
+	handler := func(w radius.ResponseWriter, r *radius.Request) {
+		response := r.Response(radius.CodeAccessReject)
+		if !checkMessageAuthenticator(r.Packet, r.Authenticator) {
+			w.Write(response)
+			return
+		}
+
+		switch rfc2865.UserName_GetString(r.Packet) {
+		case "toaster":
+			if checkPassword(r, radiusPassword) {
+				response.Code = radius.CodeAccessAccept
+			}
+
+		case "tokenuser":
+			if bytes.Equal(rfc2865.State_Get(r.Packet), challengeState) {
+				if checkPassword(r, radiusOTP) {
+					response.Code = radius.CodeAccessAccept
+				}
+				break
+			}
+
+			if checkPassword(r, radiusPassword) {
+				response.Code = radius.CodeAccessChallenge
+				rfc2865.State_Set(response, challengeState)
+				rfc2865.ReplyMessage_SetString(response, "Enter the code from your token")
+			}
+
+		case "unsigned":
+			w.Write(r.Response(radius.CodeAccessAccept))
+			return
+
+		case "badsigned":
+			response.Code = radius.CodeAccessAccept
+			rfc2869.MessageAuthenticator_Set(response, make([]byte, md5.Size))
+			w.Write(response)
+			return
+		}
+
+		if err := setMessageAuthenticator(response, r.Authenticator); err != nil {
+			t.Error(err)
+			return
+		}
+
+		w.Write(response)
+	}
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := &radius.PacketServer{
+		Handler:      radius.HandlerFunc(handler),
+		SecretSource: radius.StaticSecretSource([]byte(secret)),
+	}
+
+	go server.Serve(conn)
+	t.Cleanup(func() {
+		conn.Close()
+	})
+
+	return conn.LocalAddr().String()
+}
+
+// unreachableRadiusServer returns an address that nothing is listening on
+func unreachableRadiusServer(t *testing.T) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	address := conn.LocalAddr().String()
+	conn.Close()
+
+	return address
+}
+
+func testRadiusClient(chap bool, addresses ...string) *radiusClient {
+	client := &radiusClient{
+		chap:    chap,
+		timeout: 2 * time.Second,
+	}
+
+	for _, address := range addresses {
+		client.servers = append(client.servers, radiusServer{address: address, secret: []byte(radiusSecret)})
+	}
+
+	return client
+}
+
+func TestRadiusPapAndChap(t *testing.T) {
+	address := startRadiusServer(t, radiusSecret)
+
+	for _, chap := range []bool{false, true} {
+		client := testRadiusClient(chap, address)
+
+		challenge, err := client.authenticate("toaster", radiusPassword, nil)
+		if err != nil {
+			t.Fatalf("chap %t: %s", chap, err)
+		}
+
+		if challenge != nil {
+			t.Fatalf("chap %t: unexpected challenge: %s", chap, challenge.message)
+		}
+
+		if _, err := client.authenticate("toaster", "wrong password", nil); err == nil {
+			t.Fatalf("chap %t: accepted wrong password", chap)
+		}
+	}
+}
+
+func TestRadiusMessageAuthenticator(t *testing.T) {
+	address := startRadiusServer(t, radiusSecret)
+	client := testRadiusClient(false, address)
+
+	request, err := client.request(client.servers[0], "toaster", radiusPassword, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if request.Attributes[0].Type != rfc2869.MessageAuthenticator_Type {
+		t.Fatal("Message-Authenticator was not the first attribute of the request")
+	}
+
+	if !checkMessageAuthenticator(request, request.Authenticator) {
+		t.Fatal("request did not have a valid Message-Authenticator")
+	}
+
+	// Both are accepted by the server, but the responses cannot be trusted
+	for _, username := range []string{"unsigned", "badsigned"} {
+		if _, err := client.authenticate(username, radiusPassword, nil); err == nil {
+			t.Fatalf("%s: accepted response without a valid Message-Authenticator", username)
+		}
+	}
+}
+
+func TestRadiusChallenge(t *testing.T) {
+	address := startRadiusServer(t, radiusSecret)
+	client := testRadiusClient(false, address)
+
+	challenge, err := client.authenticate("tokenuser", radiusPassword, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if challenge == nil {
+		t.Fatal("user was accepted without answering the challenge")
+	}
+
+	if challenge.message != "Enter the code from your token" {
+		t.Fatal("challenge did not have the servers message: ", challenge.message)
+	}
+
+	if _, err := client.authenticate("toaster", radiusOTP, challenge); err == nil {
+		t.Fatal("another user answered the challenge")
+	}
+
+	if _, err := client.authenticate("tokenuser", "000000", challenge); err == nil {
+		t.Fatal("accepted wrong otp")
+	}
+
+	challenge, err = client.authenticate("tokenuser", radiusOTP, challenge)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if challenge != nil {
+		t.Fatal("user was challenged again after answering the challenge")
+	}
+}
+
+func TestRadiusFailover(t *testing.T) {
+	address := startRadiusServer(t, radiusSecret)
+
+	client := testRadiusClient(false, unreachableRadiusServer(t), address)
+	if _, err := client.authenticate("toaster", radiusPassword, nil); err != nil {
+		t.Fatal("did not fail over to second server: ", err)
+	}
+
+	// Responses signed with a different secret are not trusted
+	client = testRadiusClient(false, startRadiusServer(t, "not the secret"))
+	client.timeout = 500 * time.Millisecond
+	if _, err := client.authenticate("toaster", radiusPassword, nil); err == nil {
+		t.Fatal("accepted response from server with a different secret")
+	}
+
+	client = testRadiusClient(false, unreachableRadiusServer(t))
+	client.timeout = 500 * time.Millisecond
+	if _, err := client.authenticate("toaster", radiusPassword, nil); err == nil {
+		t.Fatal("accepted user without a server to authenticate them")
+	}
+}
@@ -0,0 +1,110 @@
+package methods
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/NHAS/wag/internal/config"
+	"github.com/NHAS/wag/internal/data"
+	"github.com/NHAS/wag/internal/router"
+	"github.com/NHAS/wag/internal/users"
+	"github.com/NHAS/wag/internal/utils"
+	"github.com/NHAS/wag/internal/webserver/authenticators"
+	"github.com/NHAS/wag/internal/webserver/resources"
+)
+
+// Recovery lets users authorise with one of their single use recovery codes when they cannot use any of their mfa methods
+// It cannot be registered, so is not one of the methods in authenticators.MFA and is added under /authorise/recovery/ by the webserver
+type Recovery struct {
+}
+
+func (rc *Recovery) Type() string {
+	return authenticators.RecoveryMFA
+}
+
+// Shows the recovery code prompt on GET, and authorises the device with the code on POST
+func (rc *Recovery) AuthorisationAPI(w http.ResponseWriter, r *http.Request) {
+	clientTunnelIp := utils.GetIPFromRequest(r)
+
+	if router.IsAuthed(clientTunnelIp.String()) && !router.RequiresStepUp(clientTunnelIp.String()) {
+		w.Header().Set("Content-Type", "text/html; charset=UTF-8")
+		resources.Render("success.html", w, nil)
+		return
+	}
+
+	user, err := users.GetUserFromAddress(clientTunnelIp)
+	if err != nil {
+		log.Println("unknown", clientTunnelIp, "could not get associated device:", err)
+		http.Error(w, "Bad request", 400)
+		return
+	}
+
+	if !user.IsEnforcingMFA() {
+		http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		if err := resources.Render("prompt_mfa_recovery.html", w, &resources.Msg{
+			HelpMail:   config.Values().HelpMail,
+			NumMethods: enrolledMethods(user.Username),
+		}); err != nil {
+			log.Println(user.Username, clientTunnelIp, "unable to render recovery prompt template: ", err)
+		}
+
+	case "POST":
+		err := r.ParseForm()
+		if err != nil {
+			http.Error(w, "Bad request", 400)
+			return
+		}
+
+		remaining := 0
+		err = user.Authenticate(clientTunnelIp.String(), rc.Type(), func(_, username string) error {
+			left, err := data.UseRecoveryCode(username, r.FormValue("code"), clientTunnelIp.String())
+			remaining = left
+			return err
+		})
+
+		msg, status := resultMessage(err)
+		jsonResponse(w, msg, status)
+
+		if err != nil {
+			log.Println(user.Username, clientTunnelIp, "failed to authorise with recovery code: ", err.Error())
+			return
+		}
+
+		log.Println(user.Username, clientTunnelIp, "authorised with a recovery code,", remaining, "codes remaining")
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// Sent to the user when they complete registering an mfa method
+type registered struct {
+	Message string
+
+	// Only set for the first method a user registers, as the codes cannot be shown again
+	RecoveryCodes []string `json:",omitempty"`
+}
+
+func registrationResult(username, ip string, firstMethod bool) registered {
+	result := registered{Message: "Success"}
+	if !firstMethod {
+		return result
+	}
+
+	codes, err := data.GenerateRecoveryCodes(username)
+	if err != nil {
+		// The user is registered, an admin can generate codes for them
+		log.Println(username, ip, "unable to generate recovery codes:", err)
+		return result
+	}
+
+	log.Println(username, ip, "generated recovery codes")
+
+	result.RecoveryCodes = codes
+	return result
+}
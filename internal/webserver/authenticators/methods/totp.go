@@ -48,12 +48,6 @@ func (t *Totp) FriendlyName() string {
 func (t *Totp) RegistrationAPI(w http.ResponseWriter, r *http.Request) {
 	clientTunnelIp := utils.GetIPFromRequest(r)
 
-	if router.IsAuthed(clientTunnelIp.String()) {
-		w.Header().Set("Content-Type", "text/html; charset=UTF-8")
-		resources.Render("success.html", w, nil)
-		return
-	}
-
 	user, err := users.GetUserFromAddress(clientTunnelIp)
 	if err != nil {
 		log.Println("unknown", clientTunnelIp, "could not get associated device:", err)
@@ -61,8 +55,8 @@ func (t *Totp) RegistrationAPI(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if user.IsEnforcingMFA() {
-		log.Println(user.Username, clientTunnelIp, "tried to re-register mfa despite already being registered")
+	if err := user.CanRegisterMFA(clientTunnelIp.String(), t.Type()); err != nil {
+		log.Println(user.Username, clientTunnelIp, "tried to register", t.Type(), "mfa:", err)
 
 		http.Error(w, "Bad request", 400)
 		return
@@ -116,11 +110,14 @@ func (t *Totp) RegistrationAPI(w http.ResponseWriter, r *http.Request) {
 		jsonResponse(w, &mfa, 200)
 
 	case "POST":
-		err = user.Authenticate(clientTunnelIp.String(), t.Type(), t.AuthoriseFunc(w, r))
-		msg, status := resultMessage(err)
-		jsonResponse(w, msg, status)
+		// Recovery codes are given out with the first method the user registers
+		firstMethod := !user.IsEnforcingMFA()
 
+		err = user.Authenticate(clientTunnelIp.String(), t.Type(), t.AuthoriseFunc(w, r))
 		if err != nil {
+			msg, status := resultMessage(err)
+			jsonResponse(w, msg, status)
+
 			log.Println(user.Username, clientTunnelIp, "failed to authorise: ", err.Error())
 			return
 		}
@@ -128,6 +125,8 @@ func (t *Totp) RegistrationAPI(w http.ResponseWriter, r *http.Request) {
 		log.Println(user.Username, clientTunnelIp, "authorised")
 		user.EnforceMFA()
 
+		jsonResponse(w, registrationResult(user.Username, clientTunnelIp.String(), firstMethod), http.StatusOK)
+
 	default:
 		http.NotFound(w, r)
 		return
@@ -142,7 +141,7 @@ func (t *Totp) AuthorisationAPI(w http.ResponseWriter, r *http.Request) {
 
 	clientTunnelIp := utils.GetIPFromRequest(r)
 
-	if router.IsAuthed(clientTunnelIp.String()) {
+	if router.IsAuthed(clientTunnelIp.String()) && !router.RequiresStepUp(clientTunnelIp.String()) {
 		w.Header().Set("Content-Type", "text/html; charset=UTF-8")
 		resources.Render("success.html", w, nil)
 		return
@@ -210,7 +209,7 @@ func (t *Totp) AuthoriseFunc(w http.ResponseWriter, r *http.Request) authenticat
 func (t *Totp) MFAPromptUI(w http.ResponseWriter, r *http.Request, username, ip string) {
 	if err := resources.Render("prompt_mfa_totp.html", w, &resources.Msg{
 		HelpMail:   config.Values().HelpMail,
-		NumMethods: len(authenticators.MFA),
+		NumMethods: enrolledMethods(username),
 	}); err != nil {
 		log.Println(username, ip, "unable to render totp prompt template: ", err)
 	}
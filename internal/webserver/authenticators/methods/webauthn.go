@@ -41,12 +41,6 @@ func (wa *Webauthn) FriendlyName() string {
 func (wa *Webauthn) RegistrationAPI(w http.ResponseWriter, r *http.Request) {
 	clientTunnelIp := utils.GetIPFromRequest(r)
 
-	if router.IsAuthed(clientTunnelIp.String()) {
-		w.Header().Set("Content-Type", "text/html; charset=UTF-8")
-		resources.Render("success.html", w, nil)
-		return
-	}
-
 	user, err := users.GetUserFromAddress(clientTunnelIp)
 	if err != nil {
 		log.Println("unknown", clientTunnelIp, "could not get associated device:", err)
@@ -54,8 +48,8 @@ func (wa *Webauthn) RegistrationAPI(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if user.IsEnforcingMFA() {
-		log.Println(user.Username, clientTunnelIp, "tried to re-register mfa despite already being registered")
+	if err := user.CanRegisterMFA(clientTunnelIp.String(), wa.Type()); err != nil {
+		log.Println(user.Username, clientTunnelIp, "tried to register", wa.Type(), "mfa:", err)
 
 		http.Error(w, "Bad request", 400)
 		return
@@ -99,6 +93,9 @@ func (wa *Webauthn) RegistrationAPI(w http.ResponseWriter, r *http.Request) {
 
 		jsonResponse(w, options, http.StatusOK)
 	case "POST":
+		// Recovery codes are given out with the first method the user registers
+		firstMethod := !user.IsEnforcingMFA()
+
 		err = user.Authenticate(clientTunnelIp.String(), wa.Type(),
 
 			func(mfaSecret, username string) error {
@@ -147,10 +144,10 @@ func (wa *Webauthn) RegistrationAPI(w http.ResponseWriter, r *http.Request) {
 				return nil
 			})
 
-		msg, status := resultMessage(err)
-		jsonResponse(w, msg, status) // Send back an error message before we do the server side of handling it
-
 		if err != nil {
+			msg, status := resultMessage(err)
+			jsonResponse(w, msg, status)
+
 			log.Println(user.Username, clientTunnelIp, "failed to authorise: ", err.Error())
 			return
 		}
@@ -159,6 +156,8 @@ func (wa *Webauthn) RegistrationAPI(w http.ResponseWriter, r *http.Request) {
 
 		log.Println(user.Username, clientTunnelIp, "registered new webauthn key")
 
+		jsonResponse(w, registrationResult(user.Username, clientTunnelIp.String(), firstMethod), http.StatusOK)
+
 	default:
 		http.NotFound(w, r)
 		return
@@ -169,7 +168,7 @@ func (wa *Webauthn) AuthorisationAPI(w http.ResponseWriter, r *http.Request) {
 
 	clientTunnelIp := utils.GetIPFromRequest(r)
 
-	if router.IsAuthed(clientTunnelIp.String()) {
+	if router.IsAuthed(clientTunnelIp.String()) && !router.RequiresStepUp(clientTunnelIp.String()) {
 		w.Header().Set("Content-Type", "text/html; charset=UTF-8")
 		resources.Render("success.html", w, nil)
 		return
@@ -190,7 +189,7 @@ func (wa *Webauthn) AuthorisationAPI(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case "GET":
 
-		webauthUserData, err := user.MFA()
+		webauthUserData, err := user.MFA(wa.Type())
 		if err != nil {
 			log.Println(user.Username, clientTunnelIp, "could not get webauthn MFA details from db:", err)
 
@@ -294,7 +293,7 @@ func (wa *Webauthn) MFAPromptUI(w http.ResponseWriter, r *http.Request, username
 
 	if err := resources.Render("prompt_mfa_webauthn.html", w, &resources.Msg{
 		HelpMail:   config.Values().HelpMail,
-		NumMethods: len(authenticators.MFA),
+		NumMethods: enrolledMethods(username),
 	}); err != nil {
 		log.Println(username, ip, "unable to render weauthn prompt template: ", err)
 	}
@@ -12,6 +12,7 @@ import (
 type Interface struct {
 	ClientPrivateKey   string
 	ClientAddress      string
+	ClientAddress6     string
 	ClientPresharedKey string
 
 	ServerAddress     string
@@ -30,6 +31,9 @@ type Msg struct {
 type Menu struct {
 	MFAMethods  []MenuEntry
 	LastElement int
+
+	// Page the selected method is sent to, either registration or authorisation
+	Action string
 }
 
 type MenuEntry struct {
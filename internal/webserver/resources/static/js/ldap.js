@@ -0,0 +1,84 @@
+document.addEventListener('DOMContentLoaded', function () {
+    let location = '/authorise/ldap/';
+    if (document.getElementById("registration") !== null) {
+        location = "/register_mfa/ldap/";
+        populateLdapDetails()
+    }
+
+    document.getElementById('loginForm').onsubmit = function () {
+        loginUser(location);
+        return false;
+    };
+}, false);
+
+async function populateLdapDetails() {
+    const response = await fetch("/register_mfa/ldap/", {
+        method: 'GET',
+        mode: 'same-origin',
+        cache: 'no-cache',
+        credentials: 'same-origin',
+        redirect: 'follow'
+    });
+
+    if (response.ok) {
+
+        let details;
+        try {
+            details = await response.json();
+        } catch (e) {
+            document.getElementById("error").hidden = false;
+            return
+        }
+
+        document.getElementById("AccountName").textContent = details;
+
+    }
+}
+
+async function loginUser(location) {
+
+    try {
+        const send = await fetch(location, {
+            method: 'POST',
+            mode: 'same-origin',
+            cache: 'no-cache',
+            credentials: 'same-origin',
+            redirect: 'follow',
+            headers: {
+                'Accept': 'application/json',
+                'Content-Type': 'application/x-www-form-urlencoded;charset=UTF-8'
+            },
+            body: new URLSearchParams({
+                "password": document.getElementById("mfaPassword").value
+            })
+        });
+
+        document.getElementById("mfaPassword").value = "";
+
+        if (!send.ok) {
+            console.log("failed to send ldap password")
+
+            let response;
+            try {
+                response = await send.json();
+            } catch (e) {
+                console.log("logging in failed")
+
+                document.getElementById("error").hidden = false;
+                return
+            }
+
+            document.getElementById("errorMsg").textContent = response;
+            document.getElementById("error").hidden = false;
+            return
+        }
+    } catch (e) {
+        console.log("logging in user failed")
+        document.getElementById("errorMsg").textContent = e.message;
+        document.getElementById("error").hidden = false;
+        return
+    }
+
+
+    window.location.href = "/";
+}
\ No newline at end of file
@@ -0,0 +1,96 @@
+document.addEventListener('DOMContentLoaded', function () {
+    let location = '/authorise/radius/';
+    if (document.getElementById("registration") !== null) {
+        location = "/register_mfa/radius/";
+        populateRadiusDetails()
+    }
+
+    document.getElementById('loginForm').onsubmit = function () {
+        loginUser(location);
+        return false;
+    };
+}, false);
+
+async function populateRadiusDetails() {
+    const response = await fetch("/register_mfa/radius/", {
+        method: 'GET',
+        mode: 'same-origin',
+        cache: 'no-cache',
+        credentials: 'same-origin',
+        redirect: 'follow'
+    });
+
+    if (response.ok) {
+
+        let details;
+        try {
+            details = await response.json();
+        } catch (e) {
+            document.getElementById("error").hidden = false;
+            return
+        }
+
+        document.getElementById("AccountName").textContent = details;
+
+    }
+}
+
+async function loginUser(location) {
+
+    try {
+        const send = await fetch(location, {
+            method: 'POST',
+            mode: 'same-origin',
+            cache: 'no-cache',
+            credentials: 'same-origin',
+            redirect: 'follow',
+            headers: {
+                'Accept': 'application/json',
+                'Content-Type': 'application/x-www-form-urlencoded;charset=UTF-8'
+            },
+            body: new URLSearchParams({
+                "password": document.getElementById("mfaPassword").value
+            })
+        });
+
+        document.getElementById("mfaPassword").value = "";
+
+        if (!send.ok) {
+            console.log("failed to send radius password")
+
+            let response;
+            try {
+                response = await send.json();
+            } catch (e) {
+                console.log("logging in failed")
+
+                document.getElementById("error").hidden = false;
+                return
+            }
+
+            // The radius server wants something else, e.g a one time password, which is sent as the next password
+            if (response.Challenge !== undefined) {
+                document.getElementById("challengeMsg").textContent = response.Challenge || "Enter the response to your authentication challenge";
+                document.getElementById("challenge").hidden = false;
+                document.getElementById("error").hidden = true;
+                document.getElementById("mfaPassword").placeholder = "Challenge Response";
+                document.getElementById("mfaPassword").focus();
+                return
+            }
+
+            document.getElementById("challenge").hidden = true;
+            document.getElementById("mfaPassword").placeholder = "Account Password";
+            document.getElementById("errorMsg").textContent = response;
+            document.getElementById("error").hidden = false;
+            return
+        }
+    } catch (e) {
+        console.log("logging in user failed")
+        document.getElementById("errorMsg").textContent = e.message;
+        document.getElementById("error").hidden = false;
+        return
+    }
+
+
+    window.location.href = "/";
+}
\ No newline at end of file
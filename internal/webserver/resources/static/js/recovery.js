@@ -0,0 +1,70 @@
+document.addEventListener('DOMContentLoaded', function () {
+    const recoveryForm = document.getElementById("recoveryForm");
+    if (recoveryForm !== null) {
+        recoveryForm.onsubmit = function () {
+            useRecoveryCode();
+            return false;
+        };
+    }
+}, false);
+
+// Called when registration completes, the codes are only sent with the first method a user registers
+// Returns true if there were codes to show, as the user needs to save them before continuing
+function showRecoveryCodes(result) {
+    if (result === null || typeof result !== "object" || !Array.isArray(result.RecoveryCodes)) {
+        return false;
+    }
+
+    document.getElementById("recoveryCodes").textContent = result.RecoveryCodes.join("\n");
+    document.getElementById("registration").hidden = true;
+    document.getElementById("recovery").hidden = false;
+
+    return true;
+}
+
+async function useRecoveryCode() {
+
+    try {
+        const send = await fetch("/authorise/recovery/", {
+            method: 'POST',
+            mode: 'same-origin',
+            cache: 'no-cache',
+            credentials: 'same-origin',
+            redirect: 'follow',
+            headers: {
+                'Accept': 'application/json',
+                'Content-Type': 'application/x-www-form-urlencoded;charset=UTF-8'
+            },
+            body: new URLSearchParams({
+                "code": document.getElementById("recoveryCode").value
+            })
+        });
+
+        document.getElementById("recoveryCode").value = "";
+
+        if (!send.ok) {
+            console.log("failed to send recovery code")
+
+            let response;
+            try {
+                response = await send.json();
+            } catch (e) {
+                console.log("logging in failed")
+
+                document.getElementById("error").hidden = false;
+                return
+            }
+
+            document.getElementById("errorMsg").textContent = response;
+            document.getElementById("error").hidden = false;
+            return
+        }
+    } catch (e) {
+        console.log("logging in user failed")
+        document.getElementById("errorMsg").textContent = e.message;
+        document.getElementById("error").hidden = false;
+        return
+    }
+
+    window.location.href = "/";
+}
@@ -79,6 +79,10 @@ async function loginUser(location) {
             document.getElementById("error").hidden = false;
             return
         }
+
+        if (location.startsWith("/register_mfa/") && showRecoveryCodes(await send.json())) {
+            return
+        }
     } catch (e) {
         console.log("logging in user failed")
         document.getElementById("errorMsg").textContent = e.message;
@@ -103,6 +103,10 @@ async function registerUser(event) {
             document.getElementById("error").hidden = false;
             return
         }
+
+        if (showRecoveryCodes(await finalise.json())) {
+            return
+        }
     } catch (e) {
         console.log("registering user failed")
         document.getElementById("errorMsg").textContent = e.message;
@@ -9,6 +9,7 @@ import (
 	"html/template"
 	"image/png"
 	"log"
+	"net"
 	"net/http"
 	"net/url"
 	"sort"
@@ -22,13 +23,12 @@ import (
 	"github.com/NHAS/wag/internal/users"
 	"github.com/NHAS/wag/internal/utils"
 	"github.com/NHAS/wag/internal/webserver/authenticators"
+	"github.com/NHAS/wag/internal/webserver/authenticators/methods"
 	"github.com/NHAS/wag/internal/webserver/resources"
 	"github.com/boombuler/barcode"
 	"github.com/boombuler/barcode/qr"
 
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
-
-	_ "github.com/NHAS/wag/internal/webserver/authenticators/methods"
 )
 
 func Start(errChan chan<- error) error {
@@ -101,6 +101,7 @@ func Start(errChan chan<- error) error {
 		tunnel.HandleFunc("/register_mfa/"+method+"/", handler.RegistrationAPI)
 
 	}
+	tunnel.HandleFunc("/authorise/"+authenticators.RecoveryMFA+"/", new(methods.Recovery).AuthorisationAPI)
 	tunnel.HandleFunc("/authorise/", authorise)
 	tunnel.HandleFunc("/register_mfa/", registerMFA)
 
@@ -154,7 +155,8 @@ func index(w http.ResponseWriter, r *http.Request) {
 
 	clientTunnelIp := utils.GetIPFromRequest(r)
 
-	if router.IsAuthed(clientTunnelIp.String()) {
+	// Devices with a session that is too old for step up routes are sent through authorisation again
+	if router.IsAuthed(clientTunnelIp.String()) && !router.RequiresStepUp(clientTunnelIp.String()) {
 		w.Header().Set("Content-Type", "text/html; charset=UTF-8")
 		resources.Render("success.html", w, nil)
 
@@ -185,13 +187,6 @@ func registerMFA(w http.ResponseWriter, r *http.Request) {
 
 	clientTunnelIp := utils.GetIPFromRequest(r)
 
-	if router.IsAuthed(clientTunnelIp.String()) {
-		w.Header().Set("Content-Type", "text/html; charset=UTF-8")
-		resources.Render("success.html", w, nil)
-
-		return
-	}
-
 	user, err := users.GetUserFromAddress(clientTunnelIp)
 	if err != nil {
 		log.Println("unknown", clientTunnelIp, "could not get associated device:", err)
@@ -199,39 +194,39 @@ func registerMFA(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if user.IsEnforcingMFA() {
+	// Once a user has enrolled a method they can add others, but only from a device that has recently authorised
+	if user.IsEnforcingMFA() && (!router.IsAuthed(clientTunnelIp.String()) || router.RequiresStepUp(clientTunnelIp.String())) {
 		log.Println(user.Username, clientTunnelIp, "tried to re-register mfa despite already being registered")
 
 		http.Error(w, "Bad request", 400)
 		return
 	}
 
-	method := r.URL.Query().Get("method")
-	if method == "" {
-		method = config.Values().Authenticators.DefaultMethod
+	enrolled := user.GetEnrolledMFATypes()
+
+	var available []string
+	for method := range authenticators.MFA {
+		if !contains(enrolled, method) {
+			available = append(available, method)
+		}
 	}
 
-	if method == "" || method == "select" {
+	if len(available) == 0 {
 		w.Header().Set("Content-Type", "text/html; charset=UTF-8")
+		resources.Render("success.html", w, nil)
 
-		var menu resources.Menu
-
-		keys := make([]string, 0, len(authenticators.MFA))
-		for k := range authenticators.MFA {
-			keys = append(keys, k)
-		}
-		sort.Strings(keys)
+		return
+	}
 
-		for _, method := range keys {
-			menu.MFAMethods = append(menu.MFAMethods, resources.MenuEntry{
-				Path:         authenticators.MFA[method].Type(),
-				FriendlyName: authenticators.MFA[method].FriendlyName(),
-			})
-		}
+	method := r.URL.Query().Get("method")
+	if method == "" {
+		method = config.Values().Authenticators.DefaultMethod
+	}
 
-		menu.LastElement = len(menu.MFAMethods) - 1
+	if method == "" || method == "select" || contains(enrolled, method) {
+		w.Header().Set("Content-Type", "text/html; charset=UTF-8")
 
-		err = resources.Render("register_mfa.html", w, &menu)
+		err = resources.Render("register_mfa.html", w, mfaMenu(available, "/register_mfa/"))
 		if err != nil {
 			log.Println(user.Username, clientTunnelIp, "unable to build template:", err)
 			http.Error(w, "Server error", 500)
@@ -258,7 +253,7 @@ func authorise(w http.ResponseWriter, r *http.Request) {
 
 	clientTunnelIp := utils.GetIPFromRequest(r)
 
-	if router.IsAuthed(clientTunnelIp.String()) {
+	if router.IsAuthed(clientTunnelIp.String()) && !router.RequiresStepUp(clientTunnelIp.String()) {
 		w.Header().Set("Content-Type", "text/html; charset=UTF-8")
 		resources.Render("success.html", w, nil)
 
@@ -277,9 +272,29 @@ func authorise(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	mfaMethod, ok := authenticators.MFA[user.GetMFAType()]
+	enrolled := user.GetEnrolledMFATypes()
+
+	method := r.URL.Query().Get("method")
+	if method == "select" && len(enrolled) > 1 {
+		w.Header().Set("Content-Type", "text/html; charset=UTF-8")
+
+		err = resources.Render("register_mfa.html", w, mfaMenu(enrolled, "/authorise/"))
+		if err != nil {
+			log.Println(user.Username, clientTunnelIp, "unable to build template:", err)
+			http.Error(w, "Server error", 500)
+		}
+
+		return
+	}
+
+	// The users primary method, unless they have picked another they have enrolled
+	if !contains(enrolled, method) {
+		method = user.GetMFAType()
+	}
+
+	mfaMethod, ok := authenticators.MFA[method]
 	if !ok {
-		log.Println(user.Username, clientTunnelIp, "Invalid MFA type requested: ", user.GetMFAType())
+		log.Println(user.Username, clientTunnelIp, "Invalid MFA type requested: ", method)
 
 		http.NotFound(w, r)
 		return
@@ -288,6 +303,42 @@ func authorise(w http.ResponseWriter, r *http.Request) {
 	mfaMethod.MFAPromptUI(w, r, user.Username, clientTunnelIp.String())
 }
 
+// Builds the menu of mfa methods for the page at action, leaving out methods that are not enabled
+func mfaMenu(methods []string, action string) *resources.Menu {
+	menu := resources.Menu{
+		Action: action,
+	}
+
+	sorted := append([]string{}, methods...)
+	sort.Strings(sorted)
+
+	for _, method := range sorted {
+		authenticator, ok := authenticators.MFA[method]
+		if !ok {
+			continue
+		}
+
+		menu.MFAMethods = append(menu.MFAMethods, resources.MenuEntry{
+			Path:         authenticator.Type(),
+			FriendlyName: authenticator.FriendlyName(),
+		})
+	}
+
+	menu.LastElement = len(menu.MFAMethods) - 1
+
+	return &menu
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
+
 func reachability(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 	w.Header().Add("Content-Type", "text/plain")
@@ -314,7 +365,7 @@ func registerDevice(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	username, overwrites, groups, err := data.GetRegistrationToken(key)
+	username, overwrites, requestedAddress, groups, gatewayRoutes, err := data.GetRegistrationToken(key)
 	if err != nil {
 		log.Println(username, remoteAddr, "failed to get registration key:", err)
 		http.NotFound(w, r)
@@ -374,7 +425,7 @@ func registerDevice(w http.ResponseWriter, r *http.Request) {
 
 	} else {
 
-		device, err := user.AddDevice(publickey)
+		device, err := user.AddDevice(publickey, requestedAddress, gatewayRoutes)
 		if err != nil {
 			log.Println(username, remoteAddr, "unable to add device: ", err)
 
@@ -419,7 +470,7 @@ func registerDevice(w http.ResponseWriter, r *http.Request) {
 	dnsWithOutSubnet := config.Values().Wireguard.DNS
 
 	for i := 0; i < len(dnsWithOutSubnet); i++ {
-		dnsWithOutSubnet[i] = strings.TrimSuffix(dnsWithOutSubnet[i], "/32")
+		dnsWithOutSubnet[i] = strings.TrimSuffix(strings.TrimSuffix(dnsWithOutSubnet[i], "/32"), "/128")
 	}
 
 	routes, err := routetypes.AclsToRoutes(append(acl.Allow, acl.Mfa...))
@@ -429,9 +480,23 @@ func registerDevice(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// The addresses of other devices change as they are added, so if any can be reached the whole tunnel range is routed
+	if len(routetypes.PeerTargets(acl.Allow, acl.Mfa)) > 0 {
+		routes = append(routes, config.Values().Wireguard.Range.String())
+		if config.Values().Wireguard.Range6 != nil {
+			routes = append(routes, config.Values().Wireguard.Range6.String())
+		}
+	}
+
+	address6 := ""
+	if ip6 := config.TunnelIPv6Address(net.ParseIP(address)); ip6 != nil {
+		address6 = ip6.String()
+	}
+
 	wireguardInterface := resources.Interface{
 		ClientPrivateKey:   keyStr,
 		ClientAddress:      address,
+		ClientAddress6:     address6,
 		ServerAddress:      fmt.Sprintf("%s:%d", config.Values().ExternalAddress, wgPort),
 		ServerPublicKey:    wgPublicKey.String(),
 		CapturedAddresses:  routes,
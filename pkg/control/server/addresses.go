@@ -0,0 +1,83 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/NHAS/wag/internal/data"
+)
+
+func listAddressReservations(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.NotFound(w, r)
+		return
+	}
+
+	reservations, err := data.GetAddressReservations()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	b, err := json.Marshal(reservations)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+func addAddressReservation(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.NotFound(w, r)
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	address := r.FormValue("address")
+	username := r.FormValue("username")
+	publickey := r.FormValue("publickey")
+
+	err = data.AddAddressReservation(address, username, publickey)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	log.Println("reserved", address, "for", username, publickey)
+
+	w.Write([]byte("OK"))
+}
+
+func deleteAddressReservation(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.NotFound(w, r)
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	address := r.FormValue("address")
+
+	err = data.DeleteAddressReservation(address)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	log.Println("removed reservation for", address)
+
+	w.Write([]byte("OK"))
+}
@@ -68,11 +68,22 @@ func policies(w http.ResponseWriter, r *http.Request) {
 	sort.Strings(accessOrder)
 	//Stable output for the display or usage, gross because of unordered maps in golang thanks golang
 	for _, policyName := range accessOrder {
-		data = append(data, control.PolicyData{
+		policy := control.PolicyData{
 			Effects:      policyName,
 			PublicRoutes: policies[policyName].Allow,
 			MfaRoutes:    policies[policyName].Mfa,
-		})
+			DenyRoutes:   policies[policyName].Deny,
+
+			MaxSessionLifetimeMinutes:       policies[policyName].MaxSessionLifetimeMinutes,
+			SessionInactivityTimeoutMinutes: policies[policyName].SessionInactivityTimeoutMinutes,
+		}
+
+		if rateLimit := policies[policyName].RateLimit; rateLimit != nil {
+			policy.RateLimitBitsPerSecond = rateLimit.BitsPerSecond
+			policy.RateLimitBurstBits = rateLimit.BurstBits
+		}
+
+		data = append(data, policy)
 	}
 
 	result, _ := json.Marshal(data)
@@ -81,6 +92,18 @@ func policies(w http.ResponseWriter, r *http.Request) {
 	w.Write(result)
 }
 
+// The rate limit of a policy, nil if the policy is not rate limited
+func policyRateLimit(policy control.PolicyData) *config.RateLimit {
+	if policy.RateLimitBitsPerSecond == 0 {
+		return nil
+	}
+
+	return &config.RateLimit{
+		BitsPerSecond: policy.RateLimitBitsPerSecond,
+		BurstBits:     policy.RateLimitBurstBits,
+	}
+}
+
 func newPolicy(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
 		http.NotFound(w, r)
@@ -95,7 +118,16 @@ func newPolicy(w http.ResponseWriter, r *http.Request) {
 
 	}
 
-	if err := config.AddAcl(acl.Effects, config.Acl{Mfa: acl.MfaRoutes, Allow: acl.PublicRoutes}); err != nil {
+	if err := config.AddAcl(acl.Effects, config.Acl{
+		Mfa:   acl.MfaRoutes,
+		Allow: acl.PublicRoutes,
+		Deny:  acl.DenyRoutes,
+
+		MaxSessionLifetimeMinutes:       acl.MaxSessionLifetimeMinutes,
+		SessionInactivityTimeoutMinutes: acl.SessionInactivityTimeoutMinutes,
+
+		RateLimit: policyRateLimit(acl),
+	}); err != nil {
 		http.Error(w, err.Error(), 500)
 		return
 	}
@@ -124,7 +156,16 @@ func editPolicy(w http.ResponseWriter, r *http.Request) {
 
 	}
 
-	if err := config.EditAcl(data.Effects, config.Acl{Mfa: data.MfaRoutes, Allow: data.PublicRoutes}); err != nil {
+	if err := config.EditAcl(data.Effects, config.Acl{
+		Mfa:   data.MfaRoutes,
+		Allow: data.PublicRoutes,
+		Deny:  data.DenyRoutes,
+
+		MaxSessionLifetimeMinutes:       data.MaxSessionLifetimeMinutes,
+		SessionInactivityTimeoutMinutes: data.SessionInactivityTimeoutMinutes,
+
+		RateLimit: policyRateLimit(data),
+	}); err != nil {
 		http.Error(w, err.Error(), 500)
 		return
 	}
@@ -191,3 +191,31 @@ func deleteDevice(w http.ResponseWriter, r *http.Request) {
 
 	w.Write([]byte("OK"))
 }
+
+func roamingEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.NotFound(w, r)
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	events, err := data.GetRoamingEvents(r.FormValue("address"))
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	b, err := json.Marshal(events)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
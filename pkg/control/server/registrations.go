@@ -51,6 +51,7 @@ func newRegistration(w http.ResponseWriter, r *http.Request) {
 	token := r.FormValue("token")
 	username := r.FormValue("username")
 	overwrite := r.FormValue("overwrite")
+	address := r.FormValue("address")
 
 	groupsString := r.FormValue("groups")
 	usesString := r.FormValue("uses")
@@ -62,6 +63,16 @@ func newRegistration(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Routes are only sent for gateways
+	var routes []string = nil
+	if routesString := r.FormValue("routes"); routesString != "" {
+		err = json.Unmarshal([]byte(routesString), &routes)
+		if err != nil {
+			http.Error(w, "invalid routes: "+err.Error(), 400)
+			return
+		}
+	}
+
 	if len(groups) > 0 {
 
 		for _, group := range groups {
@@ -85,15 +96,17 @@ func newRegistration(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	resp := control.RegistrationResult{Token: token, Username: username, Groups: groups, NumUses: uses}
+	resp := control.RegistrationResult{Token: token, Username: username, Groups: groups, NumUses: uses, Address: address, Routes: routes}
 
 	tokenType := "registration"
 	if overwrite != "" {
 		tokenType = "overwrite"
+	} else if len(routes) > 0 {
+		tokenType = "gateway registration"
 	}
 
 	if token != "" {
-		err := data.AddRegistrationToken(token, username, overwrite, groups, uses)
+		err := data.AddRegistrationToken(token, username, overwrite, address, groups, routes, uses)
 		if err != nil {
 			http.Error(w, err.Error(), 500)
 			return
@@ -111,7 +124,7 @@ func newRegistration(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	token, err = data.GenerateToken(username, overwrite, groups, uses)
+	token, err = data.GenerateToken(username, overwrite, address, groups, routes, uses)
 	if err != nil {
 		http.Error(w, err.Error(), 500)
 		return
@@ -6,6 +6,7 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"strconv"
 
 	"github.com/NHAS/wag/internal/config"
 	"github.com/NHAS/wag/internal/router"
@@ -33,6 +34,144 @@ func firewallRules(w http.ResponseWriter, r *http.Request) {
 	w.Write(result)
 }
 
+func firewallCounters(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.NotFound(w, r)
+		return
+	}
+
+	counters, err := router.GetTrafficCounters()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	result, err := json.Marshal(counters)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	w.Write(result)
+}
+
+func firewallDomains(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	result, err := json.Marshal(router.GetDomainResolutions())
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	w.Write(result)
+}
+
+func firewallFlows(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.NotFound(w, r)
+		return
+	}
+
+	flows, err := router.GetFlows()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	result, err := json.Marshal(flows)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	w.Write(result)
+}
+
+// Run a simulated packet from each of a users devices through the firewall, and report the decision
+func firewallTest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.NotFound(w, r)
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	destination := net.ParseIP(r.FormValue("destination"))
+	if destination == nil {
+		http.Error(w, "destination is not a valid ip address", 400)
+		return
+	}
+
+	port := uint64(0)
+	if r.FormValue("port") != "" {
+		port, err = strconv.ParseUint(r.FormValue("port"), 10, 16)
+		if err != nil {
+			http.Error(w, "port is invalid: "+err.Error(), 400)
+			return
+		}
+	}
+
+	results, err := router.Simulate(r.FormValue("username"), destination, uint16(port), r.FormValue("protocol"))
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	result, err := json.Marshal(results)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	w.Write(result)
+}
+
+// Stream denied flow events from the xdp firewall as newline delimited json until the client disconnects
+func firewallEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.NotFound(w, r)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", 500)
+		return
+	}
+
+	events, cancel := router.SubscribeDropEvents()
+	defer cancel()
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(200)
+	flusher.Flush()
+
+	encoder := json.NewEncoder(w)
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case event := <-events:
+			if err := encoder.Encode(event); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
 func version(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "GET" {
 		http.NotFound(w, r)
@@ -107,12 +246,19 @@ func StartControlSocket() error {
 	controlMux.HandleFunc("/device/unlock", unlockDevice)
 	controlMux.HandleFunc("/device/sessions", sessions)
 	controlMux.HandleFunc("/device/delete", deleteDevice)
+	controlMux.HandleFunc("/device/roaming", roamingEvents)
+	controlMux.HandleFunc("/device/reservations/list", listAddressReservations)
+	controlMux.HandleFunc("/device/reservations/add", addAddressReservation)
+	controlMux.HandleFunc("/device/reservations/delete", deleteAddressReservation)
 
 	controlMux.HandleFunc("/users/list", listUsers)
 	controlMux.HandleFunc("/users/lock", lockUser)
 	controlMux.HandleFunc("/users/unlock", unlockUser)
 	controlMux.HandleFunc("/users/delete", deleteUser)
 	controlMux.HandleFunc("/users/reset", resetMfaUser)
+	controlMux.HandleFunc("/users/mfa/list", listUserMfa)
+	controlMux.HandleFunc("/users/mfa/delete", deleteUserMfa)
+	controlMux.HandleFunc("/users/recovery", generateRecoveryCodes)
 
 	controlMux.HandleFunc("/webadmin/list", listAdminUsers)
 	controlMux.HandleFunc("/webadmin/lock", lockAdminUser)
@@ -122,6 +268,11 @@ func StartControlSocket() error {
 	controlMux.HandleFunc("/webadmin/add", addAdminUser)
 
 	controlMux.HandleFunc("/firewall/list", firewallRules)
+	controlMux.HandleFunc("/firewall/counters", firewallCounters)
+	controlMux.HandleFunc("/firewall/events", firewallEvents)
+	controlMux.HandleFunc("/firewall/domains", firewallDomains)
+	controlMux.HandleFunc("/firewall/flows", firewallFlows)
+	controlMux.HandleFunc("/firewall/test", firewallTest)
 
 	controlMux.HandleFunc("/config/full_reload", configReload)
 
@@ -23,33 +23,32 @@ func listUsers(w http.ResponseWriter, r *http.Request) {
 
 	username := r.FormValue("username")
 
+	var allUsers []data.UserModel
 	if username != "" {
-
-		user, err := users.GetUser(username)
+		user, err := data.GetUserData(username)
 		if err != nil {
 			http.Error(w, err.Error(), 500)
 			return
 		}
 
-		b, err := json.Marshal(user)
+		allUsers = append(allUsers, user)
+	} else {
+		allUsers, err = data.GetAllUsers()
 		if err != nil {
 			http.Error(w, err.Error(), 500)
 			return
 		}
-
-		w.Header().Set("Content-Type", "application/json")
-		w.Write(b)
-
-		return
 	}
 
-	users, err := data.GetAllUsers()
-	if err != nil {
-		http.Error(w, err.Error(), 500)
-		return
+	for i := range allUsers {
+		allUsers[i].IdentityGroups, err = data.GetIdentityGroups(allUsers[i].Username)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
 	}
 
-	b, err := json.Marshal(users)
+	b, err := json.Marshal(allUsers)
 	if err != nil {
 		http.Error(w, err.Error(), 500)
 		return
@@ -356,3 +355,107 @@ func resetMfaUser(w http.ResponseWriter, r *http.Request) {
 
 	w.Write([]byte("OK"))
 }
+
+func listUserMfa(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.NotFound(w, r)
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	user, err := users.GetUser(r.FormValue("username"))
+	if err != nil {
+		http.Error(w, "not found: "+err.Error(), 404)
+		return
+	}
+
+	factors, err := user.GetMFAFactors()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	b, err := json.Marshal(factors)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+func deleteUserMfa(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.NotFound(w, r)
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	username := r.FormValue("username")
+	mfaType := r.FormValue("type")
+
+	user, err := users.GetUser(username)
+	if err != nil {
+		http.Error(w, "not found: "+err.Error(), 404)
+		return
+	}
+
+	err = user.DeleteMFAFactor(mfaType)
+	if err != nil {
+		http.Error(w, "unable to remove mfa method: "+err.Error(), 400)
+		return
+	}
+
+	log.Println(username, "MFA method", mfaType, "has been removed")
+
+	w.Write([]byte("OK"))
+}
+
+func generateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.NotFound(w, r)
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	username := r.FormValue("username")
+
+	user, err := users.GetUser(username)
+	if err != nil {
+		http.Error(w, "not found: "+err.Error(), 404)
+		return
+	}
+
+	codes, err := user.GenerateRecoveryCodes()
+	if err != nil {
+		http.Error(w, "unable to generate recovery codes: "+err.Error(), 500)
+		return
+	}
+
+	b, err := json.Marshal(codes)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	log.Println(username, "recovery codes have been regenerated")
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
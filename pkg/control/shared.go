@@ -6,12 +6,22 @@ type RegistrationResult struct {
 	Groups     []string
 	Overwrites string
 	NumUses    int
+	Address    string   `json:",omitempty"`
+	Routes     []string `json:",omitempty"`
 }
 
 type PolicyData struct {
 	Effects      string   `json:"effects"`
 	PublicRoutes []string `json:"public_routes"`
 	MfaRoutes    []string `json:"mfa_routes"`
+	DenyRoutes   []string `json:"deny_routes"`
+
+	MaxSessionLifetimeMinutes       *int `json:"max_session_lifetime_minutes,omitempty"`
+	SessionInactivityTimeoutMinutes *int `json:"session_inactivity_timeout_minutes,omitempty"`
+
+	// 0 if the policy has no rate limit, or uses the default burst
+	RateLimitBitsPerSecond uint64 `json:"rate_limit_bits_per_second,omitempty"`
+	RateLimitBurstBits     uint64 `json:"rate_limit_burst_bits,omitempty"`
 }
 
 type GroupData struct {
@@ -10,6 +10,7 @@ import (
 	"net"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 
 	"github.com/NHAS/wag/internal/data"
@@ -86,6 +87,71 @@ func (c *CtrlClient) DeleteDevice(address string) error {
 	return c.simplepost("device/delete", form)
 }
 
+// List the endpoint changes of the device with address, or of all devices if address is empty
+func (c *CtrlClient) RoamingEvents(address string) (events []data.RoamingEvent, err error) {
+
+	response, err := c.httpClient.Get("http://unix/device/roaming?address=" + url.QueryEscape(address))
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != 200 {
+		result, err := io.ReadAll(response.Body)
+		if err != nil {
+			return nil, err
+		}
+
+		return nil, errors.New(string(result))
+	}
+
+	err = json.NewDecoder(response.Body).Decode(&events)
+
+	return
+}
+
+// List addresses reserved for users and devices
+func (c *CtrlClient) AddressReservations() (reservations []data.AddressReservation, err error) {
+
+	response, err := c.httpClient.Get("http://unix/device/reservations/list")
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != 200 {
+		result, err := io.ReadAll(response.Body)
+		if err != nil {
+			return nil, err
+		}
+
+		return nil, errors.New(string(result))
+	}
+
+	err = json.NewDecoder(response.Body).Decode(&reservations)
+
+	return
+}
+
+// Reserve address for the users new devices, or if publickey is not empty for only the device with that key
+func (c *CtrlClient) ReserveAddress(address, username, publickey string) error {
+
+	form := url.Values{}
+	form.Add("address", address)
+	form.Add("username", username)
+	form.Add("publickey", publickey)
+
+	return c.simplepost("device/reservations/add", form)
+}
+
+func (c *CtrlClient) DeleteAddressReservation(address string) error {
+
+	form := url.Values{}
+	form.Add("address", address)
+
+	return c.simplepost("device/reservations/delete", form)
+}
+
 func (c *CtrlClient) LockDevice(address string) error {
 
 	form := url.Values{}
@@ -220,6 +286,65 @@ func (c *CtrlClient) ResetUserMFA(username string) error {
 	return c.simplepost("users/reset", form)
 }
 
+// List the MFA methods a user has registered, including any they have not finished registering
+func (c *CtrlClient) ListUserMFA(username string) (factors []data.MFAFactor, err error) {
+
+	response, err := c.httpClient.Get("http://unix/users/mfa/list?username=" + url.QueryEscape(username))
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != 200 {
+		result, err := io.ReadAll(response.Body)
+		if err != nil {
+			return nil, err
+		}
+
+		return nil, errors.New(string(result))
+	}
+
+	err = json.NewDecoder(response.Body).Decode(&factors)
+
+	return
+}
+
+// Remove a single MFA method from a user, deauthenticates their devices
+func (c *CtrlClient) DeleteUserMFA(username, mfaType string) error {
+
+	form := url.Values{}
+	form.Add("username", username)
+	form.Add("type", mfaType)
+
+	return c.simplepost("users/mfa/delete", form)
+}
+
+// Replace the recovery codes of a user, returns the new codes which cannot be retrieved again
+func (c *CtrlClient) GenerateRecoveryCodes(username string) (codes []string, err error) {
+
+	form := url.Values{}
+	form.Add("username", username)
+
+	response, err := c.httpClient.Post("http://unix/users/recovery", "application/x-www-form-urlencoded", strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != 200 {
+		result, err := io.ReadAll(response.Body)
+		if err != nil {
+			return nil, err
+		}
+
+		return nil, errors.New(string(result))
+	}
+
+	err = json.NewDecoder(response.Body).Decode(&codes)
+
+	return
+}
+
 func (c *CtrlClient) Sessions() (out []string, err error) {
 
 	response, err := c.httpClient.Get("http://unix/device/sessions")
@@ -263,6 +388,154 @@ func (c *CtrlClient) FirewallRules() (rules map[string]router.FirewallRules, err
 	return
 }
 
+// Get the per-user and per-device traffic counters from the xdp firewall, keyed by username
+func (c *CtrlClient) FirewallCounters() (counters map[string]router.UserTraffic, err error) {
+
+	response, err := c.httpClient.Get("http://unix/firewall/counters")
+	if err != nil {
+		return counters, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != 200 {
+		result, err := io.ReadAll(response.Body)
+		if err != nil {
+			return counters, err
+		}
+
+		return counters, errors.New("Error: " + string(result))
+	}
+
+	err = json.NewDecoder(response.Body).Decode(&counters)
+	if err != nil {
+		return counters, err
+	}
+
+	return
+}
+
+// Get the current addresses of domains used in acls, and the history of them being re-resolved
+func (c *CtrlClient) FirewallDomains() (domains router.DomainResolutions, err error) {
+
+	response, err := c.httpClient.Get("http://unix/firewall/domains")
+	if err != nil {
+		return domains, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != 200 {
+		result, err := io.ReadAll(response.Body)
+		if err != nil {
+			return domains, err
+		}
+
+		return domains, errors.New("Error: " + string(result))
+	}
+
+	err = json.NewDecoder(response.Body).Decode(&domains)
+	if err != nil {
+		return domains, err
+	}
+
+	return
+}
+
+// List the flows started by devices that return traffic is currently allowed for
+func (c *CtrlClient) FirewallFlows() (flows []router.Flow, err error) {
+
+	response, err := c.httpClient.Get("http://unix/firewall/flows")
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != 200 {
+		result, err := io.ReadAll(response.Body)
+		if err != nil {
+			return nil, err
+		}
+
+		return nil, errors.New("Error: " + string(result))
+	}
+
+	err = json.NewDecoder(response.Body).Decode(&flows)
+	if err != nil {
+		return nil, err
+	}
+
+	return
+}
+
+// Simulate a packet from each of the users devices to destination, and get whether the firewall would allow it and why
+func (c *CtrlClient) FirewallTest(username, destination string, port uint16, protocol string) (results []router.SimulationResult, err error) {
+
+	form := url.Values{}
+	form.Add("username", username)
+	form.Add("destination", destination)
+	form.Add("port", strconv.Itoa(int(port)))
+	form.Add("protocol", protocol)
+
+	response, err := c.httpClient.Get("http://unix/firewall/test?" + form.Encode())
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != 200 {
+		result, err := io.ReadAll(response.Body)
+		if err != nil {
+			return nil, err
+		}
+
+		return nil, errors.New("Error: " + string(result))
+	}
+
+	err = json.NewDecoder(response.Body).Decode(&results)
+	if err != nil {
+		return nil, err
+	}
+
+	return
+}
+
+// Stream denied flow events from the xdp firewall, the returned channel is closed when the stream ends
+func (c *CtrlClient) FirewallEvents() (<-chan router.DropEvent, error) {
+
+	response, err := c.httpClient.Get("http://unix/firewall/events")
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode != 200 {
+		defer response.Body.Close()
+
+		result, err := io.ReadAll(response.Body)
+		if err != nil {
+			return nil, err
+		}
+
+		return nil, errors.New("Error: " + string(result))
+	}
+
+	events := make(chan router.DropEvent)
+	go func() {
+		defer close(events)
+		defer response.Body.Close()
+
+		decoder := json.NewDecoder(response.Body)
+		for {
+			var event router.DropEvent
+			if err := decoder.Decode(&event); err != nil {
+				return
+			}
+
+			events <- event
+		}
+	}()
+
+	return events, nil
+}
+
 func (c *CtrlClient) FullConfigReload() error {
 
 	response, err := c.httpClient.Post("http://unix/config/full_reload", "text/plain", nil)
@@ -526,7 +799,8 @@ func (c *CtrlClient) Registrations() (result []control.RegistrationResult, err e
 	return
 }
 
-func (c *CtrlClient) NewRegistration(token, username, overwrite string, uses int, groups ...string) (r control.RegistrationResult, err error) {
+// NewRegistration creates a registration token, if routes are set the device registered with it is a gateway for those networks
+func (c *CtrlClient) NewRegistration(token, username, overwrite, address string, routes []string, uses int, groups ...string) (r control.RegistrationResult, err error) {
 
 	if uses <= 0 {
 		err = errors.New("unable to create token with <= 0 uses")
@@ -537,6 +811,7 @@ func (c *CtrlClient) NewRegistration(token, username, overwrite string, uses int
 	form.Add("username", username)
 	form.Add("token", token)
 	form.Add("overwrite", overwrite)
+	form.Add("address", address)
 	form.Add("uses", fmt.Sprintf("%d", uses))
 
 	for _, group := range groups {
@@ -552,6 +827,15 @@ func (c *CtrlClient) NewRegistration(token, username, overwrite string, uses int
 
 	form.Add("groups", string(groupsJson))
 
+	if len(routes) > 0 {
+		routesJson, err := json.Marshal(routes)
+		if err != nil {
+			return r, err
+		}
+
+		form.Add("routes", string(routesJson))
+	}
+
 	response, err := c.httpClient.Post("http://unix/registration/create", "application/x-www-form-urlencoded", strings.NewReader(form.Encode()))
 	if err != nil {
 		return control.RegistrationResult{}, err
@@ -42,6 +42,17 @@ window.operateEvents = {
     }
     $("#public_routes").val(public_routes_content)
 
+    let deny_routes_content = ""
+    if (row.deny_routes != null) {
+      deny_routes_content = row.deny_routes.join("\n")
+    }
+    $("#deny_routes").val(deny_routes_content)
+
+    $("#max_session_lifetime_minutes").val(row.max_session_lifetime_minutes)
+    $("#session_inactivity_timeout_minutes").val(row.session_inactivity_timeout_minutes)
+    $("#rate_limit_bits_per_second").val(row.rate_limit_bits_per_second)
+    $("#rate_limit_burst_bits").val(row.rate_limit_burst_bits)
+
 
     $("#action").val("edit")
 
@@ -86,6 +97,13 @@ $(function () {
       align: 'center',
       formatter: rulesFormatter
 
+    }, {
+      field: 'deny_routes',
+      title: 'Deny Routes (Number)',
+      sortable: true,
+      align: 'center',
+      formatter: rulesFormatter
+
     }, {
       field: 'edit',
       title: 'Edit',
@@ -161,6 +179,11 @@ $(function () {
 
     $("#mfa_routes").val("")
     $("#public_routes").val("")
+    $("#deny_routes").val("")
+    $("#max_session_lifetime_minutes").val("")
+    $("#session_inactivity_timeout_minutes").val("")
+    $("#rate_limit_bits_per_second").val("")
+    $("#rate_limit_burst_bits").val("")
 
     $("#ruleModal").modal("show")
   })
@@ -170,6 +193,15 @@ $(function () {
       "effects": $('#effects').val(),
       "mfa_routes": $('#mfa_routes').val().split("\n").filter(element => element),
       "public_routes": $('#public_routes').val().split("\n").filter(element => element),
+      "deny_routes": $('#deny_routes').val().split("\n").filter(element => element),
+    }
+
+    // Blank timeouts and rate limits are left out, so the global timeouts are used and there is no limit
+    for (const field of ["max_session_lifetime_minutes", "session_inactivity_timeout_minutes", "rate_limit_bits_per_second", "rate_limit_burst_bits"]) {
+      let value = $('#' + field).val()
+      if (value !== "") {
+        data[field] = parseInt(value)
+      }
     }
 
     let method = "POST";
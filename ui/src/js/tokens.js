@@ -67,6 +67,18 @@ $(function () {
       sortable: true,
       align: 'center',
       escape: "true"
+    }, {
+      field: 'address',
+      title: 'Address',
+      sortable: true,
+      align: 'center',
+      escape: "true"
+    }, {
+      field: 'routes',
+      title: 'Gateway Routes',
+      sortable: true,
+      align: 'center',
+      escape: "true"
     }, {
       field: 'uses',
       title: 'Uses',
@@ -116,6 +128,8 @@ $(function () {
       "username": $('#recipient-name').val(),
       "token": $('#token').val(),
       "overwrites": $('#overwrite').val(),
+      "address": $('#address').val(),
+      "routes": $('#routes').val(),
       "groups": $('#groups').val(),
       "uses": ($("#uses").val() == "" ? "1" : $("#uses").val())
     }
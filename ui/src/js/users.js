@@ -40,6 +40,25 @@ function mfaFormatter(value) {
   return p.outerHTML
 }
 
+function identityGroupsFormatter(values) {
+
+  let result = ""
+
+  values.forEach(function (e) {
+
+    let a = document.createElement('a')
+    a.className = "badge badge-info"
+    a.href = '/policy/groups/?group=' + encodeURIComponent(e.group)
+    a.title = "From " + e.source + ", last updated " + e.updated
+    a.innerText = e.group + " (" + e.source + ")"
+
+
+    result += a.outerHTML + "\n"
+  });
+
+  return result
+}
+
 function groupsFormatter(values) {
 
   let result = ""
@@ -78,6 +97,11 @@ $(function () {
       sortable: true,
       align: 'center',
       formatter: groupsFormatter
+    }, {
+      field: 'identity_groups',
+      title: 'Identity Provider Groups',
+      align: 'center',
+      formatter: identityGroupsFormatter
     }, {
       field: 'devices',
       title: 'Devices',
@@ -63,6 +63,15 @@ type UsersData struct {
 	DateAdded string   `json:"date_added"`
 	MFAType   string   `json:"mfa_type"`
 	Groups    []string `json:"groups"`
+
+	IdentityGroups []IdentityGroupData `json:"identity_groups"`
+}
+
+// A group an identity provider (oidc, ldap) gave the user when they last authorised with it
+type IdentityGroupData struct {
+	Group   string `json:"group"`
+	Source  string `json:"source"`
+	Updated string `json:"updated"`
 }
 
 type DevicesData struct {
@@ -80,6 +89,8 @@ type TokensData struct {
 	Username   string   `json:"username"`
 	Groups     []string `json:"groups"`
 	Overwrites string   `json:"overwrites"`
+	Address    string   `json:"address"`
+	Routes     []string `json:"routes"`
 	Uses       int      `json:"uses"`
 }
 
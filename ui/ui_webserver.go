@@ -238,6 +238,11 @@ func populateDashboard(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	subnet := config.Values().Wireguard.Range.String()
+	if config.Values().Wireguard.Range6 != nil {
+		subnet += ", " + config.Values().Wireguard.Range6.String()
+	}
+
 	d := Dashboard{
 		Page: Page{
 			Update:      getUpdate(),
@@ -250,7 +255,7 @@ func populateDashboard(w http.ResponseWriter, r *http.Request) {
 		Port:            port,
 		PublicKey:       pubkey.String(),
 		ExternalAddress: config.Values().ExternalAddress,
-		Subnet:          config.Values().Wireguard.Range.String(),
+		Subnet:          subnet,
 
 		NumUsers:           len(allUsers),
 		ActiveSessions:     activeSessions,
@@ -411,7 +416,11 @@ func StartWebServer(errs chan<- error) error {
 			for _, peer := range peers {
 				ip := "-"
 				if len(peer.AllowedIPs) > 0 {
-					ip = peer.AllowedIPs[0].String()
+					addresses := []string{}
+					for _, allowed := range peer.AllowedIPs {
+						addresses = append(addresses, allowed.String())
+					}
+					ip = strings.Join(addresses, ", ")
 				}
 
 				data = append(data, WgDevicesData{
@@ -460,9 +469,17 @@ func StartWebServer(errs chan<- error) error {
 				return
 			}
 
+			counters, err := ctrl.FirewallCounters()
+			if err != nil {
+				log.Println("error getting firewall counters", err)
+				http.Error(w, "Server Error", 500)
+				return
+			}
+
 			d := struct {
 				Page
 				XDPState string
+				Traffic  map[string]router.UserTraffic
 			}{
 				Page: Page{
 					Update:      getUpdate(),
@@ -472,6 +489,7 @@ func StartWebServer(errs chan<- error) error {
 					WagVersion:  WagVersion,
 				},
 				XDPState: string(result),
+				Traffic:  counters,
 			}
 
 			err = uiTemplates["firewall"].Execute(w, d)
@@ -1149,6 +1167,8 @@ func registrationTokens(w http.ResponseWriter, r *http.Request) {
 				Token:      reg.Token,
 				Groups:     reg.Groups,
 				Overwrites: reg.Overwrites,
+				Address:    reg.Address,
+				Routes:     reg.Routes,
 				Uses:       reg.NumUses,
 			})
 		}
@@ -1185,6 +1205,8 @@ func registrationTokens(w http.ResponseWriter, r *http.Request) {
 			Username   string
 			Token      string
 			Overwrites string
+			Address    string
+			Routes     string
 			Groups     string
 			Uses       string
 		}
@@ -1212,7 +1234,12 @@ func registrationTokens(w http.ResponseWriter, r *http.Request) {
 			groups = strings.Split(b.Groups, ",")
 		}
 
-		_, err = ctrl.NewRegistration(b.Token, b.Username, b.Overwrites, uses, groups...)
+		var routes []string
+		if len(b.Routes) > 0 {
+			routes = strings.Split(b.Routes, ",")
+		}
+
+		_, err = ctrl.NewRegistration(b.Token, b.Username, b.Overwrites, b.Address, routes, uses, groups...)
 		if err != nil {
 			http.Error(w, err.Error(), 400)
 			return
@@ -1242,14 +1269,36 @@ func manageUsers(w http.ResponseWriter, r *http.Request) {
 		for _, u := range users {
 			devices, _ := ctrl.ListDevice(u.Username)
 
+			mfaTypes := []string{}
+			factors, _ := ctrl.ListUserMFA(u.Username)
+			for _, factor := range factors {
+				if factor.IsEnrolled() {
+					mfaTypes = append(mfaTypes, factor.Type)
+				}
+			}
+
+			if len(mfaTypes) == 0 {
+				mfaTypes = append(mfaTypes, u.MfaType)
+			}
+
 			groups := append([]string{"*"}, config.Values().Acls.GetUserGroups(u.Username)...)
 
+			identityGroups := []IdentityGroupData{}
+			for _, group := range u.IdentityGroups {
+				identityGroups = append(identityGroups, IdentityGroupData{
+					Group:   group.Group,
+					Source:  group.Source,
+					Updated: group.Updated.Format(time.RFC3339),
+				})
+			}
+
 			data = append(data, UsersData{
-				Username: u.Username,
-				Locked:   u.Locked,
-				Devices:  len(devices),
-				Groups:   groups,
-				MFAType:  u.MfaType,
+				Username:       u.Username,
+				Locked:         u.Locked,
+				Devices:        len(devices),
+				Groups:         groups,
+				MFAType:        strings.Join(mfaTypes, ", "),
+				IdentityGroups: identityGroups,
 			})
 		}
 